@@ -1,30 +1,87 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"syscall"
 	"time"
+
+	"media-proxy/config"
 )
 
-var httpClient *http.Client
+// ErrTooManyRedirects fails requests that were redirected more often than SetRedirectPolicy allows
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// NewHTTPClient creates the client origin fetches go through. Connecting, the TLS handshake included, fails after
+// APP_HTTP_CONNECT_TIMEOUT_SECONDS and waiting for the response headers after APP_HTTP_RESPONSE_HEADER_TIMEOUT_SECONDS.
+// Reading the body has no limit here since proxied videos can stream for minutes, callers buffering it set their own.
+// control runs on the resolved address of every connection before connecting, an error from it fails the request.
+// The headers of APP_ORIGIN_HEADERS are added to every request
+func NewHTTPClient(config *config.Config, control func(network, address string, conn syscall.RawConn) error) *http.Client {
+	connectTimeout := 10 * time.Second
+	if config.HTTPConnectTimeout > 0 {
+		connectTimeout = time.Duration(config.HTTPConnectTimeout) * time.Second
+	}
+	responseHeaderTimeout := 30 * time.Second
+	if config.HTTPResponseHeaderTimeout > 0 {
+		responseHeaderTimeout = time.Duration(config.HTTPResponseHeaderTimeout) * time.Second
+	}
+	maxIdleConns := 100
+	if config.HTTPMaxIdleConns > 0 {
+		maxIdleConns = config.HTTPMaxIdleConns
+	}
+	idleTimeout := 90 * time.Second
+	if config.HTTPIdleTimeout > 0 {
+		idleTimeout = time.Duration(config.HTTPIdleTimeout) * time.Second
+	}
 
-func init() {
-	// Create a custom HTTP client with optimized settings
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second, Control: control}
 	transport := &http.Transport{
-		MaxIdleConns:        100,              // Maximum number of idle connections
-		MaxIdleConnsPerHost: 10,               // Maximum idle connections per host
-		IdleConnTimeout:     90 * time.Second, // How long to keep idle connections
-		TLSHandshakeTimeout: 10 * time.Second, // TLS handshake timeout
-		DisableCompression:  false,            // Enable compression
-		ForceAttemptHTTP2:   true,             // Enable HTTP/2
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          maxIdleConns,          // Maximum number of idle connections
+		MaxIdleConnsPerHost:   min(10, maxIdleConns), // Maximum idle connections per host
+		IdleConnTimeout:       idleTimeout,           // How long to keep idle connections
+		TLSHandshakeTimeout:   connectTimeout,        // TLS handshake timeout
+		ResponseHeaderTimeout: responseHeaderTimeout, // Time to wait for the response headers once the request is sent
+		DisableCompression:    false,                 // Enable compression
+		ForceAttemptHTTP2:     true,                  // Enable HTTP/2
 	}
 
-	httpClient = &http.Client{
-		Transport: transport,
-		Timeout:   30 * time.Second, // Overall request timeout
+	if len(config.OriginHeaders) == 0 {
+		return &http.Client{Transport: transport}
 	}
+	return &http.Client{Transport: originHeaders{next: transport, headers: config.OriginHeaders}}
 }
 
-// GetHTTPClient returns the optimized HTTP client
-func GetHTTPClient() *http.Client {
-	return httpClient
+// originHeaders sets APP_ORIGIN_HEADERS on every request, redirects included, before handing it to the transport
+type originHeaders struct {
+	next    http.RoundTripper
+	headers map[string]string
+}
+
+func (o originHeaders) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't change the request it is given
+	req = req.Clone(req.Context())
+	for name, value := range o.headers {
+		req.Header.Set(name, value)
+	}
+	return o.next.RoundTrip(req)
+}
+
+// SetRedirectPolicy makes the client follow up to max redirects per request and run validate on every redirect target
+// before following it, an error from validate fails the request. A nil validate follows any target
+func SetRedirectPolicy(httpClient *http.Client, max int, validate func(target *url.URL) error) {
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		// via holds the requests made so far, the first redirect comes with one
+		if len(via) > max {
+			return fmt.Errorf("%w: stopped after %d", ErrTooManyRedirects, max)
+		}
+		if validate != nil {
+			return validate(req.URL)
+		}
+		return nil
+	}
 }
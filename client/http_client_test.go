@@ -0,0 +1,35 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"media-proxy/config"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	defaults := NewHTTPClient(&config.Config{}, nil)
+	transport := defaults.Transport.(*http.Transport)
+	if transport.TLSHandshakeTimeout != 10*time.Second || transport.ResponseHeaderTimeout != 30*time.Second ||
+		transport.MaxIdleConns != 100 || transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("expected the defaults without config, got connect timeout %s, header timeout %s, %d idle conns and idle timeout %s",
+			transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout, transport.MaxIdleConns, transport.IdleConnTimeout)
+	}
+
+	configured := NewHTTPClient(&config.Config{HTTPConnectTimeout: 2, HTTPResponseHeaderTimeout: 5, HTTPMaxIdleConns: 4, HTTPIdleTimeout: 20}, nil)
+	transport = configured.Transport.(*http.Transport)
+	if transport.TLSHandshakeTimeout != 2*time.Second || transport.ResponseHeaderTimeout != 5*time.Second ||
+		transport.MaxIdleConns != 4 || transport.IdleConnTimeout != 20*time.Second {
+		t.Errorf("expected the configured values, got connect timeout %s, header timeout %s, %d idle conns and idle timeout %s",
+			transport.TLSHandshakeTimeout, transport.ResponseHeaderTimeout, transport.MaxIdleConns, transport.IdleConnTimeout)
+	}
+	if transport.MaxIdleConnsPerHost > transport.MaxIdleConns {
+		t.Errorf("expected at most %d idle conns per host, got %d", transport.MaxIdleConns, transport.MaxIdleConnsPerHost)
+	}
+
+	// Streams are only bounded by the connect and header timeouts
+	if configured.Timeout != 0 {
+		t.Errorf("expected no overall timeout, got %s", configured.Timeout)
+	}
+}
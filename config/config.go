@@ -4,28 +4,170 @@ type Config struct {
 	Address string `json:"address" env:"APP_ADDRESS"`
 	Prefork bool   `json:"prefork" env:"APP_PREFORK"`
 	Metrics *bool  `json:"metrics" env:"APP_METRICS"`
+	// Lowest level logged, one of debug, info, warn, error. Defaults to info
+	LogLevel string `json:"logLevel" env:"APP_LOG_LEVEL"`
+	// Log encoding, json or console. Defaults to json
+	LogFormat string `json:"logFormat" env:"APP_LOG_FORMAT"`
+	// Collapses duplicate slashes, drops trailing ones and lowercases route prefixes before routing, defaults to true
+	NormalizePaths *bool `json:"normalizePaths" env:"APP_NORMALIZE_PATHS"`
+	// Writes parameters that can't change a result the way the default request does before keying the cache, so
+	// equivalent requests share an entry. Defaults to true
+	NormalizeCacheKeys *bool `json:"normalizeCacheKeys" env:"APP_NORMALIZE_CACHE_KEYS"`
+	// Keys images fetched from a URL by the strong ETag the origin answers a HEAD request with as well, so a changed
+	// source gets a new entry instead of the cached one. Costs a HEAD request per image request
+	ContentAddressedCache bool `json:"contentAddressedCache" env:"APP_CONTENT_ADDRESSED_CACHE"`
 
 	Webp bool `json:"webp" env:"APP_WEBP"`
 
+	// Auto WebP encodes JPEG and PNG results as WebP too and serves whichever is smaller, WebP has to win by the margin.
+	// Larger images skip the second encode and keep their format
+	WebpAuto          bool  `json:"webpAuto" env:"APP_WEBP_AUTO"`
+	WebpAutoMargin    int   `json:"webpAutoMarginPercent" env:"APP_WEBP_AUTO_MARGIN_PERCENT"`
+	WebpAutoMaxPixels int64 `json:"webpAutoMaxPixels" env:"APP_WEBP_AUTO_MAX_PIXELS"`
+
+	// Encodes JPEG results as progressive JPEGs, which show blurred while they load instead of top to bottom
+	JPEGProgressive bool `json:"jpegProgressive" env:"APP_JPEG_PROGRESSIVE"`
+
+	// WebP encoder effort from 0 (fastest) to 6 (smallest files) when the path has no m:, defaults to libwebp's 4
+	WebpMethod *int `json:"webpMethod" env:"APP_WEBP_METHOD"`
+
+	// Default interpolation (0-5, as in i:) per source content type for requests without i:, e.g. image/png:0,image/jpeg:5
+	InterpolationByFormat map[string]int `json:"interpolationByFormat" env:"APP_INTERPOLATION_BY_FORMAT"`
+
+	// Highest output quality (1-100) when re-encoding a source of the content type, e.g. image/jpeg:90. Lossy sources
+	// gain nothing from a higher one
+	MaxQualityByFormat map[string]int `json:"maxQualityByFormat" env:"APP_MAX_QUALITY_BY_FORMAT"`
+
+	// Deep-zoom tiling for huge images: oversized sources are served as an overview, regions via tile:z/x/y
+	TilingEnabled      bool `json:"tilingEnabled" env:"APP_TILING_ENABLED"`
+	TileSize           int  `json:"tileSize" env:"APP_TILE_SIZE"`
+	TilingOverviewSize int  `json:"tilingOverviewSize" env:"APP_TILING_OVERVIEW_SIZE"`
+	// Tiles and overviews fully decode the source, larger sources are rejected; decoded levels are cached up to the given size
+	TilingMaxPixels    int64 `json:"tilingMaxPixels" env:"APP_TILING_MAX_PIXELS"`
+	TilingLevelCacheMB int   `json:"tilingLevelCacheMB" env:"APP_TILING_LEVEL_CACHE_MB"`
+
+	// HEIC/HEIF decoding goes through ffmpeg and requires it to be built with HEVC support
+	HeicEnabled bool `json:"heicEnabled" env:"APP_HEIC_ENABLED"`
+
 	AllowedOrigins []string `json:"allowedOrigins" env:"APP_ALLOWED_ORIGINS"`
+	AllowedSchemes []string `json:"allowedSchemes" env:"APP_ALLOWED_SCHEMES"` // Extra URL schemes besides http(s)
+
+	// Origin fetches to loopback, private, link-local and other internal addresses are refused unless the address is in
+	// AllowedPrivateOrigins (IPs or CIDR ranges). Defaults to true
+	BlockPrivateOrigins   *bool    `json:"blockPrivateOrigins" env:"APP_BLOCK_PRIVATE_ORIGINS"`
+	AllowedPrivateOrigins []string `json:"allowedPrivateOrigins" env:"APP_ALLOWED_PRIVATE_ORIGINS"`
+	// Headers set on every origin request, e.g. an API key or basic auth for a protected bucket. KEY=VALUE pairs,
+	// comma-separated in the environment. They are never passed on to clients
+	OriginHeaders map[string]string `json:"originHeaders" env:"APP_ORIGIN_HEADERS" envKeyValSeparator:"="`
+
+	// Redirects an origin fetch follows, every target has to pass the origin validation. Defaults to 5
+	MaxRedirects int `json:"maxRedirects" env:"APP_MAX_REDIRECTS"`
+
+	// Clients (IPs or CIDR ranges) the media routes answer, denied ones win. X-Forwarded-For names the client only when
+	// the request comes from one of the trusted proxies
+	AllowedIPs     []string `json:"allowedIPs" env:"APP_ALLOWED_IPS"`
+	DeniedIPs      []string `json:"deniedIPs" env:"APP_DENIED_IPS"`
+	TrustedProxies []string `json:"trustedProxies" env:"APP_TRUSTED_PROXIES"`
 
-	Token            string `json:"token" env:"APP_TOKEN"`
-	HmacKey          string `json:"hmacKey" env:"APP_HMAC_KEY"`
-	UploadingEnabled bool   `json:"uploadingEnabled" env:"APP_UPLOADING_ENABLED"`
+	// Fetches per second from each origin hostname, bursts of up to OriginBurst. Requests beyond it get 429, 0 disables it
+	OriginRateLimit float64 `json:"originRateLimit" env:"APP_ORIGIN_RATE_LIMIT"`
+	OriginBurst     int     `json:"originBurst" env:"APP_ORIGIN_BURST"`
+
+	Token            string   `json:"token" env:"APP_TOKEN"`
+	HmacKey          string   `json:"hmacKey" env:"APP_HMAC_KEY"`
+	HmacKeys         []string `json:"hmacKeys" env:"APP_HMAC_KEYS"`           // Previous keys still accepted during a rotation
+	HmacAlgorithm    string   `json:"hmacAlgorithm" env:"APP_HMAC_ALGORITHM"` // Hash of signatures without a sha512:<hex> style prefix
+	UploadingEnabled bool     `json:"uploadingEnabled" env:"APP_UPLOADING_ENABLED"`
 
 	CacheTTL         int64 `json:"cacheTTLSeconds" env:"APP_CACHE_TTL_SECONDS"`
 	CacheMaxCost     int64 `json:"cacheMaxCost" env:"APP_CACHE_MAX_COST"`
 	CacheNumCounters int64 `json:"cacheNumCounters" env:"APP_CACHE_NUM_COUNTERS"`
 	CacheBufferItems int64 `json:"cacheBufferItems" env:"APP_CACHE_BUFFER_ITEMS"`
+	// Images whose origin sent an ETag or Last-Modified stay cached this long after expiring, to be revalidated with a conditional GET
+	CacheRevalidateTTL int64 `json:"cacheRevalidateSeconds" env:"APP_CACHE_REVALIDATE_SECONDS"`
+	// Query parameters left out of the source URL when keying cached results, e.g. rotating CDN auth tokens. The
+	// origin is still fetched with them
+	CacheIgnoredQueryParams []string `json:"cacheIgnoredQueryParams" env:"APP_CACHE_IGNORED_QUERY_PARAMS"`
+	// Floor for every cache TTL of processed results and the max-age sent with them, 0 disables it
+	MinCacheTTL int64 `json:"minCacheTTLSeconds" env:"APP_MIN_CACHE_TTL_SECONDS"`
+	// POST /cache/warm processes queued images with this many workers, requests beyond the queue size are dropped
+	CacheWarmConcurrency int `json:"cacheWarmConcurrency" env:"APP_CACHE_WARM_CONCURRENCY"`
+	CacheWarmQueueSize   int `json:"cacheWarmQueueSize" env:"APP_CACHE_WARM_QUEUE_SIZE"`
+	// Memory cache hits older than the soft TTL are served and refreshed in the background by this many workers,
+	// 0 disables it. Only takes effect below APP_CACHE_TTL_SECONDS, after that the entry is gone or revalidated
+	CacheSoftTTL            int64 `json:"cacheSoftTTLSeconds" env:"APP_CACHE_SOFT_TTL_SECONDS"`
+	CacheRefreshConcurrency int   `json:"cacheRefreshConcurrency" env:"APP_CACHE_REFRESH_CONCURRENCY"`
+	// Seconds an image URL whose origin answered 404 or with something other than an image is remembered, requests
+	// for it get the same error meanwhile without a fetch; 0 disables it
+	NegativeCacheTTL int64 `json:"negativeCacheTTLSeconds" env:"APP_NEGATIVE_CACHE_TTL_SECONDS"`
 
 	// Performance tuning options
-	HTTPTimeout      int `json:"httpTimeoutSeconds" env:"APP_HTTP_TIMEOUT_SECONDS"`
+	HTTPTimeout      int `json:"httpTimeoutSeconds" env:"APP_HTTP_TIMEOUT_SECONDS"` // Bounds a whole image fetch, body included
 	HTTPMaxIdleConns int `json:"httpMaxIdleConns" env:"APP_HTTP_MAX_IDLE_CONNS"`
 	HTTPIdleTimeout  int `json:"httpIdleTimeoutSeconds" env:"APP_HTTP_IDLE_TIMEOUT_SECONDS"`
 	HTTPCacheTTL     int `json:"httpCacheTTLSeconds" env:"APP_HTTP_CACHE_TTL_SECONDS"`
+	HTTPCacheMaxTTL  int `json:"httpCacheMaxTTLSeconds" env:"APP_HTTP_CACHE_MAX_TTL_SECONDS"` // Upper bound of maxage: requests
+	ReadinessTimeout int `json:"readinessTimeoutSeconds" env:"APP_READINESS_TIMEOUT_SECONDS"`
+	DecodeTimeout    int `json:"imageDecodeTimeoutSeconds" env:"APP_IMAGE_DECODE_TIMEOUT"` // Seconds before a stuck image decode is abandoned
 	MaxImageSize     int `json:"maxImageSizeMB" env:"APP_MAX_IMAGE_SIZE_MB"`
 	MaxVideoSize     int `json:"maxVideoSizeMB" env:"APP_MAX_VIDEO_SIZE_MB"`
+	VideoCacheMaxMB  int `json:"videoCacheMaxMB" env:"APP_VIDEO_CACHE_MAX_MB"` // Largest proxied video kept in memory to serve Range requests
 	URLCacheSize     int `json:"urlCacheSize" env:"APP_URL_CACHE_SIZE"`
+	EncoderThreads   int `json:"encoderThreads" env:"APP_ENCODER_THREADS"` // Per-request thread cap for codecs
+	MaxOpenInputs    int `json:"maxOpenInputs" env:"APP_MAX_OPEN_INPUTS"`  // Cap on concurrently open ffmpeg inputs, extra previews wait
+
+	// Connecting to an origin (TLS handshake included) and waiting for its response headers are bounded on their own.
+	// Proxied video streams only have these two, reading them can take minutes
+	HTTPConnectTimeout        int `json:"httpConnectTimeoutSeconds" env:"APP_HTTP_CONNECT_TIMEOUT_SECONDS"`
+	HTTPResponseHeaderTimeout int `json:"httpResponseHeaderTimeoutSeconds" env:"APP_HTTP_RESPONSE_HEADER_TIMEOUT_SECONDS"`
+
+	// How long in-flight requests may run after SIGTERM or SIGINT before they are cut off
+	ShutdownGracePeriod int `json:"shutdownGracePeriodSeconds" env:"APP_SHUTDOWN_GRACE_PERIOD_SECONDS"`
+
+	// Workers per work class: video frames and images over ExpensiveImagePixels are expensive, other image transforms
+	// cheap. Documents (PDF, office, ebooks) have their own class, rendering them can take a lot of memory. Requests
+	// beyond the workers wait in a queue of the given size, a full queue answers 503
+	CheapWorkers         int   `json:"cheapWorkers" env:"APP_CHEAP_WORKERS"`
+	ExpensiveWorkers     int   `json:"expensiveWorkers" env:"APP_EXPENSIVE_WORKERS"`
+	DocumentWorkers      int   `json:"documentWorkers" env:"APP_DOCUMENT_WORKERS"`
+	CheapQueueSize       int   `json:"cheapQueueSize" env:"APP_CHEAP_QUEUE_SIZE"`
+	ExpensiveQueueSize   int   `json:"expensiveQueueSize" env:"APP_EXPENSIVE_QUEUE_SIZE"`
+	DocumentQueueSize    int   `json:"documentQueueSize" env:"APP_DOCUMENT_QUEUE_SIZE"`
+	ExpensiveImagePixels int64 `json:"expensiveImagePixels" env:"APP_EXPENSIVE_IMAGE_PIXELS"`
+
+	// Seconds opening a video and reading its stream info may take for a preview, separate from the decoding after it
+	VideoProbeTimeout int `json:"videoProbeTimeoutSeconds" env:"APP_VIDEO_PROBE_TIMEOUT"`
+	// Seconds a URL source that failed its checks is remembered, previews of it fail fast with the same response meanwhile; 0 disables it
+	VideoProbeFailureTTL int64 `json:"videoProbeFailureTTLSeconds" env:"APP_VIDEO_PROBE_FAILURE_TTL_SECONDS"`
+	// Previews and proxying of videos longer than this many seconds are rejected with 422, 0 disables it
+	MaxVideoDuration int `json:"maxVideoDurationSeconds" env:"APP_MAX_VIDEO_DURATION_SECONDS"`
+
+	// Bounds of /videos/sprite/*: the most frames a sheet may hold and the most pixels the tiled sheet may have
+	SpriteMaxFrames int   `json:"spriteMaxFrames" env:"APP_SPRITE_MAX_FRAMES"`
+	SpriteMaxPixels int64 `json:"spriteMaxPixels" env:"APP_SPRITE_MAX_PIXELS"`
+
+	// Bounds of /videos/animated/*: the longest clip in seconds and the highest frame rate an animated preview may have
+	AnimationMaxDuration float64 `json:"animationMaxDurationSeconds" env:"APP_ANIMATION_MAX_DURATION_SECONDS"`
+	AnimationMaxFPS      float64 `json:"animationMaxFPS" env:"APP_ANIMATION_MAX_FPS"`
+
+	// Store previews of S3 location sources next to the source as <location>.preview.<params>.<ext> instead of under hashed keys
+	PreviewKeysFromLocation bool `json:"previewKeysFromLocation" env:"APP_PREVIEW_KEYS_FROM_LOCATION"`
+
+	// How preview frames are extracted: "libav" (FFmpeg libraries, in process) or "ffmpeg" (ffmpeg/ffprobe binaries)
+	VideoFrameBackend string `json:"videoFrameBackend" env:"APP_VIDEO_FRAME_BACKEND"`
+	FFmpegPath        string `json:"ffmpegPath" env:"APP_FFMPEG_PATH"`
+	FFprobePath       string `json:"ffprobePath" env:"APP_FFPROBE_PATH"`
+
+	// What to do when a preview frame position is past the video duration: "clamp" (last frame) or "reject" (400)
+	FramePositionBeyondDuration string `json:"framePositionBeyondDuration" env:"APP_FRAME_POSITION_BEYOND_DURATION"`
+	// How a scale requested along with a width or height is applied: "compose" (scales the resized result),
+	// "dimensions" (the width and height win, scale is ignored) or "reject" (400)
+	ScaleWithDimensions string `json:"scaleWithDimensions" env:"APP_SCALE_WITH_DIMENSIONS"`
+	// Resized and rescaled results are at most this many pixels on either side and in total, larger ones are rejected
+	// (400) or shrunk to fit keeping their aspect ratio ("clamp")
+	MaxOutputDimension int    `json:"maxOutputDimension" env:"APP_MAX_OUTPUT_DIMENSION"`
+	MaxOutputPixels    int64  `json:"maxOutputPixels" env:"APP_MAX_OUTPUT_PIXELS"`
+	OversizedOutput    string `json:"oversizedOutput" env:"APP_OVERSIZED_OUTPUT"`
 
 	// Optional S3 storage for persistent result caching
 	S3Enabled         bool   `json:"s3Enabled" env:"S3_ENABLED"`
@@ -35,6 +177,17 @@ type Config struct {
 	S3Bucket          string `json:"s3Bucket" env:"S3_BUCKET"`
 	S3SSL             bool   `json:"s3SSL" env:"S3_SSL"`
 	S3Prefix          string `json:"s3Prefix" env:"S3_PREFIX"`
+	S3CreateBucket    bool   `json:"s3CreateBucket" env:"APP_S3_CREATE_BUCKET"` // Create a missing bucket at startup instead of disabling S3
+	// Expiry of results stored in S3, defaults to a day. 0 stores them without one
+	S3CacheTTL *int64 `json:"s3CacheTTLSeconds" env:"APP_S3_CACHE_TTL_SECONDS"`
+	// Days uploaded videos are kept, 0 keeps them forever. Set as the Expires and a retention tag of the object
+	UploadRetentionDays int64 `json:"uploadRetentionDays" env:"APP_UPLOAD_RETENTION_DAYS"`
+	// Eventually consistent stores: uploads wait for the written objects to become readable, retrying this many times
+	// with a doubling backoff. 0 skips the check for strongly consistent stores
+	S3ConsistencyRetries   int `json:"s3ConsistencyRetries" env:"S3_CONSISTENCY_RETRIES"`
+	S3ConsistencyBackoffMs int `json:"s3ConsistencyBackoffMs" env:"S3_CONSISTENCY_BACKOFF_MS"`
+	// Local directory results are stored in when S3 is disabled, uses the S3 expiry
+	FileCacheDir string `json:"fileCacheDir" env:"APP_FILE_CACHE_DIR"`
 
 	// Optional Redis for multi-part upload tracking
 	RedisEnabled  bool   `json:"redisEnabled" env:"REDIS_ENABLED"`
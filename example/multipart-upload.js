@@ -49,6 +49,8 @@ async function uploadPart(token, uploadId, partIndex, partData) {
 
     const url = new URL(`http://localhost:3000/videos/multiparts/${uploadId}/parts/${partIndex}`);
     url.searchParams.set('token', token);
+    // Lets the server reject the part if it arrives corrupted
+    url.searchParams.set('checksum', 'sha256:' + crypto.createHash('sha256').update(partData).digest('hex'));
 
     const response = await fetch(url, {
         method: 'POST',
@@ -85,6 +87,27 @@ async function getUploadStatus(token, uploadId) {
     return await response.json();
 }
 
+/**
+ * Complete a multi-part upload, merging the parts into the final video
+ * 
+ * @param {string} uploadToken - Upload token from initialization
+ * @param {string} uploadId - Upload ID from initialization
+ * @returns {Promise<object>} Final location and size
+ */
+async function completeMultipartUpload(uploadToken, uploadId) {
+    const url = new URL(`http://localhost:3000/videos/multiparts/${uploadId}/complete`);
+    url.searchParams.set('uploadToken', uploadToken);
+
+    const response = await fetch(url, { method: 'POST' });
+
+    if (!response.ok) {
+        const error = await response.text();
+        throw new Error(`Failed to complete upload: ${error}`);
+    }
+
+    return await response.json();
+}
+
 /**
  * Upload a video file using multi-part upload
  * 
@@ -164,9 +187,44 @@ async function uploadVideoMultipart(filePath, location, token, onProgress = null
     console.log(`  Parts uploaded: ${status.uploadedCount}/${status.partsCount}`);
     console.log(`  Progress: ${status.progress}%`);
 
+    // Step 4: Merge the parts into the final video
+    const result = await completeMultipartUpload(uploadInfo.uploadToken, uploadInfo.uploadId);
+    console.log(`  Stored at: ${result.location}`);
+
     return status;
 }
 
+/**
+ * Resume an interrupted multi-part upload, sending only the parts the server reports missing
+ * 
+ * @param {string} filePath - Path to the video file
+ * @param {string} token - Authentication token
+ * @param {string} uploadToken - Upload token from initialization
+ * @param {string} uploadId - Upload ID from initialization
+ * @param {number} chunkSize - Chunk size the upload was initialized with
+ * @returns {Promise<object>} Final location and size
+ */
+async function resumeMultipartUpload(filePath, token, uploadToken, uploadId, chunkSize = CHUNK_SIZE) {
+    const status = await getUploadStatus(token, uploadId);
+    const { partSizes, partOffsets } = calculateParts(fs.statSync(filePath).size, chunkSize);
+
+    const fd = fs.openSync(filePath, 'r');
+    try {
+        for (const index of status.missingParts) {
+            const buffer = Buffer.alloc(partSizes[index]);
+            fs.readSync(fd, buffer, 0, partSizes[index], partOffsets[index]);
+
+            // A part that made it before the connection dropped is acknowledged with alreadyUploaded
+            const result = await uploadPart(token, uploadId, index, buffer);
+            console.log(`  ✓ Part ${index + 1} ${result.alreadyUploaded ? 'was already uploaded' : 'uploaded'}`);
+        }
+    } finally {
+        fs.closeSync(fd);
+    }
+
+    return await completeMultipartUpload(uploadToken, uploadId);
+}
+
 /**
  * Calculate parts information for a file
  * This matches the logic from your example
@@ -228,7 +286,9 @@ module.exports = {
     initializeMultipartUpload,
     uploadPart,
     getUploadStatus,
+    completeMultipartUpload,
     uploadVideoMultipart,
+    resumeMultipartUpload,
     calculateParts,
     CHUNK_SIZE
 };
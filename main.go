@@ -1,8 +1,14 @@
 package main
 
 import (
-	"log"
+	"context"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2/middleware/cache"
@@ -15,11 +21,13 @@ import (
 	"github.com/caarlos0/env/v11"
 	"github.com/gofiber/fiber/v2"
 
+	"media-proxy/client"
 	"media-proxy/config"
 	"media-proxy/metrics"
 	fiberprometheus "media-proxy/middlewares/prometheus"
 	"media-proxy/routes"
 	"media-proxy/storage"
+	"media-proxy/validation"
 
 	"github.com/dgraph-io/ristretto/v2"
 )
@@ -27,17 +35,36 @@ import (
 var logger *zap.Logger
 
 func main() {
-	logger, _ = zap.NewProduction()
-	defer func(logger *zap.Logger) {
-		err := logger.Sync()
-		if err != nil {
-			log.Fatal(err)
+	// The logger is built from the config, so errors parsing it are only logged once the logger exists
+	config, configErr := env.ParseAs[config.Config]()
+
+	// JSON at info unless APP_LOG_LEVEL and APP_LOG_FORMAT say otherwise, unknown values keep the default
+	loggerConfig := zap.NewProductionConfig()
+	var invalidLogConfig []zap.Field
+	if config.LogLevel != "" {
+		if err := loggerConfig.Level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			invalidLogConfig = append(invalidLogConfig, zap.String("level", config.LogLevel))
 		}
+	}
+	switch config.LogFormat {
+	case "", "json":
+	case "console":
+		loggerConfig.Encoding = "console"
+		loggerConfig.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		invalidLogConfig = append(invalidLogConfig, zap.String("format", config.LogFormat))
+	}
+	logger, _ = loggerConfig.Build()
+	defer func(logger *zap.Logger) {
+		// Syncing fails for stderr attached to a pipe or terminal, which have nothing buffered to flush
+		_ = logger.Sync()
 	}(logger)
 
-	config, err := env.ParseAs[config.Config]()
-	if err != nil {
-		logger.Fatal(err.Error())
+	if configErr != nil {
+		logger.Fatal(configErr.Error())
+	}
+	if len(invalidLogConfig) > 0 {
+		logger.Warn("ignoring invalid log settings, using the defaults", invalidLogConfig...)
 	}
 
 	if config.Metrics == nil {
@@ -45,23 +72,204 @@ func main() {
 		config.Metrics = &metrics
 	}
 
+	if config.NormalizePaths == nil {
+		normalizePaths := true
+		config.NormalizePaths = &normalizePaths
+	}
+
+	if config.NormalizeCacheKeys == nil {
+		normalizeCacheKeys := true
+		config.NormalizeCacheKeys = &normalizeCacheKeys
+	}
+
+	if config.BlockPrivateOrigins == nil {
+		blockPrivateOrigins := true
+		config.BlockPrivateOrigins = &blockPrivateOrigins
+	}
+
+	if config.MaxRedirects <= 0 {
+		config.MaxRedirects = 5
+	}
+
+	if config.HTTPTimeout <= 0 {
+		config.HTTPTimeout = 30
+	}
+
 	cacheConfig := &ristretto.Config[string, routes.CacheValue]{
-		NumCounters: 1e7,     // number of keys to track frequency of (10M).
-		MaxCost:     1 << 30, // maximum cost of cache (1GB).
-		BufferItems: 64,      // number of keys per Get buffer.
+		NumCounters: 1e7,             // number of keys to track frequency of (10M).
+		MaxCost:     1 << 30,         // maximum cost of cache (1GB).
+		BufferItems: 64,              // number of keys per Get buffer.
+		Metrics:     *config.Metrics, // track hit ratio for the performance metrics.
 	}
 
 	// HTTP cache configuration for middleware
 	httpCacheConfig := &ristretto.Config[string, []byte]{
-		NumCounters: 1e6,     // number of keys to track frequency of (1M).
-		MaxCost:     1 << 28, // maximum cost of cache (256MB).
-		BufferItems: 64,      // number of keys per Get buffer.
+		NumCounters: 1e6,             // number of keys to track frequency of (1M).
+		MaxCost:     1 << 28,         // maximum cost of cache (256MB).
+		BufferItems: 64,              // number of keys per Get buffer.
+		Metrics:     *config.Metrics, // track hit ratio for the performance metrics.
 	}
 
 	if config.HTTPCacheTTL == 0 {
 		config.HTTPCacheTTL = 1800 // 30 minutes
 	}
 
+	if config.HTTPCacheMaxTTL <= 0 {
+		config.HTTPCacheMaxTTL = 7 * 24 * 3600 // one week
+	}
+
+	if config.WebpAutoMargin <= 0 {
+		config.WebpAutoMargin = 10
+	}
+
+	if config.WebpAutoMaxPixels <= 0 {
+		config.WebpAutoMaxPixels = 1 << 24 // ~16MP
+	}
+
+	if config.WebpMethod == nil {
+		webpMethod := 4 // libwebp's default
+		config.WebpMethod = &webpMethod
+	}
+	if *config.WebpMethod < 0 || *config.WebpMethod > 6 {
+		logger.Fatal("invalid webp method", zap.Int("method", *config.WebpMethod))
+	}
+
+	for contentType, interpolation := range config.InterpolationByFormat {
+		if interpolation < 0 || interpolation > 5 {
+			logger.Fatal("invalid interpolation for content type", zap.String("content_type", contentType), zap.Int("interpolation", interpolation))
+		}
+	}
+
+	for contentType, quality := range config.MaxQualityByFormat {
+		if quality < 1 || quality > 100 {
+			logger.Fatal("invalid max quality for content type", zap.String("content_type", contentType), zap.Int("quality", quality))
+		}
+	}
+
+	if config.CacheWarmConcurrency <= 0 {
+		config.CacheWarmConcurrency = 4
+	}
+
+	if config.CacheWarmQueueSize <= 0 {
+		config.CacheWarmQueueSize = 1000
+	}
+
+	if config.CacheRefreshConcurrency <= 0 {
+		config.CacheRefreshConcurrency = 2
+	}
+
+	if config.S3CacheTTL == nil {
+		s3CacheTTL := int64(86400) // 1 day
+		config.S3CacheTTL = &s3CacheTTL
+	}
+
+	// Stored results expire no sooner than the cache TTL floor, 0 keeps storing them without an expiry
+	if *config.S3CacheTTL > 0 {
+		*config.S3CacheTTL = max(*config.S3CacheTTL, config.MinCacheTTL)
+	}
+
+	if config.S3ConsistencyBackoffMs <= 0 {
+		config.S3ConsistencyBackoffMs = 100
+	}
+
+	if config.TileSize <= 0 {
+		config.TileSize = 256
+	}
+
+	if config.TilingOverviewSize <= 0 {
+		config.TilingOverviewSize = 2048
+	}
+
+	if config.TilingMaxPixels <= 0 {
+		config.TilingMaxPixels = 1 << 28 // ~268MP, about 1GB decoded
+	}
+
+	if config.TilingLevelCacheMB <= 0 {
+		config.TilingLevelCacheMB = 512
+	}
+
+	if config.VideoCacheMaxMB <= 0 {
+		config.VideoCacheMaxMB = 16
+	}
+
+	if config.HmacAlgorithm == "" {
+		config.HmacAlgorithm = validation.DefaultHmacAlgorithm
+	} else if !validation.IsHmacAlgorithm(config.HmacAlgorithm) {
+		logger.Fatal("invalid hmac algorithm", zap.String("algorithm", config.HmacAlgorithm))
+	}
+
+	if config.ShutdownGracePeriod <= 0 {
+		config.ShutdownGracePeriod = 30
+	}
+
+	if config.ReadinessTimeout <= 0 {
+		config.ReadinessTimeout = 2
+	}
+
+	if config.DecodeTimeout <= 0 {
+		config.DecodeTimeout = 30
+	}
+
+	if config.VideoProbeTimeout <= 0 {
+		config.VideoProbeTimeout = 10
+	}
+
+	if config.SpriteMaxFrames <= 0 {
+		config.SpriteMaxFrames = 100
+	}
+
+	if config.SpriteMaxPixels <= 0 {
+		config.SpriteMaxPixels = 4096 * 4096
+	}
+
+	if config.AnimationMaxDuration <= 0 {
+		config.AnimationMaxDuration = 10
+	}
+
+	if config.AnimationMaxFPS <= 0 {
+		config.AnimationMaxFPS = 15
+	}
+
+	if config.FFmpegPath == "" {
+		config.FFmpegPath = "ffmpeg"
+	}
+
+	if config.FFprobePath == "" {
+		config.FFprobePath = "ffprobe"
+	}
+
+	switch config.FramePositionBeyondDuration {
+	case "":
+		config.FramePositionBeyondDuration = "clamp"
+	case "clamp", "reject":
+	default:
+		logger.Fatal("invalid frame position beyond duration mode", zap.String("mode", config.FramePositionBeyondDuration))
+	}
+
+	switch config.ScaleWithDimensions {
+	case "":
+		config.ScaleWithDimensions = "reject"
+	case "compose", "dimensions", "reject":
+	default:
+		logger.Fatal("invalid scale with dimensions mode", zap.String("mode", config.ScaleWithDimensions))
+	}
+
+	if config.MaxOutputDimension <= 0 {
+		config.MaxOutputDimension = 16384
+	}
+
+	if config.MaxOutputPixels <= 0 {
+		config.MaxOutputPixels = 1 << 26 // ~67MP, 256MB decoded
+	}
+
+	switch config.OversizedOutput {
+	case "":
+		config.OversizedOutput = "reject"
+	case "reject", "clamp":
+	default:
+		logger.Fatal("invalid oversized output mode", zap.String("mode", config.OversizedOutput))
+	}
+
 	if config.CacheBufferItems > 0 {
 		cacheConfig.BufferItems = config.CacheBufferItems
 	}
@@ -78,6 +286,52 @@ func main() {
 		config.CacheTTL = 1800 // 30 minutes
 	}
 
+	if config.CacheRevalidateTTL <= 0 {
+		config.CacheRevalidateTTL = 3600 // 1 hour
+	}
+
+	if config.EncoderThreads <= 0 {
+		// Leave room for concurrent requests instead of giving every codec all cores
+		config.EncoderThreads = max(1, runtime.GOMAXPROCS(0)/4)
+	}
+
+	if config.MaxOpenInputs <= 0 {
+		config.MaxOpenInputs = 64
+	}
+
+	if config.CheapWorkers <= 0 {
+		config.CheapWorkers = runtime.GOMAXPROCS(0) * 2
+	}
+
+	if config.ExpensiveWorkers <= 0 {
+		config.ExpensiveWorkers = max(1, runtime.GOMAXPROCS(0)/2)
+	}
+
+	// The burst defaults to a second worth of fetches, at least one
+	if config.OriginRateLimit > 0 && config.OriginBurst <= 0 {
+		config.OriginBurst = max(1, int(math.Ceil(config.OriginRateLimit)))
+	}
+
+	if config.DocumentWorkers <= 0 {
+		config.DocumentWorkers = max(1, runtime.GOMAXPROCS(0)/4)
+	}
+
+	if config.CheapQueueSize <= 0 {
+		config.CheapQueueSize = 256
+	}
+
+	if config.ExpensiveQueueSize <= 0 {
+		config.ExpensiveQueueSize = 64
+	}
+
+	if config.DocumentQueueSize <= 0 {
+		config.DocumentQueueSize = 16
+	}
+
+	if config.ExpensiveImagePixels <= 0 {
+		config.ExpensiveImagePixels = 1 << 24 // ~16MP
+	}
+
 	cacheStore, err := ristretto.NewCache(cacheConfig)
 	if err != nil {
 		logger.Fatal(err.Error())
@@ -98,10 +352,35 @@ func main() {
 		config.S3Bucket,
 		config.S3SSL,
 		config.S3Prefix,
+		time.Duration(*config.S3CacheTTL)*time.Second,
 	)
 	if s3err != nil {
 		logger.Warn("failed to initialize S3 cache", zap.Error(s3err))
 	}
+	if s3cache != nil {
+		s3cache.UploadRetention = time.Duration(config.UploadRetentionDays) * 24 * time.Hour
+	}
+	if s3cache != nil && s3cache.Enabled {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := s3cache.EnsureBucket(ctx, config.S3CreateBucket); err != nil {
+			// Every S3 operation would fail, so results are only cached in memory
+			logger.Warn("S3 bucket is not usable, disabling S3 caching", zap.Error(err), zap.String("bucket", config.S3Bucket))
+			s3cache.Enabled = false
+		}
+		cancel()
+	}
+
+	// Without S3, results can be kept in a local directory instead
+	if (s3cache == nil || !s3cache.Enabled) && config.FileCacheDir != "" {
+		ttl := time.Duration(*config.S3CacheTTL) * time.Second
+		files, err := routes.NewFileCache(config.FileCacheDir, ttl)
+		if err != nil {
+			logger.Warn("failed to initialize file cache", zap.Error(err), zap.String("dir", config.FileCacheDir))
+		} else {
+			s3cache = &routes.S3Cache{Enabled: true, TTL: ttl, Files: files}
+			logger.Info("caching results in local directory", zap.String("dir", config.FileCacheDir))
+		}
+	}
 
 	// Initialize optional Redis upload tracker
 	uploadTracker, redisErr := routes.NewRedisUploadTracker(
@@ -134,10 +413,29 @@ func main() {
 		BodyLimit:             bodyLimit,
 	})
 
+	// Every response carries an X-Request-ID, handlers log it with each line of the request
+	app.Use(routes.RequestID())
+
+	// Wraps the HTTP cache and every route, so errors are never cached downstream
+	app.Use(routes.NoStoreErrors())
+
+	// Registered first so metrics, the HTTP cache and routing all see the canonical path
+	if *config.NormalizePaths {
+		app.Use(routes.NormalizePaths())
+	}
+
 	prometheusModule := fiberprometheus.New("media-proxy")
 	prometheusModule.RegisterAt(app, "/metrics")
 
 	prometheusRegistry := prometheusModule.GetRegistry()
+	performanceMetrics := metrics.InitializePerformanceMetrics(prometheusRegistry, prometheusModule.GetConstLabels())
+	if *config.Metrics {
+		go metrics.CollectPerformanceMetrics(context.Background(), performanceMetrics, 15*time.Second, map[string]*ristretto.Metrics{
+			"memory": cacheStore.Metrics,
+			"http":   httpCacheStore.Metrics,
+		})
+	}
+
 	metrics := metrics.InitializeMetrics(prometheusRegistry, prometheusModule.GetConstLabels())
 
 	if *config.Metrics {
@@ -145,12 +443,30 @@ func main() {
 	}
 
 	app.Use(healthcheck.New())
+
+	// Registered before compression and caching so readiness is always evaluated live
+	routes.RegisterHealthRoutes(logger, &config, app, s3cache, uploadTracker)
+	// The HTTP cache keys on the path only, a cached response would skip the token check
+	routes.RegisterFeatureRoutes(logger, &config, app)
+
+	// Health, metrics and feature routes stay reachable for probes, the media routes below only answer allowed clients
+	ipFilter, err := routes.IPFilter(&config)
+	if err != nil {
+		logger.Fatal("invalid ip filter", zap.Error(err))
+	}
+	if ipFilter != nil {
+		app.Use(ipFilter)
+	}
+
 	app.Use(compress.New())
 	app.Use(etag.New())
 	app.Use(cache.New(cache.Config{
 		Expiration: time.Minute * 10,
 		Storage:    storage.NewRistrettoStorage(httpCacheStore),
+		// Keeps headers such as X-Frame-Position-Clamped on responses served from this cache
+		StoreResponseHeaders: true,
 		Next: func(c *fiber.Ctx) bool {
+			// Raw video bytes are cached by the proxy itself, which slices full objects for Range requests
 			if strings.HasPrefix(c.Path(), "/videos/") && !strings.HasPrefix(c.Path(), "/videos/preview/") {
 				return true
 			}
@@ -166,15 +482,49 @@ func main() {
 		},
 	}))
 
-	routes.RegisterImageRoutes(logger, cacheStore, &config, app, metrics, s3cache)
-	routes.RegisterVideoRoutes(logger, cacheStore, &config, app, metrics, s3cache, uploadTracker)
+	// Image and video routes share the workers of each work class
+	scheduler := routes.NewWorkScheduler(&config, performanceMetrics)
+	// Image and video routes fetch from origins through one client, so they share its connection pool
+	originControl, err := routes.PrivateOriginControl(&config)
+	if err != nil {
+		logger.Fatal("invalid private origins", zap.Error(err))
+	}
+	httpClient := client.NewHTTPClient(&config, originControl)
+	routes.ValidateRedirects(httpClient, logger, &config)
+	// Fetches from an origin share its token bucket across image and video routes
+	origins := routes.NewOriginRateLimiter(&config)
+	routes.RegisterImageRoutes(logger, cacheStore, &config, app, metrics, performanceMetrics, s3cache, scheduler, httpClient, origins)
+	routes.RegisterVideoRoutes(logger, cacheStore, httpCacheStore, &config, app, metrics, performanceMetrics, s3cache, uploadTracker, scheduler, httpClient, origins)
+	routes.RegisterPurgeRoutes(logger, cacheStore, httpCacheStore, &config, app, s3cache, httpClient)
 
 	address := config.Address
 	if address == "" {
 		address = ":3000"
 	}
 
-	log.Fatal(app.Listen(address))
+	// Logged once the listener is bound, with the address it resolved to
+	app.Hooks().OnListen(func(listenData fiber.ListenData) error {
+		logger.Info("server started", zap.String("address", net.JoinHostPort(listenData.Host, listenData.Port)), zap.Bool("tls", listenData.TLS))
+		return nil
+	})
 
-	logger.Info("server started", zap.String("address", address))
+	// Listening in the background lets SIGTERM drain in-flight requests, so deploys don't cut off uploads and streams
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(address)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-listenErr:
+		logger.Error("server stopped", zap.Error(err))
+	case sig := <-signals:
+		grace := time.Duration(config.ShutdownGracePeriod) * time.Second
+		logger.Info("shutting down", zap.String("signal", sig.String()), zap.Duration("grace_period", grace))
+		if err := app.ShutdownWithTimeout(grace); err != nil {
+			logger.Warn("grace period passed, remaining requests were cut off", zap.Error(err))
+		}
+	}
 }
@@ -3,6 +3,8 @@ package metrics
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"mime"
+	"strconv"
 	"strings"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,6 +13,9 @@ import (
 type Metrics struct {
 	SuccessfullyServed *prometheus.CounterVec
 	ServedCached       *prometheus.CounterVec
+	BytesServed        *prometheus.CounterVec
+	OutputSizeBytes    *prometheus.HistogramVec
+	OriginErrors       *prometheus.CounterVec
 }
 
 func InitializeMetrics(registry prometheus.Registerer, constLabels prometheus.Labels) *Metrics {
@@ -25,15 +30,73 @@ func InitializeMetrics(registry prometheus.Registerer, constLabels prometheus.La
 			Help:        "Number of served responses from cache",
 			ConstLabels: constLabels,
 		}, []string{"type", "hostname", "url_hash"}), // Use URL hash instead of full URL
+		BytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "bytes_served_total",
+			Help:        "Number of response body bytes served",
+			ConstLabels: constLabels,
+		}, []string{"type", "cache_hit"}),
+		OutputSizeBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "output_size_bytes",
+			Help:        "Size of served response bodies in bytes",
+			ConstLabels: constLabels,
+			Buckets:     []float64{1024, 10240, 102400, 1048576, 10485760, 104857600}, // 1KB to 100MB
+		}, []string{"type", "format"}),
+		OriginErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "origin_errors_total",
+			Help:        "Number of failed upstream fetches from origins or S3",
+			ConstLabels: constLabels,
+		}, []string{"type", "hostname"}),
 	}
 
 	// Register the custom metrics with the Prometheus registry
 	registry.MustRegister(metrics.SuccessfullyServed)
 	registry.MustRegister(metrics.ServedCached)
+	registry.MustRegister(metrics.BytesServed)
+	registry.MustRegister(metrics.OutputSizeBytes)
+	registry.MustRegister(metrics.OriginErrors)
 
 	return metrics
 }
 
+// ObserveServed counts the bytes of a served response body and records its size by output format
+func (m *Metrics) ObserveServed(responseType string, cacheHit bool, contentType string, size int64) {
+	m.BytesServed.WithLabelValues(responseType, strconv.FormatBool(cacheHit)).Add(float64(size))
+	m.OutputSizeBytes.WithLabelValues(responseType, OutputFormat(contentType)).Observe(float64(size))
+}
+
+// outputFormats maps the content types the proxy serves to short format labels
+var outputFormats = map[string]string{
+	"image/jpeg":       "jpeg",
+	"image/png":        "png",
+	"image/webp":       "webp",
+	"image/gif":        "gif",
+	"image/bmp":        "bmp",
+	"image/tiff":       "tiff",
+	"image/avif":       "avif",
+	"image/heic":       "heic",
+	"image/heif":       "heif",
+	"video/mp4":        "mp4",
+	"video/ogg":        "ogg",
+	"video/webm":       "webm",
+	"video/quicktime":  "quicktime",
+	"video/x-msvideo":  "avi",
+	"video/x-matroska": "mkv",
+	"video/x-flv":      "flv",
+	"video/x-m4v":      "m4v",
+}
+
+// OutputFormat turns a content type into a format label, anything unknown is "other" to keep the label bounded
+func OutputFormat(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "other"
+	}
+	if format, ok := outputFormats[mediaType]; ok {
+		return format
+	}
+	return "other"
+}
+
 // HashURL creates a short hash of the URL to reduce metric cardinality
 func HashURL(url string) string {
 	// Truncate URL if too long to prevent extremely long URLs from affecting hash performance
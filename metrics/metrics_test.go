@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"media-proxy/validation"
+)
+
+func TestObserveServed(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := InitializeMetrics(registry, prometheus.Labels{})
+
+	metrics.ObserveServed("image", false, "image/png", 2048)
+	metrics.ObserveServed("image", true, "image/png", 4096)
+	metrics.ObserveServed("video", false, "video/mp4; codecs=avc1", 1<<20)
+	metrics.ObserveServed("video", false, "multipart/byteranges; boundary=x", 10)
+
+	if served := testutil.ToFloat64(metrics.BytesServed.WithLabelValues("image", "true")); served != 4096 {
+		t.Errorf("expected 4096 cached bytes, got %v", served)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	counts := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != "output_size_bytes" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counts[labels["type"]+"/"+labels["format"]] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	expected := map[string]uint64{"image/png": 2, "video/mp4": 1, "video/other": 1}
+	for series, count := range expected {
+		if counts[series] != count {
+			t.Errorf("expected %d observations for %s, got %d", count, series, counts[series])
+		}
+	}
+	if len(counts) != len(expected) {
+		t.Errorf("expected %d series, got %v", len(expected), counts)
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := map[string]string{
+		"image/webp":                "webp",
+		"IMAGE/JPEG":                "jpeg",
+		"video/x-matroska":          "mkv",
+		"text/plain; charset=utf-8": "other",
+		"":                          "other",
+	}
+	for contentType, expected := range tests {
+		if format := OutputFormat(contentType); format != expected {
+			t.Errorf("%q: expected %s, got %s", contentType, expected, format)
+		}
+	}
+}
+
+// TestOutputFormat_CoversAcceptedMimeTypes keeps the format labels in step with the mime allowlists in validation
+func TestOutputFormat_CoversAcceptedMimeTypes(t *testing.T) {
+	for _, mimeType := range append(validation.ImageMimeTypes(), validation.VideoMimeTypes()...) {
+		if format := OutputFormat(mimeType); format == "other" {
+			t.Errorf("accepted mime type %q has no output format label", mimeType)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package metrics
 
 import (
+	"context"
+	"runtime"
 	"time"
 
+	"github.com/dgraph-io/ristretto/v2"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -15,6 +18,9 @@ type PerformanceMetrics struct {
 	HTTPRequestTime  *prometheus.HistogramVec
 	ImageSizeBytes   *prometheus.HistogramVec
 	VideoSizeBytes   *prometheus.HistogramVec
+	OpenInputs       prometheus.Gauge
+	WorkQueueDepth   *prometheus.GaugeVec
+	WorkInFlight     *prometheus.GaugeVec
 }
 
 func InitializePerformanceMetrics(registry prometheus.Registerer, constLabels prometheus.Labels) *PerformanceMetrics {
@@ -72,6 +78,24 @@ func InitializePerformanceMetrics(registry prometheus.Registerer, constLabels pr
 			ConstLabels: constLabels,
 			Buckets:     []float64{1048576, 10485760, 104857600, 1073741824}, // 1MB to 1GB
 		}, []string{"format"}),
+
+		OpenInputs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "ffmpeg_open_inputs",
+			Help:        "Number of ffmpeg input contexts currently open",
+			ConstLabels: constLabels,
+		}),
+
+		WorkQueueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "work_queue_depth",
+			Help:        "Number of requests waiting for a worker, by work class",
+			ConstLabels: constLabels,
+		}, []string{"class"}),
+
+		WorkInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "work_in_flight",
+			Help:        "Number of requests holding a worker, by work class",
+			ConstLabels: constLabels,
+		}, []string{"class"}),
 	}
 
 	// Register all metrics
@@ -84,6 +108,9 @@ func InitializePerformanceMetrics(registry prometheus.Registerer, constLabels pr
 		metrics.HTTPRequestTime,
 		metrics.ImageSizeBytes,
 		metrics.VideoSizeBytes,
+		metrics.OpenInputs,
+		metrics.WorkQueueDepth,
+		metrics.WorkInFlight,
 	)
 
 	return metrics
@@ -102,6 +129,26 @@ func TimeFunction[T any](fn func() (T, error), operation string, metrics *Perfor
 	return result, err
 }
 
+// TimeImageOperation starts timing an image processing step, call the returned function when the step is done
+func TimeImageOperation(operation string, metrics *PerformanceMetrics) func() {
+	start := time.Now()
+	return func() {
+		if metrics != nil {
+			metrics.ImageProcessTime.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// TimeVideoOperation starts timing a video processing step, call the returned function when the step is done
+func TimeVideoOperation(operation string, metrics *PerformanceMetrics) func() {
+	start := time.Now()
+	return func() {
+		if metrics != nil {
+			metrics.VideoProcessTime.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
 // TimeHTTPRequest measures HTTP request duration
 func TimeHTTPRequest(hostname string, metrics *PerformanceMetrics) func() {
 	start := time.Now()
@@ -112,3 +159,39 @@ func TimeHTTPRequest(hostname string, metrics *PerformanceMetrics) func() {
 		}
 	}
 }
+
+// CollectPerformanceMetrics periodically refreshes the cache hit ratio and memory usage gauges until ctx is done.
+// cacheMetrics maps the "type" label to the ristretto metrics of that cache (the cache must be created with Metrics enabled).
+func CollectPerformanceMetrics(ctx context.Context, metrics *PerformanceMetrics, interval time.Duration, cacheMetrics map[string]*ristretto.Metrics) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		updatePerformanceMetrics(metrics, cacheMetrics)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updatePerformanceMetrics sets the gauges from the current cache and runtime statistics
+func updatePerformanceMetrics(metrics *PerformanceMetrics, cacheMetrics map[string]*ristretto.Metrics) {
+	if metrics == nil {
+		return
+	}
+
+	for cacheType, cm := range cacheMetrics {
+		metrics.CacheHitRatio.WithLabelValues(cacheType).Set(cm.Ratio())
+	}
+
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	metrics.MemoryUsage.WithLabelValues("heap_alloc").Set(float64(memStats.HeapAlloc))
+	metrics.MemoryUsage.WithLabelValues("heap_inuse").Set(float64(memStats.HeapInuse))
+	metrics.MemoryUsage.WithLabelValues("stack_inuse").Set(float64(memStats.StackInuse))
+	metrics.MemoryUsage.WithLabelValues("sys").Set(float64(memStats.Sys))
+}
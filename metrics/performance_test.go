@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPerformanceMetrics_RegisterAndUpdate(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := InitializePerformanceMetrics(registry, prometheus.Labels{"service": "test"})
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, []byte]{
+		NumCounters: 100,
+		MaxCost:     1 << 10,
+		BufferItems: 64,
+		Metrics:     true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("key", []byte("value"), 1)
+	cache.Wait()
+	cache.Get("key")
+	cache.Get("missing")
+
+	updatePerformanceMetrics(metrics, map[string]*ristretto.Metrics{
+		"memory": cache.Metrics,
+		"http":   nil, // caches without metrics report a zero ratio
+	})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	found := map[string]bool{}
+	ratios := map[string]float64{}
+	for _, family := range families {
+		found[family.GetName()] = true
+
+		if family.GetName() != "cache_hit_ratio" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "type" {
+					ratios[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	for _, name := range []string{"cache_hit_ratio", "memory_usage_bytes"} {
+		if !found[name] {
+			t.Errorf("expected metric %s to be gathered", name)
+		}
+	}
+
+	// One hit and one miss
+	if ratio, ok := ratios["memory"]; !ok || ratio != 0.5 {
+		t.Errorf("expected memory hit ratio 0.5, got %v (present: %v)", ratio, ok)
+	}
+	if ratio, ok := ratios["http"]; !ok || ratio != 0 {
+		t.Errorf("expected http hit ratio 0 for a cache without metrics, got %v (present: %v)", ratio, ok)
+	}
+}
+
+func TestTimeOperation_ObservesHistograms(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := InitializePerformanceMetrics(registry, prometheus.Labels{})
+
+	TimeImageOperation("resize", metrics)()
+	TimeVideoOperation("frame-extract", metrics)()
+	TimeVideoOperation("frame-extract", metrics)()
+
+	// Disabled metrics are a no-op
+	TimeImageOperation("resize", nil)()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+
+	counts := map[string]uint64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if histogram := metric.GetHistogram(); histogram != nil {
+				counts[family.GetName()+"/"+metric.GetLabel()[0].GetValue()] = histogram.GetSampleCount()
+			}
+		}
+	}
+
+	if counts["image_process_time_seconds/resize"] != 1 {
+		t.Errorf("expected one resize observation, got %d", counts["image_process_time_seconds/resize"])
+	}
+	if counts["video_process_time_seconds/frame-extract"] != 2 {
+		t.Errorf("expected two frame-extract observations, got %d", counts["video_process_time_seconds/frame-extract"])
+	}
+}
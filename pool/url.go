@@ -16,11 +16,18 @@ var (
 	urlCacheSize = 1000 // Limit cache size
 )
 
-func ValidateUrl(logger *zap.Logger, urlStr string, origins []string) (valid bool, hostname string) {
+// defaultSchemes are always allowed for origin fetches
+var defaultSchemes = []string{"http", "https"}
+
+// ValidateUrl checks the URL scheme against http(s) plus the extra allowed schemes, then the hostname against the allowed origins
+func ValidateUrl(logger *zap.Logger, urlStr string, origins []string, schemes []string) (valid bool, hostname string) {
 	// Check cache first
 	urlCacheMux.RLock()
 	if parsedUrl, exists := urlCache[urlStr]; exists {
 		urlCacheMux.RUnlock()
+		if !ValidateScheme(parsedUrl, schemes) {
+			return false, ""
+		}
 		return ValidateHostname(parsedUrl, origins, logger)
 	}
 	urlCacheMux.RUnlock()
@@ -40,9 +47,35 @@ func ValidateUrl(logger *zap.Logger, urlStr string, origins []string) (valid boo
 	urlCache[urlStr] = parsedUrl
 	urlCacheMux.Unlock()
 
+	if !ValidateScheme(parsedUrl, schemes) {
+		logger.Debug("url scheme rejected", zap.String("scheme", parsedUrl.Scheme))
+		return false, ""
+	}
+
 	return ValidateHostname(parsedUrl, origins, logger)
 }
 
+// ValidateScheme rejects anything but http(s) and the explicitly allowed schemes (e.g. file: or data:),
+// regardless of whether an origins allowlist is configured
+func ValidateScheme(parsedUrl *url.URL, schemes []string) bool {
+	scheme := strings.ToLower(parsedUrl.Scheme)
+
+	for _, allowed := range defaultSchemes {
+		if scheme == allowed {
+			return true
+		}
+	}
+
+	for _, allowed := range schemes {
+		if scheme == strings.ToLower(allowed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateHostname checks the hostname against the allowed origins, an origins allowlist only ever matches http(s) URLs
 func ValidateHostname(parsedUrl *url.URL, origins []string, logger *zap.Logger) (valid bool, hostname string) {
 	if len(origins) == 0 {
 		return true, ""
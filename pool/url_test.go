@@ -0,0 +1,47 @@
+package pool
+
+import (
+	"net/url"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestValidateHostname_RejectsNonHTTPSchemes(t *testing.T) {
+	logger := zap.NewNop()
+	origins := []string{"example.com", "*.cdn.example.com"}
+
+	for _, tc := range []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/cat.jpg", true},
+		{"http://img.cdn.example.com/cat.jpg", true},
+		{"https://other.com/cat.jpg", false},
+		// Called directly, the hostname check still refuses schemes that merely carry an allowed host
+		{"ftp://example.com/cat.jpg", false},
+		{"file://example.com/etc/passwd", false},
+	} {
+		parsedUrl, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", tc.url, err)
+		}
+
+		if valid, _ := ValidateHostname(parsedUrl, origins, logger); valid != tc.valid {
+			t.Errorf("%s: expected valid=%v, got %v", tc.url, tc.valid, valid)
+		}
+	}
+}
+
+func TestValidateUrl_AllowedSchemeWithOrigins(t *testing.T) {
+	logger := zap.NewNop()
+
+	// An extra scheme passes the scheme check but an origins allowlist only matches http(s)
+	if valid, _ := ValidateUrl(logger, "ftp://example.com/cat.jpg", []string{"example.com"}, []string{"ftp"}); valid {
+		t.Error("expected ftp to be rejected when an origins allowlist is configured")
+	}
+
+	if valid, _ := ValidateUrl(logger, "ftp://example.com/cat.jpg", nil, []string{"ftp"}); !valid {
+		t.Error("expected ftp to be accepted without an origins allowlist")
+	}
+}
@@ -0,0 +1,417 @@
+// Package progjpeg encodes progressive JPEGs, which image/jpeg can decode but not write. The first scan carries the
+// DC coefficient of every block so a browser can show the whole image blurred, the later ones sharpen it as they
+// arrive.
+package progjpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// component is one plane of the frame with its quantized blocks
+type component struct {
+	id byte
+	// h and v are the sampling factors, 2 for luminance of a color image and 1 otherwise
+	h, v int
+	// table selects the quantization and Huffman tables, 0 for luminance and 1 for chrominance
+	table int
+	// width and height are the size of the plane in pixels, the AC scans only cover the blocks within them
+	width, height int
+	// blocksX is the number of blocks in a row, the blocks cover whole MCUs
+	blocksX int
+	// blocks holds the 64 quantized coefficients of every block in zigzag order
+	blocks []int16
+}
+
+// scan is the band of coefficients from start to end of the listed components, the DC scan is the one band that
+// may interleave components
+type scan struct {
+	components []int
+	start, end int
+}
+
+// colorScans send all DC coefficients first, then the low luminance frequencies, the chrominance and the rest of
+// the luminance
+var colorScans = []scan{
+	{[]int{0, 1, 2}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{1}, 1, 63},
+	{[]int{2}, 1, 63},
+	{[]int{0}, 6, 63},
+}
+
+var grayScans = []scan{
+	{[]int{0}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{0}, 6, 63},
+}
+
+// Encode writes m to w as a progressive JPEG. Only the quality of o is used, like image/jpeg it defaults to
+// jpeg.DefaultQuality when o is nil.
+func Encode(w io.Writer, m image.Image, o *jpeg.Options) error {
+	b := m.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("progjpeg: image is empty")
+	}
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("progjpeg: image is too large to encode")
+	}
+
+	quality := jpeg.DefaultQuality
+	if o != nil {
+		quality = o.Quality
+	}
+	quant := scaleQuant(quality)
+
+	var components []*component
+	scans := colorScans
+	if gray, ok := m.(*image.Gray); ok {
+		components = grayComponents(gray, &quant)
+		scans = grayScans
+	} else {
+		components = colorComponents(m, &quant)
+	}
+
+	e := &encoder{w: bufio.NewWriter(w)}
+	e.write(0xff, 0xd8)
+	e.writeDQT(&quant, len(components))
+	e.writeSOF2(b.Dx(), b.Dy(), components)
+	e.writeDHT(len(components))
+	for _, s := range scans {
+		e.writeScan(components, s)
+	}
+	e.write(0xff, 0xd9)
+	return e.w.Flush()
+}
+
+// scaleQuant scales the tables by quality the way image/jpeg does
+func scaleQuant(quality int) [2][64]byte {
+	quality = min(max(quality, 1), 100)
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+
+	var quant [2][64]byte
+	for i := range quant {
+		for j := range quant[i] {
+			x := (int(unscaledQuant[i][j])*scale + 50) / 100
+			quant[i][j] = byte(min(max(x, 1), 255))
+		}
+	}
+	return quant
+}
+
+func grayComponents(m *image.Gray, quant *[2][64]byte) []*component {
+	b := m.Bounds()
+	plane := make([]uint8, b.Dx()*b.Dy())
+	for y := range b.Dy() {
+		copy(plane[y*b.Dx():], m.Pix[m.PixOffset(b.Min.X, b.Min.Y+y):][:b.Dx()])
+	}
+
+	c := newComponent(1, 1, 1, 0, b.Dx(), b.Dy(), (b.Dx()+7)/8, (b.Dy()+7)/8)
+	c.fill(plane, b.Dx(), b.Dy(), 1, &quant[0])
+	return []*component{c}
+}
+
+// colorComponents converts m to YCbCr with the chrominance subsampled to half the width and height
+func colorComponents(m image.Image, quant *[2][64]byte) []*component {
+	b := m.Bounds()
+	rgba, ok := m.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(b)
+		draw.Draw(rgba, b, m, b.Min, draw.Src)
+	}
+
+	width, height := b.Dx(), b.Dy()
+	planes := [3][]uint8{make([]uint8, width*height), make([]uint8, width*height), make([]uint8, width*height)}
+	for y := range height {
+		row := rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y+y):]
+		for x := range width {
+			p := row[4*x:]
+			i := y*width + x
+			planes[0][i], planes[1][i], planes[2][i] = color.RGBToYCbCr(p[0], p[1], p[2])
+		}
+	}
+
+	// An MCU is 16x16 pixels, four luminance blocks and one block of each chrominance
+	mcusX, mcusY := (width+15)/16, (height+15)/16
+	chromaWidth, chromaHeight := (width+1)/2, (height+1)/2
+	components := []*component{
+		newComponent(1, 2, 2, 0, width, height, mcusX, mcusY),
+		newComponent(2, 1, 1, 1, chromaWidth, chromaHeight, mcusX, mcusY),
+		newComponent(3, 1, 1, 1, chromaWidth, chromaHeight, mcusX, mcusY),
+	}
+	for i, c := range components {
+		c.fill(planes[i], width, height, 2/c.h, &quant[c.table])
+	}
+	return components
+}
+
+// newComponent allocates the blocks of a width by height plane over the whole MCU grid
+func newComponent(id byte, h, v, table, width, height, mcusX, mcusY int) *component {
+	return &component{
+		id:      id,
+		h:       h,
+		v:       v,
+		table:   table,
+		width:   width,
+		height:  height,
+		blocksX: mcusX * h,
+		blocks:  make([]int16, mcusX*h*mcusY*v*64),
+	}
+}
+
+// fill transforms and quantizes every block of the component from a full resolution plane, averaging factor by
+// factor pixels into one sample and repeating the last row and column past the edges
+func (c *component) fill(plane []uint8, width, height, factor int, quant *[64]byte) {
+	var samples [64]float64
+	blocksY := len(c.blocks) / 64 / c.blocksX
+	for by := range blocksY {
+		for bx := range c.blocksX {
+			for j := range 8 {
+				for i := range 8 {
+					sum := 0
+					for dy := range factor {
+						y := min((by*8+j)*factor+dy, height-1)
+						for dx := range factor {
+							x := min((bx*8+i)*factor+dx, width-1)
+							sum += int(plane[y*width+x])
+						}
+					}
+					samples[j*8+i] = float64(sum)/float64(factor*factor) - 128
+				}
+			}
+			index := (by*c.blocksX + bx) * 64
+			transform(&samples, (*[64]int16)(c.blocks[index:index+64]), quant)
+		}
+	}
+}
+
+// dctCos holds the orthonormal DCT basis, the cosine of frequency u at sample x scaled by its normalization
+var dctCos = func() (table [8][8]float64) {
+	for u := range 8 {
+		scale := 0.5
+		if u == 0 {
+			scale = math.Sqrt(0.125)
+		}
+		for x := range 8 {
+			table[u][x] = scale * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}()
+
+// transform runs the forward DCT over the rows and then the columns of the samples, and writes the coefficients
+// divided by quant in zigzag order
+func transform(samples *[64]float64, block *[64]int16, quant *[64]byte) {
+	var rows [64]float64
+	for y := range 8 {
+		for u := range 8 {
+			sum := 0.0
+			for x := range 8 {
+				sum += dctCos[u][x] * samples[y*8+x]
+			}
+			rows[y*8+u] = sum
+		}
+	}
+
+	var coefficients [64]float64
+	for u := range 8 {
+		for v := range 8 {
+			sum := 0.0
+			for y := range 8 {
+				sum += dctCos[v][y] * rows[y*8+u]
+			}
+			coefficients[v*8+u] = sum
+		}
+	}
+
+	for k := range 64 {
+		block[k] = int16(math.Round(coefficients[unzig[k]] / float64(quant[k])))
+	}
+}
+
+// encoder buffers the entropy coded bits of a scan and stuffs a zero after every 0xff byte
+type encoder struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint32
+}
+
+func (e *encoder) write(p ...byte) {
+	_, _ = e.w.Write(p)
+}
+
+// writeSegment writes a marker and the two byte length of its payload, the payload follows
+func (e *encoder) writeSegment(marker byte, length int) {
+	e.write(0xff, marker, byte((length+2)>>8), byte(length+2))
+}
+
+// emit writes the low nBits of bits
+func (e *encoder) emit(bits, nBits uint32) {
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := byte(bits >> 24)
+		_ = e.w.WriteByte(b)
+		if b == 0xff {
+			_ = e.w.WriteByte(0x00)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+func (e *encoder) emitHuff(lut *huffmanLUT, value int32) {
+	x := lut[value]
+	e.emit(x&(1<<24-1), x>>24)
+}
+
+// emitHuffRLE writes the run of zeros and the size of value as one symbol, followed by the bits of value
+func (e *encoder) emitHuffRLE(lut *huffmanLUT, runLength, value int32) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	nBits := uint32(bits.Len32(uint32(a)))
+	e.emitHuff(lut, runLength<<4|int32(nBits))
+	if nBits > 0 {
+		e.emit(uint32(b)&(1<<nBits-1), nBits)
+	}
+}
+
+// flush pads the last byte of a scan with one bits
+func (e *encoder) flush() {
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+func (e *encoder) writeDQT(quant *[2][64]byte, tables int) {
+	tables = min(tables, 2)
+	e.writeSegment(0xdb, tables*65)
+	for i := range tables {
+		e.write(byte(i))
+		e.write(quant[i][:]...)
+	}
+}
+
+// writeSOF2 starts a progressive frame with Huffman coding
+func (e *encoder) writeSOF2(width, height int, components []*component) {
+	e.writeSegment(0xc2, 6+3*len(components))
+	e.write(8, byte(height>>8), byte(height), byte(width>>8), byte(width), byte(len(components)))
+	for _, c := range components {
+		e.write(c.id, byte(c.h<<4|c.v), byte(c.table))
+	}
+}
+
+func (e *encoder) writeDHT(components int) {
+	specs := huffmanSpecs[:2]
+	if components > 1 {
+		specs = huffmanSpecs[:]
+	}
+
+	length := 0
+	for _, spec := range specs {
+		length += 17 + len(spec.value)
+	}
+	e.writeSegment(0xc4, length)
+	for i, spec := range specs {
+		// The specs alternate DC and AC, table 0 for luminance and 1 for chrominance
+		e.write(byte((i%2)<<4 | i/2))
+		e.write(spec.count[:]...)
+		e.write(spec.value...)
+	}
+}
+
+func (e *encoder) writeScan(components []*component, s scan) {
+	e.writeSegment(0xda, 4+2*len(s.components))
+	e.write(byte(len(s.components)))
+	for _, i := range s.components {
+		table := byte(components[i].table)
+		e.write(components[i].id, table<<4|table)
+	}
+	e.write(byte(s.start), byte(s.end), 0)
+
+	if s.start == 0 {
+		e.writeDC(components, s.components)
+	} else {
+		e.writeAC(components[s.components[0]], s.start, s.end)
+	}
+	e.flush()
+}
+
+// writeDC codes the difference of every DC coefficient to the previous one of its component. A single component is
+// coded in raster order over its own blocks, several are interleaved MCU by MCU.
+func (e *encoder) writeDC(components []*component, indexes []int) {
+	if len(indexes) == 1 {
+		c := components[indexes[0]]
+		lut := huffmanLUTs[2*c.table]
+		prev := int16(0)
+		for by := range (c.height + 7) / 8 {
+			for bx := range (c.width + 7) / 8 {
+				dc := c.blocks[(by*c.blocksX+bx)*64]
+				e.emitHuffRLE(lut, 0, int32(dc-prev))
+				prev = dc
+			}
+		}
+		return
+	}
+
+	first := components[indexes[0]]
+	mcusX := first.blocksX / first.h
+	mcusY := len(first.blocks) / 64 / first.blocksX / first.v
+	prev := make([]int16, len(indexes))
+	for my := range mcusY {
+		for mx := range mcusX {
+			for n, i := range indexes {
+				c := components[i]
+				lut := huffmanLUTs[2*c.table]
+				for v := range c.v {
+					for h := range c.h {
+						dc := c.blocks[((my*c.v+v)*c.blocksX+mx*c.h+h)*64]
+						e.emitHuffRLE(lut, 0, int32(dc-prev[n]))
+						prev[n] = dc
+					}
+				}
+			}
+		}
+	}
+}
+
+// writeAC codes the coefficients from start to end of every block of the component, ending each block with an
+// end of band symbol when its last coefficients are zero
+func (e *encoder) writeAC(c *component, start, end int) {
+	lut := huffmanLUTs[2*c.table+1]
+	for by := range (c.height + 7) / 8 {
+		for bx := range (c.width + 7) / 8 {
+			block := c.blocks[(by*c.blocksX+bx)*64:]
+			run := int32(0)
+			for k := start; k <= end; k++ {
+				ac := int32(block[k])
+				if ac == 0 {
+					run++
+					continue
+				}
+				for run > 15 {
+					e.emitHuff(lut, 0xf0)
+					run -= 16
+				}
+				e.emitHuffRLE(lut, run, ac)
+				run = 0
+			}
+			if run > 0 {
+				e.emitHuff(lut, 0x00)
+			}
+		}
+	}
+}
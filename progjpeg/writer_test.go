@@ -0,0 +1,109 @@
+package progjpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// gradient paints a smooth image, so the decoded pixels stay close to the source at a high quality
+func gradient(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func encodeDecode(t *testing.T, img image.Image, quality int) (image.Image, []byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return decoded, buf.Bytes()
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func TestEncode(t *testing.T) {
+	for _, size := range []image.Point{{64, 48}, {1, 1}, {17, 33}, {100, 7}} {
+		img := gradient(size.X, size.Y)
+		decoded, data := encodeDecode(t, img, 95)
+
+		if !bytes.Contains(data, []byte{0xff, 0xc2}) || bytes.Contains(data, []byte{0xff, 0xc0}) {
+			t.Errorf("%v: expected a progressive frame only", size)
+		}
+		if decoded.Bounds().Size() != size {
+			t.Errorf("expected %v, got %v", size, decoded.Bounds().Size())
+		}
+		for y := 0; y < size.Y; y += 3 {
+			for x := 0; x < size.X; x += 3 {
+				r, g, _, _ := img.At(x, y).RGBA()
+				dr, dg, _, _ := decoded.At(x, y).RGBA()
+				if absDiff(r>>8, dr>>8) > 12 || absDiff(g>>8, dg>>8) > 12 {
+					t.Fatalf("%v: pixel %d,%d decoded as %v, expected about %v", size, x, y, decoded.At(x, y), img.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestEncode_Gray(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 30, 20))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 30 * 8)
+	}
+	// A sub-image starts past the origin and its rows are longer than its width
+	sub := img.SubImage(image.Rect(5, 3, 25, 18)).(*image.Gray)
+
+	decoded, _ := encodeDecode(t, sub, 90)
+	gray, ok := decoded.(*image.Gray)
+	if !ok {
+		t.Fatalf("expected a grayscale image, got %T", decoded)
+	}
+	if gray.Bounds().Size() != image.Pt(20, 15) {
+		t.Fatalf("expected 20x15, got %v", gray.Bounds().Size())
+	}
+	if got, expected := gray.GrayAt(10, 5).Y, sub.GrayAt(15, 8).Y; absDiff(uint32(got), uint32(expected)) > 12 {
+		t.Errorf("expected about %d, got %d", expected, got)
+	}
+}
+
+func TestEncode_OtherImageTypes(t *testing.T) {
+	nrgba := image.NewNRGBA(image.Rect(10, 10, 42, 42))
+	for i := range nrgba.Pix {
+		nrgba.Pix[i] = 0xff
+	}
+	decoded, _ := encodeDecode(t, nrgba, 75)
+	if r, g, b, _ := decoded.At(20, 20).RGBA(); r>>8 < 245 || g>>8 < 245 || b>>8 < 245 {
+		t.Errorf("expected white, got %v", decoded.At(20, 20))
+	}
+
+	// Noise at the lowest quality has large coefficients and long runs of zeros
+	noisy := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for i := range noisy.Pix {
+		noisy.Pix[i] = uint8(i * 7919 % 251)
+	}
+	encodeDecode(t, noisy, 1)
+	encodeDecode(t, noisy, 100)
+}
+
+func TestEncode_Empty(t *testing.T) {
+	if err := Encode(&bytes.Buffer{}, image.NewRGBA(image.Rect(0, 0, 0, 10)), nil); err == nil {
+		t.Error("expected an empty image to be rejected")
+	}
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/pool"
+	"media-proxy/validation"
+)
+
+const (
+	// defaultWaveformWidth and defaultWaveformHeight apply to waveforms whose path has no w: or h:
+	defaultWaveformWidth  = 800
+	defaultWaveformHeight = 120
+	// maxWaveformWidth and maxWaveformHeight bound the image, one bucket of the audio is decoded per column
+	maxWaveformWidth  = 4096
+	maxWaveformHeight = 1024
+	// defaultWaveformColor is the color of the bars when the path has no c:
+	defaultWaveformColor = "000000"
+)
+
+// waveformCacheKey keys a waveform apart from the previews of the same parameters
+func waveformCacheKey(config *config.Config, params *validation.ImageContext, color string) string {
+	return "waveform;" + cacheKey(config, params) + ";color=" + color
+}
+
+// handleAudioWaveformRequest answers GET /audio/waveform/* with a PNG of the peak amplitude of the audio over time,
+// one column per w: pixel
+func handleAudioWaveformRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, inputs *inputLimiter, reader waveformReader, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		pathParams := c.Params("*")
+		logger.Info("audio waveform request received", zap.String("pathParams", pathParams))
+
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+
+		return processAudioWaveform(c, logger, cache, config, counters, performance, params, s3cache, inputs, reader, failures, scheduler, httpClient, origins)
+	}
+}
+
+// processAudioWaveform decodes the whole audio stream once, only the peak of every column is kept while it is read
+func processAudioWaveform(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, reader waveformReader, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) error {
+	width, height := params.Width, params.Height
+	if width == 0 {
+		width = defaultWaveformWidth
+	}
+	if height == 0 {
+		height = defaultWaveformHeight
+	}
+	if width > maxWaveformWidth || height > maxWaveformHeight {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("a waveform is at most %dx%d pixels", maxWaveformWidth, maxWaveformHeight))
+	}
+	color := params.Color
+	if color == "" {
+		color = defaultWaveformColor
+	}
+
+	key := waveformCacheKey(config, params, color)
+	cacheValue, ok := cache.Get(key)
+	if !ok && s3cache != nil && s3cache.Enabled {
+		if s3val, err := s3cache.Get(context.Background(), key); err == nil && s3val != nil {
+			s3val.ETag = contentETag(key, s3val.Body)
+			cache.SetWithTTL(key, *s3val, 1000, cacheTTL(config))
+			cacheValue, ok = *s3val, true
+		}
+	}
+	if ok {
+		counters.SuccessfullyServed.WithLabelValues("audio-waveform", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+		counters.ServedCached.WithLabelValues("audio-waveform", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+
+		setPreviewHeaders(c, false, cacheValue.Headers)
+		c.Set("Content-Type", cacheValue.ContentType)
+		c.Set("Cache-Control", cacheControl(config, params))
+		if setResponseValidators(c, cacheValue) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		counters.ObserveServed("audio-waveform", true, cacheValue.ContentType, int64(len(cacheValue.Body)))
+		return c.Send(cacheValue.Body)
+	}
+
+	source, err := resolveMediaSource(c, logger, config, counters, params, s3cache, failures, httpClient, origins, "audio-waveform", audioMedia)
+	if source == nil {
+		return err
+	}
+	fail := func(status int, message string) error {
+		failures.add(source.FailureKey, probeFailure{Status: status, Message: message})
+		return c.Status(status).SendString(message)
+	}
+
+	release, err := scheduler.acquire(workExpensive)
+	if err != nil {
+		return sendBusy(c, logger, err)
+	}
+	defer release()
+
+	done := metrics.TimeVideoOperation("waveform-decode", performance)
+	waveform, err := reader.ReadWaveform(source.URL, width, frameExtractionOptions{
+		Threads:      config.EncoderThreads,
+		Inputs:       inputs,
+		ProbeTimeout: time.Duration(config.VideoProbeTimeout) * time.Second,
+		Headers:      source.Headers,
+		MaxDuration:  float64(config.MaxVideoDuration),
+	})
+	done()
+	if errors.Is(err, errProbeTimeout) {
+		logger.Error("audio probe timed out", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusGatewayTimeout, "audio probe timed out")
+	}
+	if errors.Is(err, errVideoTooLong) {
+		logger.Warn("audio is too long for a waveform", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, "audio is longer than the allowed duration")
+	}
+	if errors.Is(err, errUnknownDuration) {
+		logger.Warn("audio duration is unknown", zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, "audio duration is unknown, samples can't be spread over the width")
+	}
+	if err != nil {
+		logger.Error("failed to read audio waveform", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusInternalServerError, "failed to read audio waveform")
+	}
+	failures.forget(source.FailureKey)
+
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+
+	if err := png.Encode(buf, renderWaveform(waveform.Peaks, height, parseHexColor(color))); err != nil {
+		logger.Error("failed to encode waveform", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to encode waveform")
+	}
+
+	// The buffer goes back to the pool, the cached body can't share it
+	headers := waveform.headers()
+	value := CacheValue{Body: bytes.Clone(buf.Bytes()), ContentType: "image/png", Headers: headers}
+	value.ETag = contentETag(key, value.Body)
+	cache.SetWithTTL(key, value, 1000, cacheTTL(config))
+	storePreviewInS3(s3cache, key, "", value)
+
+	setPreviewHeaders(c, false, headers)
+	c.Set("Content-Type", value.ContentType)
+	c.Set("Cache-Control", cacheControl(config, params))
+	c.Set("ETag", value.ETag)
+
+	logger.Info("audio waveform served successfully", zap.Int("width", width), zap.Int("height", height), zap.String("origin", params.Hostname))
+	counters.SuccessfullyServed.WithLabelValues("audio-waveform", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	counters.ObserveServed("audio-waveform", false, value.ContentType, int64(len(value.Body)))
+
+	return c.Send(value.Body)
+}
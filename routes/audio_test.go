@@ -0,0 +1,207 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+// stubWaveformReader returns the same peaks for every source, spread over the requested buckets
+type stubWaveformReader struct {
+	duration float64
+	err      error
+	buckets  int
+	calls    int
+}
+
+func (s *stubWaveformReader) ReadWaveform(urlStr string, buckets int, options frameExtractionOptions) (*audioWaveform, error) {
+	s.calls++
+	s.buckets = buckets
+	if s.err != nil {
+		return nil, s.err
+	}
+	peaks := make([]float64, buckets)
+	for i := range peaks {
+		peaks[i] = float64(i%2) * 0.5
+	}
+	return &audioWaveform{Peaks: peaks, Duration: s.duration}, nil
+}
+
+// float32Samples encodes samples the way the decoders hand them over
+func float32Samples(samples ...float32) []byte {
+	data := make([]byte, 0, 4*len(samples))
+	for _, sample := range samples {
+		data = binary.LittleEndian.AppendUint32(data, math.Float32bits(sample))
+	}
+	return data
+}
+
+func TestPeakAccumulator(t *testing.T) {
+	peaks := newPeakAccumulator(4, 8)
+	peaks.add(float32Samples(0.1, -0.2, 0.3, 0.1, -0.9, 0.4, 0, 0.2))
+	// Samples past the reported duration land in the last bucket, broken ones are left out
+	peaks.add(float32Samples(-0.6, float32(math.NaN()), 2))
+	peaks.add([]byte{0, 0})
+
+	expected := []float64{0.2, 0.3, 0.9, 1}
+	for i, peak := range peaks.peaks {
+		if math.Abs(peak-expected[i]) > 1e-6 {
+			t.Errorf("expected peak %v in bucket %d, got %v", expected[i], i, peak)
+		}
+	}
+	if peaks.seen != 11 {
+		t.Errorf("expected 11 samples, got %d", peaks.seen)
+	}
+}
+
+func TestRenderWaveform(t *testing.T) {
+	fill := parseHexColor("ff880080")
+	if fill != (color.NRGBA{R: 0xff, G: 0x88, A: 0x80}) {
+		t.Errorf("unexpected color %v", fill)
+	}
+	if opaque := parseHexColor("3b82f6"); opaque.A != 0xff {
+		t.Errorf("expected a color without alpha digits to be opaque, got %v", opaque)
+	}
+
+	img := renderWaveform([]float64{0, 1, 0.5}, 10, fill)
+	if size := img.Bounds().Size(); size != image.Pt(3, 10) {
+		t.Fatalf("expected a 3x10 image, got %v", size)
+	}
+	column := func(x int) int {
+		filled := 0
+		for y := range 10 {
+			if img.NRGBAAt(x, y) == fill {
+				filled++
+			}
+		}
+		return filled
+	}
+	// Silence still shows as a line
+	for x, expected := range []int{1, 10, 5} {
+		if filled := column(x); filled != expected {
+			t.Errorf("expected %d filled pixels in column %d, got %d", expected, x, filled)
+		}
+	}
+	if img.NRGBAAt(2, 0).A != 0 || img.NRGBAAt(2, 5) != fill {
+		t.Error("expected the bars to be centered on a transparent background")
+	}
+}
+
+func TestAudioWaveform(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{EncoderThreads: 1}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	reader := &stubWaveformReader{duration: 182.5}
+	app := fiber.New()
+	app.Get("/audio/waveform/*", handleAudioWaveformRequest(zap.NewNop(), cache, cfg, counters, nil, nil, newInputLimiter(0, nil), reader, nil, nil, newOriginClient(t, cfg), nil))
+
+	request := func(pathParams, contentType string) *http.Response {
+		t.Helper()
+		encoded := base64.URLEncoding.EncodeToString([]byte(serveOrigin(t, contentType, []byte("not decoded by the stub"))))
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, "/audio/waveform/"+pathParams+encoded, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return response
+	}
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(serveOrigin(t, "audio/mpeg", []byte("not decoded by the stub"))))
+	for range 2 {
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, "/audio/waveform/w:200/h:40/c:ff0000/"+encoded, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200, got %d", response.StatusCode)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("expected a png, got %q", contentType)
+		}
+		if duration := response.Header.Get("X-Audio-Duration"); duration != "182.500" {
+			t.Errorf("expected X-Audio-Duration 182.500, got %q", duration)
+		}
+		img, err := png.Decode(response.Body)
+		if err != nil {
+			t.Fatalf("expected a png waveform: %v", err)
+		}
+		if size := img.Bounds().Size(); size != image.Pt(200, 40) {
+			t.Errorf("expected a 200x40 waveform, got %v", size)
+		}
+		if r, g, _, a := img.At(1, 20).RGBA(); r != 0xffff || g != 0 || a != 0xffff {
+			t.Errorf("expected a red bar in the middle of the second column, got %v", img.At(1, 20))
+		}
+		cache.Wait()
+	}
+	if reader.calls != 1 || reader.buckets != 200 {
+		t.Errorf("expected one read of 200 buckets, got %d reads of %d", reader.calls, reader.buckets)
+	}
+
+	if response := request("", "audio/flac"); response.StatusCode != fiber.StatusOK || reader.buckets != defaultWaveformWidth {
+		t.Errorf("expected a default width waveform, got %d with %d buckets", response.StatusCode, reader.buckets)
+	}
+	if response := request("", "video/mp4"); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 for a video source, got %d", response.StatusCode)
+	}
+	if response := request("w:5000/", "audio/mpeg"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for a waveform wider than the limit, got %d", response.StatusCode)
+	}
+
+	reader.err = errUnknownDuration
+	if response := request("w:300/", "audio/ogg"); response.StatusCode != fiber.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for audio of unknown duration, got %d", response.StatusCode)
+	}
+}
+
+func TestFFmpegWaveformReader(t *testing.T) {
+	reader, lastArgs := fakeFFmpeg(t, `{"streams":[{"codec_name":"mp3"}],"format":{"duration":"12.0"}}`)
+
+	waveform, err := reader.ReadWaveform("http://origin/audio.mp3", 16, frameExtractionOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(waveform.Peaks) != 16 || waveform.Duration != 12 {
+		t.Errorf("expected 16 peaks of 12s of audio, got %d and %v", len(waveform.Peaks), waveform.Duration)
+	}
+	if args := lastArgs(); !strings.Contains(args, "-map 0:a:0 -ac 1 -ar 8000 -f f32le pipe:1") {
+		t.Errorf("expected raw mono samples at 8kHz, got %q", args)
+	}
+
+	if _, err := reader.ReadWaveform("http://origin/audio.mp3", 16, frameExtractionOptions{MaxDuration: 10}); !errors.Is(err, errVideoTooLong) {
+		t.Errorf("expected errVideoTooLong, got %v", err)
+	}
+
+	unknown, _ := fakeFFmpeg(t, `{"streams":[{"codec_name":"mp3"}],"format":{"duration":"N/A"}}`)
+	if _, err := unknown.ReadWaveform("http://origin/live.m3u8", 16, frameExtractionOptions{}); !errors.Is(err, errUnknownDuration) {
+		t.Errorf("expected errUnknownDuration, got %v", err)
+	}
+
+	silent, _ := fakeFFmpeg(t, `{"streams":[],"format":{"duration":"12.0"}}`)
+	if _, err := silent.ReadWaveform("http://origin/video.mp4", 16, frameExtractionOptions{}); err == nil || !strings.Contains(err.Error(), "no audio stream") {
+		t.Errorf("expected no audio stream to be found, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+
+	"media-proxy/config"
+)
+
+// waveformSampleRate is the rate audio is resampled to before its peaks are taken, plenty for a waveform image and
+// far less to go through than the source rate
+const waveformSampleRate = 8000
+
+// waveformReader decodes the first audio stream of a source down to the peak amplitude of evenly long buckets
+type waveformReader interface {
+	ReadWaveform(urlStr string, buckets int, options frameExtractionOptions) (*audioWaveform, error)
+}
+
+// newWaveformReader returns the backend selected by APP_VIDEO_FRAME_BACKEND, the one the video routes decode with
+func newWaveformReader(config *config.Config) (waveformReader, error) {
+	backend, err := decodeBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	if backend == "libav" {
+		return libavFrameExtractor{}, nil
+	}
+	return ffmpegFrameExtractor{FFmpeg: config.FFmpegPath, FFprobe: config.FFprobePath}, nil
+}
+
+// audioWaveform holds the peak amplitude of every bucket from 0 to 1, and the duration of the audio in seconds
+type audioWaveform struct {
+	Peaks    []float64
+	Duration float64
+}
+
+// headers describes the audio as the X-Audio-Duration response header
+func (w *audioWaveform) headers() map[string]string {
+	return map[string]string{"X-Audio-Duration": strconv.FormatFloat(w.Duration, 'f', 3, 64)}
+}
+
+// peakAccumulator spreads mono samples over the buckets by their index within the expected number of samples, so
+// memory stays the same however long the audio is
+type peakAccumulator struct {
+	peaks []float64
+	total int64
+	seen  int64
+}
+
+// newPeakAccumulator expects about total samples, the count derived from the reported duration
+func newPeakAccumulator(buckets int, total int64) *peakAccumulator {
+	return &peakAccumulator{peaks: make([]float64, buckets), total: max(total, 1)}
+}
+
+// add takes samples as little endian 32 bit floats, a trailing partial sample is left out
+func (p *peakAccumulator) add(samples []byte) {
+	for i := 0; i+4 <= len(samples); i += 4 {
+		sample := math.Abs(float64(math.Float32frombits(binary.LittleEndian.Uint32(samples[i:]))))
+		// The duration is an estimate, samples past it go to the last bucket
+		bucket := min(int(p.seen*int64(len(p.peaks))/p.total), len(p.peaks)-1)
+		p.seen++
+		if math.IsNaN(sample) {
+			continue
+		}
+		p.peaks[bucket] = max(p.peaks[bucket], min(sample, 1))
+	}
+}
+
+// readFrom adds the samples of r until it ends
+func (p *peakAccumulator) readFrom(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := io.ReadFull(r, buf)
+		p.add(buf[:n])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// renderWaveform draws one column per peak on a transparent background, each a bar centered vertically and at
+// least a pixel tall so silence still shows as a line
+func renderWaveform(peaks []float64, height int, fill color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, len(peaks), height))
+	for x, peak := range peaks {
+		bar := max(int(math.Round(peak*float64(height))), 1)
+		top := (height - bar) / 2
+		for y := top; y < top+bar; y++ {
+			img.SetNRGBA(x, y, fill)
+		}
+	}
+	return img
+}
+
+// parseHexColor reads RRGGBB or RRGGBBAA hex digits as validated by the path parser, opaque without alpha digits
+func parseHexColor(value string) color.NRGBA {
+	digits, err := hex.DecodeString(value)
+	if err != nil || (len(digits) != 3 && len(digits) != 4) {
+		return color.NRGBA{A: 0xff}
+	}
+	fill := color.NRGBA{R: digits[0], G: digits[1], B: digits[2], A: 0xff}
+	if len(digits) == 4 {
+		fill.A = digits[3]
+	}
+	return fill
+}
@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ReadWaveform has ffmpeg downmix the audio stream to raw mono floats at the waveform rate, read from the pipe as
+// they are written
+func (e ffmpegFrameExtractor) ReadWaveform(urlStr string, buckets int, options frameExtractionOptions) (*audioWaveform, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	output, err := e.runProbe(urlStr, options.ProbeTimeout, options.Headers, "a:0", "format=duration:stream=codec_name")
+	if err != nil {
+		return nil, err
+	}
+	duration, err := parseAudioProbeOutput(output)
+	if err != nil {
+		return nil, err
+	}
+	if duration <= 0 {
+		return nil, errUnknownDuration
+	}
+	if err := options.checkDuration(duration); err != nil {
+		return nil, err
+	}
+
+	args := []string{"-nostdin", "-v", "error"}
+	if options.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(options.Threads))
+	}
+	if len(options.Headers) > 0 {
+		args = append(args, "-headers", ffmpegHeaders(options.Headers))
+	}
+	args = append(args, "-i", urlStr, "-map", "0:a:0", "-ac", "1", "-ar", strconv.Itoa(waveformSampleRate), "-f", "f32le", "pipe:1")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(e.FFmpeg, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	peaks := newPeakAccumulator(buckets, int64(duration*waveformSampleRate))
+	if err := peaks.readFrom(stdout); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if peaks.seen == 0 {
+		return nil, fmt.Errorf("no audio samples found")
+	}
+	return &audioWaveform{Peaks: peaks.peaks, Duration: duration}, nil
+}
+
+// parseAudioProbeOutput reads the duration from the JSON printed by ffprobe for the first audio stream, 0 when the
+// container doesn't report it
+func parseAudioProbeOutput(output []byte) (float64, error) {
+	var probed struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probed); err != nil {
+		return 0, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	if len(probed.Streams) == 0 {
+		return 0, fmt.Errorf("no audio stream found")
+	}
+
+	duration, _ := strconv.ParseFloat(probed.Format.Duration, 64)
+	return duration, nil
+}
@@ -0,0 +1,117 @@
+//go:build !nolibav
+
+package routes
+
+import (
+	"fmt"
+
+	"github.com/asticode/go-astiav"
+)
+
+// ReadWaveform decodes the audio stream and has swresample downmix every frame to mono floats at the waveform rate
+func (libavFrameExtractor) ReadWaveform(urlStr string, buckets int, options frameExtractionOptions) (*audioWaveform, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	inputFormatContext, closeInput, err := openMediaInput(urlStr, options)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	audioStream := findStream(inputFormatContext, astiav.MediaTypeAudio)
+	if audioStream == nil {
+		return nil, fmt.Errorf("no audio stream found")
+	}
+
+	duration := float64(inputFormatContext.Duration()) / 1000000.0 // Duration is in microseconds
+	if duration <= 0 {
+		return nil, errUnknownDuration
+	}
+	if err := options.checkDuration(duration); err != nil {
+		return nil, err
+	}
+
+	codecContext, err := openDecoder(audioStream, options.Threads)
+	if err != nil {
+		return nil, err
+	}
+	defer codecContext.Free()
+
+	resampler := astiav.AllocSoftwareResampleContext()
+	defer resampler.Free()
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+
+	mono := astiav.AllocFrame()
+	defer mono.Free()
+
+	peaks := newPeakAccumulator(buckets, int64(duration*waveformSampleRate))
+	// receive takes every frame the decoder has ready, an audio packet can hold several
+	receive := func() error {
+		for {
+			if err := codecContext.ReceiveFrame(frame); err != nil {
+				if err == astiav.ErrEagain || err == astiav.ErrEof {
+					return nil
+				}
+				return fmt.Errorf("failed to receive frame: %w", err)
+			}
+
+			// The resampler allocates the samples of mono, its format has to be set again once they are released
+			mono.SetChannelLayout(astiav.ChannelLayoutMono)
+			mono.SetSampleFormat(astiav.SampleFormatFlt)
+			mono.SetSampleRate(waveformSampleRate)
+			err := resampler.ConvertFrame(frame, mono)
+			frame.Unref()
+			if err != nil {
+				return fmt.Errorf("failed to resample frame: %w", err)
+			}
+			samples, err := mono.Data().Bytes(1)
+			mono.Unref()
+			if err != nil {
+				return fmt.Errorf("failed to read samples: %w", err)
+			}
+			peaks.add(samples)
+		}
+	}
+
+	for {
+		if err := inputFormatContext.ReadFrame(packet); err != nil {
+			if err == astiav.ErrEof {
+				break
+			}
+			return nil, fmt.Errorf("failed to read frame: %w", err)
+		}
+
+		if packet.StreamIndex() != audioStream.Index() {
+			packet.Unref()
+			continue
+		}
+
+		err := codecContext.SendPacket(packet)
+		packet.Unref()
+		if err != nil {
+			return nil, fmt.Errorf("failed to send packet: %w", err)
+		}
+		if err := receive(); err != nil {
+			return nil, err
+		}
+	}
+
+	// A nil packet flushes the frames the decoder still holds
+	if err := codecContext.SendPacket(nil); err != nil {
+		return nil, fmt.Errorf("failed to flush decoder: %w", err)
+	}
+	if err := receive(); err != nil {
+		return nil, err
+	}
+
+	if peaks.seen == 0 {
+		return nil, fmt.Errorf("no audio samples found")
+	}
+	return &audioWaveform{Peaks: peaks.peaks, Duration: duration}, nil
+}
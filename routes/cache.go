@@ -5,12 +5,17 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"io"
+	"media-proxy/config"
 	"media-proxy/validation"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
@@ -18,9 +23,120 @@ import (
 type CacheValue struct {
 	Body        []byte
 	ContentType string
+	// FrameClamped marks video previews whose requested frame position was clamped to the video duration
+	FrameClamped bool
+	// Headers are extra response headers sent along with the body, e.g. the X-Video-* details of a preview
+	Headers map[string]string
+
+	// ETag is the contentETag of the body, clients holding it get 304 Not Modified. Empty leaves it to the etag middleware
+	ETag string
+	// OriginETag and OriginLastModified are the validators the origin sent with the source, used to revalidate the entry
+	// once it expires; Last-Modified is forwarded to clients as well
+	OriginETag         string
+	OriginLastModified string
+	// Expires is when an entry with validators has to be revalidated, it is kept in memory past that for the conditional GET
+	Expires time.Time
+	// Stored is when an image was processed or last revalidated, entries older than APP_CACHE_SOFT_TTL_SECONDS are
+	// refreshed in the background
+	Stored time.Time
+}
+
+// setCachedHeaders sends the extra response headers kept with a cached value
+func setCachedHeaders(c *fiber.Ctx, value CacheValue) {
+	for key, headerValue := range value.Headers {
+		c.Set(key, headerValue)
+	}
+}
+
+// stale reports whether the entry expired and has to be revalidated with the origin before it is served again
+func (v CacheValue) stale() bool {
+	return !v.Expires.IsZero() && time.Now().After(v.Expires)
+}
+
+// CacheBackend persists processed results beyond the in-memory cache, implemented by S3Cache and FileCache.
+// Get returns nil without an error for a missing entry
+type CacheBackend interface {
+	Get(ctx context.Context, cacheKey string) (*CacheValue, error)
+	GetAtLocation(ctx context.Context, location string) (*CacheValue, error)
+	Put(ctx context.Context, cacheKey string, body []byte, contentType string) error
+	PutValue(ctx context.Context, cacheKey string, value CacheValue) error
+	PutAtLocation(ctx context.Context, location string, body []byte, contentType string) error
+	PutAtLocationExpiring(ctx context.Context, location string, body []byte, contentType string, expire time.Time) error
+}
+
+var (
+	_ CacheBackend = (*S3Cache)(nil)
+	_ CacheBackend = (*FileCache)(nil)
+)
+
+// frameClampedMetadata is the S3 user metadata key that persists CacheValue.FrameClamped
+const frameClampedMetadata = "Frame-Position-Clamped"
+
+// cacheTTL is how long processed results stay in the memory cache
+func cacheTTL(config *config.Config) time.Duration {
+	return time.Duration(flooredTTL(config, config.CacheTTL)) * time.Second
+}
+
+// cacheControl is the Cache-Control header sent with processed results. A maxage: of the request replaces
+// APP_HTTP_CACHE_TTL_SECONDS, up to APP_HTTP_CACHE_MAX_TTL_SECONDS when that is set
+func cacheControl(config *config.Config, params *validation.ImageContext) string {
+	if params.MaxAgeSet {
+		maxAge := params.MaxAge
+		if config.HTTPCacheMaxTTL > 0 {
+			maxAge = min(maxAge, config.HTTPCacheMaxTTL)
+		}
+		return fmt.Sprintf("public, max-age=%d", maxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", flooredTTL(config, int64(config.HTTPCacheTTL)))
+}
+
+// NoStoreErrors marks error responses with Cache-Control: no-store, so CDNs and browsers don't keep a failure around
+// after the cause is gone
+func NoStoreErrors() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		err := c.Next()
+		// A returned error is turned into the response by the error handler after this, with the headers set here
+		if err != nil || c.Response().StatusCode() >= fiber.StatusBadRequest {
+			c.Set(fiber.HeaderCacheControl, "no-store")
+		}
+		return err
+	}
+}
+
+// flooredTTL raises a TTL in seconds to APP_MIN_CACHE_TTL_SECONDS, so a short TTL doesn't make hot results churn.
+// Zero and below are kept, they mean no expiry where they are used
+func flooredTTL(config *config.Config, seconds int64) int64 {
+	if seconds <= 0 {
+		return seconds
+	}
+	return max(seconds, config.MinCacheTTL)
+}
+
+// normalizedKeyParams writes the parameters of a request that can't change its result the way the default request
+// does, so equivalent requests share cached results under APP_NORMALIZE_CACHE_KEYS. Requests already written that way
+// keep their key
+func normalizedKeyParams(config *config.Config, params *validation.ImageContext) *validation.ImageContext {
+	if config.NormalizeCacheKeys == nil || !*config.NormalizeCacheKeys {
+		return params
+	}
+
+	normalized := *params
+	// Only a positive scale rescales
+	normalized.Scale = max(normalized.Scale, 0)
+	// m: of the configured effort encodes just like no m:
+	if normalized.WebpMethodSet && normalized.WebpMethod == configuredWebpMethod(config) {
+		normalized.WebpMethodSet = false
+	}
+	// Times in seconds seek to the same frame however they are written, 30.0 is 30
+	if seconds, err := strconv.ParseFloat(strings.TrimSpace(normalized.FramePosition), 64); err == nil && seconds >= 0 {
+		normalized.FramePosition = strconv.FormatFloat(seconds, 'f', -1, 64)
+	}
+	return &normalized
 }
 
-func cacheKey(params *validation.ImageContext) string {
+func cacheKey(config *config.Config, params *validation.ImageContext) string {
+	params = normalizedKeyParams(config, params)
+
 	// Use string builder for more efficient cache key generation
 	var builder strings.Builder
 
@@ -29,7 +145,7 @@ func cacheKey(params *validation.ImageContext) string {
 		builder.WriteString(params.CustomObjectKey)
 	} else {
 		builder.WriteString("url=")
-		builder.WriteString(params.Url)
+		builder.WriteString(cacheSourceURL(config, params.Url))
 	}
 
 	builder.WriteString(";quality=")
@@ -41,22 +157,93 @@ func cacheKey(params *validation.ImageContext) string {
 	builder.WriteString(";scale=")
 	builder.WriteString(strconv.FormatFloat(params.Scale, 'f', -1, 64))
 	builder.WriteString(";interpolation=")
-	builder.WriteString(strconv.Itoa(int(params.Interpolation)))
-	builder.WriteString(";webp=")
-	builder.WriteString(strconv.FormatBool(params.Webp))
+	if params.InterpolationByFormat {
+		builder.WriteString("format")
+	} else {
+		builder.WriteString(strconv.Itoa(int(params.Interpolation)))
+	}
+	builder.WriteString(";format=")
+	builder.WriteString(params.OutputFormat())
+	// Only m: splits the key, results encoded with APP_WEBP_METHOD keep the existing one
+	if params.WebpMethodSet {
+		builder.WriteString(";method=")
+		builder.WriteString(strconv.Itoa(params.WebpMethod))
+	}
+	// The default first frame keeps the original key so existing entries stay valid
+	if params.FramePosition != "" && params.FramePosition != "first" {
+		builder.WriteString(";fp=")
+		builder.WriteString(params.FramePosition)
+	}
+	if params.Tiled {
+		builder.WriteString(";tile=")
+		builder.WriteString(strconv.Itoa(params.TileZ))
+		builder.WriteString("/")
+		builder.WriteString(strconv.Itoa(params.TileX))
+		builder.WriteString("/")
+		builder.WriteString(strconv.Itoa(params.TileY))
+	}
+	if params.SourceETag != "" {
+		builder.WriteString(";etag=")
+		builder.WriteString(params.SourceETag)
+	}
 	return builder.String()
 }
 
+// cacheSourceURL leaves the APP_CACHE_IGNORED_QUERY_PARAMS out of a source URL, so URLs that only differ in them
+// share cached results. URLs without any of them are returned unchanged, keeping their existing keys
+func cacheSourceURL(config *config.Config, rawURL string) string {
+	if len(config.CacheIgnoredQueryParams) == 0 {
+		return rawURL
+	}
+
+	base, query, found := strings.Cut(rawURL, "?")
+	if !found {
+		return rawURL
+	}
+	query, fragment, hasFragment := strings.Cut(query, "#")
+
+	pairs := strings.Split(query, "&")
+	kept := pairs[:0:0]
+	for _, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !slices.ContainsFunc(config.CacheIgnoredQueryParams, func(ignored string) bool { return strings.EqualFold(ignored, name) }) {
+			kept = append(kept, pair)
+		}
+	}
+	if len(kept) == len(pairs) {
+		return rawURL
+	}
+
+	stripped := base
+	if len(kept) > 0 {
+		stripped += "?" + strings.Join(kept, "&")
+	}
+	if hasFragment {
+		stripped += "#" + fragment
+	}
+	return stripped
+}
+
 // S3Cache holds a MinIO client and configuration for persistent caching
 type S3Cache struct {
 	Enabled bool
 	Client  *minio.Client
 	Bucket  string
 	Prefix  string
+	TTL     time.Duration // Expiry of stored objects, 0 stores them without one
+	// UploadRetention is how long uploaded videos are kept, 0 keeps them forever. Uploads don't use TTL, they
+	// aren't cache artifacts
+	UploadRetention time.Duration
+	// Files stores results in a local directory instead when there is no client, S3 source locations and uploads
+	// stay unavailable
+	Files *FileCache
 }
 
 // NewS3Cache creates a new S3Cache from configuration values. If not enabled or misconfigured, returns a disabled cache.
-func NewS3Cache(enabled bool, endpoint, accessKeyID, secretAccessKey, bucket string, useSSL bool, prefix string) (*S3Cache, error) {
+func NewS3Cache(enabled bool, endpoint, accessKeyID, secretAccessKey, bucket string, useSSL bool, prefix string, ttl time.Duration) (*S3Cache, error) {
 	if !enabled {
 		return &S3Cache{Enabled: false}, nil
 	} else if endpoint == "" || accessKeyID == "" || secretAccessKey == "" || bucket == "" {
@@ -71,7 +258,61 @@ func NewS3Cache(enabled bool, endpoint, accessKeyID, secretAccessKey, bucket str
 		return nil, err
 	}
 
-	return &S3Cache{Enabled: true, Client: client, Bucket: bucket, Prefix: prefix}, nil
+	return &S3Cache{Enabled: true, Client: client, Bucket: bucket, Prefix: prefix, TTL: ttl}, nil
+}
+
+// usable reports whether results can be read and stored, in S3 or in the file cache
+func (s *S3Cache) usable() bool {
+	return s != nil && s.Enabled && (s.Client != nil || s.Files != nil)
+}
+
+// backend returns the cache as a CacheBackend, nil when results can't be stored so callers skip it entirely
+func (s *S3Cache) backend() CacheBackend {
+	if !s.usable() {
+		return nil
+	}
+	return s
+}
+
+// expiry is the Expires time of an object stored now, zero when objects don't expire
+func (s *S3Cache) expiry() time.Time {
+	if s == nil || s.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.TTL)
+}
+
+// EnsureBucket checks at startup that the bucket exists, creating it when create is set
+func (s *S3Cache) EnsureBucket(ctx context.Context, create bool) error {
+	exists, err := s.Client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if !create {
+		return fmt.Errorf("bucket %q does not exist", s.Bucket)
+	}
+
+	return s.Client.MakeBucket(ctx, s.Bucket, minio.MakeBucketOptions{})
+}
+
+// Ping checks that the configured bucket is reachable and exists
+func (s *S3Cache) Ping(ctx context.Context) error {
+	if s == nil || !s.Enabled || s.Client == nil {
+		return fmt.Errorf("s3 not configured")
+	}
+
+	exists, err := s.Client.BucketExists(ctx, s.Bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s.Bucket)
+	}
+
+	return nil
 }
 
 // objectKeyFromCacheKey produces a deterministic S3 object key for a given cache key
@@ -107,138 +348,407 @@ func objectKeyFromExplicitLocation(prefix, location string) string {
 	return prefix + "/" + location
 }
 
+// previewObjectKey derives the object key of a video preview from its source location, so previews sit next to the
+// source as <location>.preview.<params>.<ext>. Returns "" for URL sources or when the option is off, those keep hashed keys
+func previewObjectKey(config *config.Config, params *validation.ImageContext) string {
+	if !config.PreviewKeysFromLocation || params.CustomObjectKey == "" {
+		return ""
+	}
+	params = normalizedKeyParams(config, params)
+
+	framePosition := params.FramePosition
+	if framePosition == "" {
+		framePosition = "first"
+	}
+	extension := "jpg"
+	if params.Webp {
+		extension = "webp"
+	}
+
+	var builder strings.Builder
+	builder.WriteString(params.CustomObjectKey)
+	builder.WriteString(".preview.q")
+	builder.WriteString(strconv.Itoa(params.Quality))
+	builder.WriteString("_w")
+	builder.WriteString(strconv.Itoa(params.Width))
+	builder.WriteString("_h")
+	builder.WriteString(strconv.Itoa(params.Height))
+	builder.WriteString("_s")
+	builder.WriteString(strconv.FormatFloat(params.Scale, 'f', -1, 64))
+	builder.WriteString("_i")
+	if params.InterpolationByFormat {
+		builder.WriteString("format")
+	} else {
+		builder.WriteString(strconv.Itoa(int(params.Interpolation)))
+	}
+	builder.WriteString("_fp")
+	builder.WriteString(framePosition)
+	builder.WriteString(".")
+	builder.WriteString(extension)
+	return builder.String()
+}
+
 // Get tries to fetch an object from S3 by cache key. Returns nil if missing or disabled.
 func (s *S3Cache) Get(ctx context.Context, cacheKey string) (*CacheValue, error) {
-	if s == nil || !s.Enabled || s.Client == nil {
+	if !s.usable() {
 		return nil, nil
 	}
 
-	objKey := objectKeyFromCacheKey(s.Prefix, cacheKey)
-	obj, err := s.Client.GetObject(ctx, s.Bucket, objKey, minio.GetObjectOptions{})
-	if err != nil {
+	return s.getValue(ctx, objectKeyFromCacheKey(s.Prefix, cacheKey))
+}
+
+// GetValueDirect is Get for an object key from the bucket root (no prefix added), as stored by PutValueDirect
+func (s *S3Cache) GetValueDirect(ctx context.Context, objectKey string) (*CacheValue, error) {
+	if !s.usable() {
 		return nil, nil
 	}
 
-	// Read all content
-	data, rerr := io.ReadAll(obj)
-	if rerr != nil {
-		return nil, nil
+	return s.getValue(ctx, objectKey)
+}
+
+// Delete removes the object stored for a cache key and reports whether there was one. Disabled caches have nothing to delete
+func (s *S3Cache) Delete(ctx context.Context, cacheKey string) (bool, error) {
+	if !s.usable() {
+		return false, nil
 	}
 
-	// Try to get content-type from object info
-	info, herr := obj.Stat()
-	contentType := "application/octet-stream"
-	if herr == nil {
-		if ct, ok := info.Metadata["Content-Type"]; ok && len(ct) > 0 {
-			contentType = ct[0]
-		} else if info.ContentType != "" {
-			contentType = info.ContentType
+	return s.deleteObject(ctx, objectKeyFromCacheKey(s.Prefix, cacheKey))
+}
+
+// DeleteDirect is Delete for an object key from the bucket root (no prefix added)
+func (s *S3Cache) DeleteDirect(ctx context.Context, objectKey string) (bool, error) {
+	if !s.usable() {
+		return false, nil
+	}
+
+	return s.deleteObject(ctx, objectKey)
+}
+
+// deleteObject removes an object, a missing one is not an error
+func (s *S3Cache) deleteObject(ctx context.Context, objKey string) (bool, error) {
+	if s.Files != nil {
+		return s.Files.deleteObject(objKey)
+	}
+
+	if _, err := s.Client.StatObject(ctx, s.Bucket, objKey, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
 		}
+		return false, err
 	}
 
-	return &CacheValue{Body: data, ContentType: contentType}, nil
+	if err := s.Client.RemoveObject(ctx, s.Bucket, objKey, minio.RemoveObjectOptions{}); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// GetAtLocation fetches an object from S3 by explicit object key (location)
-func (s *S3Cache) GetAtLocation(ctx context.Context, location string) (*CacheValue, error) {
-	if s == nil || !s.Enabled || s.Client == nil {
-		return nil, nil
+// getValue reads an object along with the flags and headers kept in its metadata, nil if missing
+func (s *S3Cache) getValue(ctx context.Context, objKey string) (*CacheValue, error) {
+	if s.Files != nil {
+		return s.Files.getValue(objKey)
 	}
-	objKey := objectKeyFromExplicitLocation(s.Prefix, location)
-	obj, err := s.Client.GetObject(ctx, s.Bucket, objKey, minio.GetObjectOptions{})
-	if err != nil {
-		return nil, nil
+
+	value, info, err := s.readObject(ctx, objKey)
+	if value == nil {
+		return nil, err
 	}
-	data, rerr := io.ReadAll(obj)
-	if rerr != nil {
-		return nil, nil
+
+	value.FrameClamped = info.UserMetadata[frameClampedMetadata] == "true"
+	for key, headerValue := range info.UserMetadata {
+		if strings.HasPrefix(key, "X-") {
+			if value.Headers == nil {
+				value.Headers = map[string]string{}
+			}
+			value.Headers[key] = headerValue
+		}
+	}
+	return value, nil
+}
+
+// getObject reads an object with its content type only, nil if missing
+func (s *S3Cache) getObject(ctx context.Context, objKey string) (*CacheValue, error) {
+	if s.Files != nil {
+		return s.Files.getValue(objKey)
 	}
-	info, herr := obj.Stat()
-	contentType := "application/octet-stream"
-	if herr == nil {
-		if ct, ok := info.Metadata["Content-Type"]; ok && len(ct) > 0 {
-			contentType = ct[0]
-		} else if info.ContentType != "" {
-			contentType = info.ContentType
+
+	value, _, err := s.readObject(ctx, objKey)
+	return value, err
+}
+
+// readObject stats an object before streaming it, so a missing object is told apart from a failed read
+// and the content type is known up front. Returns nil without an error when the object doesn't exist
+func (s *S3Cache) readObject(ctx context.Context, objKey string) (*CacheValue, *minio.ObjectInfo, error) {
+	info, err := s.Client.StatObject(ctx, s.Bucket, objKey, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, nil, nil
 		}
+		return nil, nil, err
+	}
+
+	// Read the version that was stat'ed, an object replaced in between fails instead of mixing the two
+	opts := minio.GetObjectOptions{}
+	if info.ETag != "" {
+		_ = opts.SetMatchETag(info.ETag)
+	}
+	obj, err := s.Client.GetObject(ctx, s.Bucket, objKey, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		return nil, nil, err
 	}
-	return &CacheValue{Body: data, ContentType: contentType}, nil
+
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &CacheValue{Body: data, ContentType: contentType}, &info, nil
+}
+
+// GetAtLocation fetches an object from S3 by explicit object key (location)
+func (s *S3Cache) GetAtLocation(ctx context.Context, location string) (*CacheValue, error) {
+	if !s.usable() {
+		return nil, nil
+	}
+
+	return s.getObject(ctx, objectKeyFromExplicitLocation(s.Prefix, location))
 }
 
 // Put uploads object to S3 by cache key with content type. Best-effort, errors are returned but non-fatal to caller.
 func (s *S3Cache) Put(ctx context.Context, cacheKey string, body []byte, contentType string) error {
-	if s == nil || !s.Enabled || s.Client == nil {
+	if !s.usable() {
 		return nil
 	}
 
-	objKey := objectKeyFromCacheKey(s.Prefix, cacheKey)
-	reader := bytes.NewReader(body)
-	_, err := s.Client.PutObject(ctx, s.Bucket, objKey, reader, int64(len(body)), minio.PutObjectOptions{
-		ContentType: contentType,
-		Expires:     time.Now().Add(time.Hour * 24),
-	})
+	return s.putObject(ctx, objectKeyFromCacheKey(s.Prefix, cacheKey), body, contentType, s.expiry())
+}
+
+// PutValue uploads a cache value by cache key, keeping its flags and headers as object metadata so Get can restore them
+func (s *S3Cache) PutValue(ctx context.Context, cacheKey string, value CacheValue) error {
+	if !s.usable() {
+		return nil
+	}
+
+	return s.putValue(ctx, objectKeyFromCacheKey(s.Prefix, cacheKey), value)
+}
+
+// PutValueDirect is PutValue for an object key from the bucket root (no prefix added)
+func (s *S3Cache) PutValueDirect(ctx context.Context, objectKey string, value CacheValue) error {
+	if !s.usable() {
+		return nil
+	}
+
+	return s.putValue(ctx, objectKey, value)
+}
+
+// putValue uploads a cache value with its flags and headers as object metadata
+func (s *S3Cache) putValue(ctx context.Context, objKey string, value CacheValue) error {
+	if s.Files != nil {
+		return s.Files.putValue(objKey, value, s.expiry())
+	}
+
+	options := minio.PutObjectOptions{
+		ContentType: value.ContentType,
+		Expires:     s.expiry(),
+	}
+	// Header names are kept as metadata keys, Get restores every X- prefixed key as a header
+	options.UserMetadata = map[string]string{}
+	for key, headerValue := range value.Headers {
+		options.UserMetadata[key] = headerValue
+	}
+	if value.FrameClamped {
+		options.UserMetadata[frameClampedMetadata] = "true"
+	}
+
+	_, err := s.Client.PutObject(ctx, s.Bucket, objKey, bytes.NewReader(value.Body), int64(len(value.Body)), options)
 	return err
 }
 
+// uploadRetentionTag is the object tag holding the retention of an uploaded video, bucket lifecycle rules can filter
+// on it since many stores ignore Expires
+const uploadRetentionTag = "retention"
+
+// uploadOptions are the options of an uploaded video: Expires and the retention tag follow UploadRetention
+func (s *S3Cache) uploadOptions(contentType string) minio.PutObjectOptions {
+	options := minio.PutObjectOptions{
+		ContentType: contentType,
+		UserTags:    map[string]string{uploadRetentionTag: "forever"},
+	}
+	if s.UploadRetention > 0 {
+		options.Expires = time.Now().Add(s.UploadRetention)
+		options.UserTags[uploadRetentionTag] = fmt.Sprintf("%dd", int64(s.UploadRetention/(24*time.Hour)))
+	}
+	return options
+}
+
 // PutAtLocation uploads object to S3 by explicit location key
 func (s *S3Cache) PutAtLocation(ctx context.Context, location string, body []byte, contentType string) error {
-	return s.PutAtLocationExpiring(ctx, location, body, contentType, time.Now().Add(time.Hour*24))
+	return s.PutAtLocationExpiring(ctx, location, body, contentType, s.expiry())
 }
 
 // PutAtLocationExpiring uploads object to S3 by explicit location key with a specified TTL
 func (s *S3Cache) PutAtLocationExpiring(ctx context.Context, location string, body []byte, contentType string, expire time.Time) error {
-	if s == nil || !s.Enabled || s.Client == nil {
+	if !s.usable() {
 		return nil
 	}
-	objKey := objectKeyFromExplicitLocation(s.Prefix, location)
-	reader := bytes.NewReader(body)
-	_, err := s.Client.PutObject(ctx, s.Bucket, objKey, reader, int64(len(body)), minio.PutObjectOptions{
-		ContentType: contentType,
-		Expires:     expire,
-	})
+	return s.putObject(ctx, objectKeyFromExplicitLocation(s.Prefix, location), body, contentType, expire)
+}
+
+// PutAtLocationStream uploads a video of size bytes read from body to S3 by explicit location key, kept for
+// UploadRetention. The body is streamed, large objects go up as a multipart upload holding at most one part in memory
+func (s *S3Cache) PutAtLocationStream(ctx context.Context, location string, body io.Reader, size int64, contentType string) error {
+	if !s.usable() || s.Client == nil {
+		return fmt.Errorf("s3 not configured")
+	}
+
+	_, err := s.Client.PutObject(ctx, s.Bucket, objectKeyFromExplicitLocation(s.Prefix, location), body, size, s.uploadOptions(contentType))
 	return err
 }
 
-// GetDirect fetches an object directly from S3 by key (from bucket root, no prefix added)
-// Used for user-provided S3 locations
-func (s *S3Cache) GetDirect(ctx context.Context, objectKey string) (*CacheValue, error) {
-	if s == nil || !s.Enabled || s.Client == nil {
-		return nil, nil
+// NewMultipartUpload starts an S3 multipart upload of the video at an explicit location and returns its upload ID.
+// The assembled video is kept for UploadRetention
+func (s *S3Cache) NewMultipartUpload(ctx context.Context, location string, contentType string) (string, error) {
+	if !s.usable() || s.Client == nil {
+		return "", fmt.Errorf("s3 not configured")
 	}
-	obj, err := s.Client.GetObject(ctx, s.Bucket, objectKey, minio.GetObjectOptions{})
+
+	core := minio.Core{Client: s.Client}
+	return core.NewMultipartUpload(ctx, s.Bucket, objectKeyFromExplicitLocation(s.Prefix, location), s.uploadOptions(contentType))
+}
+
+// PutObjectPart uploads one part of a multipart upload and returns its ETag. Part numbers start at 1
+func (s *S3Cache) PutObjectPart(ctx context.Context, location, uploadID string, partNumber int, body []byte) (string, error) {
+	if !s.usable() || s.Client == nil {
+		return "", fmt.Errorf("s3 not configured")
+	}
+
+	core := minio.Core{Client: s.Client}
+	part, err := core.PutObjectPart(ctx, s.Bucket, objectKeyFromExplicitLocation(s.Prefix, location), uploadID, partNumber, bytes.NewReader(body), int64(len(body)), minio.PutObjectPartOptions{})
 	if err != nil {
-		return nil, nil
+		return "", err
 	}
-	data, rerr := io.ReadAll(obj)
-	if rerr != nil {
-		return nil, nil
+	return part.ETag, nil
+}
+
+// CompleteMultipartUpload assembles the uploaded parts into the object at location, it only shows up once complete
+func (s *S3Cache) CompleteMultipartUpload(ctx context.Context, location, uploadID string, parts []minio.CompletePart) error {
+	if !s.usable() || s.Client == nil {
+		return fmt.Errorf("s3 not configured")
+	}
+
+	core := minio.Core{Client: s.Client}
+	_, err := core.CompleteMultipartUpload(ctx, s.Bucket, objectKeyFromExplicitLocation(s.Prefix, location), uploadID, parts, minio.PutObjectOptions{})
+	return err
+}
+
+// ListPartETags returns the ETags of the parts S3 holds for a multipart upload, keyed by part number
+func (s *S3Cache) ListPartETags(ctx context.Context, location, uploadID string) (map[int]string, error) {
+	if !s.usable() || s.Client == nil {
+		return nil, fmt.Errorf("s3 not configured")
+	}
+
+	core := minio.Core{Client: s.Client}
+	objKey := objectKeyFromExplicitLocation(s.Prefix, location)
+	etags := map[int]string{}
+	marker := 0
+	for {
+		result, err := core.ListObjectParts(ctx, s.Bucket, objKey, uploadID, marker, 0)
+		if err != nil {
+			return nil, err
+		}
+		// Listed ETags keep their quotes, uploaded ones come without
+		for _, part := range result.ObjectParts {
+			etags[part.PartNumber] = strings.Trim(part.ETag, `"`)
+		}
+		if !result.IsTruncated {
+			return etags, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// AbortMultipartUpload discards a multipart upload along with its uploaded parts, one already gone is not an error
+func (s *S3Cache) AbortMultipartUpload(ctx context.Context, location, uploadID string) error {
+	if !s.usable() || s.Client == nil {
+		return fmt.Errorf("s3 not configured")
 	}
-	info, herr := obj.Stat()
-	contentType := "application/octet-stream"
-	if herr == nil {
-		if ct, ok := info.Metadata["Content-Type"]; ok && len(ct) > 0 {
-			contentType = ct[0]
-		} else if info.ContentType != "" {
-			contentType = info.ContentType
+
+	core := minio.Core{Client: s.Client}
+	err := core.AbortMultipartUpload(ctx, s.Bucket, objectKeyFromExplicitLocation(s.Prefix, location), uploadID)
+	if err != nil && minio.ToErrorResponse(err).Code == "NoSuchUpload" {
+		return nil
+	}
+	return err
+}
+
+// WaitVisibleAtLocation waits for an object written with PutAtLocation to become readable on eventually consistent
+// stores. It stats the object up to retries+1 times, doubling backoff in between, and returns the last error if it stays missing
+func (s *S3Cache) WaitVisibleAtLocation(ctx context.Context, location string, retries int, backoff time.Duration) error {
+	if !s.usable() {
+		return nil
+	}
+
+	return s.waitVisible(ctx, objectKeyFromExplicitLocation(s.Prefix, location), retries, backoff)
+}
+
+// waitVisible stats an object until it exists, errors other than a missing object are returned right away
+func (s *S3Cache) waitVisible(ctx context.Context, objKey string, retries int, backoff time.Duration) error {
+	// Files are readable as soon as they are renamed into place
+	if s.Files != nil {
+		return nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		_, err := s.Client.StatObject(ctx, s.Bucket, objKey, minio.StatObjectOptions{})
+		if err == nil || minio.ToErrorResponse(err).Code != "NoSuchKey" || attempt >= retries {
+			return err
 		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff << attempt):
+		}
+	}
+}
+
+// GetDirect fetches an object directly from S3 by key (from bucket root, no prefix added)
+// Used for user-provided S3 locations
+func (s *S3Cache) GetDirect(ctx context.Context, objectKey string) (*CacheValue, error) {
+	if !s.usable() {
+		return nil, nil
 	}
-	return &CacheValue{Body: data, ContentType: contentType}, nil
+
+	return s.getObject(ctx, objectKey)
 }
 
 // PutDirect uploads object directly to S3 by key (to bucket root, no prefix added)
 // Used for user-provided S3 locations
 func (s *S3Cache) PutDirect(ctx context.Context, objectKey string, body []byte, contentType string) error {
-	return s.PutDirectExpiring(ctx, objectKey, body, contentType, time.Now().Add(time.Hour*24))
+	return s.PutDirectExpiring(ctx, objectKey, body, contentType, s.expiry())
 }
 
 // PutDirectExpiring uploads object directly to S3 by key with a specified TTL (no prefix added)
 // Used for user-provided S3 locations
 func (s *S3Cache) PutDirectExpiring(ctx context.Context, objectKey string, body []byte, contentType string, expire time.Time) error {
-	if s == nil || !s.Enabled || s.Client == nil {
+	if !s.usable() {
 		return nil
 	}
-	reader := bytes.NewReader(body)
-	_, err := s.Client.PutObject(ctx, s.Bucket, objectKey, reader, int64(len(body)), minio.PutObjectOptions{
+	return s.putObject(ctx, objectKey, body, contentType, expire)
+}
+
+// putObject uploads a body with its content type
+func (s *S3Cache) putObject(ctx context.Context, objKey string, body []byte, contentType string, expire time.Time) error {
+	if s.Files != nil {
+		return s.Files.putValue(objKey, CacheValue{Body: body, ContentType: contentType}, expire)
+	}
+
+	_, err := s.Client.PutObject(ctx, s.Bucket, objKey, bytes.NewReader(body), int64(len(body)), minio.PutObjectOptions{
 		ContentType: contentType,
 		Expires:     expire,
 	})
@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"sync"
+	"time"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+// cacheRefreshLocal marks a request run by the cacheRefresher, it skips the memory cache hit and fetches the source
+// again, conditionally when the entry has origin validators
+const cacheRefreshLocal = "cache-refresh"
+
+// refreshQueueSize is how many refreshes may wait for a worker, further ones are dropped and retried by a later hit
+const refreshQueueSize = 256
+
+// cacheRefresher re-processes images whose memory cache entry is older than APP_CACHE_SOFT_TTL_SECONDS in the
+// background, the older entry keeps being served meanwhile. An entry is only refreshed once at a time
+type cacheRefresher struct {
+	softTTL time.Duration
+	workers *cacheWarmer
+	// refreshing holds the cache keys with a refresh queued or running
+	refreshing sync.Map
+}
+
+// newCacheRefresher runs refreshes with APP_CACHE_REFRESH_CONCURRENCY workers. Returns nil when no soft TTL is configured
+func newCacheRefresher(config *config.Config, refresh func(params *validation.ImageContext)) *cacheRefresher {
+	if config.CacheSoftTTL <= 0 {
+		return nil
+	}
+
+	refresher := &cacheRefresher{softTTL: time.Duration(config.CacheSoftTTL) * time.Second}
+	refresher.workers = newCacheWarmer(config.CacheRefreshConcurrency, refreshQueueSize, func(params *validation.ImageContext) {
+		// The key is taken before the refresh, which may key its result by a new source ETag
+		defer refresher.refreshing.Delete(cacheKey(config, params))
+		refresh(params)
+	})
+	return refresher
+}
+
+// due reports whether a cached value is old enough to be refreshed. A nil refresher never refreshes
+func (r *cacheRefresher) due(value CacheValue) bool {
+	return r != nil && !value.Stored.IsZero() && time.Since(value.Stored) > r.softTTL
+}
+
+// refresh queues a refresh of the entry under cacheKey unless one is already queued or the queue is full
+func (r *cacheRefresher) refresh(cacheKey string, params *validation.ImageContext) {
+	if _, queued := r.refreshing.LoadOrStore(cacheKey, struct{}{}); queued {
+		return
+	}
+
+	// The request's params aren't used past its response, the refresh gets its own copy
+	refreshParams := *params
+	if !r.workers.enqueue(&refreshParams) {
+		r.refreshing.Delete(cacheKey)
+	}
+}
@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+func TestImageRequest_RefreshesPastSoftTTL(t *testing.T) {
+	cfg := &config.Config{CacheTTL: 3600, CacheSoftTTL: 60, CacheRefreshConcurrency: 1}
+	app, cache, _ := newImageTestAppWithState(t, cfg)
+
+	// The origin grows the image with every fetch, so the refreshed entry can be told apart
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size := 8 * int(hits.Add(1))
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(encodePNG(t, size, size))
+	}))
+	t.Cleanup(server.Close)
+	originURL := server.URL + "/source"
+
+	requestImage(t, app, "png/", originURL)
+	cache.Wait()
+
+	// Age the entry past the soft TTL
+	ok, _, params, err := validation.ProcessImageContextFromPath(zap.NewNop(), "png/"+base64.URLEncoding.EncodeToString([]byte(originURL)), cfg)
+	if !ok {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	key := cacheKey(cfg, params)
+	value, found := cache.Get(key)
+	if !found || value.Stored.IsZero() {
+		t.Fatalf("expected the entry to be cached with its store time, got %+v", value)
+	}
+	value.Stored = time.Now().Add(-2 * time.Minute)
+	cache.Set(key, value, 1)
+	cache.Wait()
+
+	// The aged entry is served right away, the refresh runs behind it
+	response := requestImage(t, app, "png/", originURL)
+	if response.StatusCode != fiber.StatusOK || response.Header.Get("X-Cache-Place") != cachePlaceResponseHandler {
+		t.Fatalf("expected the cached entry to be served, got %d from %q", response.StatusCode, response.Header.Get("X-Cache-Place"))
+	}
+	if img, _ := decodeResponseImage(t, response); img.Bounds().Dx() != 8 {
+		t.Errorf("expected the aged image, got width %d", img.Bounds().Dx())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cache.Wait()
+		if refreshed, ok := cache.Get(key); ok && time.Since(refreshed.Stored) < time.Minute {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to be refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected one background fetch, got %d origin hits", hits.Load())
+	}
+
+	// The refreshed entry is served from memory without another fetch
+	response = requestImage(t, app, "png/", originURL)
+	if img, _ := decodeResponseImage(t, response); img.Bounds().Dx() != 16 {
+		t.Errorf("expected the refreshed image, got width %d", img.Bounds().Dx())
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected the fresh entry not to be refreshed again, got %d origin hits", hits.Load())
+	}
+}
+
+func TestCacheRefresher_OneRefreshPerEntry(t *testing.T) {
+	cfg := &config.Config{CacheSoftTTL: 60, CacheRefreshConcurrency: 1}
+	unblock := make(chan struct{})
+	var runs atomic.Int32
+	refresher := newCacheRefresher(cfg, func(params *validation.ImageContext) {
+		runs.Add(1)
+		<-unblock
+	})
+
+	params := &validation.ImageContext{Url: "http://origin.test/source"}
+	for range 3 {
+		refresher.refresh(cacheKey(cfg, params), params)
+	}
+	close(unblock)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, queued := refresher.refreshing.Load(cacheKey(cfg, params)); !queued {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the refresh to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if runs.Load() != 1 {
+		t.Errorf("expected one refresh for repeated hits, got %d", runs.Load())
+	}
+
+	// Without a soft TTL nothing is refreshed
+	if disabled := newCacheRefresher(&config.Config{}, nil); disabled.due(CacheValue{Stored: time.Now().Add(-time.Hour)}) {
+		t.Error("expected no refresh without a soft TTL")
+	}
+}
@@ -0,0 +1,784 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// newDelayedS3 starts a fake S3 endpoint whose objects only become visible after the given number of HEAD requests,
+// status is answered instead of 404 while they are hidden
+func newDelayedS3(t *testing.T, hiddenFor int32, status int) (*S3Cache, *atomic.Int32) {
+	t.Helper()
+
+	heads := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		if heads.Add(1) <= hiddenFor {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}, heads
+}
+
+func TestWaitVisibleAtLocation(t *testing.T) {
+	// The object shows up after two misses
+	s3cache, heads := newDelayedS3(t, 2, http.StatusNotFound)
+	if err := s3cache.WaitVisibleAtLocation(context.Background(), "videos/clip.mp4", 3, time.Millisecond); err != nil {
+		t.Fatalf("expected the object to become visible, got %v", err)
+	}
+	if heads.Load() != 3 {
+		t.Errorf("expected 3 stats, got %d", heads.Load())
+	}
+
+	// The retries are bounded
+	s3cache, heads = newDelayedS3(t, 10, http.StatusNotFound)
+	if err := s3cache.WaitVisibleAtLocation(context.Background(), "videos/clip.mp4", 2, time.Millisecond); err == nil {
+		t.Fatalf("expected the object to stay missing")
+	}
+	if heads.Load() != 3 {
+		t.Errorf("expected 3 stats, got %d", heads.Load())
+	}
+
+	// Errors other than a missing object aren't retried
+	s3cache, heads = newDelayedS3(t, 10, http.StatusForbidden)
+	if err := s3cache.WaitVisibleAtLocation(context.Background(), "videos/clip.mp4", 2, time.Millisecond); err == nil {
+		t.Fatalf("expected the error to be returned")
+	}
+	if heads.Load() != 1 {
+		t.Errorf("expected a single stat, got %d", heads.Load())
+	}
+
+	// A disabled cache has nothing to wait for
+	if err := (&S3Cache{Enabled: false}).WaitVisibleAtLocation(context.Background(), "videos/clip.mp4", 2, time.Millisecond); err != nil {
+		t.Errorf("expected no error for a disabled cache, got %v", err)
+	}
+}
+
+func TestCacheKey_OutputFormat(t *testing.T) {
+	cfg := &config.Config{}
+	original := &validation.ImageContext{Url: "https://example.com/cat.jpg", Quality: 80, Width: 320}
+	webp := *original
+	webp.Webp = true
+
+	if cacheKey(cfg, original) == cacheKey(cfg, &webp) {
+		t.Error("expected different output formats of the same source and size to get different keys")
+	}
+	if objectKeyFromCacheKey("cache", cacheKey(cfg, original)) == objectKeyFromCacheKey("cache", cacheKey(cfg, &webp)) {
+		t.Error("expected different output formats to be stored under different object keys")
+	}
+	if !strings.Contains(cacheKey(cfg, &webp), ";format=webp") || !strings.Contains(cacheKey(cfg, original), ";format=original") {
+		t.Errorf("expected the keys to name the output format, got %q and %q", cacheKey(cfg, &webp), cacheKey(cfg, original))
+	}
+
+	// An effort from the path gets its own key, the configured one keeps the existing key
+	fast := webp
+	fast.WebpMethod, fast.WebpMethodSet = 0, true
+	if cacheKey(cfg, &fast) == cacheKey(cfg, &webp) || strings.Contains(cacheKey(cfg, &webp), ";method=") {
+		t.Errorf("expected only m: to split the key, got %q and %q", cacheKey(cfg, &fast), cacheKey(cfg, &webp))
+	}
+}
+
+func TestCacheKey_Normalized(t *testing.T) {
+	normalize := true
+	method := 6
+	cfg := &config.Config{NormalizeCacheKeys: &normalize, WebpMethod: &method}
+	encoded := base64.URLEncoding.EncodeToString([]byte("https://example.com/clip.mp4"))
+	key := func(cfg *config.Config, path string) string {
+		t.Helper()
+		ok, _, params, err := validation.ProcessImageContextFromPath(zap.NewNop(), path+encoded, cfg)
+		if !ok {
+			t.Fatalf("failed to parse %q: %v", path, err)
+		}
+		return cacheKey(cfg, params)
+	}
+
+	equivalent := [][]string{
+		{"webp/", "m:6/webp/", "method:6/webp/"},
+		{"fp:30/", "fp:30.0/", "fp:030/", "fp:3e1/"},
+		{"w:100/fp:0.5/", "w:100/fp:.50/"},
+	}
+	for _, paths := range equivalent {
+		for _, path := range paths[1:] {
+			if key(cfg, path) != key(cfg, paths[0]) {
+				t.Errorf("expected %q to share the key of %q, got %q and %q", path, paths[0], key(cfg, path), key(cfg, paths[0]))
+			}
+		}
+	}
+
+	// The default request keeps its key, requests for other results keep theirs apart
+	disabled := &config.Config{WebpMethod: &method}
+	if key(cfg, "webp/") != key(disabled, "webp/") || key(cfg, "fp:30/") != key(disabled, "fp:30/") {
+		t.Error("expected requests already in the normalized form to keep their key")
+	}
+	for _, paths := range [][2]string{{"webp/", "m:4/webp/"}, {"fp:30/", "fp:30.5/"}, {"fp:first/", "fp:0/"}} {
+		if key(cfg, paths[0]) == key(cfg, paths[1]) {
+			t.Errorf("expected %q and %q to get different keys", paths[0], paths[1])
+		}
+	}
+
+	// Without APP_NORMALIZE_CACHE_KEYS the key is built from the request as written
+	if key(disabled, "fp:30.0/") == key(disabled, "fp:30/") || key(disabled, "m:6/webp/") == key(disabled, "webp/") {
+		t.Error("expected no normalization when it is disabled")
+	}
+}
+
+func TestCacheSourceURL(t *testing.T) {
+	cfg := &config.Config{CacheIgnoredQueryParams: []string{"token", "X-Amz-Signature"}}
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://cdn.example.com/a.png", "https://cdn.example.com/a.png"},
+		{"https://cdn.example.com/a.png?token=abc", "https://cdn.example.com/a.png"},
+		{"https://cdn.example.com/a.png?v=2&token=abc&w=10", "https://cdn.example.com/a.png?v=2&w=10"},
+		{"https://cdn.example.com/a.png?x-amz-signature=abc&v=2", "https://cdn.example.com/a.png?v=2"},
+		{"https://cdn.example.com/a.png?to%6Ben=abc#top", "https://cdn.example.com/a.png#top"},
+		// Nothing ignored keeps the URL as it was, parameter order included
+		{"https://cdn.example.com/a.png?w=10&v=2", "https://cdn.example.com/a.png?w=10&v=2"},
+		{"https://cdn.example.com/a.png?tokens=abc", "https://cdn.example.com/a.png?tokens=abc"},
+	}
+	for _, test := range tests {
+		if stripped := cacheSourceURL(cfg, test.url); stripped != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, stripped)
+		}
+	}
+
+	if stripped := cacheSourceURL(&config.Config{}, "https://cdn.example.com/a.png?token=abc"); stripped != "https://cdn.example.com/a.png?token=abc" {
+		t.Errorf("expected the URL to be kept without ignored params, got %s", stripped)
+	}
+}
+
+func TestImageRequest_IgnoredQueryParamsShareCache(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{CacheIgnoredQueryParams: []string{"token"}})
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	if response := requestImage(t, app, "q:80/", originURL+"?token=first"); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	cache.Wait()
+
+	// A rotated token is the same asset, it is served from the cache
+	if response := requestImage(t, app, "q:80/", originURL+"?token=second"); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+}
+
+func TestS3CacheExpiry(t *testing.T) {
+	before := time.Now()
+	expiry := (&S3Cache{TTL: time.Hour}).expiry()
+	if expiry.Before(before.Add(time.Hour)) || expiry.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expected an expiry an hour from now, got %v", expiry)
+	}
+
+	// Without a TTL objects are stored without an expiry
+	if expiry := (&S3Cache{}).expiry(); !expiry.IsZero() {
+		t.Errorf("expected no expiry, got %v", expiry)
+	}
+	var disabled *S3Cache
+	if expiry := disabled.expiry(); !expiry.IsZero() {
+		t.Errorf("expected no expiry for a missing cache, got %v", expiry)
+	}
+}
+
+func TestS3CacheUploadRetention(t *testing.T) {
+	var mu sync.Mutex
+	var created []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		mu.Lock()
+		created = append(created, r.Header.Clone())
+		mu.Unlock()
+		if r.Method == http.MethodPost {
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>", r.URL.Path)
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	// upload stores a video both ways and returns the headers each one was created with
+	upload := func(s3cache *S3Cache) []http.Header {
+		mu.Lock()
+		created = nil
+		mu.Unlock()
+		if err := s3cache.PutAtLocationStream(context.Background(), "videos/single.mp4", strings.NewReader("video"), 5, "video/mp4"); err != nil {
+			t.Fatalf("failed to upload: %v", err)
+		}
+		if _, err := s3cache.NewMultipartUpload(context.Background(), "videos/multi.mp4", "video/mp4"); err != nil {
+			t.Fatalf("failed to start multipart upload: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(created) != 2 {
+			t.Fatalf("expected 2 requests, got %d", len(created))
+		}
+		return created
+	}
+
+	// The cache TTL is for results, uploads are kept forever unless a retention is set
+	for _, header := range upload(&S3Cache{Enabled: true, Client: client, Bucket: "bucket", TTL: time.Hour}) {
+		if tagging := header.Get("X-Amz-Tagging"); tagging != "retention=forever" {
+			t.Errorf("expected uploads to be tagged to be kept forever, got %q", tagging)
+		}
+		if expires := header.Get("Expires"); expires != "" {
+			t.Errorf("expected uploads kept forever to have no expiry, got %q", expires)
+		}
+	}
+
+	for _, header := range upload(&S3Cache{Enabled: true, Client: client, Bucket: "bucket", TTL: time.Hour, UploadRetention: 30 * 24 * time.Hour}) {
+		if tagging := header.Get("X-Amz-Tagging"); tagging != "retention=30d" {
+			t.Errorf("expected uploads to be tagged with their retention, got %q", tagging)
+		}
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil || expires.Before(time.Now().Add(29*24*time.Hour)) {
+			t.Errorf("expected uploads to expire after 30 days, got %q", header.Get("Expires"))
+		}
+	}
+}
+
+func TestEnsureBucket(t *testing.T) {
+	newBucketS3 := func(exists bool) (*S3Cache, *atomic.Int32) {
+		created := &atomic.Int32{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.Method == http.MethodPut:
+				created.Add(1)
+				w.WriteHeader(http.StatusOK)
+			case r.Method == http.MethodHead && exists:
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+		t.Cleanup(server.Close)
+
+		client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+			Creds:  credentials.NewStaticV4("access", "secret", ""),
+			Region: "us-east-1",
+		})
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		return &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}, created
+	}
+
+	s3cache, created := newBucketS3(true)
+	if err := s3cache.EnsureBucket(context.Background(), true); err != nil || created.Load() != 0 {
+		t.Errorf("expected an existing bucket to be used as is, got %v with %d created", err, created.Load())
+	}
+
+	// A missing bucket is reported unless it may be created
+	s3cache, created = newBucketS3(false)
+	if err := s3cache.EnsureBucket(context.Background(), false); err == nil || created.Load() != 0 {
+		t.Errorf("expected a missing bucket to be reported, got %v with %d created", err, created.Load())
+	}
+	if err := s3cache.EnsureBucket(context.Background(), true); err != nil || created.Load() != 1 {
+		t.Errorf("expected the bucket to be created, got %v with %d created", err, created.Load())
+	}
+}
+
+func TestS3CacheGet(t *testing.T) {
+	reads := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/cache/present":
+			if r.Method == http.MethodGet {
+				reads.Add(1)
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Content-Type", "image/webp")
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("X-Amz-Meta-Frame-Position-Clamped", "true")
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte("webp"))
+			}
+		case "/bucket/cache/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			if r.Method == http.MethodGet {
+				reads.Add(1)
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	s3cache := &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}
+
+	value, err := s3cache.GetValueDirect(context.Background(), "cache/present")
+	if err != nil || value == nil {
+		t.Fatalf("expected the object, got %v %v", value, err)
+	}
+	if string(value.Body) != "webp" || value.ContentType != "image/webp" || !value.FrameClamped {
+		t.Errorf("unexpected value %q %q %v", value.Body, value.ContentType, value.FrameClamped)
+	}
+
+	// A missing object is a miss without ever being read
+	if value, err := s3cache.GetValueDirect(context.Background(), "cache/missing"); value != nil || err != nil {
+		t.Errorf("expected a clean miss, got %v %v", value, err)
+	}
+	if value, err := s3cache.GetDirect(context.Background(), "cache/missing"); value != nil || err != nil {
+		t.Errorf("expected a clean miss, got %v %v", value, err)
+	}
+	if reads.Load() != 1 {
+		t.Errorf("expected a single read, got %d", reads.Load())
+	}
+
+	// Other failures are reported instead of passing for a miss
+	if value, err := s3cache.GetDirect(context.Background(), "cache/forbidden"); value != nil || err == nil {
+		t.Errorf("expected an error, got %v %v", value, err)
+	}
+}
+
+// newMultipartS3 starts a fake S3 endpoint supporting multipart uploads. It returns the completed objects and the
+// parts of uploads in progress, keyed by uploadId/partNumber
+func newMultipartS3(t *testing.T) (*S3Cache, map[string][]byte, map[string][]byte) {
+	t.Helper()
+
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	parts := map[string][]byte{}
+	uploads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		query := r.URL.Query()
+		uploadID := query.Get("uploadId")
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			uploads++
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload-%d</UploadId></InitiateMultipartUploadResult>", r.URL.Path, uploads)
+		case r.Method == http.MethodPut && query.Has("partNumber"):
+			body, _ := io.ReadAll(r.Body)
+			if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+				body = decodeAWSChunked(body)
+			}
+			parts[uploadID+"/"+query.Get("partNumber")] = body
+			w.Header().Set("ETag", `"etag-`+query.Get("partNumber")+`"`)
+		case r.Method == http.MethodGet && uploadID != "":
+			var listed strings.Builder
+			for key := range parts {
+				if number, ok := strings.CutPrefix(key, uploadID+"/"); ok {
+					fmt.Fprintf(&listed, `<Part><PartNumber>%s</PartNumber><ETag>"etag-%s"</ETag></Part>`, number, number)
+				}
+			}
+			fmt.Fprintf(w, "<ListPartsResult><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>%s</ListPartsResult>", uploadID, listed.String())
+		case r.Method == http.MethodPost && uploadID != "":
+			var complete struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+			if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var object []byte
+			for _, part := range complete.Parts {
+				body, ok := parts[fmt.Sprintf("%s/%d", uploadID, part.PartNumber)]
+				if !ok || strings.Trim(part.ETag, `"`) != fmt.Sprintf("etag-%d", part.PartNumber) {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+					return
+				}
+				object = append(object, body...)
+			}
+			objects[r.URL.Path] = object
+			fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, r.URL.Path)
+		case r.Method == http.MethodDelete && uploadID != "":
+			if !strings.HasPrefix(uploadID, "upload-") {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, "<Error><Code>NoSuchUpload</Code></Error>")
+				return
+			}
+			for key := range parts {
+				if strings.HasPrefix(key, uploadID+"/") {
+					delete(parts, key)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}, objects, parts
+}
+
+// decodeAWSChunked strips the chunk headers of a streaming signed upload body
+func decodeAWSChunked(body []byte) []byte {
+	var decoded []byte
+	for len(body) > 0 {
+		header, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			break
+		}
+		sizeHex, _, _ := strings.Cut(string(header), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil || size == 0 || int(size) > len(rest) {
+			break
+		}
+		decoded = append(decoded, rest[:size]...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+	return decoded
+}
+
+func TestS3CacheMultipartUpload(t *testing.T) {
+	s3cache, objects, parts := newMultipartS3(t)
+	ctx := context.Background()
+
+	video := []byte("first-second-")
+	info := testUploadInfo(int64(len(video)), 5)
+	uploadID, err := s3cache.NewMultipartUpload(ctx, "videos/clip.mp4", "video/mp4")
+	if err != nil {
+		t.Fatalf("failed to start the upload: %v", err)
+	}
+
+	// Parts may arrive in any order
+	for _, index := range []int{2, 0, 1} {
+		part := info.Parts[index]
+		etag, err := s3cache.PutObjectPart(ctx, "videos/clip.mp4", uploadID, index+1, video[part.Offset:part.Offset+part.Size])
+		if err != nil {
+			t.Fatalf("failed to upload part %d: %v", index, err)
+		}
+		_ = recordPartUpload(info, index, part.Size, etag, "")
+	}
+	if len(objects) != 0 {
+		t.Errorf("expected nothing to be visible before completion, got %d objects", len(objects))
+	}
+
+	etags, err := s3cache.ListPartETags(ctx, "videos/clip.mp4", uploadID)
+	if err != nil {
+		t.Fatalf("failed to list the parts: %v", err)
+	}
+	for _, part := range info.Parts {
+		if etags[part.Index+1] != part.ETag {
+			t.Errorf("part %d: expected the listed ETag %q, got %q", part.Index, part.ETag, etags[part.Index+1])
+		}
+	}
+
+	if err := s3cache.CompleteMultipartUpload(ctx, "videos/clip.mp4", uploadID, completedParts(info)); err != nil {
+		t.Fatalf("failed to complete the upload: %v", err)
+	}
+	if body := string(objects["/bucket/videos/clip.mp4"]); body != string(video) {
+		t.Errorf("unexpected object %q", body)
+	}
+
+	// An aborted upload drops its parts
+	uploadID, err = s3cache.NewMultipartUpload(ctx, "videos/other.mp4", "video/mp4")
+	if err != nil {
+		t.Fatalf("failed to start the upload: %v", err)
+	}
+	if _, err := s3cache.PutObjectPart(ctx, "videos/other.mp4", uploadID, 1, []byte("part")); err != nil {
+		t.Fatalf("failed to upload part: %v", err)
+	}
+	if err := s3cache.AbortMultipartUpload(ctx, "videos/other.mp4", uploadID); err != nil {
+		t.Fatalf("failed to abort the upload: %v", err)
+	}
+	for key := range parts {
+		if strings.HasPrefix(key, uploadID+"/") {
+			t.Errorf("expected part %s to be dropped", key)
+		}
+	}
+
+	// Aborting an upload that is already gone succeeds
+	if err := s3cache.AbortMultipartUpload(ctx, "videos/other.mp4", "unknown"); err != nil {
+		t.Errorf("expected a missing upload to be ignored, got %v", err)
+	}
+}
+
+// recordingBackend is a CacheBackend keeping results in a map
+type recordingBackend struct {
+	mu     sync.Mutex
+	values map[string]CacheValue
+}
+
+func (b *recordingBackend) Get(ctx context.Context, cacheKey string) (*CacheValue, error) {
+	return b.GetAtLocation(ctx, "key:"+cacheKey)
+}
+
+func (b *recordingBackend) GetAtLocation(ctx context.Context, location string) (*CacheValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if value, ok := b.values[location]; ok {
+		return &value, nil
+	}
+	return nil, nil
+}
+
+func (b *recordingBackend) Put(ctx context.Context, cacheKey string, body []byte, contentType string) error {
+	return b.PutAtLocation(ctx, "key:"+cacheKey, body, contentType)
+}
+
+func (b *recordingBackend) PutValue(ctx context.Context, cacheKey string, value CacheValue) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values["key:"+cacheKey] = CacheValue{Body: value.Body, ContentType: value.ContentType, Headers: value.Headers}
+	return nil
+}
+
+func (b *recordingBackend) PutAtLocation(ctx context.Context, location string, body []byte, contentType string) error {
+	return b.PutAtLocationExpiring(ctx, location, body, contentType, time.Time{})
+}
+
+func (b *recordingBackend) PutAtLocationExpiring(ctx context.Context, location string, body []byte, contentType string, expire time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.values[location] = CacheValue{Body: body, ContentType: contentType}
+	return nil
+}
+
+func TestProcessImageData_StoresInBackend(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{NumCounters: 1e3, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+	app := fiber.New()
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	backend := &recordingBackend{values: map[string]CacheValue{}}
+
+	params := &validation.ImageContext{Url: "https://example.com/a.png", Quality: 100}
+	c := app.AcquireCtx(&fasthttp.RequestCtx{})
+	defer app.ReleaseCtx(c)
+	if err := processImageData(c, zap.NewNop(), cache, &config.Config{EncoderThreads: 1}, counters, nil, params, encodePNG(t, 8, 8), "image/png", backend, nil, nil); err != nil {
+		t.Fatalf("failed to process image: %v", err)
+	}
+
+	// The result is stored in the background under its cache key
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if value, _ := backend.Get(context.Background(), cacheKey(&config.Config{}, params)); value != nil {
+			if value.ContentType != "image/png" {
+				t.Errorf("expected the result content type, got %q", value.ContentType)
+			}
+			if value.Headers["X-Image-Width"] != "8" || value.Headers["X-Image-Height"] != "8" {
+				t.Errorf("expected the source dimensions to be stored with the result, got %v", value.Headers)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the result to be stored in the backend")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCacheTTLFloor(t *testing.T) {
+	cfg := &config.Config{CacheTTL: 60, HTTPCacheTTL: 30, MinCacheTTL: 300}
+
+	// Shorter TTLs are raised to the floor
+	if ttl := cacheTTL(cfg); ttl != 300*time.Second {
+		t.Errorf("expected the memory TTL to be raised to 300s, got %s", ttl)
+	}
+	if header := cacheControl(cfg, &validation.ImageContext{}); header != "public, max-age=300" {
+		t.Errorf("expected max-age to be raised to 300, got %q", header)
+	}
+
+	// Longer ones and no expiry are kept
+	if ttl := flooredTTL(cfg, 3600); ttl != 3600 {
+		t.Errorf("expected 3600 to be kept, got %d", ttl)
+	}
+	if ttl := flooredTTL(cfg, 0); ttl != 0 {
+		t.Errorf("expected no expiry to be kept, got %d", ttl)
+	}
+
+	// Without a floor the configured TTLs apply
+	cfg.MinCacheTTL = 0
+	if ttl := cacheTTL(cfg); ttl != 60*time.Second {
+		t.Errorf("expected the configured 60s, got %s", ttl)
+	}
+}
+
+// newDiscardingS3 is a fake S3 server accepting single and multipart uploads without keeping them, it counts the
+// bytes received for object data (chunk signatures included)
+func newDiscardingS3(t *testing.T) (*S3Cache, *atomic.Int64) {
+	t.Helper()
+
+	received := &atomic.Int64{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		switch {
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>upload</UploadId></InitiateMultipartUploadResult>", r.URL.Path)
+		case r.Method == http.MethodPut:
+			n, _ := io.Copy(io.Discard, r.Body)
+			received.Add(n)
+			w.Header().Set("ETag", `"etag-`+query.Get("partNumber")+`"`)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			_, _ = io.Copy(io.Discard, r.Body)
+			fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, r.URL.Path)
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}, received
+}
+
+// patternReader produces bytes without holding them, so the reader itself doesn't count towards allocations
+type patternReader struct{}
+
+func (patternReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(i)
+	}
+	return len(p), nil
+}
+
+func TestS3CachePutAtLocationStream(t *testing.T) {
+	s3cache, received := newDiscardingS3(t)
+	const size = 96 << 20
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	err := s3cache.PutAtLocationStream(context.Background(), "videos/large.mp4", io.LimitReader(patternReader{}, size), size, "video/mp4")
+	if err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	if received.Load() < size {
+		t.Errorf("expected at least %d bytes to reach the server, got %d", size, received.Load())
+	}
+	// Only a part buffer is held at a time, reading the whole video into memory would allocate its full size
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > size/2 {
+		t.Errorf("expected the upload to allocate well below its %d bytes, allocated %d", size, allocated)
+	}
+}
+
+func TestImageRequest_MaxAge(t *testing.T) {
+	cfg := &config.Config{HTTPCacheTTL: 1800, HTTPCacheMaxTTL: 3600}
+	app := newImageTestApp(t, cfg)
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	for path, expected := range map[string]string{
+		"":              "public, max-age=1800",
+		"maxage:60/":    "public, max-age=60",
+		"maxage:0/":     "public, max-age=0",
+		"maxage:99999/": "public, max-age=3600",
+	} {
+		response := requestImage(t, app, path, originURL)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200 for %q, got %d", path, response.StatusCode)
+		}
+		if header := response.Header.Get("Cache-Control"); header != expected {
+			t.Errorf("expected %q for %q, got %q", expected, path, header)
+		}
+	}
+}
+
+func TestNoStoreErrors(t *testing.T) {
+	app := fiber.New()
+	app.Use(NoStoreErrors())
+	app.Get("/ok", func(c *fiber.Ctx) error {
+		c.Set("Cache-Control", "public, max-age=60")
+		return c.SendString("ok")
+	})
+	app.Get("/failed", func(c *fiber.Ctx) error {
+		c.Set("Cache-Control", "public, max-age=60")
+		return c.Status(fiber.StatusInternalServerError).SendString("failed")
+	})
+	app.Get("/error", func(c *fiber.Ctx) error {
+		return fiber.NewError(fiber.StatusBadGateway, "bad gateway")
+	})
+
+	for path, expected := range map[string]string{
+		"/ok":      "public, max-age=60",
+		"/failed":  "no-store",
+		"/error":   "no-store",
+		"/missing": "no-store",
+	} {
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if header := response.Header.Get("Cache-Control"); header != expected {
+			t.Errorf("expected Cache-Control %q for %s, got %q", expected, path, header)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package routes
+
+import (
+	"github.com/dgraph-io/ristretto/v2"
+	"golang.org/x/sync/singleflight"
+)
+
+// requestCoalescer lets the first of identical concurrent cache misses do the work while the others wait for it and
+// are then served from the cache, so a stampede on an uncached result fetches and processes the source once
+type requestCoalescer struct {
+	group singleflight.Group
+	cache *ristretto.Cache[string, CacheValue]
+}
+
+func newRequestCoalescer(cache *ristretto.Cache[string, CacheValue]) *requestCoalescer {
+	return &requestCoalescer{cache: cache}
+}
+
+// do runs miss unless a request for the same key is already running it, then it waits for that one and reports
+// true. The result is cached by then unless it failed or the cache didn't admit it, the caller looks it up again and
+// runs miss itself when it isn't there. A nil coalescer runs every miss
+func (r *requestCoalescer) do(key string, miss func() error) (bool, error) {
+	if r == nil {
+		return false, miss()
+	}
+
+	ran := false
+	_, err, _ := r.group.Do(key, func() (any, error) {
+		ran = true
+		err := miss()
+		// Sets are applied in the background, the waiting requests look the result up right after
+		r.cache.Wait()
+		return nil, err
+	})
+	if ran {
+		return false, err
+	}
+	return true, nil
+}
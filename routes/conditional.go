@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// contentETag is a strong ETag for a response body. It is computed once when the response is cached,
+// the cache key is hashed in as well so that variants with equal bytes still differ
+func contentETag(cacheKey string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(cacheKey))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+}
+
+// setResponseValidators sends the ETag and Last-Modified of a cached response and reports whether the client already
+// holds it, in which case 304 Not Modified is answered instead of the body
+func setResponseValidators(c *fiber.Ctx, value CacheValue) bool {
+	if value.ETag != "" {
+		c.Set(fiber.HeaderETag, value.ETag)
+	}
+	if value.OriginLastModified != "" {
+		c.Set(fiber.HeaderLastModified, value.OriginLastModified)
+	}
+
+	// If-Modified-Since is only looked at without If-None-Match
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		return value.ETag != "" && etagListMatches(noneMatch, value.ETag)
+	}
+
+	modifiedSince := c.Get(fiber.HeaderIfModifiedSince)
+	if modifiedSince == "" || value.OriginLastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(modifiedSince)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(value.OriginLastModified)
+	if err != nil {
+		return false
+	}
+	return !lastModified.After(since)
+}
+
+// etagListMatches compares the ETags of an If-None-Match header against etag, weak ETags match their strong form
+func etagListMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package routes
+
+import "testing"
+
+func TestEtagListMatches(t *testing.T) {
+	tests := []struct {
+		list     string
+		expected bool
+	}{
+		{`"abc"`, true},
+		{`"other", "abc"`, true},
+		{`W/"abc"`, true},
+		{`*`, true},
+		{`"other"`, false},
+		{`abc`, false},
+	}
+	for _, test := range tests {
+		if matches := etagListMatches(test.list, `"abc"`); matches != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.list, test.expected, matches)
+		}
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	body := []byte("processed image")
+
+	etag := contentETag("images:a", body)
+	if etag != contentETag("images:a", body) {
+		t.Errorf("expected the ETag to be deterministic")
+	}
+	if len(etag) != 34 || etag[0] != '"' || etag[33] != '"' {
+		t.Errorf("expected a quoted strong ETag, got %s", etag)
+	}
+	if etag == contentETag("images:b", body) {
+		t.Errorf("expected variants with equal bytes to get different ETags")
+	}
+	if etag == contentETag("images:a", []byte("other image")) {
+		t.Errorf("expected different bytes to get a different ETag")
+	}
+}
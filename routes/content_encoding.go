@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// acceptedEncodings is sent as Accept-Encoding with image fetches, decodedBody undoes each of them
+const acceptedEncodings = "gzip, br"
+
+// errUnsupportedEncoding is returned for a Content-Encoding decodedBody can't undo
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodedBody returns the body of the response with its Content-Encoding undone. Setting Accept-Encoding on the request
+// turns off the transparent gzip handling of the client, so gzip is decoded here along with brotli
+func decodedBody(response *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return response.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(response.Body)
+	case "br":
+		return brotli.NewReader(response.Body), nil
+	}
+	return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+}
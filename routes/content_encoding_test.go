@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// serveEncodedOrigin serves the body with the given Content-Encoding, after checking the client accepts it
+func serveEncodedOrigin(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if encoding == "br" && !strings.Contains(r.Header.Get("Accept-Encoding"), "br") {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Encoding", encoding)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/source"
+}
+
+func TestImageRequest_ContentEncodings(t *testing.T) {
+	png := encodePNG(t, 8, 8)
+
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	_, _ = gzipWriter.Write(png)
+	_ = gzipWriter.Close()
+
+	var brotlied bytes.Buffer
+	brotliWriter := brotli.NewWriter(&brotlied)
+	_, _ = brotliWriter.Write(png)
+	_ = brotliWriter.Close()
+
+	for encoding, body := range map[string][]byte{"gzip": gzipped.Bytes(), "br": brotlied.Bytes(), "identity": png} {
+		response := requestImage(t, newImageTestApp(t, &config.Config{}), "w:4/", serveEncodedOrigin(t, encoding, body))
+		if response.StatusCode != fiber.StatusOK {
+			message, _ := io.ReadAll(response.Body)
+			t.Errorf("expected a %s encoded image to be decoded, got %d: %s", encoding, response.StatusCode, message)
+		}
+	}
+
+	response := requestImage(t, newImageTestApp(t, &config.Config{}), "w:4/", serveEncodedOrigin(t, "zstd", png))
+	message, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusBadGateway || !strings.Contains(string(message), "unsupported content encoding") {
+		t.Errorf("expected 502 for an unknown encoding, got %d: %s", response.StatusCode, message)
+	}
+}
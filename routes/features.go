@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+// RegisterFeatureRoutes sets up the route reporting which optional features the configuration enables
+func RegisterFeatureRoutes(logger *zap.Logger, config *config.Config, app *fiber.App) {
+	app.Get("/features", handleFeaturesRequest(logger, config))
+}
+
+//#region handleFeaturesRequest
+
+// handleFeaturesRequest answers with the resolved on/off switches of the configuration, keyed by their JSON names
+func handleFeaturesRequest(logger *zap.Logger, config *config.Config) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		token := c.Query("token")
+		if token == "" || token != config.Token {
+			logger.Error("invalid or missing token")
+			return c.Status(fiber.StatusForbidden).SendString("invalid token")
+		}
+
+		return c.JSON(featureFlags(config))
+	}
+}
+
+// featureFlags collects every bool and *bool field of the configuration, so new switches are listed without
+// touching this route. Pointers are resolved to their defaults in main, one left nil is reported as off
+func featureFlags(config *config.Config) map[string]bool {
+	features := map[string]bool{}
+
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			name = field.Name
+		}
+
+		switch fieldValue := value.Field(i); {
+		case fieldValue.Kind() == reflect.Bool:
+			features[name] = fieldValue.Bool()
+		case fieldValue.Kind() == reflect.Pointer && fieldValue.Type().Elem().Kind() == reflect.Bool:
+			features[name] = !fieldValue.IsNil() && fieldValue.Elem().Bool()
+		}
+	}
+	return features
+}
+
+//#endregion
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+func TestFeatures_ReportsConfig(t *testing.T) {
+	metricsEnabled := true
+	cfg := &config.Config{Token: "secret", Metrics: &metricsEnabled, WebpAuto: true, S3Enabled: true, S3Bucket: "bucket"}
+	app := fiber.New()
+	RegisterFeatureRoutes(zap.NewNop(), cfg, app)
+
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, "/features?token=wrong", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("expected 403 without the token, got %d", response.StatusCode)
+	}
+
+	response, err = app.Test(httptest.NewRequest(http.MethodGet, "/features?token=secret", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	var features map[string]any
+	if err := json.NewDecoder(response.Body).Decode(&features); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	expected := map[string]any{"metrics": true, "webpAuto": true, "s3Enabled": true, "webp": false, "heicEnabled": false, "normalizePaths": false}
+	for name, enabled := range expected {
+		if features[name] != enabled {
+			t.Errorf("expected %s to be %v, got %v", name, enabled, features[name])
+		}
+	}
+
+	// Only switches are listed, no other settings
+	if _, found := features["s3Bucket"]; found {
+		t.Errorf("expected only boolean settings, got %v", features)
+	}
+}
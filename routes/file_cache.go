@@ -0,0 +1,189 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileCache stores results as files under a local directory, for setups without S3. Objects are laid out like
+// the S3 keys (aa/bb/<hash> for cache keys, the location itself for explicit locations), each next to a
+// <key>.meta.json sidecar holding its content type and metadata
+type FileCache struct {
+	Dir string
+	TTL time.Duration // Expiry of stored files, 0 keeps them until they are overwritten or purged
+}
+
+// fileMetadata is the sidecar of a stored file
+type fileMetadata struct {
+	ContentType  string            `json:"contentType"`
+	FrameClamped bool              `json:"frameClamped,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Expires      time.Time         `json:"expires"`
+}
+
+// fileMetadataSuffix is appended to the path of a stored file to get the path of its sidecar
+const fileMetadataSuffix = ".meta.json"
+
+// NewFileCache creates the cache directory if needed
+func NewFileCache(dir string, ttl time.Duration) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &FileCache{Dir: dir, TTL: ttl}, nil
+}
+
+// Get reads the file stored for a cache key. Returns nil if missing or expired
+func (f *FileCache) Get(ctx context.Context, cacheKey string) (*CacheValue, error) {
+	return f.getValue(objectKeyFromCacheKey("", cacheKey))
+}
+
+// Put stores a body for a cache key
+func (f *FileCache) Put(ctx context.Context, cacheKey string, body []byte, contentType string) error {
+	return f.putValue(objectKeyFromCacheKey("", cacheKey), CacheValue{Body: body, ContentType: contentType}, f.expiry())
+}
+
+// PutValue stores a cache value for a cache key along with its flags and headers
+func (f *FileCache) PutValue(ctx context.Context, cacheKey string, value CacheValue) error {
+	return f.putValue(objectKeyFromCacheKey("", cacheKey), value, f.expiry())
+}
+
+// GetAtLocation reads the file stored at an explicit location. Returns nil if missing or expired
+func (f *FileCache) GetAtLocation(ctx context.Context, location string) (*CacheValue, error) {
+	return f.getValue(location)
+}
+
+// PutAtLocation stores a body at an explicit location
+func (f *FileCache) PutAtLocation(ctx context.Context, location string, body []byte, contentType string) error {
+	return f.PutAtLocationExpiring(ctx, location, body, contentType, f.expiry())
+}
+
+// PutAtLocationExpiring stores a body at an explicit location with a specified expiry
+func (f *FileCache) PutAtLocationExpiring(ctx context.Context, location string, body []byte, contentType string, expire time.Time) error {
+	return f.putValue(location, CacheValue{Body: body, ContentType: contentType}, expire)
+}
+
+// expiry is the expiry of a file stored now, zero when files don't expire
+func (f *FileCache) expiry() time.Time {
+	if f.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(f.TTL)
+}
+
+// path resolves an object key below the cache directory, keys escaping it are rejected
+func (f *FileCache) path(objKey string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(objKey)) {
+		return "", fmt.Errorf("invalid file cache key %q", objKey)
+	}
+	return filepath.Join(f.Dir, filepath.FromSlash(objKey)), nil
+}
+
+// getValue reads a file along with its sidecar, an expired one is removed and reported missing
+func (f *FileCache) getValue(objKey string) (*CacheValue, error) {
+	path, err := f.path(objKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sidecar is written last, a file without one isn't complete yet
+	data, err := os.ReadFile(path + fileMetadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var metadata fileMetadata
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("invalid file cache metadata for %q: %w", objKey, err)
+	}
+
+	if !metadata.Expires.IsZero() && time.Now().After(metadata.Expires) {
+		_, err := f.deleteObject(objKey)
+		return nil, err
+	}
+
+	body, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	contentType := metadata.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return &CacheValue{Body: body, ContentType: contentType, FrameClamped: metadata.FrameClamped, Headers: metadata.Headers}, nil
+}
+
+// putValue writes a file and then its sidecar, each to a temporary file renamed into place so readers never see
+// a partial write
+func (f *FileCache) putValue(objKey string, value CacheValue, expire time.Time) error {
+	path, err := f.path(objKey)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	metadata, err := json.Marshal(fileMetadata{
+		ContentType:  value.ContentType,
+		FrameClamped: value.FrameClamped,
+		Headers:      value.Headers,
+		Expires:      expire,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(path, value.Body); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+fileMetadataSuffix, metadata)
+}
+
+// deleteObject removes a file and its sidecar, a missing one is not an error
+func (f *FileCache) deleteObject(objKey string) (bool, error) {
+	path, err := f.path(objKey)
+	if err != nil {
+		return false, err
+	}
+
+	// Removing the sidecar first makes the file invisible to getValue right away
+	err = os.Remove(path + fileMetadataSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return true, err
+	}
+	return true, nil
+}
+
+// writeFileAtomic writes data next to path and renames it into place
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(file.Name()) }()
+
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
@@ -0,0 +1,157 @@
+package routes
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+func TestFileCache_RoundTrip(t *testing.T) {
+	files, err := NewFileCache(filepath.Join(t.TempDir(), "cache"), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create file cache: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := files.Put(ctx, "url=https://example.com/a.png;quality=80", []byte("png"), "image/png"); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	value, err := files.Get(ctx, "url=https://example.com/a.png;quality=80")
+	if err != nil || value == nil {
+		t.Fatalf("expected the stored value, got %v %v", value, err)
+	}
+	if string(value.Body) != "png" || value.ContentType != "image/png" {
+		t.Errorf("unexpected value %q %q", value.Body, value.ContentType)
+	}
+
+	// Cache keys use the sharded S3 layout, with the content type in the sidecar
+	objKey := objectKeyFromCacheKey("", "url=https://example.com/a.png;quality=80")
+	if _, err := os.Stat(filepath.Join(files.Dir, filepath.FromSlash(objKey)+fileMetadataSuffix)); err != nil {
+		t.Errorf("expected a sidecar at %s: %v", objKey, err)
+	}
+
+	if err := files.PutAtLocation(ctx, "images/out.webp", []byte("webp"), "image/webp"); err != nil {
+		t.Fatalf("failed to put at location: %v", err)
+	}
+	value, err = files.GetAtLocation(ctx, "images/out.webp")
+	if err != nil || value == nil || string(value.Body) != "webp" || value.ContentType != "image/webp" {
+		t.Errorf("expected the value at the location, got %v %v", value, err)
+	}
+
+	if value, err := files.Get(ctx, "url=https://example.com/missing.png"); value != nil || err != nil {
+		t.Errorf("expected a clean miss, got %v %v", value, err)
+	}
+	if _, err := files.GetAtLocation(ctx, "../outside"); err == nil {
+		t.Errorf("expected a location outside the directory to be rejected")
+	}
+}
+
+func TestFileCache_Expiry(t *testing.T) {
+	files, err := NewFileCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("failed to create file cache: %v", err)
+	}
+
+	if err := files.putValue("expired", CacheValue{Body: []byte("old"), ContentType: "image/png"}, time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if value, err := files.getValue("expired"); value != nil || err != nil {
+		t.Errorf("expected an expired file to be a miss, got %v %v", value, err)
+	}
+	if _, err := os.Stat(filepath.Join(files.Dir, "expired")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired file to be removed, got %v", err)
+	}
+
+	// Without a TTL files don't expire
+	if err := files.PutAtLocation(context.Background(), "kept", []byte("new"), "image/png"); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if value, _ := files.GetAtLocation(context.Background(), "kept"); value == nil {
+		t.Errorf("expected the file to be kept")
+	}
+}
+
+func TestS3Cache_FileBackend(t *testing.T) {
+	files, err := NewFileCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("failed to create file cache: %v", err)
+	}
+	s3cache := &S3Cache{Enabled: true, Files: files}
+	ctx := context.Background()
+
+	// Previews keep their flags and headers
+	preview := CacheValue{Body: []byte("jpeg"), ContentType: "image/jpeg", FrameClamped: true, Headers: map[string]string{"X-Video-Duration": "10"}}
+	if err := s3cache.PutValue(ctx, "preview", preview); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	value, err := s3cache.Get(ctx, "preview")
+	if err != nil || value == nil {
+		t.Fatalf("expected the stored preview, got %v %v", value, err)
+	}
+	if !value.FrameClamped || value.Headers["X-Video-Duration"] != "10" {
+		t.Errorf("expected the preview details to be kept, got %v %v", value.FrameClamped, value.Headers)
+	}
+
+	if deleted, err := s3cache.Delete(ctx, "preview"); !deleted || err != nil {
+		t.Errorf("expected the preview to be deleted, got %v %v", deleted, err)
+	}
+	if value, err := s3cache.Get(ctx, "preview"); value != nil || err != nil {
+		t.Errorf("expected a miss after the delete, got %v %v", value, err)
+	}
+}
+
+func TestImageRequest_FileCache(t *testing.T) {
+	files, err := NewFileCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("failed to create file cache: %v", err)
+	}
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	// Each app starts with an empty memory cache, like a restarted process
+	newApp := func() *fiber.App {
+		cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{NumCounters: 1e3, MaxCost: 1 << 20, BufferItems: 64})
+		if err != nil {
+			t.Fatalf("failed to create cache: %v", err)
+		}
+		t.Cleanup(cache.Close)
+
+		app := fiber.New()
+		counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+		RegisterImageRoutes(zap.NewNop(), cache, &config.Config{EncoderThreads: 1}, app, counters, nil, &S3Cache{Enabled: true, Files: files}, nil, newOriginClient(t, &config.Config{}), nil)
+		return app
+	}
+
+	if response := requestImage(t, newApp(), "w:4/", originURL); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+
+	// The result is written in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if sidecars, _ := filepath.Glob(filepath.Join(files.Dir, "*", "*", "*"+fileMetadataSuffix)); len(sidecars) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the image to be written to the file cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response := requestImage(t, newApp(), "w:4/", originURL)
+	if response.StatusCode != fiber.StatusOK || response.Header.Get("X-Cache-Place") != cachePlaceS3Cache {
+		t.Fatalf("expected the image to be served from the file cache, got %d %q", response.StatusCode, response.Header.Get("X-Cache-Place"))
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+}
@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+// RegisterHealthRoutes sets up the readiness route that verifies configured dependencies
+func RegisterHealthRoutes(logger *zap.Logger, config *config.Config, app *fiber.App, s3cache *S3Cache, uploadTracker *RedisUploadTracker) {
+	app.Get("/healthz", handleReadinessRequest(logger, config, s3cache, uploadTracker))
+}
+
+//#region handleReadinessRequest
+
+// handleReadinessRequest pings Redis and S3 and reports 503 if any of them is unreachable.
+// A dependency is required when it is configured, regardless of whether its client could be built at startup,
+// so a broken S3 or Redis configuration is reported as "not initialized" instead of being skipped.
+func handleReadinessRequest(logger *zap.Logger, config *config.Config, s3cache *S3Cache, uploadTracker *RedisUploadTracker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ReadinessTimeout)*time.Second)
+		defer cancel()
+
+		dependencies := fiber.Map{}
+		ready := true
+
+		check := func(name string, initialized bool, ping func(context.Context) error) {
+			var err error
+			if !initialized {
+				err = fmt.Errorf("not initialized")
+			} else {
+				err = ping(ctx)
+			}
+
+			if err != nil {
+				logger.Warn("readiness check failed", zap.String("dependency", name), zap.Error(err))
+				dependencies[name] = err.Error()
+				ready = false
+				return
+			}
+			dependencies[name] = "ok"
+		}
+
+		if config.RedisAddr != "" {
+			check("redis", uploadTracker != nil, uploadTracker.Ping)
+		}
+
+		if config.S3Enabled {
+			check("s3", s3cache != nil && s3cache.Enabled && s3cache.Client != nil, s3cache.Ping)
+		}
+
+		if !ready {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"status":       "unavailable",
+				"dependencies": dependencies,
+			})
+		}
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"status":       "ok",
+			"dependencies": dependencies,
+		})
+	}
+}
+
+//#endregion
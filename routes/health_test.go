@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+// requestReadiness calls /healthz and decodes the reported dependencies
+func requestReadiness(t *testing.T, cfg *config.Config, s3cache *S3Cache, uploadTracker *RedisUploadTracker) (int, map[string]string) {
+	t.Helper()
+
+	app := fiber.New()
+	RegisterHealthRoutes(zap.NewNop(), cfg, app, s3cache, uploadTracker)
+
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, "/healthz", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	var body struct {
+		Dependencies map[string]string `json:"dependencies"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	return response.StatusCode, body.Dependencies
+}
+
+func TestReadiness_NothingConfigured(t *testing.T) {
+	status, dependencies := requestReadiness(t, &config.Config{ReadinessTimeout: 1}, &S3Cache{Enabled: false}, nil)
+	if status != fiber.StatusOK {
+		t.Errorf("expected 200, got %d", status)
+	}
+	if len(dependencies) != 0 {
+		t.Errorf("expected no dependencies to be checked, got %v", dependencies)
+	}
+}
+
+func TestReadiness_S3ConfiguredButNotInitialized(t *testing.T) {
+	// NewS3Cache returns a disabled cache when the configuration is incomplete
+	status, dependencies := requestReadiness(t, &config.Config{ReadinessTimeout: 1, S3Enabled: true}, &S3Cache{Enabled: false}, nil)
+	if status != fiber.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", status)
+	}
+	if dependencies["s3"] != "not initialized" {
+		t.Errorf("expected s3 to be reported as not initialized, got %q", dependencies["s3"])
+	}
+}
+
+func TestReadiness_RedisConfiguredButNotInitialized(t *testing.T) {
+	status, dependencies := requestReadiness(t, &config.Config{ReadinessTimeout: 1, RedisAddr: "localhost:6379"}, nil, nil)
+	if status != fiber.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", status)
+	}
+	if dependencies["redis"] != "not initialized" {
+		t.Errorf("expected redis to be reported as not initialized, got %q", dependencies["redis"])
+	}
+}
@@ -1,23 +1,27 @@
 package routes
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"image"
 	"io"
 	"mime"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
 
-	"media-proxy/client"
 	"media-proxy/config"
 	"media-proxy/metrics"
 	"media-proxy/pool"
 	"media-proxy/validation"
 
 	"github.com/dgraph-io/ristretto/v2"
-	"github.com/kolesa-team/go-webp/encoder"
 	"github.com/kolesa-team/go-webp/webp"
 	"github.com/minio/minio-go/v7"
 )
@@ -26,22 +30,70 @@ const (
 	cachePlaceResponseHandler = "response-handler"
 	cachePlaceS3CacheLocation = "s3cache-location"
 	cachePlaceS3Cache         = "s3cache"
+	cachePlaceRevalidated     = "revalidated"
 )
 
+// originValidatorsLocal is the fiber local holding the validators of a freshly fetched source, they are cached with the result
+const originValidatorsLocal = "origin-validators"
+
+// sourceDimensionsLocal is the fiber local holding the dimensions of the decoded source, they are cached with the
+// result and sent as X-Image-Width and X-Image-Height
+const sourceDimensionsLocal = "source-dimensions"
+
+// emptyOriginResponse is sent with a 502 when a source has no content, such a response is never cached
+const emptyOriginResponse = "empty origin response"
+
+// originValidators are the ETag and Last-Modified headers an origin sent with a source
+type originValidators struct {
+	ETag         string
+	LastModified string
+}
+
 // RegisterImageRoutes sets up image processing routes
-func RegisterImageRoutes(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, app *fiber.App, counters *metrics.Metrics, s3cache *S3Cache) {
+func RegisterImageRoutes(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, app *fiber.App, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) {
+	// Decoded pyramid levels are only needed for deep-zoom tiles
+	var levels *tileLevelCache
+	if config.TilingEnabled {
+		var err error
+		levels, err = newTileLevelCache(int64(config.TilingLevelCacheMB)*1024*1024, time.Duration(config.CacheTTL)*time.Second)
+		if err != nil {
+			logger.Warn("failed to create tile level cache, tiles will decode their source on every miss", zap.Error(err))
+		}
+	}
+
+	// Origin URLs that answered 404 or with something other than an image fail fast for APP_NEGATIVE_CACHE_TTL_SECONDS
+	failures, err := newProbeFailureCache(time.Duration(config.NegativeCacheTTL) * time.Second)
+	if err != nil {
+		logger.Warn("failed to create the negative cache, failed origin fetches are retried on every request", zap.Error(err))
+	}
+
+	// Identical concurrent misses are processed once
+	coalescer := newRequestCoalescer(cache)
+
+	// Hits older than the soft TTL are served as they are and refreshed by a background run of the same pipeline
+	refresher := newCacheRefresher(config, warmImage(logger, cache, config, app, counters, performance, s3cache, levels, scheduler, httpClient, origins, failures, coalescer, true))
+
+	// Metadata of the source, registered before the wildcard route: /images/meta/{base64-encoded-url}
+	app.Get("/images/meta/*", handleImageMetadataRequest(logger, cache, config, counters, s3cache, httpClient, origins))
+
 	// New path-based route: /images/q:50/w:500/h:300/webp/{base64-encoded-url}
-	app.Get("/images/*", handleImageRequest(logger, cache, config, counters, s3cache))
+	app.Get("/images/*", handleImageRequest(logger, cache, config, counters, performance, s3cache, levels, scheduler, httpClient, origins, failures, refresher, coalescer))
 
 	// Image upload route with path parameters
-	app.Post("/images/*", handleImageUpload(logger, cache, config, counters, s3cache))
+	app.Post("/images/*", handleImageUpload(logger, cache, config, counters, performance, s3cache, scheduler))
+
+	// Cache warming replays image requests in the background: POST /cache/warm ["q:50/w:500/{base64-url}", ...]
+	warmer := newCacheWarmer(config.CacheWarmConcurrency, config.CacheWarmQueueSize, warmImage(logger, cache, config, app, counters, performance, s3cache, levels, scheduler, httpClient, origins, failures, coalescer, false))
+	app.Post("/cache/warm", handleCacheWarmRequest(logger, config, warmer))
 }
 
 //#region handleImageRequest
 
 // handleImageRequest processes image requests with path parameters
-func handleImageRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache) fiber.Handler {
+func handleImageRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, levels *tileLevelCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, failures *probeFailureCache, refresher *cacheRefresher, coalescer *requestCoalescer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		pathParams := c.Params("*")
 		logger.Info("image request received", zap.String("pathParams", pathParams), zap.String("method", c.Method()), zap.String("remote_ip", c.IP()))
 
@@ -53,7 +105,7 @@ func handleImageRequest(logger *zap.Logger, cache *ristretto.Cache[string, Cache
 
 		logger.Debug("processed image parameters", zap.Any("params", params), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
 
-		return processImageResponse(c, logger, cache, config, counters, params, s3cache)
+		return processImageResponse(c, logger, cache, config, counters, performance, params, s3cache, levels, scheduler, httpClient, origins, failures, refresher, coalescer)
 	}
 }
 
@@ -62,68 +114,150 @@ func handleImageRequest(logger *zap.Logger, cache *ristretto.Cache[string, Cache
 //#region processImageResponse
 
 // processImageResponse handles the common image processing logic
-func processImageResponse(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache) error {
+func processImageResponse(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, levels *tileLevelCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, failures *probeFailureCache, refresher *cacheRefresher, coalescer *requestCoalescer) error {
 	// If no URL is provided but a custom location is set, this is location-based retrieval only
 	if params.Url == "" && params.CustomObjectKey == "" {
 		logger.Error("neither url nor custom location provided", zap.String("custom_object_key", params.CustomObjectKey))
 		return c.Status(fiber.StatusBadRequest).SendString("neither url nor custom location provided")
 	}
 
-	cacheKey := cacheKey(params)
+	resolveSourceETag(logger, config, httpClient, params)
+	cacheKey := cacheKey(config, params)
+
+	refreshing, _ := c.Locals(cacheRefreshLocal).(bool)
 
 	cacheValue, ok := cache.Get(cacheKey)
-	if ok {
+	if !ok && !refreshing {
+		// Identical requests arriving meanwhile wait for this one and are then served what it cached
+		waited, err := coalescer.do(cacheKey, func() error {
+			return fetchAndProcessImage(c, logger, cache, config, counters, performance, params, s3cache, levels, scheduler, httpClient, origins, failures, cacheKey, nil)
+		})
+		if !waited {
+			return err
+		}
+		cacheValue, ok = cache.Get(cacheKey)
+	}
+	if ok && !cacheValue.stale() && !refreshing {
 		counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 		counters.ServedCached.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 
 		c.Set("Content-Type", cacheValue.ContentType)
+		c.Set("Cache-Control", cacheControl(config, params))
 		c.Set("X-Cache-Place", cachePlaceResponseHandler)
+		setCachedHeaders(c, cacheValue)
+		if setResponseValidators(c, cacheValue) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		// Results only held at a location have no source to refresh from
+		if params.Url != "" && refresher.due(cacheValue) {
+			refresher.refresh(cacheKey, params)
+		}
+
+		counters.ObserveServed("image", true, cacheValue.ContentType, int64(len(cacheValue.Body)))
 		return c.Send(cacheValue.Body)
 	}
 
+	// Only entries with origin validators expire while still cached, they are revalidated with a conditional GET
+	// instead of looked up in S3, which holds a copy just as old. Refreshed entries go the same way
+	var stale *CacheValue
+	if ok {
+		stale = &cacheValue
+	}
+	return fetchAndProcessImage(c, logger, cache, config, counters, performance, params, s3cache, levels, scheduler, httpClient, origins, failures, cacheKey, stale)
+}
+
+// fetchAndProcessImage answers a request whose result isn't cached, or only stale, from S3 or by fetching and
+// processing the source
+func fetchAndProcessImage(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, levels *tileLevelCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, failures *probeFailureCache, cacheKey string, stale *CacheValue) error {
 	// Try S3 cache if enabled
-	if s3cache != nil && s3cache.Enabled {
-		if params.CustomObjectKey != "" {
-			if s3val, err := s3cache.GetAtLocation(context.Background(), params.CustomObjectKey); err == nil && s3val != nil {
+	backend := s3cache.backend()
+	if backend != nil && stale == nil {
+		// Tiles and overviews are keyed by cacheKey, the bare location only holds the regular output
+		if params.CustomObjectKey != "" && !params.Tiled {
+			if s3val, err := backend.GetAtLocation(context.Background(), params.CustomObjectKey); err == nil && s3val != nil {
 				counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 				counters.ServedCached.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 				c.Set("Content-Type", s3val.ContentType)
+				c.Set("Cache-Control", cacheControl(config, params))
 				c.Set("X-Cache-Place", cachePlaceS3CacheLocation)
+				setCachedHeaders(c, *s3val)
 				logger.Debug("image served from S3 cache location", zap.String("s3_location", params.CustomObjectKey), zap.String("content_type", s3val.ContentType), zap.String("url", params.Url))
+				s3val.ETag = contentETag(cacheKey, s3val.Body)
+				if setResponseValidators(c, *s3val) {
+					return c.SendStatus(fiber.StatusNotModified)
+				}
+				counters.ObserveServed("image", true, s3val.ContentType, int64(len(s3val.Body)))
 				return c.Send(s3val.Body)
 			}
 		}
 
-		if params.Url != "" {
-			if s3val, err := s3cache.Get(context.Background(), cacheKey); err == nil && s3val != nil {
-				counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
-				counters.ServedCached.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
-				c.Set("Content-Type", s3val.ContentType)
-				c.Set("X-Cache-Place", cachePlaceS3Cache)
-				// backfill in-memory cache
-				cache.SetWithTTL(cacheKey, *s3val, 1000, time.Duration(config.CacheTTL)*time.Second)
-				logger.Debug("image served from S3 cache", zap.String("cache_key", cacheKey), zap.String("content_type", s3val.ContentType), zap.String("url", params.Url))
-				return c.Send(s3val.Body)
-			} else if err != nil {
-				logger.Debug("S3 cache lookup failed", zap.String("cache_key", cacheKey), zap.Error(err), zap.String("url", params.Url))
+		if s3val, err := backend.Get(context.Background(), cacheKey); err == nil && s3val != nil {
+			counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+			counters.ServedCached.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+			c.Set("Content-Type", s3val.ContentType)
+			c.Set("Cache-Control", cacheControl(config, params))
+			c.Set("X-Cache-Place", cachePlaceS3Cache)
+			setCachedHeaders(c, *s3val)
+			// backfill in-memory cache, the ETag isn't kept in S3 and is computed once here
+			s3val.ETag = contentETag(cacheKey, s3val.Body)
+			s3val.Stored = time.Now()
+			cache.SetWithTTL(cacheKey, *s3val, 1000, cacheTTL(config))
+			logger.Debug("image served from S3 cache", zap.String("cache_key", cacheKey), zap.String("content_type", s3val.ContentType), zap.String("url", params.Url))
+			if setResponseValidators(c, *s3val) {
+				return c.SendStatus(fiber.StatusNotModified)
 			}
+			counters.ObserveServed("image", true, s3val.ContentType, int64(len(s3val.Body)))
+			return c.Send(s3val.Body)
+		} else if err != nil {
+			logger.Debug("S3 cache lookup failed", zap.String("cache_key", cacheKey), zap.Error(err), zap.String("url", params.Url))
 		}
 	}
 
+	// Tiles of an already decoded level don't need the source at all
+	if params.Tiled {
+		if level, ok := levels.get(params, params.TileZ); ok {
+			return processTile(c, logger, cache, config, counters, performance, params, backend, level)
+		}
+	}
+
+	processingBody, parsedContentType, notModified, err := fetchImageSource(c, logger, config, counters, params, s3cache, httpClient, origins, failures, stale)
+	if notModified {
+		return serveRevalidatedImage(c, logger, cache, config, counters, params, cacheKey, *stale)
+	}
+	if processingBody == nil {
+		return err
+	}
+
+	return processImageData(c, logger, cache, config, counters, performance, params, processingBody, parsedContentType, backend, levels, scheduler)
+}
+
+// fetchImageSource reads the source of an image request from its S3 location or origin and returns it with its content
+// type. A stale entry is revalidated with a conditional GET, the bool reports that the origin answered 304 for it.
+// On failure the request has been answered and the body is nil
+func fetchImageSource(c *fiber.Ctx, logger *zap.Logger, config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache, httpClient *http.Client, origins *OriginRateLimiter, failures *probeFailureCache, stale *CacheValue) ([]byte, string, bool, error) {
 	var processingBody []byte
 	var parsedContentType string
 
 	if params.CustomObjectKey != "" {
+		// Sources at a location are read from the bucket, a file cache has none
+		if s3cache == nil || !s3cache.Enabled || s3cache.Client == nil {
+			logger.Error("S3 storage is not enabled or configured", zap.String("custom_object_key", params.CustomObjectKey))
+			return nil, "", false, c.Status(fiber.StatusServiceUnavailable).SendString("S3 storage unavailable")
+		}
+
 		object, err := s3cache.Client.GetObject(context.Background(), s3cache.Bucket, params.CustomObjectKey, minio.GetObjectOptions{})
 		if err != nil {
 			logger.Error("failed to get object from S3", zap.String("custom_object_key", params.CustomObjectKey), zap.Error(err))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to get object from S3")
+			counters.OriginErrors.WithLabelValues("image", "s3").Inc()
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to get object from S3")
 		}
 
 		stat, err := object.Stat()
 		if err != nil {
 			logger.Error("failed to stat object from S3", zap.String("custom_object_key", params.CustomObjectKey), zap.Error(err))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to stat object from S3")
+			counters.OriginErrors.WithLabelValues("image", "s3").Inc()
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to stat object from S3")
 		}
 
 		processingBody, err = io.ReadAll(object)
@@ -132,12 +266,53 @@ func processImageResponse(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cac
 		// If no URL is provided at this point, we can't fetch from remote
 
 		logger.Error("no URL provided and no valid S3 location", zap.String("custom_object_key", params.CustomObjectKey))
-		return c.Status(fiber.StatusBadRequest).SendString("no URL or valid location provided")
+		return nil, "", false, c.Status(fiber.StatusBadRequest).SendString("no URL or valid location provided")
 	} else {
-		response, err := client.GetHTTPClient().Get(params.Url)
+		if failure, ok := failures.get(params.Url); ok {
+			logger.Info("origin fetch failed recently, not fetching it again", zap.String("url", params.Url), zap.Int("status", failure.Status))
+			return nil, "", false, c.Status(failure.Status).SendString(failure.Message)
+		}
+		// fail answers with a failure that would come again on a retry and remembers it for the URL
+		fail := func(status int, message string) ([]byte, string, bool, error) {
+			failures.add(params.Url, probeFailure{Status: status, Message: message})
+			return nil, "", false, c.Status(status).SendString(message)
+		}
+
+		if allowed, retryAfter := origins.allow(params.Hostname); !allowed {
+			return nil, "", false, sendOriginRateLimited(c, logger, params.Hostname, retryAfter)
+		}
+
+		// The client doesn't limit reading the body, the whole fetch gets APP_HTTP_TIMEOUT_SECONDS
+		ctx := context.Background()
+		if config.HTTPTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration(config.HTTPTimeout)*time.Second)
+			defer cancel()
+		}
+
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, params.Url, nil)
+		if err != nil {
+			logger.Error("failed to create request", zap.Error(err), zap.String("url", params.Url))
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to fetch image")
+		}
+		request.Header.Set("Accept-Encoding", acceptedEncodings)
+		if stale != nil {
+			if stale.OriginETag != "" {
+				request.Header.Set("If-None-Match", stale.OriginETag)
+			}
+			if stale.OriginLastModified != "" {
+				request.Header.Set("If-Modified-Since", stale.OriginLastModified)
+			}
+		}
+
+		response, err := httpClient.Do(request)
+		if refusedFetchMessage(err) != "" {
+			return nil, "", false, sendRefusedFetch(c, logger, params.Url, err)
+		}
 		if err != nil {
 			logger.Error("failed to fetch image", zap.Error(err), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch image")
+			counters.OriginErrors.WithLabelValues("image", metrics.CleanHostname(params.Hostname)).Inc()
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to fetch image")
 		}
 		defer func() {
 			if closeErr := response.Body.Close(); closeErr != nil {
@@ -145,31 +320,89 @@ func processImageResponse(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cac
 			}
 		}()
 
+		if stale != nil && response.StatusCode == http.StatusNotModified {
+			return nil, "", true, nil
+		}
+
+		if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+			logger.Error("image not found at origin", zap.Int("status", response.StatusCode), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
+			return fail(fiber.StatusNotFound, "image not found at origin")
+		}
+
 		responseContentType := response.Header.Get("Content-Type")
 		if responseContentType == "" {
 			logger.Error("no content type received from remote", zap.String("url", params.Url), zap.String("hostname", params.Hostname))
-			return c.Status(fiber.StatusForbidden).SendString("no content type received")
+			return fail(fiber.StatusForbidden, "no content type received")
 		}
 
-		parsedContentType, _, err := mime.ParseMediaType(responseContentType)
+		parsedContentType, _, err = mime.ParseMediaType(responseContentType)
 		if err != nil {
 			logger.Error("failed to parse content type", zap.String("content_type", responseContentType), zap.Error(err), zap.String("url", params.Url))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to parse content type")
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to parse content type")
 		}
 
 		if !validation.IsImageMime(parsedContentType) {
 			logger.Error("invalid image mime type", zap.String("mime_type", parsedContentType), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
-			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("content type '%s' is not allowed", parsedContentType))
+			return fail(fiber.StatusForbidden, fmt.Sprintf("content type '%s' is not allowed", parsedContentType))
 		}
 
-		processingBody, err = io.ReadAll(response.Body)
+		body, err := decodedBody(response)
+		if err != nil {
+			logger.Error("failed to decode origin response", zap.Error(err), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
+			counters.OriginErrors.WithLabelValues("image", metrics.CleanHostname(params.Hostname)).Inc()
+			return nil, "", false, c.Status(fiber.StatusBadGateway).SendString(fmt.Sprintf("origin response can't be decoded: %v", err))
+		}
+
+		processingBody, err = io.ReadAll(body)
 		if err != nil {
 			logger.Error("failed to read response body", zap.Error(err), zap.String("url", params.Url), zap.String("hostname", params.Hostname))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to read response body")
+			counters.OriginErrors.WithLabelValues("image", metrics.CleanHostname(params.Hostname)).Inc()
+			return nil, "", false, c.Status(fiber.StatusInternalServerError).SendString("failed to read response body")
+		}
+
+		if etag, lastModified := response.Header.Get("ETag"), response.Header.Get("Last-Modified"); etag != "" || lastModified != "" {
+			c.Locals(originValidatorsLocal, originValidators{ETag: etag, LastModified: lastModified})
+		}
+		// The source changed after the HEAD, the result is keyed by what was fetched
+		if etag := strongETag(response.Header); params.SourceETag != "" && etag != "" {
+			params.SourceETag = etag
 		}
 	}
 
-	return processImageData(c, logger, cache, config, counters, params, processingBody, parsedContentType, s3cache)
+	// An empty body can't be decoded, and mustn't end up cached as the result
+	if len(processingBody) == 0 {
+		logger.Error("empty origin response", zap.String("url", params.Url), zap.String("custom_object_key", params.CustomObjectKey))
+		if params.CustomObjectKey != "" {
+			counters.OriginErrors.WithLabelValues("image", "s3").Inc()
+		} else {
+			counters.OriginErrors.WithLabelValues("image", metrics.CleanHostname(params.Hostname)).Inc()
+		}
+		return nil, "", false, c.Status(fiber.StatusBadGateway).SendString(emptyOriginResponse)
+	}
+
+	return processingBody, parsedContentType, false, nil
+}
+
+// serveRevalidatedImage serves an expired entry the origin reported as unchanged and keeps it for another TTL
+func serveRevalidatedImage(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, cacheKey string, value CacheValue) error {
+	value.Stored = time.Now()
+	value.Expires = value.Stored.Add(cacheTTL(config))
+	cache.SetWithTTL(cacheKey, value, 1000, cacheTTL(config)+time.Duration(config.CacheRevalidateTTL)*time.Second)
+
+	counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	counters.ServedCached.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+
+	c.Set("Content-Type", value.ContentType)
+	c.Set("Cache-Control", cacheControl(config, params))
+	c.Set("X-Cache-Place", cachePlaceRevalidated)
+	setCachedHeaders(c, value)
+	logger.Debug("image revalidated with origin", zap.String("cache_key", cacheKey), zap.String("url", params.Url))
+	if setResponseValidators(c, value) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	counters.ObserveServed("image", true, value.ContentType, int64(len(value.Body)))
+	return c.Send(value.Body)
 }
 
 //#endregion
@@ -177,58 +410,184 @@ func processImageResponse(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cac
 //#region processImageData
 
 // processImageData handles the actual image processing and encoding
-func processImageData(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, imageData []byte, contentType string, s3cache *S3Cache) error {
-	cacheKey := cacheKey(params)
+func processImageData(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, imageData []byte, contentType string, backend CacheBackend, levels *tileLevelCache, scheduler *WorkScheduler) error {
+	cacheKey := cacheKey(config, params)
+	applyFormatInterpolation(config, params, contentType)
 
-	// Early return for unmodified images (no quality change, no webp, no resize, no scale)
-	if params.Quality == 100 && !params.Webp && params.Width == 0 && params.Height == 0 && params.Scale == 0 {
-		c.Set("Content-Type", contentType)
-		c.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.HTTPCacheTTL))
-
-		value := CacheValue{
-			Body:        imageData,
-			ContentType: contentType,
-		}
-		cache.SetWithTTL(cacheKey, value, 1000, time.Duration(config.CacheTTL)*time.Second)
-		// store in S3 asynchronously
-		if s3cache != nil && s3cache.Enabled {
-			if params.CustomObjectKey != "" {
-				// store at explicit location
-				go func() {
-					if err := s3cache.PutAtLocation(context.Background(), params.CustomObjectKey, value.Body, value.ContentType); err != nil {
-						logger.Error("failed to store unmodified image in S3 cache at location", zap.Error(err), zap.String("s3_location", params.CustomObjectKey), zap.String("content_type", contentType), zap.String("url", params.Url))
-					}
-				}()
-			} else {
-				go func() {
-					if err := s3cache.Put(context.Background(), cacheKey, value.Body, value.ContentType); err != nil {
-						logger.Error("failed to store unmodified image in S3 cache", zap.Error(err), zap.String("cache_key", cacheKey), zap.String("content_type", contentType), zap.String("url", params.Url))
-					}
-				}()
+	if validation.IsHeicMime(contentType) && !config.HeicEnabled {
+		logger.Error("heic decoding is disabled", zap.String("content_type", contentType), zap.String("url", params.Url))
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString(fmt.Sprintf("content type '%s' is not supported", contentType))
+	}
+
+	if params.Tiled {
+		release, err := acquireImageWorker(scheduler, config, imageData, contentType)
+		if err != nil {
+			return sendBusy(c, logger, err)
+		}
+		defer release()
+
+		level, status, err := decodeTileLevel(levels, config, performance, params, imageData, contentType)
+		if err != nil {
+			logger.Error("failed to render tile level", zap.Error(err), zap.Int("z", params.TileZ), zap.String("content_type", contentType), zap.String("url", params.Url))
+			return c.Status(status).SendString(err.Error())
+		}
+		return processTile(c, logger, cache, config, counters, performance, params, backend, level)
+	}
+
+	// Oversized sources are served as a downscaled overview when tiling is enabled
+	overview := false
+	if config.TilingEnabled && params.Width == 0 && params.Height == 0 && params.Scale == 0 {
+		if width, height, err := readImageDimensions(imageData, contentType); err == nil {
+			overview = needsOverview(width, height, config.TilingOverviewSize)
+			if overview && exceedsPixelLimit(width, height, config.TilingMaxPixels) {
+				logger.Error("image is too large for an overview", zap.Int("width", width), zap.Int("height", height), zap.String("url", params.Url))
+				return c.Status(fiber.StatusRequestEntityTooLarge).SendString("image is too large to decode")
 			}
 		}
+	}
 
-		logger.Debug("unmodified image served successfully", zap.String("content_type", contentType), zap.String("origin", params.Hostname), zap.String("url", params.Url), zap.String("cache_key", cacheKey))
-		counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
-		return c.Send(imageData)
+	// Early return for unmodified images (no quality change, no webp, no resize, no scale)
+	// HEIC is never passed through as is, since most clients are unable to display it; auto WebP needs the decoded image to compare
+	autoWebp := config.WebpAuto && webpAutoCandidate(contentType)
+	if params.Quality == 100 && !params.Webp && !autoWebp && params.Width == 0 && params.Height == 0 && params.Scale == 0 && !overview && !validation.IsHeicMime(contentType) {
+		// Sources whose header can't be read go without the dimensions rather than being decoded for them
+		if width, height, err := readImageDimensions(imageData, contentType); err == nil {
+			c.Locals(sourceDimensionsLocal, image.Pt(width, height))
+		}
+		return storeAndSendImage(c, logger, cache, config, counters, params, backend, cacheKey, CacheValue{Body: imageData, ContentType: contentType}, params.CustomObjectKey != "")
 	}
 
 	// Process image only when modifications are needed
-	img, err := readImageSlice(imageData, contentType)
+	release, err := acquireImageWorker(scheduler, config, imageData, contentType)
+	if err != nil {
+		return sendBusy(c, logger, err)
+	}
+	defer release()
+
+	done := metrics.TimeImageOperation("decode", performance)
+	img, err := readImageSliceTimeout(imageData, contentType, config.EncoderThreads, time.Duration(config.DecodeTimeout)*time.Second)
+	done()
+	if errors.Is(err, errDecodeTimeout) {
+		logger.Error("image decode timed out", zap.String("content_type", contentType), zap.String("url", params.Url), zap.Int("image_size", len(imageData)))
+		return c.Status(fiber.StatusUnprocessableEntity).SendString("image decode timed out")
+	}
+	if errors.Is(err, errUnsupportedFormat) {
+		logger.Warn("image format can't be decoded", zap.Error(err), zap.String("content_type", contentType), zap.String("url", params.Url))
+		return c.Status(fiber.StatusUnsupportedMediaType).SendString(fmt.Sprintf("content type '%s' is not supported", contentType))
+	}
+	if errors.Is(err, errUnreadableImage) {
+		logger.Warn("source image is unreadable", zap.Error(err), zap.String("content_type", contentType), zap.String("url", params.Url), zap.Int("image_size", len(imageData)))
+		return c.Status(fiber.StatusUnprocessableEntity).SendString("source image can't be decoded")
+	}
 	if err != nil {
 		logger.Error("failed to read image", zap.Error(err), zap.String("content_type", contentType), zap.String("url", params.Url), zap.Int("image_size", len(imageData)))
 		return c.Status(fiber.StatusInternalServerError).SendString("failed to read image")
 	}
 
+	c.Locals(sourceDimensionsLocal, img.Bounds().Size())
+
+	if overview {
+		done := metrics.TimeImageOperation("overview", performance)
+		img = renderOverview(img, config.TilingOverviewSize, params.Interpolation)
+		done()
+	}
+
+	// HEIC and overviews can't reuse the original bytes
+	var original []byte
+	if !validation.IsHeicMime(contentType) && !overview {
+		original = imageData
+	}
+
+	// Overviews are derived from the location, they must not overwrite the output stored there
+	return transformAndSendImage(c, logger, cache, config, counters, performance, params, backend, img, contentType, original, params.CustomObjectKey != "" && !overview)
+}
+
+// decodeTileLevel decodes the source and renders the requested pyramid level.
+// TIFF and other formats have no region decode here, so the whole source is decoded once and its levels are cached;
+// sources above APP_TILING_MAX_PIXELS are rejected before decoding. Returns the HTTP status to respond with on error.
+func decodeTileLevel(levels *tileLevelCache, config *config.Config, performance *metrics.PerformanceMetrics, params *validation.ImageContext, imageData []byte, contentType string) (tileLevel, int, error) {
+	width, height, err := readImageDimensions(imageData, contentType)
+	if err != nil {
+		return tileLevel{}, fiber.StatusInternalServerError, fmt.Errorf("failed to read image dimensions: %w", err)
+	}
+
+	if exceedsPixelLimit(width, height, config.TilingMaxPixels) {
+		return tileLevel{}, fiber.StatusRequestEntityTooLarge, fmt.Errorf("image is too large to decode")
+	}
+
+	maxLevel := tileMaxLevel(image.Rect(0, 0, width, height), config.TileSize)
+	if params.TileZ > maxLevel {
+		return tileLevel{}, fiber.StatusBadRequest, fmt.Errorf("tile level %d exceeds maximum level %d", params.TileZ, maxLevel)
+	}
+
+	// Reuse the full resolution level when another level of the same source was requested before
+	full, ok := levels.get(params, maxLevel)
+	if !ok {
+		done := metrics.TimeImageOperation("decode", performance)
+		img, err := readImageSliceTimeout(imageData, contentType, config.EncoderThreads, time.Duration(config.DecodeTimeout)*time.Second)
+		done()
+		if err != nil {
+			return tileLevel{}, decodeErrorStatus(err), fmt.Errorf("failed to read image: %w", err)
+		}
+		full = tileLevel{Image: img, ContentType: contentType}
+		levels.set(params, maxLevel, full)
+	}
+
+	done := metrics.TimeImageOperation("tile-level", performance)
+	img, err := tileLevelImage(full.Image, config.TileSize, params.TileZ, params.Interpolation)
+	done()
+	if err != nil {
+		return tileLevel{}, fiber.StatusBadRequest, err
+	}
+
+	level := tileLevel{Image: img, ContentType: contentType}
+	if params.TileZ != maxLevel {
+		levels.set(params, params.TileZ, level)
+	}
+
+	return level, fiber.StatusOK, nil
+}
+
+// processTile crops the requested tile out of a decoded level and sends it
+func processTile(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, backend CacheBackend, level tileLevel) error {
+	tile, err := cropTile(level.Image, config.TileSize, params.TileX, params.TileY)
+	if err != nil {
+		logger.Error("failed to render tile", zap.Error(err), zap.Int("z", params.TileZ), zap.Int("x", params.TileX), zap.Int("y", params.TileY), zap.String("url", params.Url))
+		return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+	}
+
+	// Tiles are derived from the location, they must not overwrite the output stored there
+	return transformAndSendImage(c, logger, cache, config, counters, performance, params, backend, tile, level.ContentType, nil, false)
+}
+
+// transformAndSendImage applies the requested resize and scale, encodes and sends the image.
+// original holds the source bytes when they may be sent as is, nil forces the image to be encoded.
+func transformAndSendImage(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, backend CacheBackend, img image.Image, contentType string, original []byte, atLocation bool) error {
+	cacheKey := cacheKey(config, params)
+	quality := outputQuality(config, params.Quality, contentType)
+
+	var err error
 	if params.Width > 0 || params.Height > 0 {
-		img, err = resizeImage(img, params.Width, params.Height, params.Interpolation)
+		done := metrics.TimeImageOperation("resize", performance)
+		img, err = resizeImage(img, params.Width, params.Height, params.Interpolation, newOutputLimits(config))
+		done()
+		if errors.Is(err, errOutputTooLarge) {
+			logger.Warn("resized image is too large", zap.Int("width", params.Width), zap.Int("height", params.Height), zap.String("url", params.Url))
+			return c.Status(fiber.StatusBadRequest).SendString(newOutputLimits(config).message())
+		}
 		if err != nil {
 			logger.Error("failed to resize image", zap.Error(err), zap.Int("width", params.Width), zap.Int("height", params.Height), zap.Int("interpolation", int(params.Interpolation)), zap.String("url", params.Url))
 		}
 	}
 
 	if params.Scale > 0 {
-		img, err = rescaleImage(img, params.Scale)
+		done := metrics.TimeImageOperation("rescale", performance)
+		img, err = rescaleImage(img, params.Scale, newOutputLimits(config))
+		done()
+		if errors.Is(err, errOutputTooLarge) {
+			logger.Warn("rescaled image is too large", zap.Float64("scale", params.Scale), zap.String("url", params.Url))
+			return c.Status(fiber.StatusBadRequest).SendString(newOutputLimits(config).message())
+		}
 		if err != nil {
 			logger.Error("failed to rescale image", zap.Error(err), zap.Float64("scale", params.Scale), zap.String("url", params.Url))
 		}
@@ -236,81 +595,126 @@ func processImageData(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[s
 
 	// Only encode to WebP if explicitly requested
 	if params.Webp {
-		c.Set("Content-Type", "image/webp")
-		c.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.HTTPCacheTTL))
-
 		buf := pool.GetBuffer()
 		defer pool.PutBuffer(buf)
 
-		options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(params.Quality))
+		options, err := newWebpEncoderOptions(quality, webpMethod(config, params), config.EncoderThreads)
 		if err != nil {
 			logger.Error("failed to create webp encoder options", zap.Error(err), zap.Int("quality", params.Quality), zap.String("url", params.Url))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to create webp encoder options")
 		}
+		done := metrics.TimeImageOperation("webp-encode", performance)
 		err = webp.Encode(buf, img, options)
+		done()
 		if err != nil {
 			logger.Error("failed to encode image to webp", zap.Error(err), zap.Int("quality", params.Quality), zap.String("url", params.Url))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to encode image")
 		}
 
-		value := CacheValue{Body: buf.Bytes(), ContentType: "image/webp"}
-		cache.SetWithTTL(cacheKey, value, 1000, time.Duration(config.CacheTTL)*time.Second)
-		if s3cache != nil && s3cache.Enabled {
-			data := make([]byte, len(value.Body))
-			copy(data, value.Body)
-			if params.CustomObjectKey != "" {
-				go func() {
-					if err := s3cache.PutAtLocation(context.Background(), params.CustomObjectKey, data, value.ContentType); err != nil {
-						logger.Error("failed to store webp image in S3 cache at location", zap.Error(err), zap.String("s3_location", params.CustomObjectKey), zap.String("url", params.Url))
-					}
-				}()
-			} else {
-				go func() {
-					if err := s3cache.Put(context.Background(), cacheKey, data, value.ContentType); err != nil {
-						logger.Error("failed to store webp image in S3 cache", zap.Error(err), zap.String("cache_key", cacheKey), zap.String("url", params.Url))
-					}
-				}()
-			}
+		return storeAndSendImage(c, logger, cache, config, counters, params, backend, cacheKey, CacheValue{Body: buf.Bytes(), ContentType: "image/webp"}, atLocation)
+	}
+
+	// Use original format with quality adjustment
+	// For now, just return the processed image as the original format
+	// TODO: Implement quality adjustment for other formats
+	value := CacheValue{Body: original, ContentType: contentType}
+	if original == nil {
+		// Keep the source format where possible
+		format := processedImageFormat(contentType, img)
+
+		buf := pool.GetBuffer()
+		defer pool.PutBuffer(buf)
+
+		done := metrics.TimeImageOperation(strings.TrimPrefix(format, "image/")+"-encode", performance)
+		err = encodeProcessedImage(buf, img, format, quality, webpMethod(config, params), config.EncoderThreads, config.JPEGProgressive)
+		done()
+		if err != nil {
+			logger.Error("failed to encode image", zap.Error(err), zap.String("format", format), zap.Int("quality", params.Quality), zap.String("url", params.Url))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to encode image")
 		}
 
-		logger.Info("image served successfully", zap.String("content_type", "image/webp"), zap.String("origin", params.Hostname), zap.String("url", params.Url), zap.String("cache_key", cacheKey))
+		value = CacheValue{Body: buf.Bytes(), ContentType: format}
+	}
 
-		counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	// Auto WebP replaces the result only when it is smaller, the winner is cached under the same key
+	if config.WebpAuto && webpAutoCandidate(value.ContentType) && !exceedsPixelLimit(img.Bounds().Dx(), img.Bounds().Dy(), config.WebpAutoMaxPixels) {
+		buf := pool.GetBuffer()
+		defer pool.PutBuffer(buf)
 
-		return c.Send(buf.Bytes())
-	} else {
-		// Use original format with quality adjustment
-		c.Set("Content-Type", contentType)
-		c.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.HTTPCacheTTL))
-
-		// For now, just return the processed image as the original format
-		// TODO: Implement quality adjustment for other formats
-		value := CacheValue{Body: imageData, ContentType: contentType}
-		cache.SetWithTTL(cacheKey, value, 1000, time.Duration(config.CacheTTL)*time.Second)
-		if s3cache != nil && s3cache.Enabled {
-			data := make([]byte, len(value.Body))
-			copy(data, value.Body)
-			if params.CustomObjectKey != "" {
-				go func() {
-					if err := s3cache.PutAtLocation(context.Background(), params.CustomObjectKey, data, value.ContentType); err != nil {
-						logger.Error("failed to store image in S3 cache at location", zap.Error(err), zap.String("s3_location", params.CustomObjectKey), zap.String("content_type", contentType), zap.String("url", params.Url))
-					}
-				}()
-			} else {
-				go func() {
-					if err := s3cache.Put(context.Background(), cacheKey, data, value.ContentType); err != nil {
-						logger.Error("failed to store image in S3 cache", zap.Error(err), zap.String("cache_key", cacheKey), zap.String("content_type", contentType), zap.String("url", params.Url))
-					}
-				}()
-			}
+		options, err := newWebpEncoderOptions(quality, webpMethod(config, params), config.EncoderThreads)
+		if err == nil {
+			done := metrics.TimeImageOperation("webp-encode", performance)
+			err = webp.Encode(buf, img, options)
+			done()
+		}
+		if err != nil {
+			logger.Warn("failed to encode auto webp candidate", zap.Error(err), zap.Int("quality", params.Quality), zap.String("url", params.Url))
+		} else if webpWins(buf.Len(), len(value.Body), config.WebpAutoMargin) {
+			value = CacheValue{Body: buf.Bytes(), ContentType: "image/webp"}
 		}
+	}
 
-		logger.Info("image served successfully", zap.String("content_type", contentType), zap.String("origin", params.Hostname), zap.String("url", params.Url), zap.String("cache_key", cacheKey))
+	return storeAndSendImage(c, logger, cache, config, counters, params, backend, cacheKey, value, atLocation)
+}
 
-		counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+// storeAndSendImage caches a processed image in memory and (asynchronously) in the backend when there is one, then sends it.
+// The body is copied first since encoders write into pooled buffers that are reused after the response.
+// atLocation stores the result at the requested location instead of under cacheKey.
+func storeAndSendImage(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, backend CacheBackend, cacheKey string, value CacheValue, atLocation bool) error {
+	value.Body = bytes.Clone(value.Body)
 
-		return c.Send(imageData)
+	c.Set("Content-Type", value.ContentType)
+	c.Set("Cache-Control", cacheControl(config, params))
+
+	value.ETag = contentETag(cacheKey, value.Body)
+	value.Stored = time.Now()
+
+	if dimensions, ok := c.Locals(sourceDimensionsLocal).(image.Point); ok {
+		value.Headers = map[string]string{
+			"X-Image-Width":  strconv.Itoa(dimensions.X),
+			"X-Image-Height": strconv.Itoa(dimensions.Y),
+		}
+	}
+	setCachedHeaders(c, value)
+
+	// Results of sources with validators are kept past their TTL, so they can be revalidated instead of fetched again
+	ttl := cacheTTL(config)
+	if validators, ok := c.Locals(originValidatorsLocal).(originValidators); ok {
+		value.OriginETag = validators.ETag
+		value.OriginLastModified = validators.LastModified
+		if config.CacheTTL > 0 {
+			value.Expires = time.Now().Add(ttl)
+			ttl += time.Duration(config.CacheRevalidateTTL) * time.Second
+		}
+	}
+
+	cache.SetWithTTL(cacheKey, value, 1000, ttl)
+	if backend != nil {
+		if atLocation {
+			// store at explicit location
+			go func() {
+				if err := backend.PutAtLocation(context.Background(), params.CustomObjectKey, value.Body, value.ContentType); err != nil {
+					logger.Error("failed to store image in S3 cache at location", zap.Error(err), zap.String("s3_location", params.CustomObjectKey), zap.String("content_type", value.ContentType), zap.String("url", params.Url))
+				}
+			}()
+		} else {
+			go func() {
+				if err := backend.PutValue(context.Background(), cacheKey, value); err != nil {
+					logger.Error("failed to store image in S3 cache", zap.Error(err), zap.String("cache_key", cacheKey), zap.String("content_type", value.ContentType), zap.String("url", params.Url))
+				}
+			}()
+		}
 	}
+
+	logger.Info("image served successfully", zap.String("content_type", value.ContentType), zap.String("origin", params.Hostname), zap.String("url", params.Url), zap.String("cache_key", cacheKey))
+
+	counters.SuccessfullyServed.WithLabelValues("image", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	if setResponseValidators(c, value) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	counters.ObserveServed("image", false, value.ContentType, int64(len(value.Body)))
+	return c.Send(value.Body)
 }
 
 //#endregion
@@ -319,8 +723,10 @@ func processImageData(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[s
 
 // handleImageUpload processes image upload requests with path parameters
 // Requires: token (in path parameters), optional location and signature for S3 upload
-func handleImageUpload(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache) fiber.Handler {
+func handleImageUpload(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, scheduler *WorkScheduler) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		logger.Info("image upload request received")
 
 		pathParams := c.Params("*")
@@ -329,6 +735,16 @@ func handleImageUpload(logger *zap.Logger, cache *ristretto.Cache[string, CacheV
 			return c.Status(fiber.StatusBadRequest).SendString("failed to get image file")
 		}
 
+		// Validate file size
+		var maxSizeBytes int64
+		if config.MaxImageSize > 0 {
+			maxSizeBytes = int64(config.MaxImageSize) * 1024 * 1024
+			if body.Size > maxSizeBytes {
+				logger.Error("image file too large", zap.Int64("size", body.Size), zap.Int("maxMB", config.MaxImageSize))
+				return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("image file exceeds maximum size of %d MB", config.MaxImageSize))
+			}
+		}
+
 		imageFile, err := body.Open()
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).SendString("failed to open image file")
@@ -362,12 +778,21 @@ func handleImageUpload(logger *zap.Logger, cache *ristretto.Cache[string, CacheV
 			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("content type '%s' is not allowed", parsedContentType))
 		}
 
-		requestBody, err := io.ReadAll(imageFile)
+		// The reported size isn't trusted, reading stops one byte past the limit
+		var reader io.Reader = imageFile
+		if maxSizeBytes > 0 {
+			reader = io.LimitReader(imageFile, maxSizeBytes+1)
+		}
+		requestBody, err := io.ReadAll(reader)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to read image file")
 		}
+		if maxSizeBytes > 0 && int64(len(requestBody)) > maxSizeBytes {
+			logger.Error("image file too large", zap.Int("maxMB", config.MaxImageSize))
+			return c.Status(fiber.StatusRequestEntityTooLarge).SendString(fmt.Sprintf("image file exceeds maximum size of %d MB", config.MaxImageSize))
+		}
 
-		return processImageData(c, logger, cache, config, counters, params, requestBody, parsedContentType, s3cache)
+		return processImageData(c, logger, cache, config, counters, performance, params, requestBody, parsedContentType, s3cache.backend(), nil, scheduler)
 	}
 }
 
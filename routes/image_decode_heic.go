@@ -0,0 +1,117 @@
+//go:build !nolibav
+
+package routes
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/asticode/go-astiav"
+)
+
+// decodeHeic decodes the primary image of a HEIC/HEIF or AVIF container.
+// The container is parsed in Go so grid images (the default for iOS camera photos) are reassembled from their tiles,
+// ffmpeg is only used to decode the individual HEVC or AV1 items.
+func decodeHeic(r io.Reader, threads int) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read heic data: %w", err)
+	}
+
+	heif, err := parseHeif(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse heif container: %w", errUnreadableImage, err)
+	}
+
+	var img image.Image
+	if heif.Grid == nil {
+		img, err = decodeHeifItem(heif.Primary, threads)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tiles := make([]image.Image, len(heif.Tiles))
+		for i, tile := range heif.Tiles {
+			tiles[i], err = decodeHeifItem(tile, threads)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode grid tile %d: %w", i, err)
+			}
+		}
+
+		img, err = composeHeifGrid(heif.Grid, tiles)
+		if err != nil {
+			return unreadable(nil, err)
+		}
+	}
+
+	return rotateQuarterTurns(img, heif.Primary.Rotation), nil
+}
+
+// decodeHeifItem decodes a single hvc1 or av01 item, its payload is one access unit described by the hvcC or av1C record
+func decodeHeifItem(item *heifItem, threads int) (image.Image, error) {
+	if len(item.Config) == 0 || len(item.Data) == 0 {
+		return nil, fmt.Errorf("%w: item %d has no decoder configuration or data", errUnreadableImage, item.ID)
+	}
+
+	var codec *astiav.Codec
+	switch item.Type {
+	case "hvc1":
+		codec = astiav.FindDecoder(astiav.CodecIDHevc)
+	case "av01":
+		// The native av1 decoder only drives hardware decoding, dav1d decodes in software
+		if codec = astiav.FindDecoderByName("libdav1d"); codec == nil {
+			codec = astiav.FindDecoder(astiav.CodecIDAv1)
+		}
+	default:
+		return nil, fmt.Errorf("%w: item type %q", errUnsupportedFormat, item.Type)
+	}
+	if codec == nil {
+		return nil, fmt.Errorf("%w: no %s decoder in ffmpeg", errUnsupportedFormat, item.Type)
+	}
+
+	codecContext := astiav.AllocCodecContext(codec)
+	if codecContext == nil {
+		return nil, fmt.Errorf("failed to allocate codec context")
+	}
+	defer codecContext.Free()
+
+	// The hvcC record carries the parameter sets and the NAL length size, the av1C record the sequence header
+	if err := codecContext.SetExtraData(item.Config); err != nil {
+		return nil, fmt.Errorf("failed to set decoder configuration: %w", err)
+	}
+
+	// Limit decoder threads so concurrent requests don't oversubscribe the CPU
+	if threads > 0 {
+		codecContext.SetThreadCount(threads)
+	}
+
+	if err := codecContext.Open(codec, nil); err != nil {
+		return nil, fmt.Errorf("failed to open codec: %w", err)
+	}
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	if err := packet.FromData(item.Data); err != nil {
+		return nil, fmt.Errorf("failed to create packet: %w", err)
+	}
+
+	if err := codecContext.SendPacket(packet); err != nil {
+		return nil, fmt.Errorf("%w: failed to send packet: %w", errUnreadableImage, err)
+	}
+
+	// Still images are a single access unit, flush the decoder to get it out
+	if err := codecContext.SendPacket(nil); err != nil {
+		return nil, fmt.Errorf("failed to flush decoder: %w", err)
+	}
+
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+
+	if err := codecContext.ReceiveFrame(frame); err != nil {
+		return nil, fmt.Errorf("%w: failed to receive frame: %w", errUnreadableImage, err)
+	}
+
+	return frameToImage(frame)
+}
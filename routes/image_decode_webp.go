@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+
+	"github.com/kolesa-team/go-webp/decoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+// decodeWebp decodes a WebP. libwebp's still decoder rejects animations, images are processed as stills so the
+// first frame of an animation is decoded instead
+func decodeWebp(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if webpAnimated(data) {
+		return webpFirstFrame(data)
+	}
+	return webp.Decode(bytes.NewReader(data), &decoder.Options{})
+}
+
+// webpAnimated reports whether a WebP holds an animation, which its VP8X chunk flags
+func webpAnimated(data []byte) bool {
+	return len(data) >= 30 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP" && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// webpFirstFrame decodes the first frame of an animated WebP as a still and places it on the canvas at its offset,
+// the rest of the canvas stays transparent
+func webpFirstFrame(data []byte) (image.Image, error) {
+	canvas := image.Rect(0, 0, uint24(data[24:])+1, uint24(data[27:])+1)
+
+	var frame []byte
+	for offset := 12; offset+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		end := offset + 8 + size
+		if end > len(data) {
+			return nil, errors.New("truncated webp chunk")
+		}
+		if string(data[offset:offset+4]) == "ANMF" {
+			frame = data[offset+8 : end]
+			break
+		}
+		offset = end + size%2 // Chunks are padded to an even size
+	}
+	if len(frame) < 16 {
+		return nil, errors.New("animated webp has no frames")
+	}
+
+	// The frame header holds its offset in pixel pairs and its size, its image chunks follow
+	bounds := image.Rect(0, 0, uint24(frame[6:])+1, uint24(frame[9:])+1).Add(image.Pt(uint24(frame[0:])*2, uint24(frame[3:])*2))
+	if !bounds.In(canvas) {
+		return nil, fmt.Errorf("webp frame %v is outside of the %v canvas", bounds, canvas)
+	}
+
+	chunks, _, err := webpImageChunks(append([]byte("RIFF\x00\x00\x00\x00WEBP"), frame[16:]...))
+	if err != nil {
+		return nil, err
+	}
+
+	// A lossy frame with alpha keeps it in an ALPH chunk, which a still only holds after a VP8X chunk
+	var still bytes.Buffer
+	if bytes.HasPrefix(chunks, []byte("ALPH")) {
+		vp8x := make([]byte, 10)
+		vp8x[0] = 0x10 // Alpha
+		putUint24(vp8x[4:], bounds.Dx()-1)
+		putUint24(vp8x[7:], bounds.Dy()-1)
+		writeWebpChunk(&still, "VP8X", vp8x)
+	}
+	still.Write(chunks)
+
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+still.Len()))
+	copy(header[8:], "WEBP")
+
+	img, err := webp.Decode(io.MultiReader(bytes.NewReader(header), &still), &decoder.Options{})
+	if err != nil {
+		return nil, err
+	}
+	if bounds == canvas {
+		return img, nil
+	}
+
+	composed := image.NewNRGBA(canvas)
+	draw.Draw(composed, bounds, img, img.Bounds().Min, draw.Src)
+	return composed, nil
+}
+
+// uint24 reads the 24 bit little endian numbers WebP headers use
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
@@ -0,0 +1,72 @@
+package routes
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// encodeAnimatedWebp encodes an animation of solid frames of the given sizes and colors, they are placed at the top
+// left corner of a canvas as large as the largest frame
+func encodeAnimatedWebp(t *testing.T, sizes []image.Point, colors []color.RGBA) []byte {
+	t.Helper()
+
+	options, err := newWebpEncoderOptions(90, 4, 1)
+	if err != nil {
+		t.Fatalf("failed to create webp encoder options: %v", err)
+	}
+	animation := newWebpAnimation(10, options)
+	for i, size := range sizes {
+		frame := image.NewRGBA(image.Rectangle{Max: size})
+		draw.Draw(frame, frame.Bounds(), image.NewUniform(colors[i]), image.Point{}, draw.Src)
+		if err := animation.add(frame); err != nil {
+			t.Fatalf("failed to add frame %d: %v", i, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := animation.encode(&buf); err != nil {
+		t.Fatalf("failed to encode animation: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadImage_AnimatedWebp(t *testing.T) {
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	data := encodeAnimatedWebp(t, []image.Point{{8, 8}, {16, 16}}, []color.RGBA{red, blue})
+	if !webpAnimated(data) {
+		t.Fatal("expected the animation to be detected")
+	}
+
+	img, err := readImageSlice(data, "image/webp", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(16, 16) {
+		t.Fatalf("expected the 16x16 canvas, got %v", size)
+	}
+
+	// The first frame covers the top left corner, the rest of the canvas is transparent
+	if r, _, b, _ := img.At(2, 2).RGBA(); r>>8 < 200 || b>>8 > 50 {
+		t.Errorf("expected the red first frame, got %v", img.At(2, 2))
+	}
+	if _, _, _, a := img.At(12, 12).RGBA(); a != 0 {
+		t.Errorf("expected the canvas outside the first frame to be transparent, got %v", img.At(12, 12))
+	}
+
+	// Stills aren't affected
+	still := encodeAnimatedWebp(t, []image.Point{{8, 8}}, []color.RGBA{red})
+	if _, err := readImageSlice(still, "image/webp", 1); err != nil {
+		t.Errorf("unexpected error for a single frame animation: %v", err)
+	}
+	if webpAnimated(encodePNG(t, 8, 8)) {
+		t.Error("expected a png not to be detected as an animated webp")
+	}
+
+	// The RIFF header, VP8X and ANIM take 44 bytes, the first frame is cut off
+	if _, err := readImageSlice(data[:60], "image/webp", 1); err == nil {
+		t.Error("expected an error for a truncated first frame")
+	}
+}
@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"github.com/kolesa-team/go-webp/webp"
+
+	"media-proxy/config"
+	"media-proxy/progjpeg"
+)
+
+// outputQuality caps the requested quality at the configured maximum of the source content type. The loss of a lossy
+// source is already baked in, encoding it again at a higher quality only adds bytes
+func outputQuality(config *config.Config, quality int, contentType string) int {
+	if maxQuality, ok := config.MaxQualityByFormat[contentType]; ok {
+		return min(quality, maxQuality)
+	}
+	return quality
+}
+
+// processedImageFormat picks the output format for images that can't reuse the original bytes (HEIC, tiles, overviews).
+// JPEG, PNG and WebP sources keep their format, anything else becomes PNG when it has transparency and JPEG otherwise.
+func processedImageFormat(contentType string, img image.Image) string {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return contentType
+	}
+
+	if hasAlpha(img) {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
+
+// hasAlpha reports whether the image may contain transparent pixels
+func hasAlpha(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+	return true
+}
+
+// encodeProcessedImage encodes the image in one of the formats returned by processedImageFormat
+func encodeProcessedImage(w io.Writer, img image.Image, format string, quality int, method int, threads int, progressive bool) error {
+	switch format {
+	case "image/jpeg":
+		return encodeJPEG(w, img, quality, progressive)
+	case "image/png":
+		return png.Encode(w, img)
+	case "image/webp":
+		options, err := newWebpEncoderOptions(quality, method, threads)
+		if err != nil {
+			return err
+		}
+		return webp.Encode(w, img, options)
+	default:
+		return fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+// encodeJPEG writes a baseline JPEG with image/jpeg, or a progressive one under APP_JPEG_PROGRESSIVE
+func encodeJPEG(w io.Writer, img image.Image, quality int, progressive bool) error {
+	if progressive {
+		return progjpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,49 @@
+package routes
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"media-proxy/config"
+)
+
+func TestProcessedImageFormat(t *testing.T) {
+	opaque := image.NewYCbCr(image.Rect(0, 0, 2, 2), image.YCbCrSubsampleRatio420)
+
+	transparent := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	transparent.SetRGBA(0, 0, color.RGBA{R: 255, A: 255})
+
+	cases := []struct {
+		contentType string
+		img         image.Image
+		expected    string
+	}{
+		{"image/jpeg", opaque, "image/jpeg"},
+		{"image/png", opaque, "image/png"},
+		{"image/webp", transparent, "image/webp"},
+		{"image/gif", transparent, "image/png"},
+		{"image/heic", opaque, "image/jpeg"},
+		{"image/tiff", transparent, "image/png"},
+	}
+
+	for _, tc := range cases {
+		if got := processedImageFormat(tc.contentType, tc.img); got != tc.expected {
+			t.Errorf("processedImageFormat(%q) = %q, expected %q", tc.contentType, got, tc.expected)
+		}
+	}
+}
+
+func TestOutputQuality(t *testing.T) {
+	cfg := &config.Config{MaxQualityByFormat: map[string]int{"image/jpeg": 90}}
+
+	if got := outputQuality(cfg, 100, "image/jpeg"); got != 90 {
+		t.Errorf("expected q:100 of a JPEG source to be capped at 90, got %d", got)
+	}
+	if got := outputQuality(cfg, 75, "image/jpeg"); got != 75 {
+		t.Errorf("expected a quality below the cap to be kept, got %d", got)
+	}
+	if got := outputQuality(cfg, 100, "image/png"); got != 100 {
+		t.Errorf("expected sources without a cap to keep their quality, got %d", got)
+	}
+}
@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"github.com/kolesa-team/go-webp/encoder"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+// defaultWebpMethod is libwebp's own encoder effort, used when APP_WEBP_METHOD wasn't resolved
+const defaultWebpMethod = 4
+
+// webpMethod is the encoder effort of a request: m: when the path has it, APP_WEBP_METHOD otherwise
+func webpMethod(config *config.Config, params *validation.ImageContext) int {
+	if params.WebpMethodSet {
+		return params.WebpMethod
+	}
+	return configuredWebpMethod(config)
+}
+
+// configuredWebpMethod is APP_WEBP_METHOD, libwebp's default when it isn't set
+func configuredWebpMethod(config *config.Config) int {
+	if config.WebpMethod != nil {
+		return *config.WebpMethod
+	}
+	return defaultWebpMethod
+}
+
+// newWebpEncoderOptions creates lossy WebP encoder options honoring the configured thread cap.
+// libwebp can only toggle a single extra worker thread, so it is enabled when more than one thread is allowed.
+// method trades encoding time for size, from 0 (fastest) to 6 (smallest)
+func newWebpEncoderOptions(quality int, method int, threads int) (*encoder.Options, error) {
+	options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(quality))
+	if err != nil {
+		return nil, err
+	}
+
+	options.Method = method
+	options.ThreadLevel = threads > 1
+
+	return options, nil
+}
+
+// webpAutoCandidate reports whether auto WebP may replace an image of the given format.
+// GIFs would lose their animation and WebP sources have nothing to gain, so only JPEG and PNG qualify
+func webpAutoCandidate(contentType string) bool {
+	return contentType == "image/jpeg" || contentType == "image/png"
+}
+
+// webpWins reports whether the WebP encoding is smaller than the alternative by at least marginPercent
+func webpWins(webpSize, otherSize, marginPercent int) bool {
+	return webpSize*100 <= otherSize*(100-marginPercent)
+}
@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/kolesa-team/go-webp/webp"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+func benchmarkImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+// BenchmarkWebpEncodeThreads compares parallel encoding throughput with libwebp's extra worker thread off and on.
+// libwebp only has a boolean thread level, so every APP_ENCODER_THREADS value above 1 behaves like 2.
+func BenchmarkWebpEncodeThreads(b *testing.B) {
+	img := benchmarkImage(1920, 1080)
+
+	for _, threads := range []int{1, 2} {
+		b.Run(fmt.Sprintf("thread_level=%t", threads > 1), func(b *testing.B) {
+			options, err := newWebpEncoderOptions(80, defaultWebpMethod, threads)
+			if err != nil {
+				b.Fatalf("failed to create encoder options: %v", err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var buf bytes.Buffer
+				for pb.Next() {
+					buf.Reset()
+					if err := webp.Encode(&buf, img, options); err != nil {
+						b.Errorf("failed to encode: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestWebpWins(t *testing.T) {
+	tests := []struct {
+		webpSize, otherSize, margin int
+		expected                    bool
+	}{
+		{80, 100, 10, true},
+		{90, 100, 10, true},
+		{91, 100, 10, false},
+		{120, 100, 10, false},
+		{99, 100, 1, true},
+	}
+	for _, test := range tests {
+		if wins := webpWins(test.webpSize, test.otherSize, test.margin); wins != test.expected {
+			t.Errorf("webp %d vs %d with %d%% margin: expected %t, got %t", test.webpSize, test.otherSize, test.margin, test.expected, wins)
+		}
+	}
+}
+
+func TestWebpMethod(t *testing.T) {
+	configured := 6
+	params := &validation.ImageContext{}
+	if method := webpMethod(&config.Config{}, params); method != defaultWebpMethod {
+		t.Errorf("expected libwebp's default without APP_WEBP_METHOD, got %d", method)
+	}
+	if method := webpMethod(&config.Config{WebpMethod: &configured}, params); method != 6 {
+		t.Errorf("expected APP_WEBP_METHOD, got %d", method)
+	}
+	params.WebpMethod, params.WebpMethodSet = 0, true
+	if method := webpMethod(&config.Config{WebpMethod: &configured}, params); method != 0 {
+		t.Errorf("expected m: to override APP_WEBP_METHOD, got %d", method)
+	}
+
+	options, err := newWebpEncoderOptions(80, 1, 1)
+	if err != nil {
+		t.Fatalf("failed to create encoder options: %v", err)
+	}
+	if options.Method != 1 {
+		t.Errorf("expected method 1 in the encoder options, got %d", options.Method)
+	}
+}
@@ -0,0 +1,498 @@
+package routes
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+)
+
+// heifItem is a single image item of a HEIF container along with its decoder configuration
+type heifItem struct {
+	ID       uint32
+	Type     string // "hvc1", "av01", "grid", ...
+	Data     []byte // item payload, length-prefixed NAL units for hvc1 and OBUs for av01
+	Config   []byte // HEVCDecoderConfigurationRecord (hvcC) for hvc1, AV1CodecConfigurationRecord (av1C) for av01
+	Width    int    // from ispe
+	Height   int    // from ispe
+	Rotation int    // anticlockwise quarter turns from irot
+}
+
+// heifGrid describes how the tiles of a grid item are laid out
+type heifGrid struct {
+	Rows    int
+	Columns int
+	Width   int // output width, the right/bottom tiles may overhang it
+	Height  int // output height
+}
+
+// heifImage is the primary image of a HEIF container, HEVC coded for HEIC and AV1 coded for AVIF.
+// Grid images (the default for iOS camera photos) reference their tiles through "dimg" in reading order.
+type heifImage struct {
+	Primary *heifItem
+	Grid    *heifGrid
+	Tiles   []*heifItem
+}
+
+// heifBox is a parsed ISOBMFF box header with its payload
+type heifBox struct {
+	Type    string
+	Payload []byte
+}
+
+// readHeifBoxes splits a byte slice into consecutive boxes
+func readHeifBoxes(data []byte) ([]heifBox, error) {
+	var boxes []heifBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, fmt.Errorf("truncated box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, fmt.Errorf("truncated large box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid size %d for box %q", size, boxType)
+		}
+
+		boxes = append(boxes, heifBox{Type: boxType, Payload: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// heifReader reads big-endian fields from a box payload, remembering the first error
+type heifReader struct {
+	data []byte
+	err  error
+}
+
+func (r *heifReader) uint(size int) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if size > len(r.data) {
+		r.err = fmt.Errorf("truncated box payload")
+		return 0
+	}
+
+	var value uint64
+	for _, b := range r.data[:size] {
+		value = value<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return value
+}
+
+func (r *heifReader) u8() uint8   { return uint8(r.uint(1)) }
+func (r *heifReader) u16() uint16 { return uint16(r.uint(2)) }
+func (r *heifReader) u32() uint32 { return uint32(r.uint(4)) }
+
+// fullBox reads the version and flags of a FullBox
+func (r *heifReader) fullBox() (version uint8, flags uint32) {
+	header := r.u32()
+	return uint8(header >> 24), header & 0xffffff
+}
+
+// itemID reads an item ID, which is 16 bits wide for version 0 boxes and 32 bits otherwise
+func (r *heifReader) itemID(wide bool) uint32 {
+	if wide {
+		return r.u32()
+	}
+	return uint32(r.u16())
+}
+
+// heifExtent is a byte range of an item payload
+type heifExtent struct {
+	offset uint64
+	length uint64
+}
+
+// heifLocation is where an item payload is stored
+type heifLocation struct {
+	construction uint16 // 0 = file offset, 1 = idat offset
+	baseOffset   uint64
+	extents      []heifExtent
+}
+
+// parseHeif walks the meta box of a HEIF container and resolves the primary image.
+// Only the structure is parsed here, decoding the HEVC or AV1 payloads is left to the caller.
+func parseHeif(data []byte) (*heifImage, error) {
+	boxes, err := readHeifBoxes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta []byte
+	for _, box := range boxes {
+		if box.Type == "meta" {
+			meta = box.Payload
+			break
+		}
+	}
+	if meta == nil {
+		return nil, fmt.Errorf("no meta box found")
+	}
+
+	metaReader := &heifReader{data: meta}
+	metaReader.fullBox()
+	if metaReader.err != nil {
+		return nil, metaReader.err
+	}
+
+	children, err := readHeifBoxes(metaReader.data)
+	if err != nil {
+		return nil, err
+	}
+
+	var primaryID uint32
+	var idat []byte
+	items := map[uint32]*heifItem{}
+	locations := map[uint32]heifLocation{}
+	references := map[uint32][]uint32{} // dimg: grid item -> tile items
+
+	var properties []heifBox
+	associations := map[uint32][]int{}
+
+	for _, box := range children {
+		r := &heifReader{data: box.Payload}
+		switch box.Type {
+		case "pitm":
+			version, _ := r.fullBox()
+			primaryID = r.itemID(version != 0)
+		case "idat":
+			idat = box.Payload
+		case "iinf":
+			version, _ := r.fullBox()
+			if version == 0 {
+				r.u16()
+			} else {
+				r.u32()
+			}
+			if r.err != nil {
+				return nil, r.err
+			}
+			entries, err := readHeifBoxes(r.data)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Type != "infe" {
+					continue
+				}
+				er := &heifReader{data: entry.Payload}
+				version, _ := er.fullBox()
+				if version < 2 {
+					continue // pre-HEIF item entries carry no item type
+				}
+				id := er.itemID(version != 2)
+				er.u16() // item_protection_index
+				itemType := er.uint(4)
+				if er.err != nil {
+					return nil, er.err
+				}
+				items[id] = &heifItem{ID: id, Type: string(binary.BigEndian.AppendUint32(nil, uint32(itemType)))}
+			}
+		case "iloc":
+			if err := parseHeifLocations(r, locations); err != nil {
+				return nil, err
+			}
+		case "iref":
+			version, _ := r.fullBox()
+			if r.err != nil {
+				return nil, r.err
+			}
+			refs, err := readHeifBoxes(r.data)
+			if err != nil {
+				return nil, err
+			}
+			for _, ref := range refs {
+				if ref.Type != "dimg" {
+					continue
+				}
+				rr := &heifReader{data: ref.Payload}
+				from := rr.itemID(version != 0)
+				count := int(rr.u16())
+				for i := 0; i < count; i++ {
+					references[from] = append(references[from], rr.itemID(version != 0))
+				}
+				if rr.err != nil {
+					return nil, rr.err
+				}
+			}
+		case "iprp":
+			propertyBoxes, err := readHeifBoxes(box.Payload)
+			if err != nil {
+				return nil, err
+			}
+			for _, propertyBox := range propertyBoxes {
+				switch propertyBox.Type {
+				case "ipco":
+					properties, err = readHeifBoxes(propertyBox.Payload)
+					if err != nil {
+						return nil, err
+					}
+				case "ipma":
+					if err := parseHeifAssociations(&heifReader{data: propertyBox.Payload}, associations); err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("failed to parse %s box: %w", box.Type, r.err)
+		}
+	}
+
+	// Attach payloads and properties to the items
+	for id, item := range items {
+		if location, ok := locations[id]; ok {
+			payload, err := heifItemPayload(location, data, idat)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %w", id, err)
+			}
+			item.Data = payload
+		}
+
+		for _, index := range associations[id] {
+			if index < 1 || index > len(properties) {
+				continue
+			}
+			property := properties[index-1]
+			pr := &heifReader{data: property.Payload}
+			switch property.Type {
+			case "hvcC", "av1C":
+				item.Config = property.Payload
+			case "ispe":
+				pr.fullBox()
+				item.Width = int(pr.u32())
+				item.Height = int(pr.u32())
+			case "irot":
+				item.Rotation = int(pr.u8() & 0x3)
+			}
+			if pr.err != nil {
+				return nil, fmt.Errorf("item %d: failed to parse %s property: %w", id, property.Type, pr.err)
+			}
+		}
+	}
+
+	primary, ok := items[primaryID]
+	if !ok {
+		return nil, fmt.Errorf("primary item %d not found", primaryID)
+	}
+
+	result := &heifImage{Primary: primary}
+	switch primary.Type {
+	case "hvc1", "av01":
+		return result, nil
+	case "grid":
+		grid, err := parseHeifGrid(primary.Data)
+		if err != nil {
+			return nil, err
+		}
+
+		tileIDs := references[primary.ID]
+		if len(tileIDs) != grid.Rows*grid.Columns {
+			return nil, fmt.Errorf("grid expects %d tiles, found %d", grid.Rows*grid.Columns, len(tileIDs))
+		}
+		for _, tileID := range tileIDs {
+			tile, ok := items[tileID]
+			if !ok || tile.Type != "hvc1" && tile.Type != "av01" {
+				return nil, fmt.Errorf("grid tile %d is missing or not hevc or av1", tileID)
+			}
+			result.Tiles = append(result.Tiles, tile)
+		}
+
+		result.Grid = grid
+		return result, nil
+	default:
+		return nil, fmt.Errorf("unsupported primary item type %q", primary.Type)
+	}
+}
+
+// parseHeifLocations reads an iloc box
+func parseHeifLocations(r *heifReader, locations map[uint32]heifLocation) error {
+	version, _ := r.fullBox()
+
+	sizes := r.u16()
+	offsetSize := int(sizes >> 12)
+	lengthSize := int(sizes >> 8 & 0xf)
+	baseOffsetSize := int(sizes >> 4 & 0xf)
+	indexSize := 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0xf)
+	}
+
+	var count uint32
+	if version < 2 {
+		count = uint32(r.u16())
+	} else {
+		count = r.u32()
+	}
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		id := r.itemID(version == 2)
+
+		var location heifLocation
+		if version == 1 || version == 2 {
+			location.construction = r.u16() & 0xf
+		}
+		r.u16() // data_reference_index
+		location.baseOffset = r.uint(baseOffsetSize)
+
+		extentCount := int(r.u16())
+		for j := 0; j < extentCount && r.err == nil; j++ {
+			r.uint(indexSize)
+			location.extents = append(location.extents, heifExtent{
+				offset: r.uint(offsetSize),
+				length: r.uint(lengthSize),
+			})
+		}
+
+		locations[id] = location
+	}
+
+	return r.err
+}
+
+// parseHeifAssociations reads an ipma box, property indices are 1-based into ipco
+func parseHeifAssociations(r *heifReader, associations map[uint32][]int) error {
+	version, flags := r.fullBox()
+
+	count := r.u32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		id := r.itemID(version >= 1)
+		associationCount := int(r.u8())
+		for j := 0; j < associationCount && r.err == nil; j++ {
+			if flags&1 != 0 {
+				associations[id] = append(associations[id], int(r.u16()&0x7fff))
+			} else {
+				associations[id] = append(associations[id], int(r.u8()&0x7f))
+			}
+		}
+	}
+
+	return r.err
+}
+
+// heifItemPayload concatenates the extents of an item from the file or the idat box
+func heifItemPayload(location heifLocation, file, idat []byte) ([]byte, error) {
+	var source []byte
+	switch location.construction {
+	case 0:
+		source = file
+	case 1:
+		source = idat
+	default:
+		return nil, fmt.Errorf("unsupported construction method %d", location.construction)
+	}
+
+	var payload []byte
+	for _, extent := range location.extents {
+		start := location.baseOffset + extent.offset
+		length := extent.length
+		if length == 0 {
+			// Zero length means the rest of the source
+			if start > uint64(len(source)) {
+				return nil, fmt.Errorf("extent out of range")
+			}
+			length = uint64(len(source)) - start
+		}
+		if start > uint64(len(source)) || length > uint64(len(source))-start {
+			return nil, fmt.Errorf("extent out of range")
+		}
+		payload = append(payload, source[start:start+length]...)
+	}
+	return payload, nil
+}
+
+// parseHeifGrid reads the ImageGrid payload of a grid item
+func parseHeifGrid(data []byte) (*heifGrid, error) {
+	r := &heifReader{data: data}
+	r.u8() // version
+	flags := r.u8()
+	grid := &heifGrid{
+		Rows:    int(r.u8()) + 1,
+		Columns: int(r.u8()) + 1,
+	}
+
+	fieldSize := 2
+	if flags&1 != 0 {
+		fieldSize = 4
+	}
+	grid.Width = int(r.uint(fieldSize))
+	grid.Height = int(r.uint(fieldSize))
+
+	if r.err != nil {
+		return nil, fmt.Errorf("failed to parse grid: %w", r.err)
+	}
+	if grid.Width == 0 || grid.Height == 0 {
+		return nil, fmt.Errorf("grid has empty output size")
+	}
+	return grid, nil
+}
+
+// composeHeifGrid places the decoded tiles in reading order and crops the overhang to the grid output size
+func composeHeifGrid(grid *heifGrid, tiles []image.Image) (image.Image, error) {
+	if len(tiles) != grid.Rows*grid.Columns {
+		return nil, fmt.Errorf("grid expects %d tiles, got %d", grid.Rows*grid.Columns, len(tiles))
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, grid.Width, grid.Height))
+	tileWidth, tileHeight := tiles[0].Bounds().Dx(), tiles[0].Bounds().Dy()
+
+	for i, tile := range tiles {
+		column, row := i%grid.Columns, i/grid.Columns
+		origin := image.Pt(column*tileWidth, row*tileHeight)
+		target := image.Rectangle{Min: origin, Max: origin.Add(tile.Bounds().Size())}
+		draw.Draw(canvas, target, tile, tile.Bounds().Min, draw.Src)
+	}
+
+	return canvas, nil
+}
+
+// rotateQuarterTurns applies anticlockwise quarter turns, as found in a HEIF irot property or a video display matrix
+func rotateQuarterTurns(img image.Image, quarterTurns int) image.Image {
+	quarterTurns %= 4
+	if quarterTurns == 0 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var rotated *image.RGBA
+	if quarterTurns == 2 {
+		rotated = image.NewRGBA(image.Rect(0, 0, width, height))
+	} else {
+		rotated = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			color := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			switch quarterTurns {
+			case 1:
+				rotated.Set(y, width-1-x, color)
+			case 2:
+				rotated.Set(width-1-x, height-1-y, color)
+			case 3:
+				rotated.Set(height-1-y, x, color)
+			}
+		}
+	}
+
+	return rotated
+}
@@ -0,0 +1,233 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// heifTestBox serializes a box with the given type and payload
+func heifTestBox(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := binary.BigEndian.AppendUint32(nil, uint32(8+len(body)))
+	out = append(out, boxType...)
+	return append(out, body...)
+}
+
+// heifTestFullBox serializes a FullBox with the given version and flags
+func heifTestFullBox(boxType string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	return heifTestBox(boxType, append([][]byte{header}, payload...)...)
+}
+
+func heifU16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func heifU32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+// buildGridHeif builds a container whose primary item is a 2x2 grid (stored in idat) of hvc1 tiles (stored in mdat)
+func buildGridHeif(t *testing.T) ([]byte, [][]byte) {
+	t.Helper()
+
+	tiles := [][]byte{[]byte("tile-0"), []byte("tile-1"), []byte("tile-2"), []byte("tile-3")}
+	hvcC := []byte{1, 2, 3, 4}
+
+	infe := func(id uint16, itemType string) []byte {
+		return heifTestFullBox("infe", 2, 0, heifU16(id), heifU16(0), []byte(itemType))
+	}
+
+	// ImageGrid: version, flags, rows-1, columns-1, 16-bit output size
+	grid := append([]byte{0, 0, 1, 1}, append(heifU16(1000), heifU16(700)...)...)
+
+	ipco := heifTestBox("ipco",
+		heifTestBox("hvcC", hvcC),
+		heifTestFullBox("ispe", 0, 0, heifU32(512), heifU32(512)),
+		heifTestFullBox("ispe", 0, 0, heifU32(1000), heifU32(700)),
+		heifTestBox("irot", []byte{1}),
+	)
+
+	ipma := [][]byte{heifU32(5)}
+	ipma = append(ipma, heifU16(1), []byte{2, 0x83, 0x04}) // grid: essential ispe, irot
+	for id := uint16(2); id <= 5; id++ {
+		ipma = append(ipma, heifU16(id), []byte{2, 0x81, 0x02})
+	}
+
+	dimg := heifTestBox("dimg", heifU16(1), heifU16(4), heifU16(2), heifU16(3), heifU16(4), heifU16(5))
+
+	buildMeta := func(mdatOffset uint32) []byte {
+		iloc := [][]byte{heifU16(0x4400), heifU16(5)}
+		iloc = append(iloc, heifU16(1), heifU16(1), heifU16(0), heifU16(1), heifU32(0), heifU32(uint32(len(grid))))
+		offset := mdatOffset
+		for i, tile := range tiles {
+			iloc = append(iloc, heifU16(uint16(i+2)), heifU16(0), heifU16(0), heifU16(1), heifU32(offset), heifU32(uint32(len(tile))))
+			offset += uint32(len(tile))
+		}
+
+		return heifTestFullBox("meta", 0, 0,
+			heifTestFullBox("hdlr", 0, 0, heifU32(0), []byte("pict"), make([]byte, 13)),
+			heifTestFullBox("pitm", 0, 0, heifU16(1)),
+			heifTestFullBox("iinf", 0, 0, heifU16(5), infe(1, "grid"), infe(2, "hvc1"), infe(3, "hvc1"), infe(4, "hvc1"), infe(5, "hvc1")),
+			heifTestFullBox("iloc", 1, 0, bytes.Join(iloc, nil)),
+			heifTestFullBox("iref", 0, 0, dimg),
+			heifTestBox("iprp", ipco, heifTestFullBox("ipma", 0, 0, bytes.Join(ipma, nil))),
+			heifTestBox("idat", grid),
+		)
+	}
+
+	ftyp := heifTestBox("ftyp", []byte("heic"), heifU32(0), []byte("mif1heic"))
+
+	// The mdat offset depends on the meta size, which does not depend on the offset values
+	meta := buildMeta(0)
+	mdatOffset := uint32(len(ftyp) + len(meta) + 8)
+	meta = buildMeta(mdatOffset)
+
+	file := append(append(ftyp, meta...), heifTestBox("mdat", bytes.Join(tiles, nil))...)
+	return file, tiles
+}
+
+func TestParseHeif_Grid(t *testing.T) {
+	data, tiles := buildGridHeif(t)
+
+	heif, err := parseHeif(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if heif.Primary.Type != "grid" || heif.Primary.Rotation != 1 {
+		t.Errorf("expected rotated grid primary item, got type %q rotation %d", heif.Primary.Type, heif.Primary.Rotation)
+	}
+	if heif.Grid == nil || heif.Grid.Rows != 2 || heif.Grid.Columns != 2 || heif.Grid.Width != 1000 || heif.Grid.Height != 700 {
+		t.Fatalf("unexpected grid layout: %+v", heif.Grid)
+	}
+	if len(heif.Tiles) != len(tiles) {
+		t.Fatalf("expected %d tiles, got %d", len(tiles), len(heif.Tiles))
+	}
+
+	for i, tile := range heif.Tiles {
+		if !bytes.Equal(tile.Data, tiles[i]) {
+			t.Errorf("tile %d: expected data %q, got %q", i, tiles[i], tile.Data)
+		}
+		if !bytes.Equal(tile.Config, []byte{1, 2, 3, 4}) {
+			t.Errorf("tile %d: expected hvcC to be attached, got %v", i, tile.Config)
+		}
+		if tile.Width != 512 || tile.Height != 512 {
+			t.Errorf("tile %d: expected 512x512, got %dx%d", i, tile.Width, tile.Height)
+		}
+	}
+}
+
+// buildAvif builds a container whose primary item is a single av01 image of 64x48 stored in mdat
+func buildAvif(t *testing.T) ([]byte, []byte) {
+	t.Helper()
+
+	// A sequence header and a frame OBU would go here, the parser only moves the payload around
+	obus := []byte("av1-obus")
+	av1C := []byte{0x81, 0x00, 0x0c, 0x00}
+
+	buildMeta := func(mdatOffset uint32) []byte {
+		iloc := [][]byte{heifU16(0x4400), heifU16(1), heifU16(1), heifU16(0), heifU16(0), heifU16(1), heifU32(mdatOffset), heifU32(uint32(len(obus)))}
+		return heifTestFullBox("meta", 0, 0,
+			heifTestFullBox("hdlr", 0, 0, heifU32(0), []byte("pict"), make([]byte, 13)),
+			heifTestFullBox("pitm", 0, 0, heifU16(1)),
+			heifTestFullBox("iinf", 0, 0, heifU16(1), heifTestFullBox("infe", 2, 0, heifU16(1), heifU16(0), []byte("av01"))),
+			heifTestFullBox("iloc", 1, 0, bytes.Join(iloc, nil)),
+			heifTestBox("iprp",
+				heifTestBox("ipco", heifTestBox("av1C", av1C), heifTestFullBox("ispe", 0, 0, heifU32(64), heifU32(48))),
+				heifTestFullBox("ipma", 0, 0, heifU32(1), heifU16(1), []byte{2, 0x81, 0x02}),
+			),
+		)
+	}
+
+	ftyp := heifTestBox("ftyp", []byte("avif"), heifU32(0), []byte("mif1avifmiaf"))
+
+	meta := buildMeta(0)
+	meta = buildMeta(uint32(len(ftyp) + len(meta) + 8))
+
+	return append(append(ftyp, meta...), heifTestBox("mdat", obus)...), obus
+}
+
+func TestParseHeif_Avif(t *testing.T) {
+	data, obus := buildAvif(t)
+
+	heif, err := parseHeif(data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if heif.Primary.Type != "av01" || heif.Grid != nil {
+		t.Fatalf("expected a single av01 primary item, got type %q grid %+v", heif.Primary.Type, heif.Grid)
+	}
+	if !bytes.Equal(heif.Primary.Data, obus) || len(heif.Primary.Config) != 4 {
+		t.Errorf("expected the OBUs and the av1C record to be attached, got data %q config %v", heif.Primary.Data, heif.Primary.Config)
+	}
+
+	if width, height, err := readImageDimensions(data, "image/avif"); err != nil || width != 64 || height != 48 {
+		t.Errorf("expected 64x48, got %dx%d (%v)", width, height, err)
+	}
+
+	// AVIF goes to the AV1 decoder, the placeholder payload fails there (or for the missing FFmpeg libraries) rather
+	// than as a content type without a decoder
+	if _, err := readImageSlice(data, "image/avif", 1); err == nil || strings.HasSuffix(err.Error(), "image/avif") {
+		t.Errorf("expected the AV1 decoder to reject the placeholder payload, got %v", err)
+	}
+}
+
+func TestParseHeif_Truncated(t *testing.T) {
+	data, _ := buildGridHeif(t)
+
+	if _, err := parseHeif(data[:len(data)/2]); err == nil {
+		t.Error("expected an error for a truncated container")
+	}
+}
+
+func TestComposeHeifGrid(t *testing.T) {
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 0, 255}}
+	tiles := make([]image.Image, len(colors))
+	for i, c := range colors {
+		tile := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		for y := 0; y < 4; y++ {
+			for x := 0; x < 4; x++ {
+				tile.SetRGBA(x, y, c)
+			}
+		}
+		tiles[i] = tile
+	}
+
+	// The right column and bottom row overhang the 6x5 output
+	img, err := composeHeifGrid(&heifGrid{Rows: 2, Columns: 2, Width: 6, Height: 5}, tiles)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if img.Bounds().Dx() != 6 || img.Bounds().Dy() != 5 {
+		t.Fatalf("expected 6x5, got %v", img.Bounds())
+	}
+
+	checks := map[image.Point]color.RGBA{
+		{0, 0}: colors[0],
+		{5, 0}: colors[1],
+		{0, 4}: colors[2],
+		{5, 4}: colors[3],
+	}
+	for point, expected := range checks {
+		if got := img.At(point.X, point.Y); got != expected {
+			t.Errorf("pixel %v: expected %v, got %v", point, expected, got)
+		}
+	}
+}
+
+func TestRotateQuarterTurns(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.RGBA{255, 0, 0, 255}
+	img.SetRGBA(2, 0, marker) // top right
+
+	rotated := rotateQuarterTurns(img, 1)
+	if rotated.Bounds().Dx() != 2 || rotated.Bounds().Dy() != 3 {
+		t.Fatalf("expected 2x3 after a quarter turn, got %v", rotated.Bounds())
+	}
+
+	// Rotating anticlockwise moves the top right corner to the top left
+	if got := rotated.At(0, 0); got != marker {
+		t.Errorf("expected marker at top left, got %v", got)
+	}
+}
@@ -2,65 +2,167 @@ package routes
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
 	"io"
+	"time"
 
 	"image/gif"
 	"image/jpeg"
 	"image/png"
 
 	"github.com/gen2brain/go-fitz"
+	"github.com/gofiber/fiber/v2"
 	"github.com/kolesa-team/go-webp/decoder"
-	"github.com/kolesa-team/go-webp/webp"
 	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
+
+	"media-proxy/validation"
+)
+
+var (
+	// errUnsupportedFormat is returned for sources this build has no decoder for, answered with 415
+	errUnsupportedFormat = errors.New("unsupported image format")
+	// errUnreadableImage is returned for sources their decoder rejects, corrupt or truncated bytes, answered with 422
+	errUnreadableImage = errors.New("image can't be decoded")
 )
 
-func readImage(r io.Reader, contentType string) (image.Image, error) {
+// unreadable marks the error of a decoder as one about the source bytes
+func unreadable(img image.Image, err error) (image.Image, error) {
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnreadableImage, err)
+	}
+	return img, nil
+}
+
+// decodeErrorStatus is the status a failed decode is answered with, failures that aren't about the source are 500
+func decodeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUnsupportedFormat):
+		return fiber.StatusUnsupportedMediaType
+	case errors.Is(err, errUnreadableImage), errors.Is(err, errDecodeTimeout):
+		return fiber.StatusUnprocessableEntity
+	default:
+		return fiber.StatusInternalServerError
+	}
+}
+
+// readImage decodes an image of the given content type. threads caps the decoder threads for codecs backed by ffmpeg.
+// Failures wrap errUnsupportedFormat or errUnreadableImage when they are about the source
+func readImage(r io.Reader, contentType string, threads int) (image.Image, error) {
 	switch contentType {
 	case "image/jpeg":
-		return jpeg.Decode(r)
+		return unreadable(jpeg.Decode(r))
 
 	case "image/png":
-		return png.Decode(r)
+		return unreadable(png.Decode(r))
 
 	case "image/gif":
-		return gif.Decode(r)
+		return unreadable(gif.Decode(r))
 
 	case "image/bmp":
-		return bmp.Decode(r)
+		return unreadable(bmp.Decode(r))
 
 	case "image/tiff":
-		return tiff.Decode(r)
+		return unreadable(tiff.Decode(r))
 
 	case "image/webp":
-		return webp.Decode(r, &decoder.Options{})
-
-	case "application/pdf",
-		"application/epub+zip",
-		"application/x-mobipocket-ebook",
-		"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
-		"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
-		"application/vnd.openxmlformats-officedocument.presentationml.presentation":
+		return unreadable(decodeWebp(r))
+
+	case "image/heic", "image/heif", "image/avif":
+		return decodeHeic(r, threads)
+
+	default:
+		if !validation.IsDocumentMime(contentType) {
+			return nil, fmt.Errorf("%w: %s", errUnsupportedFormat, contentType)
+		}
+
 		doc, err := fitz.NewFromReader(r)
 		if err != nil {
-			return nil, err
+			return unreadable(nil, err)
 		}
 
 		defer doc.Close()
 
 		if pageCount := doc.NumPage(); pageCount > 0 {
-			return doc.Image(0)
+			page, err := doc.Image(0)
+			return unreadable(page, err)
 		}
 
-		return nil, fmt.Errorf("no pages found")
+		return nil, fmt.Errorf("%w: no pages found", errUnreadableImage)
+	}
+}
+
+func readImageSlice(s []byte, contentType string, threads int) (image.Image, error) {
+	return readImage(bytes.NewReader(s), contentType, threads)
+}
 
-	default:
-		return nil, fmt.Errorf("unsupported image format: %s", contentType)
+// errDecodeTimeout is returned when a decode takes longer than the configured timeout
+var errDecodeTimeout = errors.New("image decode timed out")
+
+// readImageSliceTimeout is readImageSlice bounded by timeout, a timeout of zero or less waits for the decode.
+// None of the decoders can be cancelled, so a stuck decode is abandoned: its goroutine keeps running and the result is dropped.
+func readImageSliceTimeout(s []byte, contentType string, threads int, timeout time.Duration) (image.Image, error) {
+	if timeout <= 0 {
+		return readImageSlice(s, contentType, threads)
+	}
+
+	type decoded struct {
+		img image.Image
+		err error
+	}
+
+	// Buffered so an abandoned decoder can still deliver its result and exit
+	result := make(chan decoded, 1)
+	go func() {
+		img, err := readImageSlice(s, contentType, threads)
+		result <- decoded{img, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-result:
+		return r.img, r.err
+	case <-timer.C:
+		return nil, errDecodeTimeout
 	}
 }
 
-func readImageSlice(s []byte, contentType string) (image.Image, error) {
-	return readImage(bytes.NewReader(s), contentType)
+// readImageDimensions reads the size of an image without decoding its pixels
+func readImageDimensions(data []byte, contentType string) (width, height int, err error) {
+	switch contentType {
+	case "image/webp":
+		// go-webp does not register with the image package, so image.DecodeConfig can't read WebP
+		webpDecoder, err := decoder.NewDecoder(bytes.NewReader(data), &decoder.Options{})
+		if err != nil {
+			return 0, 0, err
+		}
+		features := webpDecoder.GetFeatures()
+		return features.Width, features.Height, nil
+
+	case "image/heic", "image/heif", "image/avif":
+		heif, err := parseHeif(data)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		width, height = heif.Primary.Width, heif.Primary.Height
+		if heif.Grid != nil {
+			width, height = heif.Grid.Width, heif.Grid.Height
+		}
+		if heif.Primary.Rotation%2 == 1 {
+			width, height = height, width
+		}
+		return width, height, nil
+
+	default:
+		imageConfig, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return 0, 0, err
+		}
+		return imageConfig.Width, imageConfig.Height, nil
+	}
 }
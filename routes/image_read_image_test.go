@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// encodeSlowPNG builds a small file that takes long to decode: a large blank image compresses to almost nothing
+func encodeSlowPNG(t *testing.T, size int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, size, size))); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadImageSliceTimeout(t *testing.T) {
+	data := encodeSlowPNG(t, 4096)
+
+	start := time.Now()
+	_, err := readImageSliceTimeout(data, "image/png", 1, time.Millisecond)
+	if !errors.Is(err, errDecodeTimeout) {
+		t.Fatalf("expected a decode timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the timeout to return early, took %v", elapsed)
+	}
+
+	// The same input decodes fine without a tight deadline
+	img, err := readImageSliceTimeout(data, "image/png", 1, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if img.Bounds().Dx() != 4096 {
+		t.Errorf("expected a 4096px wide image, got %v", img.Bounds())
+	}
+
+	// Decode errors are returned as is
+	if _, err := readImageSliceTimeout([]byte("not a png"), "image/png", 1, time.Minute); err == nil || errors.Is(err, errDecodeTimeout) {
+		t.Errorf("expected a decode error, got %v", err)
+	}
+}
+
+func TestReadImage_ErrorStatus(t *testing.T) {
+	valid := encodeSlowPNG(t, 8)
+
+	for _, tc := range []struct {
+		name        string
+		data        []byte
+		contentType string
+		status      int
+	}{
+		{"unknown format", valid, "image/x-unknown", 415},
+		{"corrupt bytes", []byte("not a png"), "image/png", 422},
+		{"truncated", valid[:len(valid)/2], "image/png", 422},
+		{"wrong format", valid, "image/jpeg", 422},
+	} {
+		_, err := readImageSlice(tc.data, tc.contentType, 1)
+		if err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+			continue
+		}
+		if status := decodeErrorStatus(err); status != tc.status {
+			t.Errorf("%s: expected %d, got %d (%v)", tc.name, tc.status, status, err)
+		}
+	}
+
+	if status := decodeErrorStatus(errors.New("out of memory")); status != 500 {
+		t.Errorf("expected other failures to stay 500, got %d", status)
+	}
+}
@@ -6,11 +6,16 @@ import (
 	"github.com/nfnt/resize"
 )
 
-func rescaleImage(img image.Image, scale float64) (image.Image, error) {
+func rescaleImage(img image.Image, scale float64, limits outputLimits) (image.Image, error) {
 	dX := img.Bounds().Dx()
 	dY := img.Bounds().Dy()
 
-	resized := resize.Resize(uint(float64(dX)*scale), uint(float64(dY)*scale), img, resize.Lanczos3)
+	width, height, err := limits.fit(int(float64(dX)*scale), int(float64(dY)*scale))
+	if err != nil {
+		return nil, err
+	}
+
+	resized := resize.Resize(uint(width), uint(height), img, resize.Lanczos3)
 
 	return resized, nil
 }
@@ -1,30 +1,98 @@
 package routes
 
 import (
+	"errors"
+	"fmt"
 	"image"
+	"math"
+
+	"media-proxy/config"
+	"media-proxy/validation"
 
 	"github.com/nfnt/resize"
 )
 
-func resizeImage(img image.Image, width int, height int, interpolation resize.InterpolationFunction) (image.Image, error) {
-	// If both width and height are specified, resize to exact dimensions
-	if width > 0 && height > 0 {
-		resized := resize.Resize(uint(width), uint(height), img, interpolation)
-		return resized, nil
+// errOutputTooLarge is returned for results past APP_MAX_OUTPUT_DIMENSION or APP_MAX_OUTPUT_PIXELS when they are rejected
+var errOutputTooLarge = errors.New("requested output is too large")
+
+// outputLimits bound the size of resized and rescaled results, 0 leaves a limit out. Larger results fail with
+// errOutputTooLarge, or are shrunk to fit keeping their aspect ratio when clamp is set
+type outputLimits struct {
+	maxDimension int
+	maxPixels    int64
+	clamp        bool
+}
+
+func newOutputLimits(config *config.Config) outputLimits {
+	return outputLimits{maxDimension: config.MaxOutputDimension, maxPixels: config.MaxOutputPixels, clamp: config.OversizedOutput == "clamp"}
+}
+
+// fit returns the size a width by height result is made at
+func (l outputLimits) fit(width, height int) (int, int, error) {
+	factor := 1.0
+	if l.maxDimension > 0 && max(width, height) > l.maxDimension {
+		factor = float64(l.maxDimension) / float64(max(width, height))
+	}
+	if l.maxPixels > 0 && int64(width)*int64(height) > l.maxPixels {
+		factor = min(factor, math.Sqrt(float64(l.maxPixels)/(float64(width)*float64(height))))
 	}
 
-	// If only width is specified, maintain aspect ratio
-	if width > 0 && height == 0 {
-		resized := resize.Resize(uint(width), 0, img, interpolation)
-		return resized, nil
+	if factor == 1 {
+		return width, height, nil
+	}
+	if !l.clamp {
+		return 0, 0, errOutputTooLarge
 	}
+	return max(int(float64(width)*factor), 1), max(int(float64(height)*factor), 1), nil
+}
 
-	// If only height is specified, maintain aspect ratio
-	if width == 0 && height > 0 {
-		resized := resize.Resize(0, uint(height), img, interpolation)
-		return resized, nil
+// message answers a request whose result was rejected
+func (l outputLimits) message() string {
+	return fmt.Sprintf("requested output is too large, results are at most %d pixels on either side and %d pixels in total", l.maxDimension, l.maxPixels)
+}
+
+// applyFormatInterpolation picks the configured interpolation of the source content type for requests without i:,
+// formats without an entry keep the default
+func applyFormatInterpolation(config *config.Config, params *validation.ImageContext, contentType string) {
+	if !params.InterpolationByFormat {
+		return
+	}
+	if interpolation, ok := config.InterpolationByFormat[contentType]; ok {
+		params.Interpolation = resize.InterpolationFunction(interpolation)
 	}
+}
+
+// resizedSize is the size resize.Resize makes an image of size at, a width or height of 0 keeps the aspect ratio
+func resizedSize(size image.Point, width, height int) (int, int) {
+	if size.X <= 0 || size.Y <= 0 {
+		return width, height
+	}
+	if width == 0 {
+		width = int(0.7 + float64(size.X)*float64(height)/float64(size.Y))
+	}
+	if height == 0 {
+		height = int(0.7 + float64(size.Y)*float64(width)/float64(size.X))
+	}
+	return width, height
+}
 
+// resizeImage resizes to the width and height, only one of them keeps the aspect ratio. The whole size is checked
+// against limits before anything is allocated for it
+func resizeImage(img image.Image, width int, height int, interpolation resize.InterpolationFunction, limits outputLimits) (image.Image, error) {
 	// If neither width nor height is specified, return original image
-	return img, nil
+	if width == 0 && height == 0 {
+		return img, nil
+	}
+
+	targetWidth, targetHeight := resizedSize(img.Bounds().Size(), width, height)
+	fitWidth, fitHeight, err := limits.fit(targetWidth, targetHeight)
+	if err != nil {
+		return nil, err
+	}
+	// A clamped result gets both sides, they keep the aspect ratio of the requested size
+	if fitWidth != targetWidth || fitHeight != targetHeight {
+		width, height = fitWidth, fitHeight
+	}
+
+	return resize.Resize(uint(width), uint(height), img, interpolation), nil
 }
@@ -0,0 +1,860 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/nfnt/resize"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"media-proxy/client"
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// newImageTestApp registers the image routes on a fresh app with an in-memory cache and no S3
+func newImageTestApp(t *testing.T, cfg *config.Config) *fiber.App {
+	t.Helper()
+
+	app, _, _ := newImageTestAppWithState(t, cfg)
+	return app
+}
+
+// newImageTestAppWithState is newImageTestApp that also returns the in-memory cache and the counters the routes report to
+func newImageTestAppWithState(t *testing.T, cfg *config.Config) (*fiber.App, *ristretto.Cache[string, CacheValue], *metrics.Metrics) {
+	t.Helper()
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	if cfg.EncoderThreads == 0 {
+		cfg.EncoderThreads = 1
+	}
+
+	app := fiber.New()
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	RegisterImageRoutes(zap.NewNop(), cache, cfg, app, counters, nil, nil, nil, newOriginClient(t, cfg), NewOriginRateLimiter(cfg))
+	return app, cache, counters
+}
+
+// newOriginClient creates the origin client for the config like main does, redirects are only validated when the
+// config sets a maximum
+func newOriginClient(t *testing.T, cfg *config.Config) *http.Client {
+	t.Helper()
+
+	control, err := PrivateOriginControl(cfg)
+	if err != nil {
+		t.Fatalf("failed to create the private origin control: %v", err)
+	}
+	httpClient := client.NewHTTPClient(cfg, control)
+	if cfg.MaxRedirects > 0 {
+		ValidateRedirects(httpClient, zap.NewNop(), cfg)
+	}
+	return httpClient
+}
+
+// serveOrigin starts an origin server that answers every request with the given body and content type
+func serveOrigin(t *testing.T, contentType string, body []byte) string {
+	t.Helper()
+
+	originURL, _ := serveCountingOrigin(t, contentType, body)
+	return originURL
+}
+
+// serveCountingOrigin is serveOrigin that also reports how many times the origin was hit
+func serveCountingOrigin(t *testing.T, contentType string, body []byte) (string, *atomic.Int32) {
+	t.Helper()
+
+	hits := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/source", hits
+}
+
+// encodePNG encodes a blank RGBA image of the given size
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// requestImage performs a GET /images/<path>/<base64 url> against the app
+func requestImage(t *testing.T, app *fiber.App, path, originURL string) *http.Response {
+	t.Helper()
+
+	target := "/images/" + path + base64.URLEncoding.EncodeToString([]byte(originURL))
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return response
+}
+
+func TestImageRequest_URLOriginContentType(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{})
+	originURL := serveOrigin(t, "image/png; charset=binary", encodePNG(t, 8, 8))
+
+	response := requestImage(t, app, "q:80/", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("expected content type image/png from the origin, got %q", contentType)
+	}
+}
+
+func TestImageRequest_HeicDisabled(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{HeicEnabled: false})
+	originURL := serveOrigin(t, "image/heic", []byte("not really heic"))
+
+	response := requestImage(t, app, "", originURL)
+	if response.StatusCode != fiber.StatusUnsupportedMediaType {
+		t.Errorf("expected 415 for heic with decoding disabled, got %d", response.StatusCode)
+	}
+}
+
+// decodeResponseImage decodes the response body, failing the test on a non-200 status
+func decodeResponseImage(t *testing.T, response *http.Response) (image.Image, string) {
+	t.Helper()
+
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+
+	img, format, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	return img, format
+}
+
+func TestImageRequest_TileFromURLOrigin(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{TilingEnabled: true, TileSize: 256, TilingOverviewSize: 2048, TilingLevelCacheMB: 16})
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 600, 400))
+
+	// 600px with 256px tiles: max level is 2
+	img, format := decodeResponseImage(t, requestImage(t, app, "tile:2/0/0/", originURL))
+	if format != "png" {
+		t.Errorf("expected the png source to be tiled as png, got %s", format)
+	}
+	if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 256 {
+		t.Errorf("expected a 256x256 tile, got %v", img.Bounds())
+	}
+
+	// Edge tile of the same level comes from the cached level without hitting the origin again
+	img, _ = decodeResponseImage(t, requestImage(t, app, "tile:2/2/1/", originURL))
+	if img.Bounds().Dx() != 88 || img.Bounds().Dy() != 144 {
+		t.Errorf("expected an 88x144 edge tile, got %v", img.Bounds())
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+
+	response := requestImage(t, app, "tile:2/3/0/", originURL)
+	if response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for an out-of-range tile, got %d", response.StatusCode)
+	}
+}
+
+func TestImageRequest_OverviewFromURLOrigin(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{TilingEnabled: true, TileSize: 256, TilingOverviewSize: 512})
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 1024, 256))
+
+	img, format := decodeResponseImage(t, requestImage(t, app, "", originURL))
+	if format != "png" {
+		t.Errorf("expected the png source to keep its format, got %s", format)
+	}
+	if img.Bounds().Dx() != 512 || img.Bounds().Dy() != 128 {
+		t.Errorf("expected a 512x128 overview, got %v", img.Bounds())
+	}
+}
+
+func TestImageRequest_TileSourceTooLarge(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{TilingEnabled: true, TileSize: 256, TilingMaxPixels: 1000})
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 100, 100))
+
+	response := requestImage(t, app, "tile:0/0/0/", originURL)
+	if response.StatusCode != fiber.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a source above the pixel limit, got %d", response.StatusCode)
+	}
+}
+
+func TestImageRequest_BytesServed(t *testing.T) {
+	app, cache, counters := newImageTestAppWithState(t, &config.Config{})
+	body := encodePNG(t, 8, 8)
+	originURL := serveOrigin(t, "image/png", body)
+
+	// Quality 100 passes the source through unchanged
+	requestImage(t, app, "q:100/", originURL)
+	if served := testutil.ToFloat64(counters.BytesServed.WithLabelValues("image", "false")); served != float64(len(body)) {
+		t.Errorf("expected %d fresh bytes, got %v", len(body), served)
+	}
+
+	// Cache writes are buffered, make sure the entry landed before requesting it again
+	cache.Wait()
+
+	requestImage(t, app, "q:100/", originURL)
+	if served := testutil.ToFloat64(counters.BytesServed.WithLabelValues("image", "true")); served != float64(len(body)) {
+		t.Errorf("expected %d cached bytes, got %v", len(body), served)
+	}
+
+	// Both responses are observed under their output format
+	if count := testutil.CollectAndCount(counters.OutputSizeBytes); count != 1 {
+		t.Errorf("expected a single output size series, got %d", count)
+	}
+}
+
+func TestImageRequest_OriginErrors(t *testing.T) {
+	app, _, counters := newImageTestAppWithState(t, &config.Config{})
+
+	// A closed server refuses the connection
+	server := httptest.NewServer(http.NotFoundHandler())
+	originURL := server.URL + "/source"
+	server.Close()
+
+	response := requestImage(t, app, "", originURL)
+	if response.StatusCode != fiber.StatusInternalServerError {
+		t.Fatalf("expected 500 for an unreachable origin, got %d", response.StatusCode)
+	}
+
+	// Without allowed origins the hostname isn't resolved
+	if errors := testutil.ToFloat64(counters.OriginErrors.WithLabelValues("image", "unknown")); errors != 1 {
+		t.Errorf("expected one origin error, got %v", errors)
+	}
+}
+
+func TestImageRequest_CorruptSource(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{})
+	originURL := serveOrigin(t, "image/png", []byte("not a png"))
+
+	response := requestImage(t, app, "w:4/", originURL)
+	if response.StatusCode != fiber.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a source that can't be decoded, got %d", response.StatusCode)
+	}
+}
+
+func TestImageRequest_AnimatedWebpSource(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{})
+	source := encodeAnimatedWebp(t, []image.Point{{8, 8}, {8, 8}}, []color.RGBA{{R: 255, A: 255}, {B: 255, A: 255}})
+	originURL := serveOrigin(t, "image/webp", source)
+
+	// Encoding needs the source decoded, its first frame is used
+	response := requestImage(t, app, "w:4/webp/", originURL)
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+	if width, _, err := readImageDimensions(body, "image/webp"); err != nil || width != 4 {
+		t.Errorf("expected a 4px wide still, got %d (%v)", width, err)
+	}
+}
+
+func TestImageRequest_EmptyOriginResponse(t *testing.T) {
+	app, cache, counters := newImageTestAppWithState(t, &config.Config{})
+	originURL, hits := serveCountingOrigin(t, "image/png", nil)
+
+	for i := 0; i < 2; i++ {
+		response := requestImage(t, app, "w:4/", originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusBadGateway || string(body) != "empty origin response" {
+			t.Fatalf("expected 502 for an empty origin response, got %d: %s", response.StatusCode, body)
+		}
+		cache.Wait()
+	}
+
+	// Nothing was cached, so the origin is asked again
+	if hits.Load() != 2 {
+		t.Errorf("expected the origin to be fetched twice, got %d", hits.Load())
+	}
+	if errors := testutil.ToFloat64(counters.OriginErrors.WithLabelValues("image", "unknown")); errors != 2 {
+		t.Errorf("expected two origin errors, got %v", errors)
+	}
+}
+
+// encodeCheckerboardPNG encodes a two color 1px checkerboard, which PNG packs into a few bytes while lossy WebP can't
+func encodeCheckerboardPNG(t *testing.T, size int) []byte {
+	t.Helper()
+
+	img := image.NewPaletted(image.Rect(0, 0, size, size), color.Palette{color.Black, color.White})
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetColorIndex(x, y, uint8((x+y)%2))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageRequest_AutoWebpKeepsSmallerOriginal(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{WebpAuto: true, WebpAutoMargin: 10, WebpAutoMaxPixels: 1 << 24})
+	original := encodeCheckerboardPNG(t, 256)
+	originURL, hits := serveCountingOrigin(t, "image/png", original)
+
+	response := requestImage(t, app, "", originURL)
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("expected the smaller png to win, got %q", contentType)
+	}
+	if !bytes.Equal(body, original) {
+		t.Errorf("expected the original bytes, got %d bytes instead of %d", len(body), len(original))
+	}
+
+	// The winning format is cached, the next request neither fetches nor encodes again
+	cache.Wait()
+	response = requestImage(t, app, "", originURL)
+	if contentType := response.Header.Get("Content-Type"); contentType != "image/png" {
+		t.Errorf("expected the cached png, got %q", contentType)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+}
+
+func TestImageRequest_RevalidatesWithOrigin(t *testing.T) {
+	cfg := &config.Config{CacheTTL: 60, CacheRevalidateTTL: 60}
+	app, cache, _ := newImageTestAppWithState(t, cfg)
+	body := encodePNG(t, 8, 8)
+
+	var hits, notModified atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	originURL := server.URL + "/source"
+
+	first, _ := io.ReadAll(requestImage(t, app, "q:100/", originURL).Body)
+	cache.Wait()
+
+	// Expire the entry as if its TTL had passed, it stays in memory for the revalidation
+	ok, _, params, err := validation.ProcessImageContextFromPath(zap.NewNop(), "q:100/"+base64.URLEncoding.EncodeToString([]byte(originURL)), cfg)
+	if !ok {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	key := cacheKey(cfg, params)
+	value, found := cache.Get(key)
+	if !found || value.OriginETag != `"v1"` {
+		t.Fatalf("expected the entry to be cached with the origin etag, got %+v", value)
+	}
+	value.Expires = time.Now().Add(-time.Second)
+	cache.Set(key, value, 1)
+	cache.Wait()
+
+	response := requestImage(t, app, "q:100/", originURL)
+	second, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusOK || !bytes.Equal(first, second) {
+		t.Fatalf("expected the cached image after revalidation, got %d", response.StatusCode)
+	}
+	if place := response.Header.Get("X-Cache-Place"); place != cachePlaceRevalidated {
+		t.Errorf("expected the revalidated entry to be served, got %q", place)
+	}
+	if hits.Load() != 2 || notModified.Load() != 1 {
+		t.Errorf("expected one full fetch and one conditional GET, got %d fetches and %d 304s", hits.Load(), notModified.Load())
+	}
+
+	// The TTL was extended, the next request is served without asking the origin
+	cache.Wait()
+	if value, _ := cache.Get(key); !value.Expires.After(time.Now().Add(30 * time.Second)) {
+		t.Errorf("expected the entry to be fresh again, expires %v", value.Expires)
+	}
+	requestImage(t, app, "q:100/", originURL)
+	if hits.Load() != 2 {
+		t.Errorf("expected the refreshed entry to be served from memory, got %d origin hits", hits.Load())
+	}
+}
+
+func TestImageRequest_ConditionalRequests(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{})
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", lastModified)
+		_, _ = w.Write(encodePNG(t, 8, 8))
+	}))
+	t.Cleanup(server.Close)
+	target := "/images/q:100/" + base64.URLEncoding.EncodeToString([]byte(server.URL+"/source"))
+
+	conditional := func(header, value string) *http.Response {
+		request := httptest.NewRequest(http.MethodGet, target, nil)
+		if header != "" {
+			request.Header.Set(header, value)
+		}
+		response, err := app.Test(request, -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return response
+	}
+
+	// The first response is processed fresh and carries the ETag of its bytes and the origin Last-Modified
+	response := conditional("", "")
+	etag := response.Header.Get("ETag")
+	if response.StatusCode != fiber.StatusOK || etag == "" || etag == `"v1"` {
+		t.Fatalf("expected 200 with an ETag of the variant, got %d with %q", response.StatusCode, etag)
+	}
+	if response.Header.Get("Last-Modified") != lastModified {
+		t.Errorf("expected the origin Last-Modified to be forwarded, got %q", response.Header.Get("Last-Modified"))
+	}
+
+	tests := []struct {
+		header, value string
+		status        int
+	}{
+		{"If-None-Match", etag, fiber.StatusNotModified},
+		{"If-None-Match", `"other"`, fiber.StatusOK},
+		{"If-Modified-Since", lastModified, fiber.StatusNotModified},
+		{"If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT", fiber.StatusOK},
+	}
+	for _, test := range tests {
+		response := conditional(test.header, test.value)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != test.status {
+			t.Errorf("%s %s: expected %d, got %d", test.header, test.value, test.status, response.StatusCode)
+		}
+		if test.status == fiber.StatusNotModified && len(body) != 0 {
+			t.Errorf("%s %s: expected no body with 304, got %d bytes", test.header, test.value, len(body))
+		}
+	}
+
+	// Other variants of the same source don't share the ETag
+	other := httptest.NewRequest(http.MethodGet, "/images/q:90/"+base64.URLEncoding.EncodeToString([]byte(server.URL+"/source")), nil)
+	other.Header.Set("If-None-Match", etag)
+	response, err := app.Test(other, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected another variant not to match the ETag, got %d", response.StatusCode)
+	}
+}
+
+func TestImageRequest_FormatInterpolation(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{InterpolationByFormat: map[string]int{"image/png": int(resize.NearestNeighbor)}})
+	originURL := serveOrigin(t, "image/png", encodeCheckerboardPNG(t, 64))
+
+	resized := func(path string) []byte {
+		response := requestImage(t, app, path, originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, response.StatusCode, body)
+		}
+		return body
+	}
+
+	// Without i: the png default applies, the result matches an explicit nearest neighbor resize
+	byFormat := resized("w:24/webp/")
+	if !bytes.Equal(byFormat, resized("w:24/i:0/webp/")) {
+		t.Errorf("expected the png default interpolation to be nearest neighbor")
+	}
+
+	// An explicit i: overrides the format default
+	if bytes.Equal(byFormat, resized("w:24/i:5/webp/")) {
+		t.Errorf("expected an explicit lanczos3 resize to differ from the format default")
+	}
+}
+
+// uploadImage performs a POST /images/<path> against the app with body as the image form file
+func uploadImage(t *testing.T, app *fiber.App, path string, body []byte) *http.Response {
+	t.Helper()
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="image"; filename="image.png"`)
+	header.Set("Content-Type", "image/png")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("failed to create form file: %v", err)
+	}
+	_, _ = part.Write(body)
+	_ = writer.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/images/"+path, &form)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return response
+}
+
+func TestImageUpload_MaxSize(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{Token: "secret", MaxImageSize: 1})
+
+	if response := uploadImage(t, app, "t:secret/q:80", encodePNG(t, 8, 8)); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected a small image to be accepted, got %d", response.StatusCode)
+	}
+
+	response := uploadImage(t, app, "t:secret/q:80", make([]byte, 1024*1024+1))
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected an image over the limit to get 413, got %d", response.StatusCode)
+	}
+}
+
+func TestImageRequest_ScaleWithDimensions(t *testing.T) {
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 200, 100))
+
+	// width returns the width of the WebP result, other formats are sent as is by the original format path
+	width := func(app *fiber.App, path string) int {
+		t.Helper()
+
+		response := requestImage(t, app, path+"webp/", originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+		}
+		width, _, err := readImageDimensions(body, "image/webp")
+		if err != nil {
+			t.Fatalf("failed to read the result dimensions: %v", err)
+		}
+		return width
+	}
+
+	// compose scales the resized image, dimensions keeps the requested width
+	for mode, expectedWidth := range map[string]int{"compose": 50, "dimensions": 100} {
+		app := newImageTestApp(t, &config.Config{ScaleWithDimensions: mode})
+		if got := width(app, "w:100/s:0.5/"); got != expectedWidth {
+			t.Errorf("%s: expected a width of %d, got %d", mode, expectedWidth, got)
+		}
+	}
+
+	app := newImageTestApp(t, &config.Config{ScaleWithDimensions: "reject"})
+	if response := requestImage(t, app, "w:100/s:0.5/webp/", originURL); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for scale with a width, got %d", response.StatusCode)
+	}
+	// Scale on its own is still accepted
+	if got := width(app, "s:0.5/"); got != 100 {
+		t.Errorf("expected scale alone to halve the width, got %d", got)
+	}
+}
+
+func TestImageRequest_OversizedOutput(t *testing.T) {
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 200, 100))
+	limits := &config.Config{MaxOutputDimension: 1000, MaxOutputPixels: 600_000, OversizedOutput: "reject"}
+
+	app := newImageTestApp(t, limits)
+	// The height alone is within the limits, the width that keeps the aspect ratio isn't
+	for _, path := range []string{"w:2000/webp/", "w:1000/h:1000/webp/", "h:600/webp/"} {
+		response := requestImage(t, app, path, originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", path, response.StatusCode, body)
+		}
+	}
+	if response := requestImage(t, app, "w:400/webp/", originURL); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected a result within the limits to be served, got %d", response.StatusCode)
+	}
+
+	clamp := *limits
+	clamp.OversizedOutput = "clamp"
+	app = newImageTestApp(t, &clamp)
+	for path, expected := range map[string]image.Point{"w:2000/webp/": {1000, 500}, "w:1000/h:1000/webp/": {774, 774}} {
+		response := requestImage(t, app, path, originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", path, response.StatusCode, body)
+		}
+		width, height, err := readImageDimensions(body, "image/webp")
+		if err != nil {
+			t.Fatalf("failed to read the result dimensions: %v", err)
+		}
+		if width != expected.X || height != expected.Y {
+			t.Errorf("%s: expected %v, got %dx%d", path, expected, width, height)
+		}
+	}
+}
+
+func TestImageRequest_ContentAddressedCache(t *testing.T) {
+	var mu sync.Mutex
+	etag, body := `"v1"`, encodePNG(t, 8, 8)
+	var gets, heads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	originURL := server.URL + "/source"
+
+	// aspect requests a resize and returns the aspect ratio of the result in percent
+	aspect := func(app *fiber.App, cache *ristretto.Cache[string, CacheValue]) int {
+		t.Helper()
+
+		response := requestImage(t, app, "w:4/webp/", originURL)
+		result, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", response.StatusCode, result)
+		}
+		cache.Wait()
+		width, height, err := readImageDimensions(result, "image/webp")
+		if err != nil {
+			t.Fatalf("failed to read the result dimensions: %v", err)
+		}
+		return width * 100 / height
+	}
+
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{ContentAddressedCache: true})
+	aspect(app, cache)
+	aspect(app, cache)
+	if gets.Load() != 1 || heads.Load() != 2 {
+		t.Fatalf("expected an unchanged source to be served from the cache after a HEAD, got %d GETs and %d HEADs", gets.Load(), heads.Load())
+	}
+
+	// The origin updates the source, the next request keys on the new ETag and fetches it
+	mu.Lock()
+	etag, body = `"v2"`, encodePNG(t, 16, 8)
+	mu.Unlock()
+	if ratio := aspect(app, cache); ratio != 200 {
+		t.Errorf("expected the updated source to be served, got an aspect ratio of %d%%", ratio)
+	}
+	if gets.Load() != 2 {
+		t.Errorf("expected the updated source to be fetched, got %d GETs", gets.Load())
+	}
+
+	// Without it the cached result is served and the origin isn't asked
+	gets.Store(0)
+	heads.Store(0)
+	app, cache, _ = newImageTestAppWithState(t, &config.Config{})
+	aspect(app, cache)
+	aspect(app, cache)
+	if gets.Load() != 1 || heads.Load() != 0 {
+		t.Errorf("expected no HEAD requests when disabled, got %d GETs and %d HEADs", gets.Load(), heads.Load())
+	}
+}
+
+// encodeNoisyJPEG encodes an image whose details depend on the encoding quality
+func encodeNoisyJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, color.RGBA{R: uint8(x * 7 % 256), G: uint8(y * 13 % 256), B: uint8((x * y) % 256), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("failed to encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImageRequest_MaxQualityByFormat(t *testing.T) {
+	originURL := serveOrigin(t, "image/jpeg", encodeNoisyJPEG(t, 128, 128))
+
+	// The overview re-encodes the JPEG source as JPEG
+	render := func(cfg *config.Config, path string) []byte {
+		t.Helper()
+
+		cfg.TilingEnabled, cfg.TileSize, cfg.TilingOverviewSize = true, 32, 64
+		response := requestImage(t, newImageTestApp(t, cfg), path, originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK || response.Header.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("expected a JPEG, got %d %q", response.StatusCode, response.Header.Get("Content-Type"))
+		}
+		return body
+	}
+
+	clamped := render(&config.Config{MaxQualityByFormat: map[string]int{"image/jpeg": 90}}, "q:100/")
+	if !bytes.Equal(clamped, render(&config.Config{}, "q:90/")) {
+		t.Error("expected q:100 of a JPEG source to be encoded at the q:90 cap")
+	}
+	if unclamped := render(&config.Config{}, "q:100/"); len(unclamped) <= len(clamped) {
+		t.Errorf("expected the capped encode to be smaller, got %d bytes against %d", len(clamped), len(unclamped))
+	}
+}
+
+func TestImageRequest_ProgressiveJPEG(t *testing.T) {
+	originURL := serveOrigin(t, "image/jpeg", encodeNoisyJPEG(t, 128, 128))
+
+	// The overview re-encodes the JPEG source as JPEG, baseline frames start with the SOF0 marker and progressive
+	// ones with SOF2
+	for progressive, marker := range map[bool][]byte{false: {0xff, 0xc0}, true: {0xff, 0xc2}} {
+		cfg := &config.Config{JPEGProgressive: progressive, TilingEnabled: true, TileSize: 32, TilingOverviewSize: 64}
+		response := requestImage(t, newImageTestApp(t, cfg), "", originURL)
+		body, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusOK || response.Header.Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("expected a JPEG, got %d %q", response.StatusCode, response.Header.Get("Content-Type"))
+		}
+		if !bytes.Contains(body, marker) {
+			t.Errorf("expected the %x frame marker with APP_JPEG_PROGRESSIVE=%v", marker, progressive)
+		}
+		decoded, err := jpeg.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("expected the JPEG to decode with APP_JPEG_PROGRESSIVE=%v: %v", progressive, err)
+		}
+		if size := decoded.Bounds().Size(); size.X > 64 || size.Y > 64 || size.X == 0 {
+			t.Errorf("expected an overview of at most 64x64, got %v", size)
+		}
+	}
+}
+
+func TestImageRequest_CoalescesConcurrentMisses(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{})
+
+	// The origin holds the first fetch until the other requests have arrived
+	release := make(chan struct{})
+	hits := &atomic.Int32{}
+	body := encodePNG(t, 40, 30)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	target := "/images/w:20/" + base64.URLEncoding.EncodeToString([]byte(server.URL+"/source"))
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 5)
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+			if err != nil {
+				t.Errorf("request failed: %v", err)
+				return
+			}
+			statuses[i] = response.StatusCode
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != fiber.StatusOK {
+			t.Errorf("expected request %d to be answered with 200, got %d", i, status)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the concurrent requests to fetch the origin once, got %d", hits.Load())
+	}
+}
+
+func TestImageRequest_NegativeCache(t *testing.T) {
+	app := newImageTestApp(t, &config.Config{NegativeCacheTTL: 1})
+
+	// The origin starts out missing the image and serves it later
+	found := &atomic.Bool{}
+	hits := &atomic.Int32{}
+	body := encodePNG(t, 40, 30)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if r.URL.Path == "/page" {
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte("<html></html>"))
+			return
+		}
+		if !found.Load() {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+
+	for range 2 {
+		response := requestImage(t, app, "", server.URL+"/source")
+		message, _ := io.ReadAll(response.Body)
+		if response.StatusCode != fiber.StatusNotFound || string(message) != "image not found at origin" {
+			t.Fatalf("expected 404 for a missing source, got %d: %s", response.StatusCode, message)
+		}
+	}
+	for range 2 {
+		if response := requestImage(t, app, "", server.URL+"/page"); response.StatusCode != fiber.StatusForbidden {
+			t.Fatalf("expected 403 for a source that isn't an image, got %d", response.StatusCode)
+		}
+	}
+	if hits.Load() != 2 {
+		t.Errorf("expected each failed source to be fetched once, got %d fetches", hits.Load())
+	}
+
+	// Once the TTL has passed the source is fetched again
+	found.Store(true)
+	time.Sleep(1100 * time.Millisecond)
+	if response := requestImage(t, app, "", server.URL+"/source"); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200 once the failure expired, got %d", response.StatusCode)
+	}
+	if hits.Load() != 3 {
+		t.Errorf("expected the source to be fetched again, got %d fetches", hits.Load())
+	}
+}
+
+func TestImageRequest_SourceDimensions(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{})
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 40, 30))
+
+	// Resized, the same result from memory, and passed through as is
+	for _, path := range []string{"w:10/", "w:10/", ""} {
+		response := requestImage(t, app, path, originURL)
+		cache.Wait()
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200 for %q, got %d", path, response.StatusCode)
+		}
+		if width, height := response.Header.Get("X-Image-Width"), response.Header.Get("X-Image-Height"); width != "40" || height != "30" {
+			t.Errorf("expected the source dimensions 40x30 for %q, got %sx%s", path, width, height)
+		}
+	}
+}
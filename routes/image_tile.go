@@ -0,0 +1,155 @@
+package routes
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/nfnt/resize"
+
+	"media-proxy/validation"
+)
+
+// subImager is implemented by all standard library image types and allows cropping without copying
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+// tileMaxLevel returns the zoom level at which the image is served at full resolution.
+// Level 0 fits the whole image into a single tile, every next level doubles the resolution.
+func tileMaxLevel(bounds image.Rectangle, tileSize int) int {
+	longest := max(bounds.Dx(), bounds.Dy())
+	if longest <= tileSize {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(float64(longest) / float64(tileSize))))
+}
+
+// tileLevelImage renders pyramid level z of the source image.
+// The full resolution level is the source itself, lower levels are downscaled by a power of two.
+func tileLevelImage(img image.Image, tileSize, z int, interpolation resize.InterpolationFunction) (image.Image, error) {
+	bounds := img.Bounds()
+	maxLevel := tileMaxLevel(bounds, tileSize)
+	if z > maxLevel {
+		return nil, fmt.Errorf("tile level %d exceeds maximum level %d", z, maxLevel)
+	}
+	if z == maxLevel {
+		return img, nil
+	}
+
+	scale := math.Pow(2, float64(z-maxLevel))
+	levelWidth := int(math.Ceil(float64(bounds.Dx()) * scale))
+	levelHeight := int(math.Ceil(float64(bounds.Dy()) * scale))
+
+	return resize.Resize(uint(levelWidth), uint(levelHeight), img, interpolation), nil
+}
+
+// cropTile cuts the x/y tile out of a pyramid level.
+// Edge tiles are smaller than tileSize when the level dimensions are not a multiple of it.
+func cropTile(level image.Image, tileSize, x, y int) (image.Image, error) {
+	bounds := level.Bounds()
+
+	// Compare against the tile counts before multiplying, huge coordinates would overflow
+	columns := (bounds.Dx() + tileSize - 1) / tileSize
+	rows := (bounds.Dy() + tileSize - 1) / tileSize
+	if x >= columns || y >= rows {
+		return nil, fmt.Errorf("tile %d/%d is out of range", x, y)
+	}
+
+	left, top := bounds.Min.X+x*tileSize, bounds.Min.Y+y*tileSize
+	region := image.Rect(left, top, min(left+tileSize, bounds.Max.X), min(top+tileSize, bounds.Max.Y))
+
+	cropper, ok := level.(subImager)
+	if !ok {
+		return nil, fmt.Errorf("image type %T does not support cropping", level)
+	}
+	return cropper.SubImage(region), nil
+}
+
+// renderTile crops the region addressed by z/x/y out of the source image
+func renderTile(img image.Image, tileSize, z, x, y int, interpolation resize.InterpolationFunction) (image.Image, error) {
+	level, err := tileLevelImage(img, tileSize, z, interpolation)
+	if err != nil {
+		return nil, err
+	}
+	return cropTile(level, tileSize, x, y)
+}
+
+// needsOverview reports whether an image exceeds the overview size and should be downscaled when served without a tile
+func needsOverview(width, height, overviewSize int) bool {
+	return overviewSize > 0 && max(width, height) > overviewSize
+}
+
+// renderOverview downscales the image so its longest side fits into overviewSize, keeping the aspect ratio
+func renderOverview(img image.Image, overviewSize int, interpolation resize.InterpolationFunction) image.Image {
+	return resize.Thumbnail(uint(overviewSize), uint(overviewSize), img, interpolation)
+}
+
+// exceedsPixelLimit reports whether a source is too large to be fully decoded for tiling, 0 disables the limit
+func exceedsPixelLimit(width, height int, maxPixels int64) bool {
+	return maxPixels > 0 && int64(width)*int64(height) > maxPixels
+}
+
+// tileLevel is a decoded pyramid level of a tiled source
+type tileLevel struct {
+	Image       image.Image
+	ContentType string // content type of the source, used to pick the output format
+}
+
+// tileLevelCache keeps decoded pyramid levels of tiled sources,
+// so further tiles of the same level are cropped without fetching and decoding the source again.
+// A nil cache is valid and never hits.
+type tileLevelCache struct {
+	cache *ristretto.Cache[string, tileLevel]
+	ttl   time.Duration
+}
+
+// newTileLevelCache creates a level cache bounded by the decoded size of the cached levels
+func newTileLevelCache(maxBytes int64, ttl time.Duration) (*tileLevelCache, error) {
+	if maxBytes <= 0 {
+		return nil, nil
+	}
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, tileLevel]{
+		NumCounters: 1e5,
+		MaxCost:     maxBytes,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tileLevelCache{cache: cache, ttl: ttl}, nil
+}
+
+// tileLevelKey identifies level z of the source addressed by the request
+func tileLevelKey(params *validation.ImageContext, z int) string {
+	source := "url=" + params.Url
+	if params.CustomObjectKey != "" {
+		source = "location=" + params.CustomObjectKey
+	}
+	return source + ";level=" + strconv.Itoa(z) + ";interpolation=" + strconv.Itoa(int(params.Interpolation))
+}
+
+func (t *tileLevelCache) get(params *validation.ImageContext, z int) (tileLevel, bool) {
+	if t == nil {
+		return tileLevel{}, false
+	}
+	return t.cache.Get(tileLevelKey(params, z))
+}
+
+func (t *tileLevelCache) set(params *validation.ImageContext, z int, level tileLevel) {
+	if t == nil {
+		return
+	}
+
+	// Decoded images take roughly 4 bytes per pixel
+	bounds := level.Image.Bounds()
+	cost := int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+	t.cache.SetWithTTL(tileLevelKey(params, z), level, cost, t.ttl)
+	// Tiles of a level are requested together, the write has to land before the next ones look for it
+	t.cache.Wait()
+}
@@ -0,0 +1,149 @@
+package routes
+
+import (
+	"image"
+	"testing"
+	"time"
+
+	"github.com/nfnt/resize"
+
+	"media-proxy/validation"
+)
+
+func TestRenderOverview(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4000, 1000))
+
+	if !needsOverview(4000, 1000, 2048) {
+		t.Fatalf("expected 4000x1000 image to need an overview")
+	}
+	if needsOverview(2048, 1000, 2048) {
+		t.Fatalf("expected 2048x1000 image not to need an overview")
+	}
+
+	overview := renderOverview(img, 2048, resize.Bilinear)
+	if overview.Bounds().Dx() != 2048 || overview.Bounds().Dy() != 512 {
+		t.Fatalf("expected 2048x512 overview, got %dx%d", overview.Bounds().Dx(), overview.Bounds().Dy())
+	}
+}
+
+func TestRenderTile(t *testing.T) {
+	// 1000x600 with 256px tiles: max level is 2 (1024 >= 1000)
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 600))
+
+	if level := tileMaxLevel(img.Bounds(), 256); level != 2 {
+		t.Fatalf("expected max level 2, got %d", level)
+	}
+
+	// Full resolution tile is a plain crop
+	tile, err := renderTile(img, 256, 2, 1, 1, resize.Bilinear)
+	if err != nil {
+		t.Fatalf("renderTile failed: %v", err)
+	}
+	if tile.Bounds() != image.Rect(256, 256, 512, 512) {
+		t.Fatalf("unexpected tile bounds: %v", tile.Bounds())
+	}
+
+	// Edge tile at full resolution is clipped to the image
+	tile, err = renderTile(img, 256, 2, 3, 2, resize.Bilinear)
+	if err != nil {
+		t.Fatalf("renderTile failed: %v", err)
+	}
+	if tile.Bounds().Dx() != 232 || tile.Bounds().Dy() != 88 {
+		t.Fatalf("expected 232x88 edge tile, got %dx%d", tile.Bounds().Dx(), tile.Bounds().Dy())
+	}
+
+	// Level 0 fits the whole image into a single tile
+	tile, err = renderTile(img, 256, 0, 0, 0, resize.Bilinear)
+	if err != nil {
+		t.Fatalf("renderTile failed: %v", err)
+	}
+	if tile.Bounds().Dx() != 250 || tile.Bounds().Dy() != 150 {
+		t.Fatalf("expected 250x150 level 0 tile, got %dx%d", tile.Bounds().Dx(), tile.Bounds().Dy())
+	}
+}
+
+func TestRenderTile_OutOfRange(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 600))
+
+	if _, err := renderTile(img, 256, 3, 0, 0, resize.Bilinear); err == nil {
+		t.Fatalf("expected error for level above maximum")
+	}
+	if _, err := renderTile(img, 256, 2, 4, 0, resize.Bilinear); err == nil {
+		t.Fatalf("expected error for column out of range")
+	}
+	if _, err := renderTile(img, 256, 2, 0, 3, resize.Bilinear); err == nil {
+		t.Fatalf("expected error for row out of range")
+	}
+	if _, err := renderTile(img, 256, 1, 1<<56, 0, resize.Bilinear); err == nil {
+		t.Fatalf("expected error for a column that overflows when multiplied by the tile size")
+	}
+}
+
+func TestTileLevelImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1000, 600))
+
+	// The full resolution level is the source itself
+	level, err := tileLevelImage(img, 256, 2, resize.Bilinear)
+	if err != nil {
+		t.Fatalf("tileLevelImage failed: %v", err)
+	}
+	if level != image.Image(img) {
+		t.Fatal("expected the full resolution level to reuse the source")
+	}
+
+	level, err = tileLevelImage(img, 256, 1, resize.Bilinear)
+	if err != nil {
+		t.Fatalf("tileLevelImage failed: %v", err)
+	}
+	if level.Bounds().Dx() != 500 || level.Bounds().Dy() != 300 {
+		t.Fatalf("expected 500x300 level 1, got %dx%d", level.Bounds().Dx(), level.Bounds().Dy())
+	}
+
+	if _, err := tileLevelImage(img, 256, 3, resize.Bilinear); err == nil {
+		t.Fatal("expected error for level above maximum")
+	}
+}
+
+func TestExceedsPixelLimit(t *testing.T) {
+	if !exceedsPixelLimit(20000, 20000, 1<<28) {
+		t.Error("expected 400MP to exceed a 268MP limit")
+	}
+	if exceedsPixelLimit(10000, 10000, 1<<28) {
+		t.Error("expected 100MP to fit a 268MP limit")
+	}
+	if exceedsPixelLimit(100000, 100000, 0) {
+		t.Error("expected a zero limit to disable the check")
+	}
+}
+
+func TestTileLevelCache(t *testing.T) {
+	levels, err := newTileLevelCache(1<<24, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+
+	params := &validation.ImageContext{Url: "https://example.com/map.tiff", Interpolation: resize.Bilinear}
+	levels.set(params, 1, tileLevel{Image: image.NewRGBA(image.Rect(0, 0, 500, 300)), ContentType: "image/tiff"})
+	levels.cache.Wait()
+
+	level, ok := levels.get(params, 1)
+	if !ok || level.ContentType != "image/tiff" {
+		t.Fatalf("expected cached level 1, got ok=%v level=%+v", ok, level)
+	}
+
+	if _, ok := levels.get(params, 0); ok {
+		t.Error("expected level 0 not to be cached")
+	}
+
+	other := &validation.ImageContext{Url: "https://example.com/other.tiff", Interpolation: resize.Bilinear}
+	if _, ok := levels.get(other, 1); ok {
+		t.Error("expected levels to be keyed by source")
+	}
+
+	// A nil cache never hits
+	var disabled *tileLevelCache
+	disabled.set(params, 1, level)
+	if _, ok := disabled.get(params, 1); ok {
+		t.Error("expected a nil cache to miss")
+	}
+}
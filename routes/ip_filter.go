@@ -0,0 +1,96 @@
+package routes
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// IPFilter answers 403 to clients in APP_DENIED_IPS and, when APP_ALLOWED_IPS is set, to clients outside of it.
+// The client is the peer address, or the address X-Forwarded-For names when the peer is in APP_TRUSTED_PROXIES.
+// Returns nil when neither list is set
+func IPFilter(config *config.Config) (fiber.Handler, error) {
+	if len(config.AllowedIPs) == 0 && len(config.DeniedIPs) == 0 {
+		return nil, nil
+	}
+
+	allowed, err := parsePrefixes(config.AllowedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed ips: %w", err)
+	}
+	denied, err := parsePrefixes(config.DeniedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied ips: %w", err)
+	}
+	trusted, err := parsePrefixes(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
+
+	return func(c *fiber.Ctx) error {
+		ip := clientIP(c, trusted)
+		if !ip.IsValid() || containsAddr(denied, ip) || (len(allowed) > 0 && !containsAddr(allowed, ip)) {
+			return c.Status(fiber.StatusForbidden).SendString("client is not allowed")
+		}
+		return c.Next()
+	}, nil
+}
+
+// clientIP returns the address of the client. Behind trusted proxies it is the rightmost X-Forwarded-For entry that
+// isn't a trusted proxy itself, entries left of it were sent by the client and could be made up
+func clientIP(c *fiber.Ctx, trusted []netip.Prefix) netip.Addr {
+	peer, _ := netip.AddrFromSlice(c.Context().RemoteIP())
+	peer = peer.Unmap()
+	if !containsAddr(trusted, peer) {
+		return peer
+	}
+
+	forwarded := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	client := peer
+	for _, entry := range slices.Backward(forwarded) {
+		addr, err := netip.ParseAddr(strings.TrimSpace(entry))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !containsAddr(trusted, client) {
+			break
+		}
+	}
+	return client
+}
+
+// parsePrefixes parses CIDR ranges, single addresses are taken as a range of one
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// containsAddr reports whether any of the prefixes contains the address
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// newIPFilterApp serves 200 on / behind the IP filter of the config. Requests made with app.Test come from 0.0.0.0
+func newIPFilterApp(t *testing.T, cfg *config.Config) *fiber.App {
+	t.Helper()
+
+	filter, err := IPFilter(cfg)
+	if err != nil {
+		t.Fatalf("failed to create the filter: %v", err)
+	}
+	app := fiber.New()
+	app.Use(filter)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	return app
+}
+
+// requestFrom performs a GET / with the X-Forwarded-For header unless it is empty
+func requestFrom(t *testing.T, app *fiber.App, forwardedFor string) int {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if forwardedFor != "" {
+		request.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return response.StatusCode
+}
+
+func TestIPFilter(t *testing.T) {
+	if filter, err := IPFilter(&config.Config{}); filter != nil || err != nil {
+		t.Errorf("expected no filter without lists, got %v", err)
+	}
+	if _, err := IPFilter(&config.Config{AllowedIPs: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("expected an invalid range to be rejected")
+	}
+
+	// Without trusted proxies the peer address counts, a forwarded address is ignored
+	app := newIPFilterApp(t, &config.Config{AllowedIPs: []string{"10.0.0.0/8"}})
+	if status := requestFrom(t, app, "10.1.2.3"); status != fiber.StatusForbidden {
+		t.Errorf("expected an untrusted X-Forwarded-For to be ignored, got %d", status)
+	}
+
+	app = newIPFilterApp(t, &config.Config{AllowedIPs: []string{"0.0.0.0"}})
+	if status := requestFrom(t, app, ""); status != fiber.StatusOK {
+		t.Errorf("expected an allowed peer to pass, got %d", status)
+	}
+
+	// Denied addresses win over allowed ones
+	app = newIPFilterApp(t, &config.Config{AllowedIPs: []string{"0.0.0.0/0"}, DeniedIPs: []string{"0.0.0.0"}})
+	if status := requestFrom(t, app, ""); status != fiber.StatusForbidden {
+		t.Errorf("expected a denied peer to be refused, got %d", status)
+	}
+}
+
+func TestIPFilter_TrustedProxies(t *testing.T) {
+	app := newIPFilterApp(t, &config.Config{
+		AllowedIPs:     []string{"10.0.0.0/8"},
+		DeniedIPs:      []string{"10.6.6.6"},
+		TrustedProxies: []string{"0.0.0.0", "192.168.0.0/16"},
+	})
+
+	tests := []struct {
+		forwardedFor string
+		status       int
+	}{
+		{"10.1.2.3", fiber.StatusOK},
+		{"10.6.6.6", fiber.StatusForbidden},
+		{"203.0.113.9", fiber.StatusForbidden},
+		// Trusted proxies in the chain are skipped
+		{"10.1.2.3, 192.168.1.1", fiber.StatusOK},
+		// Entries left of the client were sent by it and aren't trusted
+		{"10.1.2.3, 203.0.113.9", fiber.StatusForbidden},
+		{"203.0.113.9, 10.1.2.3", fiber.StatusOK},
+		// Without a forwarded address the proxy itself is the client
+		{"", fiber.StatusForbidden},
+	}
+	for _, test := range tests {
+		if status := requestFrom(t, app, test.forwardedFor); status != test.status {
+			t.Errorf("%q: expected %d, got %d", test.forwardedFor, test.status, status)
+		}
+	}
+}
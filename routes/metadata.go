@@ -0,0 +1,159 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// mediaMetadata describes a source image or video, details that can't be read are left out
+type mediaMetadata struct {
+	Format string `json:"format"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// Size is the length of the source in bytes
+	Size int64 `json:"size,omitempty"`
+
+	// Duration is in seconds, FPS is the average frame rate
+	Duration float64 `json:"duration,omitempty"`
+	Codec    string  `json:"codec,omitempty"`
+	FPS      float64 `json:"fps,omitempty"`
+}
+
+// metadataCacheKey keys the metadata of a source in the memory cache. Only the source is part of it, the metadata of
+// a source is the same whatever else the path holds
+func metadataCacheKey(config *config.Config, params *validation.ImageContext, kind string) string {
+	if params.CustomObjectKey != "" {
+		return kind + "-meta;location=" + params.CustomObjectKey
+	}
+	return kind + "-meta;url=" + cacheSourceURL(config, params.Url)
+}
+
+// cachedMetadata returns the metadata cached under key and true, or reads it with read and caches it. read answers the
+// request itself and returns nil when it fails
+func cachedMetadata(cache *ristretto.Cache[string, CacheValue], config *config.Config, key string, read func() (*mediaMetadata, error)) (*mediaMetadata, bool, error) {
+	if value, ok := cache.Get(key); ok {
+		var metadata mediaMetadata
+		if err := json.Unmarshal(value.Body, &metadata); err == nil {
+			return &metadata, true, nil
+		}
+	}
+
+	metadata, err := read()
+	if metadata == nil {
+		return nil, false, err
+	}
+
+	if body, err := json.Marshal(metadata); err == nil {
+		cache.SetWithTTL(key, CacheValue{Body: body, ContentType: fiber.MIMEApplicationJSON}, 1000, cacheTTL(config))
+	}
+	return metadata, false, nil
+}
+
+// sendMetadata answers with the metadata cached under key, read as in cachedMetadata on a miss
+func sendMetadata(c *fiber.Ctx, cache *ristretto.Cache[string, CacheValue], config *config.Config, params *validation.ImageContext, key string, read func() (*mediaMetadata, error)) error {
+	metadata, cached, err := cachedMetadata(cache, config, key, read)
+	if metadata == nil {
+		return err
+	}
+
+	c.Set("Cache-Control", cacheControl(config, params))
+	if cached {
+		c.Set("X-Cache-Place", cachePlaceResponseHandler)
+	}
+	return c.JSON(metadata)
+}
+
+// handleImageMetadataRequest answers GET /images/meta/* with the format, dimensions and size of the source image.
+// The path is validated like GET /images/*, only the source is looked at
+func handleImageMetadataRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		pathParams := c.Params("*")
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+		if !ok {
+			logger.Error("failed to process image context from path", zap.String("pathParams", pathParams), zap.Int("status", status), zap.Error(err))
+			return c.Status(status).SendString(err.Error())
+		}
+
+		return sendMetadata(c, cache, config, params, metadataCacheKey(config, params, "image"), func() (*mediaMetadata, error) {
+			body, contentType, _, err := fetchImageSource(c, logger, config, counters, params, s3cache, httpClient, origins, nil, nil)
+			if body == nil {
+				return nil, err
+			}
+
+			metadata := &mediaMetadata{Format: contentType, Size: int64(len(body))}
+			// Documents and sources whose header can't be read go without dimensions rather than being decoded
+			if width, height, err := readImageDimensions(body, contentType); err == nil {
+				metadata.Width, metadata.Height = width, height
+			}
+			return metadata, nil
+		})
+	}
+}
+
+// handleVideoMetadataRequest answers GET /videos/meta/* with the format, dimensions, size, duration, codec and frame
+// rate of the source video. They are read from the container and stream headers, no frame is decoded
+func handleVideoMetadataRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, c.Params("*"), config)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+
+		return sendMetadata(c, cache, config, params, metadataCacheKey(config, params, "video"), func() (*mediaMetadata, error) {
+			return readVideoMetadata(c, logger, config, counters, params, s3cache, inputs, extractor, failures, httpClient, origins, "video-meta")
+		})
+	}
+}
+
+// readVideoMetadata checks the source of a video request and probes it. kind labels the origin error metrics. On
+// failure the request has been answered and the metadata is nil
+func readVideoMetadata(c *fiber.Ctx, logger *zap.Logger, config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, httpClient *http.Client, origins *OriginRateLimiter, kind string) (*mediaMetadata, error) {
+	source, err := resolveMediaSource(c, logger, config, counters, params, s3cache, failures, httpClient, origins, kind, videoMedia)
+	if source == nil {
+		return nil, err
+	}
+
+	video, err := extractor.ProbeVideo(source.URL, frameExtractionOptions{
+		Inputs:       inputs,
+		ProbeTimeout: time.Duration(config.VideoProbeTimeout) * time.Second,
+		Headers:      source.Headers,
+	})
+	if errors.Is(err, errProbeTimeout) {
+		logger.Error("video probe timed out", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		failures.add(source.FailureKey, probeFailure{Status: fiber.StatusGatewayTimeout, Message: "video probe timed out"})
+		return nil, c.Status(fiber.StatusGatewayTimeout).SendString("video probe timed out")
+	}
+	if err != nil {
+		logger.Error("failed to probe video", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		failures.add(source.FailureKey, probeFailure{Status: fiber.StatusInternalServerError, Message: "failed to probe video"})
+		return nil, c.Status(fiber.StatusInternalServerError).SendString("failed to probe video")
+	}
+	failures.forget(source.FailureKey)
+
+	metadata := &mediaMetadata{
+		Format:   source.ContentType,
+		Width:    video.Width,
+		Height:   video.Height,
+		Duration: video.Duration,
+		Codec:    video.Codec,
+		FPS:      video.FPS,
+	}
+	if source.Size > 0 {
+		metadata.Size = source.Size
+	}
+	return metadata, nil
+}
@@ -0,0 +1,152 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+// requestMetadata performs a GET <prefix>/meta/<base64 url> against the app and decodes the JSON answer
+func requestMetadata(t *testing.T, app *fiber.App, prefix, originURL string) (*http.Response, mediaMetadata) {
+	t.Helper()
+
+	target := prefix + "/meta/" + base64.URLEncoding.EncodeToString([]byte(originURL))
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	var metadata mediaMetadata
+	if response.StatusCode == fiber.StatusOK {
+		if err := json.NewDecoder(response.Body).Decode(&metadata); err != nil {
+			t.Fatalf("failed to decode metadata: %v", err)
+		}
+	}
+	return response, metadata
+}
+
+func TestImageMetadata(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{})
+	body := encodePNG(t, 40, 30)
+	originURL, hits := serveCountingOrigin(t, "image/png", body)
+
+	response, metadata := requestMetadata(t, app, "/images", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	expected := mediaMetadata{Format: "image/png", Width: 40, Height: 30, Size: int64(len(body))}
+	if metadata != expected {
+		t.Errorf("expected %+v, got %+v", expected, metadata)
+	}
+
+	// Repeated requests are answered from memory
+	cache.Wait()
+	if response, cached := requestMetadata(t, app, "/images", originURL); cached != expected || response.Header.Get("X-Cache-Place") != cachePlaceResponseHandler {
+		t.Errorf("expected the cached metadata, got %+v from %q", cached, response.Header.Get("X-Cache-Place"))
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected one origin fetch, got %d", hits.Load())
+	}
+
+	// Only images are described by the image route
+	if response, _ := requestMetadata(t, app, "/images", serveOrigin(t, "text/html", []byte("<html>"))); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 for a non-image source, got %d", response.StatusCode)
+	}
+}
+
+func TestVideoMetadata(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	extractor := &stubFrameExtractor{video: &probedVideo{Duration: 30, FPS: 25, Frames: 750, Width: 1080, Height: 1920, Codec: "h264"}}
+	app := fiber.New()
+	app.Get("/videos/meta/*", handleVideoMetadataRequest(zap.NewNop(), cache, cfg, counters, nil, newInputLimiter(0, nil), extractor, nil, newOriginClient(t, cfg), nil))
+
+	body := []byte("not decoded by the stub")
+	originURL := serveOrigin(t, "video/mp4", body)
+
+	response, metadata := requestMetadata(t, app, "/videos", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	expected := mediaMetadata{Format: "video/mp4", Width: 1080, Height: 1920, Size: int64(len(body)), Duration: 30, Codec: "h264", FPS: 25}
+	if metadata != expected {
+		t.Errorf("expected %+v, got %+v", expected, metadata)
+	}
+
+	cache.Wait()
+	requestMetadata(t, app, "/videos", originURL)
+	if extractor.calls != 1 {
+		t.Errorf("expected the video to be probed once, got %d probes", extractor.calls)
+	}
+
+	// Images aren't probed as videos
+	if response, _ := requestMetadata(t, app, "/videos", serveOrigin(t, "image/png", encodePNG(t, 8, 8))); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 for a non-video source, got %d", response.StatusCode)
+	}
+}
+
+func TestVideoProxy_MaxDuration(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{MaxVideoDuration: 3600}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	extractor := &stubFrameExtractor{video: &probedVideo{Duration: 7200}}
+	app := fiber.New()
+	app.Get("/videos/*", handleVideoProxyRequest(zap.NewNop(), cache, nil, cfg, counters, nil, newInputLimiter(0, nil), extractor, nil, newOriginClient(t, cfg), nil))
+
+	originURL, hits := serveCountingOrigin(t, "video/mp4", []byte("two hours of video"))
+	target := "/videos/" + base64.URLEncoding.EncodeToString([]byte(originURL))
+	for range 2 {
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if response.StatusCode != fiber.StatusUnprocessableEntity {
+			t.Errorf("expected 422 for a video over the limit, got %d", response.StatusCode)
+		}
+		cache.Wait()
+	}
+	// The duration is probed once, the video itself is never fetched
+	if extractor.calls != 1 || hits.Load() != 1 {
+		t.Errorf("expected one probe and only the content check at the origin, got %d probes and %d origin hits", extractor.calls, hits.Load())
+	}
+
+	// Shorter videos are proxied
+	extractor.video = &probedVideo{Duration: 60}
+	shortURL := serveOrigin(t, "video/mp4", []byte("one minute of video"))
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, "/videos/"+base64.URLEncoding.EncodeToString([]byte(shortURL)), nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected a video under the limit to be proxied, got %d", response.StatusCode)
+	}
+}
@@ -1,19 +1,31 @@
 package routes
 
 import (
+	"bytes"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/minio/minio-go/v7"
 	"github.com/redis/go-redis/v9"
 )
 
 const (
 	// DefaultChunkSize is 80MB per part
 	DefaultChunkSize = 80 * 1024 * 1024
+	// MinChunkSize is the smallest part S3 accepts in a multipart upload, only the last part may be smaller
+	MinChunkSize = 5 * 1024 * 1024
+	// MaxPartsCount is the most parts an S3 multipart upload can have
+	MaxPartsCount = 10000
 	// UploadKeyPrefix is the Redis key prefix for upload tracking
 	UploadKeyPrefix = "upload:"
 	// UploadTTL is how long upload tracking data is kept in Redis
@@ -24,13 +36,20 @@ const (
 type UploadPart struct {
 	Index  int   `json:"index"`
 	Offset int64 `json:"offset"`
-	Size   int64 `json:"size"`
+	Size   int64 `json:"size"` // declared size, never changes after init
+	// UploadedSize is the size actually received, which may be shorter than Size for the final part
+	UploadedSize int64 `json:"uploadedSize,omitempty"`
+	// ETag is what S3 returned for the part, needed to complete the upload
+	ETag string `json:"etag,omitempty"`
+	// Checksum is the client checksum the part was verified against, as "<algorithm>:<hex digest>"; empty when none was sent
+	Checksum string `json:"checksum,omitempty"`
 }
 
 // UploadInfo represents the multi-part upload tracking information
 type UploadInfo struct {
 	UploadID      string       `json:"uploadId"`
 	UploadToken   string       `json:"uploadToken"` // Token specific to this upload session
+	S3UploadID    string       `json:"s3UploadId"`  // ID of the S3 multipart upload receiving the parts
 	Location      string       `json:"location"`
 	TotalSize     int64        `json:"totalSize"`
 	ChunkSize     int64        `json:"chunkSize"`
@@ -42,6 +61,24 @@ type UploadInfo struct {
 	ExpiresAt     time.Time    `json:"expiresAt"`
 }
 
+// uploadedPart is what is recorded for an uploaded part
+type uploadedPart struct {
+	Size     int64  `json:"size"`
+	ETag     string `json:"etag,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// uploadPartsKey is the Redis set of uploaded part indexes. Parts are tracked apart from the upload info so concurrent
+// uploads mark them with single atomic commands instead of rewriting the upload info
+func uploadPartsKey(uploadID string) string {
+	return UploadKeyPrefix + uploadID + ":parts"
+}
+
+// uploadPartDetailsKey is the Redis hash of the uploadedPart records, keyed by part index
+func uploadPartDetailsKey(uploadID string) string {
+	return UploadKeyPrefix + uploadID + ":part-details"
+}
+
 // RedisUploadTracker manages multi-part upload state in Redis
 type RedisUploadTracker struct {
 	client *redis.Client
@@ -62,6 +99,14 @@ func NewRedisUploadTracker(addr, password string, db int) (*RedisUploadTracker,
 	return &RedisUploadTracker{client: client}, nil
 }
 
+// Ping checks that Redis is reachable
+func (r *RedisUploadTracker) Ping(ctx context.Context) error {
+	if r == nil || r.client == nil {
+		return fmt.Errorf("redis not configured")
+	}
+	return r.client.Ping(ctx).Err()
+}
+
 // Close closes the Redis connection
 func (r *RedisUploadTracker) Close() error {
 	if r == nil || r.client == nil {
@@ -80,7 +125,7 @@ func generateUploadToken() (string, error) {
 }
 
 // InitializeUpload creates upload tracking information and returns part details
-func (r *RedisUploadTracker) InitializeUpload(ctx context.Context, uploadID, location string, totalSize int64, chunkSize int64, contentType string, deadline time.Time) (*UploadInfo, error) {
+func (r *RedisUploadTracker) InitializeUpload(ctx context.Context, uploadID, s3UploadID, location string, totalSize int64, chunkSize int64, contentType string, deadline time.Time) (*UploadInfo, error) {
 	if r == nil || r.client == nil {
 		return nil, fmt.Errorf("redis not configured")
 	}
@@ -119,6 +164,7 @@ func (r *RedisUploadTracker) InitializeUpload(ctx context.Context, uploadID, loc
 	uploadInfo := &UploadInfo{
 		UploadID:      uploadID,
 		UploadToken:   uploadToken,
+		S3UploadID:    s3UploadID,
 		Location:      location,
 		TotalSize:     totalSize,
 		ChunkSize:     chunkSize,
@@ -142,7 +188,13 @@ func (r *RedisUploadTracker) InitializeUpload(ctx context.Context, uploadID, loc
 		ttl = UploadTTL
 	}
 
-	if err := r.client.Set(ctx, key, data, ttl).Err(); err != nil {
+	// Parts left over from an earlier upload with the same ID must not count for this one
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, ttl)
+		pipe.Del(ctx, uploadPartsKey(uploadID), uploadPartDetailsKey(uploadID))
+		return nil
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to store upload info: %w", err)
 	}
 
@@ -155,8 +207,16 @@ func (r *RedisUploadTracker) GetUploadInfo(ctx context.Context, uploadID string)
 		return nil, fmt.Errorf("redis not configured")
 	}
 
-	key := UploadKeyPrefix + uploadID
-	data, err := r.client.Get(ctx, key).Bytes()
+	// Read in one transaction, so a part is either fully marked or not at all
+	var infoCmd *redis.StringCmd
+	var partsCmd *redis.StringSliceCmd
+	var detailsCmd *redis.MapStringStringCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		infoCmd = pipe.Get(ctx, UploadKeyPrefix+uploadID)
+		partsCmd = pipe.SMembers(ctx, uploadPartsKey(uploadID))
+		detailsCmd = pipe.HGetAll(ctx, uploadPartDetailsKey(uploadID))
+		return nil
+	})
 	if err == redis.Nil {
 		return nil, fmt.Errorf("upload not found or expired")
 	}
@@ -165,53 +225,185 @@ func (r *RedisUploadTracker) GetUploadInfo(ctx context.Context, uploadID string)
 	}
 
 	var uploadInfo UploadInfo
-	if err := json.Unmarshal(data, &uploadInfo); err != nil {
+	if err := json.Unmarshal([]byte(infoCmd.Val()), &uploadInfo); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal upload info: %w", err)
 	}
 
+	if err := applyUploadedParts(&uploadInfo, partsCmd.Val(), detailsCmd.Val()); err != nil {
+		return nil, err
+	}
+
 	return &uploadInfo, nil
 }
 
-// MarkPartUploaded marks a part as uploaded
-func (r *RedisUploadTracker) MarkPartUploaded(ctx context.Context, uploadID string, partIndex int) error {
-	if r == nil || r.client == nil {
-		return fmt.Errorf("redis not configured")
+// PartSizeError reports an uploaded part whose size does not fit the layout computed at init
+type PartSizeError struct {
+	Index    int
+	Expected int64 // declared size, the upper bound for the final part
+	Actual   int64
+	Final    bool
+}
+
+func (e *PartSizeError) Error() string {
+	if e.Final {
+		return fmt.Sprintf("part size out of bounds: final part %d must be between 1 and %d bytes, got %d bytes", e.Index, e.Expected, e.Actual)
 	}
+	return fmt.Sprintf("part size mismatch: part %d must be exactly %d bytes, got %d bytes", e.Index, e.Expected, e.Actual)
+}
 
-	uploadInfo, err := r.GetUploadInfo(ctx, uploadID)
-	if err != nil {
-		return err
+// TooLarge reports whether the part exceeded its declared size
+func (e *PartSizeError) TooLarge() bool {
+	return e.Actual > e.Expected
+}
+
+// validatePartSize checks the size of an uploaded part against the layout computed at init.
+// Every part but the last one must match exactly; the final part may be shorter than declared.
+func validatePartSize(uploadInfo *UploadInfo, partIndex int, size int64) error {
+	expected := uploadInfo.Parts[partIndex].Size
+
+	if partIndex == uploadInfo.PartsCount-1 {
+		if size < 1 || size > expected {
+			return &PartSizeError{Index: partIndex, Expected: expected, Actual: size, Final: true}
+		}
+		return nil
+	}
+
+	if size != expected {
+		return &PartSizeError{Index: partIndex, Expected: expected, Actual: size}
+	}
+
+	return nil
+}
+
+// errChecksumMismatch is returned when a part doesn't match the checksum sent with it
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyPartChecksum checks the bytes of a part against a client checksum, "md5:<hex digest>" or "sha256:<hex digest>".
+// It returns the checksum in canonical form for recording
+func verifyPartChecksum(data []byte, checksum string) (string, error) {
+	algorithm, expected, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid checksum %q: expected <algorithm>:<hex digest>", checksum)
+	}
+
+	algorithm = strings.ToLower(algorithm)
+	var sum []byte
+	switch algorithm {
+	case "md5":
+		digest := md5.Sum(data)
+		sum = digest[:]
+	case "sha256":
+		digest := sha256.Sum256(data)
+		sum = digest[:]
+	default:
+		return "", fmt.Errorf("unsupported checksum algorithm %q: use md5 or sha256", algorithm)
 	}
 
-	// Check if part index is valid
+	expectedSum, err := hex.DecodeString(expected)
+	if err != nil || len(expectedSum) != len(sum) {
+		return "", fmt.Errorf("invalid %s checksum %q", algorithm, expected)
+	}
+	if !bytes.Equal(sum, expectedSum) {
+		return "", fmt.Errorf("%w: expected %s %x, got %x", errChecksumMismatch, algorithm, expectedSum, sum)
+	}
+
+	return algorithm + ":" + hex.EncodeToString(sum), nil
+}
+
+// recordPartUpload marks a part as uploaded and records its actual size, ETag and verified checksum.
+// The declared part sizes are kept, so a retried final part may come in at any size up to the declared one;
+// the total size follows the size of the latest final part.
+func recordPartUpload(uploadInfo *UploadInfo, partIndex int, size int64, etag, checksum string) error {
 	if partIndex < 0 || partIndex >= uploadInfo.PartsCount {
 		return fmt.Errorf("invalid part index: %d", partIndex)
 	}
 
-	// Check if already uploaded
+	uploadInfo.Parts[partIndex].UploadedSize = size
+	uploadInfo.Parts[partIndex].ETag = etag
+	uploadInfo.Parts[partIndex].Checksum = checksum
+	if partIndex == uploadInfo.PartsCount-1 && size > 0 {
+		uploadInfo.TotalSize = uploadInfo.Parts[partIndex].Offset + size
+	}
+
+	// Add to uploaded parts unless it is a re-upload
 	for _, uploaded := range uploadInfo.UploadedParts {
 		if uploaded == partIndex {
-			return nil // Already marked
+			return nil
 		}
 	}
-
-	// Add to uploaded parts
 	uploadInfo.UploadedParts = append(uploadInfo.UploadedParts, partIndex)
 
-	// Update in Redis
-	key := UploadKeyPrefix + uploadID
-	data, err := json.Marshal(uploadInfo)
+	return nil
+}
+
+// applyUploadedParts records the parts tracked in Redis on the upload info, the indexes come from the parts set and
+// the details from the part details hash. Parts are applied in index order, so UploadedParts comes out sorted
+func applyUploadedParts(uploadInfo *UploadInfo, indexes []string, details map[string]string) error {
+	sorted := make([]int, 0, len(indexes))
+	for _, index := range indexes {
+		partIndex, err := strconv.Atoi(index)
+		if err != nil {
+			return fmt.Errorf("invalid uploaded part index %q", index)
+		}
+		sorted = append(sorted, partIndex)
+	}
+	sort.Ints(sorted)
+
+	for _, partIndex := range sorted {
+		var part uploadedPart
+		if data, ok := details[strconv.Itoa(partIndex)]; ok {
+			if err := json.Unmarshal([]byte(data), &part); err != nil {
+				return fmt.Errorf("failed to unmarshal part %d: %w", partIndex, err)
+			}
+		}
+		if err := recordPartUpload(uploadInfo, partIndex, part.Size, part.ETag, part.Checksum); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MarkPartUploaded marks a part as uploaded and records its actual size, ETag and verified checksum.
+// A short final part shrinks the recorded total size accordingly. Marking is atomic, parts uploaded at the same
+// time don't overwrite each other
+func (r *RedisUploadTracker) MarkPartUploaded(ctx context.Context, uploadID string, partIndex int, size int64, etag, checksum string) error {
+	if r == nil || r.client == nil {
+		return fmt.Errorf("redis not configured")
+	}
+
+	uploadInfo, err := r.GetUploadInfo(ctx, uploadID)
 	if err != nil {
-		return fmt.Errorf("failed to marshal upload info: %w", err)
+		return err
 	}
 
-	// Keep the same TTL
+	if partIndex < 0 || partIndex >= uploadInfo.PartsCount {
+		return fmt.Errorf("invalid part index: %d", partIndex)
+	}
+
+	data, err := json.Marshal(uploadedPart{Size: size, ETag: etag, Checksum: checksum})
+	if err != nil {
+		return fmt.Errorf("failed to marshal part: %w", err)
+	}
+
+	// The part keys expire with the upload info
 	ttl := time.Until(uploadInfo.ExpiresAt)
 	if ttl <= 0 {
 		return fmt.Errorf("upload has expired")
 	}
+	if ttl > UploadTTL {
+		ttl = UploadTTL
+	}
 
-	if err := r.client.Set(ctx, key, data, ttl).Err(); err != nil {
+	partsKey, detailsKey := uploadPartsKey(uploadID), uploadPartDetailsKey(uploadID)
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, partsKey, partIndex)
+		pipe.HSet(ctx, detailsKey, strconv.Itoa(partIndex), data)
+		pipe.Expire(ctx, partsKey, ttl)
+		pipe.Expire(ctx, detailsKey, ttl)
+		return nil
+	})
+	if err != nil {
 		return fmt.Errorf("failed to update upload info: %w", err)
 	}
 
@@ -225,7 +417,59 @@ func (r *RedisUploadTracker) IsUploadComplete(ctx context.Context, uploadID stri
 		return false, err
 	}
 
-	return len(uploadInfo.UploadedParts) == uploadInfo.PartsCount, nil
+	uploaded, err := r.client.SCard(ctx, uploadPartsKey(uploadID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to count uploaded parts: %w", err)
+	}
+
+	return uploaded == int64(uploadInfo.PartsCount), nil
+}
+
+// missingParts lists the indexes of the parts not uploaded yet, in order
+func missingParts(uploadInfo *UploadInfo) []int {
+	uploaded := make(map[int]bool, len(uploadInfo.UploadedParts))
+	for _, index := range uploadInfo.UploadedParts {
+		uploaded[index] = true
+	}
+
+	missing := []int{}
+	for index := 0; index < uploadInfo.PartsCount; index++ {
+		if !uploaded[index] {
+			missing = append(missing, index)
+		}
+	}
+	return missing
+}
+
+// completedParts lists the uploaded parts in order for completing the S3 multipart upload, which numbers them from 1
+func completedParts(uploadInfo *UploadInfo) []minio.CompletePart {
+	parts := make([]minio.CompletePart, len(uploadInfo.Parts))
+	for i, part := range uploadInfo.Parts {
+		parts[i] = minio.CompletePart{PartNumber: part.Index + 1, ETag: part.ETag}
+	}
+	return parts
+}
+
+// changedParts lists the indexes of the checksum-verified parts whose ETag in S3, keyed by part number, is no longer
+// the one recorded when they were verified, in order. Such a part was replaced after the proxy checked it
+func changedParts(uploadInfo *UploadInfo, etags map[int]string) []int {
+	changed := []int{}
+	for _, part := range uploadInfo.Parts {
+		if part.Checksum != "" && etags[part.Index+1] != part.ETag {
+			changed = append(changed, part.Index)
+		}
+	}
+	return changed
+}
+
+// hasVerifiedParts reports whether any part was verified against a checksum
+func hasVerifiedParts(uploadInfo *UploadInfo) bool {
+	for _, part := range uploadInfo.Parts {
+		if part.Checksum != "" {
+			return true
+		}
+	}
+	return false
 }
 
 // DeleteUpload removes upload tracking information
@@ -235,5 +479,5 @@ func (r *RedisUploadTracker) DeleteUpload(ctx context.Context, uploadID string)
 	}
 
 	key := UploadKeyPrefix + uploadID
-	return r.client.Del(ctx, key).Err()
+	return r.client.Del(ctx, key, uploadPartsKey(uploadID), uploadPartDetailsKey(uploadID)).Err()
 }
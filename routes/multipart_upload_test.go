@@ -0,0 +1,318 @@
+package routes
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testUploadInfo(totalSize, chunkSize int64) *UploadInfo {
+	partsCount := int((totalSize + chunkSize - 1) / chunkSize)
+	parts := make([]UploadPart, partsCount)
+	for i := 0; i < partsCount; i++ {
+		size := chunkSize
+		if i == partsCount-1 {
+			size = totalSize - int64(i)*chunkSize
+		}
+		parts[i] = UploadPart{Index: i, Offset: int64(i) * chunkSize, Size: size}
+	}
+
+	return &UploadInfo{TotalSize: totalSize, ChunkSize: chunkSize, PartsCount: partsCount, Parts: parts}
+}
+
+// partSizeError unwraps a *PartSizeError, failing the test for any other error
+func partSizeError(t *testing.T, err error) *PartSizeError {
+	t.Helper()
+
+	var sizeErr *PartSizeError
+	if !errors.As(err, &sizeErr) {
+		t.Fatalf("expected a *PartSizeError, got %v", err)
+	}
+	return sizeErr
+}
+
+func TestValidatePartSize_ExactParts(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	for i, part := range info.Parts {
+		if err := validatePartSize(info, i, part.Size); err != nil {
+			t.Fatalf("part %d: expected OK, got %v", i, err)
+		}
+	}
+}
+
+func TestValidatePartSize_ShortFinalPart(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if err := validatePartSize(info, 2, 30); err != nil {
+		t.Fatalf("expected short final part to be accepted, got %v", err)
+	}
+
+	if sizeErr := partSizeError(t, validatePartSize(info, 2, 0)); sizeErr.TooLarge() {
+		t.Fatal("expected empty final part to be rejected as too small")
+	}
+}
+
+func TestValidatePartSize_OversizedPart(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if sizeErr := partSizeError(t, validatePartSize(info, 2, 51)); !sizeErr.TooLarge() {
+		t.Fatal("expected oversized final part to be rejected as too large")
+	}
+
+	if sizeErr := partSizeError(t, validatePartSize(info, 0, 101)); !sizeErr.TooLarge() {
+		t.Fatal("expected oversized part to be rejected as too large")
+	}
+}
+
+func TestValidatePartSize_ShortIntermediatePart(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if sizeErr := partSizeError(t, validatePartSize(info, 1, 99)); sizeErr.TooLarge() {
+		t.Fatal("expected short intermediate part to be rejected as too small")
+	}
+}
+
+func TestRecordPartUpload_ShortFinalPartRecomputesTotal(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	for i, size := range []int64{100, 100, 30} {
+		if err := recordPartUpload(info, i, size, "", ""); err != nil {
+			t.Fatalf("part %d: unexpected error: %v", i, err)
+		}
+	}
+
+	if info.TotalSize != 230 {
+		t.Errorf("expected total size 230 after a short final part, got %d", info.TotalSize)
+	}
+	if info.Parts[2].Size != 50 || info.Parts[2].UploadedSize != 30 {
+		t.Errorf("expected declared size 50 and uploaded size 30, got %d and %d", info.Parts[2].Size, info.Parts[2].UploadedSize)
+	}
+	if len(info.UploadedParts) != 3 {
+		t.Errorf("expected 3 uploaded parts, got %v", info.UploadedParts)
+	}
+}
+
+func TestRecordPartUpload_RetryFinalPartAtDeclaredSize(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if err := recordPartUpload(info, 2, 30, "", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A retry at the originally declared size must still validate and restore the total
+	if err := validatePartSize(info, 2, 50); err != nil {
+		t.Fatalf("expected retry at declared size to be accepted, got %v", err)
+	}
+	if err := recordPartUpload(info, 2, 50, "", ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if info.TotalSize != 250 {
+		t.Errorf("expected total size 250 after the retry, got %d", info.TotalSize)
+	}
+	if len(info.UploadedParts) != 1 {
+		t.Errorf("expected the retry not to duplicate the part, got %v", info.UploadedParts)
+	}
+}
+
+func TestRecordPartUpload_InvalidIndex(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if err := recordPartUpload(info, 3, 10, "", ""); err == nil {
+		t.Error("expected an error for an out-of-range part index")
+	}
+}
+
+func TestMissingParts(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	if missing := missingParts(info); len(missing) != 3 {
+		t.Errorf("expected every part to be missing, got %v", missing)
+	}
+
+	_ = recordPartUpload(info, 2, 50, `"c"`, "")
+	_ = recordPartUpload(info, 0, 100, `"a"`, "")
+	if missing := missingParts(info); len(missing) != 1 || missing[0] != 1 {
+		t.Errorf("expected part 1 to be missing, got %v", missing)
+	}
+
+	_ = recordPartUpload(info, 1, 100, `"b"`, "")
+	if missing := missingParts(info); len(missing) != 0 {
+		t.Errorf("expected no missing parts, got %v", missing)
+	}
+}
+
+func TestCompletedParts(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	// Parts uploaded out of order are completed in order, numbered from 1
+	_ = recordPartUpload(info, 2, 50, `"c"`, "")
+	_ = recordPartUpload(info, 0, 100, `"a"`, "")
+	_ = recordPartUpload(info, 1, 100, `"b"`, "")
+
+	parts := completedParts(info)
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+	for i, etag := range []string{`"a"`, `"b"`, `"c"`} {
+		if parts[i].PartNumber != i+1 || parts[i].ETag != etag {
+			t.Errorf("unexpected part %d: %+v", i, parts[i])
+		}
+	}
+}
+
+func TestVerifyPartChecksum(t *testing.T) {
+	data := []byte("part")
+
+	checksum, err := verifyPartChecksum(data, "MD5:"+fmt.Sprintf("%X", md5.Sum(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checksum != fmt.Sprintf("md5:%x", md5.Sum(data)) {
+		t.Errorf("expected the checksum in canonical form, got %q", checksum)
+	}
+
+	if _, err := verifyPartChecksum(data, fmt.Sprintf("sha256:%x", sha256.Sum256(data))); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = verifyPartChecksum([]byte("tampered"), fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("expected errChecksumMismatch, got %v", err)
+	}
+
+	for _, invalid := range []string{"d41d8cd98f00b204e9800998ecf8427e", "crc32:1234abcd", "md5:xyz", "md5:abcd"} {
+		if _, err := verifyPartChecksum(data, invalid); err == nil || errors.Is(err, errChecksumMismatch) {
+			t.Errorf("%q: expected an invalid checksum error, got %v", invalid, err)
+		}
+	}
+}
+
+func TestChangedParts(t *testing.T) {
+	info := testUploadInfo(250, 100)
+	_ = recordPartUpload(info, 0, 100, "a", "md5:00")
+	_ = recordPartUpload(info, 1, 100, "b", "")
+	_ = recordPartUpload(info, 2, 50, "c", "md5:02")
+
+	if !hasVerifiedParts(info) {
+		t.Fatal("expected verified parts")
+	}
+	if changed := changedParts(info, map[int]string{1: "a", 2: "b", 3: "c"}); len(changed) != 0 {
+		t.Errorf("expected no changed parts, got %v", changed)
+	}
+
+	// Only verified parts are checked, a replaced unverified part goes unnoticed
+	changed := changedParts(info, map[int]string{1: "a", 2: "x", 3: "y"})
+	if len(changed) != 1 || changed[0] != 2 {
+		t.Errorf("expected part 2 to have changed, got %v", changed)
+	}
+
+	// Re-uploading without a checksum drops the verification
+	_ = recordPartUpload(info, 0, 100, "a2", "")
+	_ = recordPartUpload(info, 2, 50, "c2", "")
+	if hasVerifiedParts(info) {
+		t.Error("expected no verified parts after re-uploads without checksums")
+	}
+}
+
+func TestApplyUploadedParts(t *testing.T) {
+	info := testUploadInfo(250, 100)
+
+	err := applyUploadedParts(info, []string{"2", "0"}, map[string]string{
+		"0": `{"size":100,"etag":"a","checksum":"md5:00"}`,
+		"2": `{"size":30,"etag":"c"}`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(info.UploadedParts) != 2 || info.UploadedParts[0] != 0 || info.UploadedParts[1] != 2 {
+		t.Errorf("expected parts 0 and 2 in order, got %v", info.UploadedParts)
+	}
+	if info.Parts[0].ETag != "a" || info.Parts[0].Checksum != "md5:00" || info.Parts[2].UploadedSize != 30 {
+		t.Errorf("expected the part details to be recorded, got %+v", info.Parts)
+	}
+	if info.TotalSize != 230 {
+		t.Errorf("expected the short final part to shrink the total size to 230, got %d", info.TotalSize)
+	}
+
+	if err := applyUploadedParts(testUploadInfo(250, 100), []string{"x"}, nil); err == nil {
+		t.Error("expected an error for an invalid index")
+	}
+	if err := applyUploadedParts(testUploadInfo(250, 100), []string{"3"}, nil); err == nil {
+		t.Error("expected an error for an out-of-range index")
+	}
+}
+
+// TestRedisUploadTracker_ConcurrentParts needs a Redis server, its address is read from MEDIA_PROXY_TEST_REDIS and the
+// test is skipped without it
+func TestRedisUploadTracker_ConcurrentParts(t *testing.T) {
+	addr := os.Getenv("MEDIA_PROXY_TEST_REDIS")
+	if addr == "" {
+		t.Skip("MEDIA_PROXY_TEST_REDIS is not set")
+	}
+
+	tracker, err := NewRedisUploadTracker(addr, "", 0)
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	t.Cleanup(func() { _ = tracker.Close() })
+
+	ctx := context.Background()
+	uploadID := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	const partsCount = 64
+	if _, err := tracker.InitializeUpload(ctx, uploadID, "s3-upload", "videos/test.mp4", partsCount*10, 10, "video/mp4", time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("failed to initialize upload: %v", err)
+	}
+	t.Cleanup(func() { _ = tracker.DeleteUpload(ctx, uploadID) })
+
+	// Every part is marked at the same time, none of them may get lost
+	var wg sync.WaitGroup
+	errs := make(chan error, partsCount)
+	for i := 0; i < partsCount; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			if err := tracker.MarkPartUploaded(ctx, uploadID, index, 10, fmt.Sprintf("etag-%d", index), ""); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("failed to mark part: %v", err)
+	}
+
+	complete, err := tracker.IsUploadComplete(ctx, uploadID)
+	if err != nil || !complete {
+		t.Fatalf("expected the upload to be complete, got %v (%v)", complete, err)
+	}
+
+	info, err := tracker.GetUploadInfo(ctx, uploadID)
+	if err != nil {
+		t.Fatalf("failed to get upload info: %v", err)
+	}
+	if len(info.UploadedParts) != partsCount {
+		t.Errorf("expected %d uploaded parts, got %d", partsCount, len(info.UploadedParts))
+	}
+	for i, part := range info.Parts {
+		if part.ETag != fmt.Sprintf("etag-%d", i) {
+			t.Errorf("part %d: expected its ETag to be recorded, got %q", i, part.ETag)
+		}
+	}
+
+	if err := tracker.DeleteUpload(ctx, uploadID); err != nil {
+		t.Fatalf("failed to delete upload: %v", err)
+	}
+	if _, err := tracker.GetUploadInfo(ctx, uploadID); err == nil {
+		t.Error("expected the upload to be gone")
+	}
+}
@@ -0,0 +1,43 @@
+//go:build nolibav
+
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Builds with the nolibav tag leave out the FFmpeg libraries and their cgo bindings.
+// Video previews then use the ffmpeg binaries and HEIC and AVIF sources can't be decoded
+
+// errLibavUnavailable is returned by the code paths that need the FFmpeg libraries
+var errLibavUnavailable = errors.New("built without the FFmpeg libraries (nolibav)")
+
+// libavAvailable reports that the FFmpeg libraries are linked in
+const libavAvailable = false
+
+// libavFrameExtractor is never selected without the FFmpeg libraries
+type libavFrameExtractor struct{}
+
+func (libavFrameExtractor) ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	return nil, errLibavUnavailable
+}
+
+func (libavFrameExtractor) ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error) {
+	return nil, errLibavUnavailable
+}
+
+func (libavFrameExtractor) ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error) {
+	return nil, errLibavUnavailable
+}
+
+func (libavFrameExtractor) ReadWaveform(urlStr string, buckets int, options frameExtractionOptions) (*audioWaveform, error) {
+	return nil, errLibavUnavailable
+}
+
+// decodeHeic needs ffmpeg to decode the HEVC and AV1 items
+func decodeHeic(r io.Reader, threads int) (image.Image, error) {
+	return nil, fmt.Errorf("%w: %w", errUnsupportedFormat, errLibavUnavailable)
+}
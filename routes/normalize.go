@@ -0,0 +1,55 @@
+package routes
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// routePrefixes are the static leading segments of the routes, longest first so nested ones match before their parents
+var routePrefixes = []string{
+	"/videos/multiparts",
+	"/videos/preview",
+	"/cache/warm",
+	"/features",
+	"/healthz",
+	"/metrics",
+	"/images",
+	"/videos",
+	"/audio",
+	"/cache",
+}
+
+// NormalizePaths rewrites request paths to a canonical form before routing, so equivalent paths reach the same
+// handler and share the HTTP cache entry: duplicate slashes are collapsed, a trailing slash is dropped and the route
+// prefix is lowercased. The rest keeps its case, the encoded source URL is case-sensitive
+func NormalizePaths() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if path := normalizePath(c.Path()); path != c.Path() {
+			c.Path(path)
+		}
+		return c.Next()
+	}
+}
+
+// normalizePath returns the canonical form of a path, see NormalizePaths
+func normalizePath(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	for _, prefix := range routePrefixes {
+		if len(path) < len(prefix) || !strings.EqualFold(path[:len(prefix)], prefix) {
+			continue
+		}
+		// Only whole segments match, /imagesfoo isn't /images
+		if len(path) > len(prefix) && path[len(prefix)] != '/' {
+			continue
+		}
+		return prefix + path[len(prefix):]
+	}
+	return path
+}
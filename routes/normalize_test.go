@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := map[string]string{
+		"/images/q:50/aHR0cHM6Ly9FeGFtcGxlLmNvbQ==":     "/images/q:50/aHR0cHM6Ly9FeGFtcGxlLmNvbQ==",
+		"/images//q:50//aHR0cHM6Ly9FeGFtcGxlLmNvbQ==/":  "/images/q:50/aHR0cHM6Ly9FeGFtcGxlLmNvbQ==",
+		"/Images/q:50/aHR0cHM6Ly9FeGFtcGxlLmNvbQ==":     "/images/q:50/aHR0cHM6Ly9FeGFtcGxlLmNvbQ==",
+		"//VIDEOS/Preview/fp:half/aHR0cHM6Ly9FeGFtcGxl": "/videos/preview/fp:half/aHR0cHM6Ly9FeGFtcGxl",
+		"/Videos/aHR0cHM6Ly9FeGFtcGxl":                  "/videos/aHR0cHM6Ly9FeGFtcGxl",
+		"/Cache/Warm":                                   "/cache/warm",
+		"/ImagesFoo/Bar":                                "/ImagesFoo/Bar",
+		"/":                                             "/",
+	}
+	for path, expected := range tests {
+		if normalized := normalizePath(path); normalized != expected {
+			t.Errorf("normalizePath(%q) = %q, expected %q", path, normalized, expected)
+		}
+	}
+}
+
+func TestNormalizePaths_SharesCacheEntry(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{NumCounters: 1e3, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	app := fiber.New()
+	app.Use(NormalizePaths())
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	RegisterImageRoutes(zap.NewNop(), cache, &config.Config{EncoderThreads: 1}, app, counters, nil, nil, nil, newOriginClient(t, &config.Config{}), nil)
+
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+	encoded := base64.URLEncoding.EncodeToString([]byte(originURL))
+
+	for _, path := range []string{"/images/w:4/" + encoded, "/Images//w:4//" + encoded + "/", "/IMAGES/w:4/" + encoded} {
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, path, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", path, response.StatusCode)
+		}
+		cache.Wait()
+	}
+
+	if hits.Load() != 1 {
+		t.Errorf("expected equivalent paths to share the cached result, got %d origin fetches", hits.Load())
+	}
+}
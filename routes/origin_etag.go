@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+// strongETag returns the ETag of an origin response, empty when it has none or only a weak one, which doesn't promise
+// the same bytes
+func strongETag(header http.Header) string {
+	etag := header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return etag
+}
+
+// resolveSourceETag sets the SourceETag of an image request with a HEAD request to its origin under
+// APP_CONTENT_ADDRESSED_CACHE. Requests for a location, and origins without a strong ETag or failing the HEAD, are
+// keyed by the request alone
+func resolveSourceETag(logger *zap.Logger, config *config.Config, httpClient *http.Client, params *validation.ImageContext) {
+	params.SourceETag = ""
+	if !config.ContentAddressedCache || params.Url == "" || params.CustomObjectKey != "" {
+		return
+	}
+
+	ctx := context.Background()
+	if config.HTTPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(config.HTTPTimeout)*time.Second)
+		defer cancel()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodHead, params.Url, nil)
+	if err != nil {
+		return
+	}
+	// The ETag is of the representation the GET receives
+	request.Header.Set("Accept-Encoding", acceptedEncodings)
+
+	response, err := httpClient.Do(request)
+	if err != nil {
+		logger.Debug("origin HEAD failed, keying the image by its URL", zap.Error(err), zap.String("url", params.Url))
+		return
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode == http.StatusOK {
+		params.SourceETag = strongETag(response.Header)
+	}
+}
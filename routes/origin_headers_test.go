@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+// serveProtectedOrigin answers 401 unless the request carries the API key, then serves the body
+func serveProtectedOrigin(t *testing.T, contentType string, body []byte) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "source", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/source"
+}
+
+func TestOriginHeaders_SentToOrigins(t *testing.T) {
+	cfg := &config.Config{OriginHeaders: map[string]string{"X-Api-Key": "secret"}}
+
+	imageURL := serveProtectedOrigin(t, "image/png", encodePNG(t, 8, 8))
+	response := requestImage(t, newImageTestApp(t, cfg), "", imageURL)
+	if response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected the image from the protected origin, got %d", response.StatusCode)
+	}
+	if key := response.Header.Get("X-Api-Key"); key != "" {
+		t.Errorf("expected the origin header not to reach the client, got %q", key)
+	}
+
+	videoURL := serveProtectedOrigin(t, "video/mp4", []byte("0123456789"))
+	app, _ := newVideoTestApp(t, cfg)
+	response, body := requestVideo(t, app, videoURL, "bytes=-4")
+	if response.StatusCode != fiber.StatusPartialContent || string(body) != "6789" {
+		t.Errorf("expected the range from the protected origin, got %d: %q", response.StatusCode, body)
+	}
+	if key := response.Header.Get("X-Api-Key"); key != "" {
+		t.Errorf("expected the origin header not to reach the client, got %q", key)
+	}
+	if response, _ := requestVideoHead(t, app, videoURL); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected HEAD to reach the protected origin, got %d", response.StatusCode)
+	}
+
+	// Without the headers the origin refuses
+	if response := requestImage(t, newImageTestApp(t, &config.Config{}), "", imageURL); response.StatusCode == fiber.StatusOK {
+		t.Error("expected the protected origin to refuse requests without the header")
+	}
+}
+
+func TestOriginHeaders_PassedToFrameExtraction(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{NumCounters: 1e4, MaxCost: 1 << 24, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{EncoderThreads: 1, OriginHeaders: map[string]string{"X-Api-Key": "secret"}}
+	extractor := &stubFrameExtractor{frame: &extractedFrame{Image: image.NewRGBA(image.Rect(0, 0, 16, 9))}}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	app := fiber.New()
+	app.Get("/videos/preview/*", handleVideoPreviewRequest(zap.NewNop(), cache, cfg, counters, nil, nil, newInputLimiter(0, nil), extractor, nil, nil, newOriginClient(t, cfg), nil, nil))
+
+	videoURL := serveProtectedOrigin(t, "video/mp4", []byte("not decoded by the stub"))
+	if response := requestVideoPreview(t, app, "", videoURL); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected the preview of the protected origin, got %d", response.StatusCode)
+	}
+	if key := extractor.headers["X-Api-Key"]; key != "secret" {
+		t.Errorf("expected the extraction to get the origin headers, got %v", extractor.headers)
+	}
+}
+
+func TestFFmpegHeaders(t *testing.T) {
+	headers := ffmpegHeaders(map[string]string{"X-Api-Key": "secret", "Authorization": "Basic dXNlcjpwYXNz"})
+	if expected := "Authorization: Basic dXNlcjpwYXNz\r\nX-Api-Key: secret\r\n"; headers != expected {
+		t.Errorf("expected %q, got %q", expected, headers)
+	}
+}
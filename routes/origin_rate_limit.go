@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"media-proxy/config"
+)
+
+// OriginRateLimiter keeps a token bucket per origin hostname, so a burst of uncached requests can't hammer one
+// upstream. Only fetches from origins take a token, cache hits and S3 locations don't
+type OriginRateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idle is how long an unused bucket takes to fill up again, after that it is dropped as it holds nothing to remember
+	idle time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*originBucket
+	lastSweep time.Time
+}
+
+type originBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// NewOriginRateLimiter limits fetches to APP_ORIGIN_RATE_LIMIT per second and origin, with bursts of up to
+// APP_ORIGIN_BURST. Returns nil when no limit is configured
+func NewOriginRateLimiter(config *config.Config) *OriginRateLimiter {
+	if config.OriginRateLimit <= 0 {
+		return nil
+	}
+
+	burst := max(config.OriginBurst, 1)
+	return &OriginRateLimiter{
+		limit:   rate.Limit(config.OriginRateLimit),
+		burst:   burst,
+		idle:    max(time.Minute, time.Duration(float64(burst)/config.OriginRateLimit*float64(time.Second))),
+		buckets: make(map[string]*originBucket),
+	}
+}
+
+// allow takes a token for a fetch from the hostname. When there is none it returns false and how long until the
+// next one, without taking it. A nil limiter allows everything
+func (o *OriginRateLimiter) allow(hostname string) (bool, time.Duration) {
+	if o == nil {
+		return true, 0
+	}
+
+	now := time.Now()
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.sweep(now)
+
+	bucket, ok := o.buckets[hostname]
+	if !ok {
+		bucket = &originBucket{limiter: rate.NewLimiter(o.limit, o.burst)}
+		o.buckets[hostname] = bucket
+	}
+	bucket.lastUsed = now
+
+	reservation := bucket.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// sweep drops the buckets of origins that weren't fetched from for a while, at most once per idle period
+func (o *OriginRateLimiter) sweep(now time.Time) {
+	if now.Sub(o.lastSweep) < o.idle {
+		return
+	}
+	o.lastSweep = now
+
+	for hostname, bucket := range o.buckets {
+		if now.Sub(bucket.lastUsed) >= o.idle {
+			delete(o.buckets, hostname)
+		}
+	}
+}
+
+// sendOriginRateLimited answers a request whose origin has no tokens left, Retry-After is rounded up to whole seconds
+func sendOriginRateLimited(c *fiber.Ctx, logger *zap.Logger, hostname string, retryAfter time.Duration) error {
+	logger.Warn("origin rate limit exceeded", zap.String("hostname", hostname), zap.Duration("retry_after", retryAfter))
+	c.Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	return c.Status(fiber.StatusTooManyRequests).SendString("too many requests to the origin, try again later")
+}
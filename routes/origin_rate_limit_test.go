@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+func TestOriginRateLimiter(t *testing.T) {
+	if NewOriginRateLimiter(&config.Config{}) != nil {
+		t.Error("expected no limiter without a rate limit")
+	}
+	var disabled *OriginRateLimiter
+	if allowed, _ := disabled.allow("example.com"); !allowed {
+		t.Error("expected a missing limiter to allow every fetch")
+	}
+
+	limiter := NewOriginRateLimiter(&config.Config{OriginRateLimit: 1, OriginBurst: 2})
+	for range 2 {
+		if allowed, _ := limiter.allow("example.com"); !allowed {
+			t.Fatal("expected the burst to be allowed")
+		}
+	}
+	allowed, retryAfter := limiter.allow("example.com")
+	if allowed || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("expected the fetch beyond the burst to wait up to a second, got %v %v", allowed, retryAfter)
+	}
+
+	// Every origin has its own bucket
+	if allowed, _ := limiter.allow("other.example.com"); !allowed {
+		t.Error("expected another origin to be allowed")
+	}
+
+	// Buckets unused for the idle period are dropped on the next fetch
+	limiter.buckets["other.example.com"].lastUsed = time.Now().Add(-2 * limiter.idle)
+	limiter.lastSweep = time.Time{}
+	limiter.allow("example.com")
+	if _, ok := limiter.buckets["other.example.com"]; ok {
+		t.Error("expected the idle bucket to be dropped")
+	}
+	if _, ok := limiter.buckets["example.com"]; !ok {
+		t.Error("expected the bucket in use to be kept")
+	}
+}
+
+func TestImageRequest_OriginRateLimited(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{OriginRateLimit: 0.1, OriginBurst: 1})
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	if response := requestImage(t, app, "q:80/", originURL); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	cache.Wait()
+
+	// Another image of the same origin has to wait for a token
+	response := requestImage(t, app, "q:80/", originURL+"?other")
+	if response.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", response.StatusCode)
+	}
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("expected Retry-After 10, got %q", retryAfter)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the limited request not to reach the origin, got %d hits", hits.Load())
+	}
+
+	// Cache hits don't fetch and aren't limited
+	if response := requestImage(t, app, "q:80/", originURL); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected the cached image to be served, got %d", response.StatusCode)
+	}
+}
+
+func TestVideoProxy_OriginRateLimited(t *testing.T) {
+	app, _ := newVideoTestApp(t, &config.Config{OriginRateLimit: 0.1, OriginBurst: 1})
+	originURL, hits := serveCountingOrigin(t, "video/mp4", []byte("0123456789abcdef"))
+
+	if response, _ := requestVideo(t, app, originURL, ""); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+
+	response, _ := requestVideo(t, app, originURL+"?other", "")
+	if response.StatusCode != fiber.StatusTooManyRequests || response.Header.Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After, got %d", response.StatusCode)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the limited request not to reach the origin, got %d hits", hits.Load())
+	}
+}
@@ -0,0 +1,29 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"go.uber.org/zap"
+
+	"media-proxy/client"
+	"media-proxy/config"
+	"media-proxy/pool"
+)
+
+// errRedirectNotAllowed fails origin fetches redirected to a URL the origin validation rejects
+var errRedirectNotAllowed = errors.New("redirect target is not allowed")
+
+// ValidateRedirects makes the client follow up to APP_MAX_REDIRECTS redirects and check every redirect target against
+// APP_ALLOWED_ORIGINS and the allowed schemes like the requested URL, so an allowed origin can't redirect the fetch
+// elsewhere. Private addresses in redirect targets are refused by PrivateOriginControl
+func ValidateRedirects(httpClient *http.Client, logger *zap.Logger, config *config.Config) {
+	client.SetRedirectPolicy(httpClient, config.MaxRedirects, func(target *url.URL) error {
+		if valid, _ := pool.ValidateUrl(logger, target.String(), config.AllowedOrigins, config.AllowedSchemes); !valid {
+			return fmt.Errorf("%w: %s", errRedirectNotAllowed, target.Redacted())
+		}
+		return nil
+	})
+}
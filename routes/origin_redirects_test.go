@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// serveRedirectingOrigin serves a png on /image.png, /hops/N redirects to /hops/N-1 and /hops/0 to /image.png
+func serveRedirectingOrigin(t *testing.T) string {
+	t.Helper()
+
+	png := encodePNG(t, 8, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hops, ok := strings.CutPrefix(r.URL.Path, "/hops/"); ok {
+			n, _ := strconv.Atoi(hops)
+			target := "/image.png"
+			if n > 0 {
+				target = "/hops/" + strconv.Itoa(n-1)
+			}
+			http.Redirect(w, r, target, http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(png)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestValidateRedirects_TargetsCheckedAgainstOrigins(t *testing.T) {
+	cfg := &config.Config{AllowedOrigins: []string{"127.0.0.1"}, MaxRedirects: 5}
+	originURL := serveRedirectingOrigin(t)
+
+	app := newImageTestApp(t, cfg)
+	if response := requestImage(t, app, "", originURL+"/hops/1"); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected redirects within the allowed origin to be followed, got %d", response.StatusCode)
+	}
+
+	// The same server under a hostname that isn't allowed
+	redirect := httptest.NewServer(http.RedirectHandler(strings.Replace(originURL, "127.0.0.1", "localhost", 1)+"/image.png", http.StatusFound))
+	t.Cleanup(redirect.Close)
+	if response := requestImage(t, app, "", redirect.URL+"/image.png"); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 for a redirect to an origin that isn't allowed, got %d", response.StatusCode)
+	}
+
+	videoApp, _ := newVideoTestApp(t, cfg)
+	if response, _ := requestVideo(t, videoApp, redirect.URL+"/video.mp4", ""); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 from the video proxy, got %d", response.StatusCode)
+	}
+}
+
+func TestValidateRedirects_MaxRedirects(t *testing.T) {
+	cfg := &config.Config{MaxRedirects: 2}
+	originURL := serveRedirectingOrigin(t)
+
+	app := newImageTestApp(t, cfg)
+	// hops/1 takes two redirects, hops/2 three
+	if response := requestImage(t, app, "", originURL+"/hops/1"); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected two redirects to be followed, got %d", response.StatusCode)
+	}
+	if response := requestImage(t, app, "", originURL+"/hops/2"); response.StatusCode == fiber.StatusOK {
+		t.Error("expected the fetch to fail after too many redirects")
+	}
+}
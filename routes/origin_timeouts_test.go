@@ -0,0 +1,68 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// serveSlowOrigin sends the headers right away and the body in chunks, pausing between them
+func serveSlowOrigin(t *testing.T, contentType string, chunks [][]byte, pause time.Duration) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			_, _ = w.Write(chunk)
+			w.(http.Flusher).Flush()
+			time.Sleep(pause)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/source"
+}
+
+func TestOriginTimeouts_VideoStreamOutlivesFetchTimeout(t *testing.T) {
+	cfg := &config.Config{HTTPTimeout: 1}
+	originURL := serveSlowOrigin(t, "video/mp4", [][]byte{[]byte("0123"), []byte("4567"), []byte("89")}, 400*time.Millisecond)
+
+	app, _ := newVideoTestApp(t, cfg)
+	response, body := requestVideo(t, app, originURL, "")
+	if response.StatusCode != fiber.StatusOK || string(body) != "0123456789" {
+		t.Errorf("expected the whole video after more than the fetch timeout, got %d: %q", response.StatusCode, body)
+	}
+
+	// An image is buffered before processing, the fetch timeout covers reading it
+	imageApp := newImageTestApp(t, cfg)
+	png := encodePNG(t, 8, 8)
+	imageURL := serveSlowOrigin(t, "image/png", [][]byte{png[:10], png[10:20], png[20:]}, 400*time.Millisecond)
+	if response := requestImage(t, imageApp, "", imageURL); response.StatusCode == fiber.StatusOK {
+		t.Error("expected the image fetch to time out")
+	}
+}
+
+func TestOriginTimeouts_ResponseHeaderTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	app, _ := newVideoTestApp(t, &config.Config{HTTPResponseHeaderTimeout: 1})
+	started := time.Now()
+	response, _ := requestVideo(t, app, server.URL+"/video.mp4", "")
+	if response.StatusCode == fiber.StatusOK {
+		t.Error("expected the origin not sending headers to fail the request")
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("expected the request to fail after the header timeout, took %s", elapsed)
+	}
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"syscall"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+// errPrivateOrigin fails origin fetches whose host resolves to an internal address
+var errPrivateOrigin = errors.New("origin resolves to a private address")
+
+// internalPrefixes are ranges that aren't reachable from the internet but aren't covered by the netip predicates:
+// "this network", carrier-grade NAT (cloud metadata lives there on some providers), IETF protocol assignments,
+// benchmarking and the reserved class E range
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// PrivateOriginControl returns the dial control for client.NewHTTPClient that refuses loopback, private, link-local
+// (which holds the 169.254.169.254 metadata endpoint) and other internal addresses, except those in
+// APP_ALLOWED_PRIVATE_ORIGINS. It checks the resolved address of every connection, so redirects and DNS answers that
+// change after validation can't get around it. Returns nil when APP_BLOCK_PRIVATE_ORIGINS is false
+func PrivateOriginControl(config *config.Config) (func(network, address string, conn syscall.RawConn) error, error) {
+	if config.BlockPrivateOrigins == nil || !*config.BlockPrivateOrigins {
+		return nil, nil
+	}
+
+	allowed, err := parsePrefixes(config.AllowedPrivateOrigins)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed private origins: %w", err)
+	}
+
+	return func(network, address string, _ syscall.RawConn) error {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: %s", errPrivateOrigin, address)
+		}
+		addr := addrPort.Addr().Unmap()
+		if isInternalAddr(addr) && !containsAddr(allowed, addr) {
+			return fmt.Errorf("%w: %s", errPrivateOrigin, addr)
+		}
+		return nil
+	}, nil
+}
+
+// isInternalAddr reports whether the address belongs to the host itself, a private network or a reserved range
+func isInternalAddr(addr netip.Addr) bool {
+	return addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() ||
+		containsAddr(internalPrefixes, addr)
+}
+
+// refusedFetchMessage tells why an origin fetch was refused by PrivateOriginControl or ValidateRedirects, empty when the
+// error is something else
+func refusedFetchMessage(err error) string {
+	switch {
+	case errors.Is(err, errPrivateOrigin):
+		return "origin address is not allowed"
+	case errors.Is(err, errRedirectNotAllowed):
+		return "redirect target is not allowed"
+	}
+	return ""
+}
+
+// sendRefusedFetch answers a request whose origin fetch was refused, see refusedFetchMessage
+func sendRefusedFetch(c *fiber.Ctx, logger *zap.Logger, url string, err error) error {
+	logger.Warn("refusing to fetch from the origin", zap.Error(err), zap.String("url", url))
+	return c.Status(fiber.StatusForbidden).SendString(refusedFetchMessage(err))
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"media-proxy/config"
+)
+
+// privateOriginsConfig returns a config blocking private origins except the allowed ones
+func privateOriginsConfig(allowed ...string) *config.Config {
+	block := true
+	return &config.Config{BlockPrivateOrigins: &block, AllowedPrivateOrigins: allowed}
+}
+
+func TestPrivateOriginControl_RefusesInternalAddresses(t *testing.T) {
+	loopbackURL := serveOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	for _, originURL := range []string{
+		loopbackURL,
+		strings.Replace(loopbackURL, "127.0.0.1", "localhost", 1),
+		"http://[::1]:1/image.png",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://10.0.0.1/image.png",
+		"http://192.168.1.1/image.png",
+		"http://100.100.100.200/latest/meta-data/",
+		"http://0.0.0.0:1/image.png",
+		"http://[::ffff:127.0.0.1]:1/image.png",
+	} {
+		app := newImageTestApp(t, privateOriginsConfig())
+		if response := requestImage(t, app, "", originURL); response.StatusCode != fiber.StatusForbidden {
+			t.Errorf("expected 403 for %s, got %d", originURL, response.StatusCode)
+		}
+	}
+
+	app, _ := newVideoTestApp(t, privateOriginsConfig())
+	if response, _ := requestVideo(t, app, "http://169.254.169.254/video.mp4", ""); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 from the video proxy, got %d", response.StatusCode)
+	}
+	if response, _ := requestVideoHead(t, app, "http://169.254.169.254/video.mp4"); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 from the video proxy HEAD, got %d", response.StatusCode)
+	}
+	if response := requestVideoPreview(t, app, "", "http://169.254.169.254/video.mp4"); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 from the video preview, got %d", response.StatusCode)
+	}
+}
+
+func TestPrivateOriginControl_AllowedRanges(t *testing.T) {
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	app := newImageTestApp(t, privateOriginsConfig("127.0.0.0/8"))
+	if response := requestImage(t, app, "", originURL); response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected an allowed private origin to be served, got %d", response.StatusCode)
+	}
+
+	// A redirect is checked like the first request, an allowed origin can't send the fetch elsewhere
+	redirect := httptest.NewServer(http.RedirectHandler("http://169.254.169.254/latest/meta-data/", http.StatusFound))
+	t.Cleanup(redirect.Close)
+	if response := requestImage(t, app, "", redirect.URL+"/image.png"); response.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected 403 for a redirect to the metadata endpoint, got %d", response.StatusCode)
+	}
+}
+
+func TestPrivateOriginControl_Disabled(t *testing.T) {
+	originURL := serveOrigin(t, "image/png", encodePNG(t, 8, 8))
+
+	app := newImageTestApp(t, &config.Config{BlockPrivateOrigins: new(bool)})
+	if response := requestImage(t, app, "", originURL); response.StatusCode != fiber.StatusOK {
+		t.Errorf("expected loopback origins to be served when blocking is off, got %d", response.StatusCode)
+	}
+
+	if control, err := PrivateOriginControl(&config.Config{BlockPrivateOrigins: new(bool), AllowedPrivateOrigins: []string{"not-a-range"}}); control != nil || err != nil {
+		t.Errorf("expected no control and the allowed ranges to be ignored when blocking is off, got %v", err)
+	}
+	if _, err := PrivateOriginControl(privateOriginsConfig("not-a-range")); err == nil {
+		t.Error("expected an invalid allowed range to be rejected")
+	}
+}
+
+func TestIsInternalAddr(t *testing.T) {
+	for addr, internal := range map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.0.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"::1":             true,
+		"fe80::1":         true,
+		"fd00:ec2::254":   true,
+		"224.0.0.1":       true,
+		"93.184.216.34":   false,
+		"8.8.8.8":         false,
+		"2606:4700::1111": false,
+	} {
+		if got := isInternalAddr(netip.MustParseAddr(addr)); got != internal {
+			t.Errorf("expected isInternalAddr(%s) to be %v, got %v", addr, internal, got)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+// RegisterPurgeRoutes sets up the route that evicts cached images and video previews
+func RegisterPurgeRoutes(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], httpCache *ristretto.Cache[string, []byte], config *config.Config, app *fiber.App, s3cache *S3Cache, httpClient *http.Client) {
+	// Takes the path parameters of the GET to purge: DELETE /cache/q:50/w:500/{base64-url}?token=...
+	app.Delete("/cache/*", handlePurgeRequest(logger, cache, httpCache, config, s3cache, httpClient))
+}
+
+//#region handlePurgeRequest
+
+// handlePurgeRequest removes the entry of a request from memory and S3, along with the responses the HTTP cache
+// middleware kept for it, so the next request goes to the origin again.
+// Outputs stored at an explicit location are left alone, they are owned by whoever requested them. Under
+// APP_CONTENT_ADDRESSED_CACHE the entry of the source the origin currently has is purged
+func handlePurgeRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], httpCache *ristretto.Cache[string, []byte], config *config.Config, s3cache *S3Cache, httpClient *http.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		token := c.Query("token")
+		if token == "" || token != config.Token {
+			logger.Error("invalid or missing token")
+			return c.Status(fiber.StatusForbidden).SendString("invalid token")
+		}
+
+		pathParams := c.Params("*")
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+		if !ok {
+			logger.Error("failed to process purge path", zap.String("pathParams", pathParams), zap.Int("status", status), zap.Error(err))
+			return c.Status(status).SendString(err.Error())
+		}
+
+		// Images are keyed by the ETag of their current source as well under APP_CONTENT_ADDRESSED_CACHE, previews aren't
+		contentParams := *params
+		resolveSourceETag(logger, config, httpClient, &contentParams)
+		keys := []string{cacheKey(config, params)}
+		if contentParams.SourceETag != "" {
+			keys = append(keys, cacheKey(config, &contentParams))
+		}
+		cacheKey := keys[0]
+
+		inMemory := false
+		for _, key := range keys {
+			_, found := cache.Get(key)
+			inMemory = inMemory || found
+			cache.Del(key)
+		}
+
+		if httpCache != nil {
+			for _, path := range []string{"/images/" + pathParams, "/videos/preview/" + pathParams} {
+				for _, key := range httpCacheKeys(path) {
+					httpCache.Del(key)
+				}
+			}
+		}
+
+		var inS3 bool
+		for _, key := range keys {
+			var found bool
+			if found, err = s3cache.Delete(context.Background(), key); err != nil {
+				break
+			}
+			inS3 = inS3 || found
+		}
+		if err == nil {
+			if previewKey := previewObjectKey(config, params); previewKey != "" {
+				var previewInS3 bool
+				previewInS3, err = s3cache.DeleteDirect(context.Background(), previewKey)
+				inS3 = inS3 || previewInS3
+			}
+		}
+		if err != nil {
+			logger.Error("failed to purge S3 cache", zap.Error(err), zap.String("cache_key", cacheKey))
+			return c.Status(fiber.StatusBadGateway).SendString("failed to purge S3 cache")
+		}
+
+		logger.Info("cache purged", zap.String("cache_key", cacheKey), zap.Bool("memory", inMemory), zap.Bool("s3", inS3))
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"key":    cacheKey,
+			"memory": inMemory,
+			"s3":     inS3,
+		})
+	}
+}
+
+// httpCacheKeys lists the storage keys the fiber cache middleware uses for the responses of a path,
+// one entry and one body per cached method
+func httpCacheKeys(path string) []string {
+	return []string{path + "_GET", path + "_GET_body", path + "_HEAD", path + "_HEAD_body"}
+}
+
+//#endregion
@@ -0,0 +1,64 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+)
+
+func TestPurge_EvictsCachedImage(t *testing.T) {
+	app, cache, _ := newImageTestAppWithState(t, &config.Config{Token: "secret"})
+	httpCache, err := ristretto.NewCache(&ristretto.Config[string, []byte]{NumCounters: 1e3, MaxCost: 1 << 20, BufferItems: 64})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(httpCache.Close)
+	RegisterPurgeRoutes(zap.NewNop(), cache, httpCache, &config.Config{Token: "secret"}, app, nil, nil)
+
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+	pathParams := "w:4/" + base64.URLEncoding.EncodeToString([]byte(originURL))
+
+	requestImage(t, app, "w:4/", originURL)
+	cache.Wait()
+	httpCache.Set("/images/"+pathParams+"_GET", []byte("cached response"), 1)
+	httpCache.Wait()
+
+	purge := func(token string) (int, map[string]any) {
+		response, err := app.Test(httptest.NewRequest(http.MethodDelete, "/cache/"+pathParams+"?token="+token, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		var summary map[string]any
+		_ = json.NewDecoder(response.Body).Decode(&summary)
+		return response.StatusCode, summary
+	}
+
+	if status, _ := purge("wrong"); status != fiber.StatusForbidden {
+		t.Fatalf("expected 403 without the token, got %d", status)
+	}
+
+	status, summary := purge("secret")
+	if status != fiber.StatusOK || summary["memory"] != true || summary["s3"] != false {
+		t.Fatalf("expected the memory entry to be purged, got %d %v", status, summary)
+	}
+	if _, found := httpCache.Get("/images/" + pathParams + "_GET"); found {
+		t.Errorf("expected the cached response to be purged")
+	}
+	if _, summary := purge("secret"); summary["memory"] != false {
+		t.Errorf("expected nothing left to purge, got %v", summary)
+	}
+
+	// The next request goes to the origin again
+	requestImage(t, app, "w:4/", originURL)
+	if hits.Load() != 2 {
+		t.Errorf("expected the origin to be fetched again after the purge, got %d hits", hits.Load())
+	}
+}
@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
+	"go.uber.org/zap"
+)
+
+// RequestID assigns every request an ID, or keeps the X-Request-ID sent by the client, and answers with it in
+// X-Request-ID. The header is set again after the handlers, since responses replayed by the HTTP cache would carry
+// the ID of the request that stored them
+func RequestID() fiber.Handler {
+	assign := requestid.New()
+	return func(c *fiber.Ctx) error {
+		err := assign(c)
+		if id := requestID(c); id != "" {
+			c.Set(fiber.HeaderXRequestID, id)
+		}
+		return err
+	}
+}
+
+// requestID returns the ID assigned to the request, empty when RequestID isn't in use
+func requestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(requestid.ConfigDefault.ContextKey).(string)
+	return id
+}
+
+// requestLogger returns a logger adding the request ID to every line, so the lines of one request can be told
+// apart. The logger is returned as is for requests without an ID
+func requestLogger(c *fiber.Ctx, logger *zap.Logger) *zap.Logger {
+	if id := requestID(c); id != "" {
+		return logger.With(zap.String("request_id", id))
+	}
+	return logger
+}
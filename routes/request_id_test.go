@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cache"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestID(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+
+	app := fiber.New()
+	app.Use(RequestID())
+	app.Use(cache.New(cache.Config{StoreResponseHeaders: true}))
+	app.Get("/fail", func(c *fiber.Ctx) error {
+		requestLogger(c, logger).Error("request failed")
+		return c.Status(fiber.StatusInternalServerError).SendString("failed")
+	})
+	app.Get("/cached", func(c *fiber.Ctx) error {
+		return c.SendString("cached")
+	})
+
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, "/fail", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	id := response.Header.Get(fiber.HeaderXRequestID)
+	if id == "" {
+		t.Fatal("expected error responses to carry a request ID")
+	}
+	entries := logs.All()
+	if len(entries) != 1 || entries[0].ContextMap()["request_id"] != id {
+		t.Errorf("expected the log line to carry request ID %q, got %v", id, entries)
+	}
+
+	// An ID sent by the client is kept
+	request := httptest.NewRequest(http.MethodGet, "/fail", nil)
+	request.Header.Set(fiber.HeaderXRequestID, "client-id")
+	response, _ = app.Test(request)
+	if got := response.Header.Get(fiber.HeaderXRequestID); got != "client-id" {
+		t.Errorf("expected the client's request ID, got %q", got)
+	}
+
+	// Responses replayed by the HTTP cache get the ID of the current request
+	first, _ := app.Test(httptest.NewRequest(http.MethodGet, "/cached", nil))
+	second, _ := app.Test(httptest.NewRequest(http.MethodGet, "/cached", nil))
+	if second.Header.Get("X-Cache") != "hit" {
+		t.Fatalf("expected the second response from the cache, got %q", second.Header.Get("X-Cache"))
+	}
+	if second.Header.Get(fiber.HeaderXRequestID) == first.Header.Get(fiber.HeaderXRequestID) {
+		t.Errorf("expected a cached response to get a new request ID, got %q twice", first.Header.Get(fiber.HeaderXRequestID))
+	}
+
+	// Without RequestID the logger is used as is
+	plain := fiber.New()
+	plain.Get("/", func(c *fiber.Ctx) error {
+		if requestLogger(c, logger) != logger {
+			t.Error("expected the logger as is without a request ID")
+		}
+		return nil
+	})
+	_, _ = plain.Test(httptest.NewRequest(http.MethodGet, "/", nil))
+}
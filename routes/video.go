@@ -1,53 +1,101 @@
 package routes
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/minio/minio-go/v7"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 
-	"image/jpeg"
-	"media-proxy/client"
 	"media-proxy/config"
 	"media-proxy/metrics"
 	"media-proxy/pool"
 	"media-proxy/validation"
 
 	"github.com/dgraph-io/ristretto/v2"
-	"github.com/kolesa-team/go-webp/encoder"
 	"github.com/kolesa-team/go-webp/webp"
 )
 
-// RegisterVideoRoutes sets up video processing routes
-func RegisterVideoRoutes(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, app *fiber.App, counters *metrics.Metrics, s3cache *S3Cache, uploadTracker *RedisUploadTracker) {
+// RegisterVideoRoutes sets up video processing routes, and the audio routes decoding with the same backend
+func RegisterVideoRoutes(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], httpCache *ristretto.Cache[string, []byte], config *config.Config, app *fiber.App, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, uploadTracker *RedisUploadTracker, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) {
+	var openInputs prometheus.Gauge
+	if performance != nil {
+		openInputs = performance.OpenInputs
+	}
+	inputs := newInputLimiter(config.MaxOpenInputs, openInputs)
+
+	extractor, err := newFrameExtractor(config)
+	if err != nil {
+		logger.Fatal("invalid video frame backend", zap.Error(err))
+	}
+
+	failures, err := newProbeFailureCache(time.Duration(config.VideoProbeFailureTTL) * time.Second)
+	if err != nil {
+		logger.Fatal("failed to create the video probe failure cache", zap.Error(err))
+	}
+
+	// Audio decodes with the same backend and counts against the same open inputs. Its failures are kept apart, a URL
+	// turned away as a video may well be audio
+	waveforms, err := newWaveformReader(config)
+	if err != nil {
+		logger.Fatal("invalid video frame backend", zap.Error(err))
+	}
+	audioFailures, err := newProbeFailureCache(time.Duration(config.VideoProbeFailureTTL) * time.Second)
+	if err != nil {
+		logger.Fatal("failed to create the audio probe failure cache", zap.Error(err))
+	}
+
 	// Multi-part upload routes (must be registered before wildcard routes)
-	app.Post("/videos/multiparts", handleMultipartUploadInit(logger, config, uploadTracker))
+	app.Post("/videos/multiparts", handleMultipartUploadInit(logger, config, s3cache, uploadTracker))
 	app.Post("/videos/multiparts/:uploadId/parts/:partIndex", handleMultipartUploadPart(logger, config, counters, s3cache, uploadTracker))
+	app.Post("/videos/multiparts/:uploadId/complete", handleMultipartUploadComplete(logger, config, counters, s3cache, uploadTracker))
+	app.Delete("/videos/multiparts/:uploadId", handleMultipartUploadAbort(logger, config, counters, s3cache, uploadTracker))
 	app.Get("/videos/multiparts/:uploadId", handleMultipartUploadStatus(logger, config, uploadTracker))
 
 	// Video upload route (single upload)
 	app.Post("/videos", handleVideoUpload(logger, config, counters, s3cache))
 
-	// New path-based route: /videos/preview/q:50/w:500/h:300/webp/{base64-encoded-url}
-	app.Get("/videos/preview/*", handleVideoPreviewRequest(logger, cache, config, counters, s3cache))
+	// Duration, dimensions and codec read without decoding frames: /videos/meta/{base64-encoded-url}
+	app.Get("/videos/meta/*", handleVideoMetadataRequest(logger, cache, config, counters, s3cache, inputs, extractor, failures, httpClient, origins))
+
+	// Evenly spaced frames tiled into one image for scrubbing: /videos/sprite/n:16/w:160/{base64-encoded-url}
+	app.Get("/videos/sprite/*", handleVideoSpriteRequest(logger, cache, config, counters, performance, s3cache, inputs, extractor, failures, scheduler, httpClient, origins))
+
+	// Looping clip of the video: /videos/animated/fp:10/dur:3/fps:10/w:320/webp/{base64-encoded-url}
+	app.Get("/videos/animated/*", handleVideoAnimationRequest(logger, cache, config, counters, performance, s3cache, inputs, extractor, failures, scheduler, httpClient, origins))
+
+	// Peak amplitude of audio over time: /audio/waveform/w:800/h:120/c:3b82f6/{base64-encoded-url}
+	app.Get("/audio/waveform/*", handleAudioWaveformRequest(logger, cache, config, counters, performance, s3cache, inputs, waveforms, audioFailures, scheduler, httpClient, origins))
+
+	// New path-based route: /videos/preview/q:50/w:500/h:300/webp/{base64-encoded-url}. Identical concurrent misses
+	// extract the frame once
+	app.Get("/videos/preview/*", handleVideoPreviewRequest(logger, cache, config, counters, performance, s3cache, inputs, extractor, failures, scheduler, httpClient, origins, newRequestCoalescer(cache)))
 
 	// Proxy routes for raw video bytes (support Range) - should be last as it's a catch-all
-	app.Get("/videos/*", handleVideoProxyRequest(logger, cache, config, counters, s3cache))
+	app.Get("/videos/*", handleVideoProxyRequest(logger, cache, httpCache, config, counters, s3cache, inputs, extractor, failures, httpClient, origins))
 }
 
 //#region handleVideoPreviewRequest
 
 // handleVideoPreviewRequest processes video preview requests with path parameters
-func handleVideoPreviewRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache) fiber.Handler {
+func handleVideoPreviewRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, coalescer *requestCoalescer) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		pathParams := c.Params("*")
 		logger.Info("video preview request received", zap.String("pathParams", pathParams))
 
@@ -64,13 +112,15 @@ func handleVideoPreviewRequest(logger *zap.Logger, cache *ristretto.Cache[string
 			zap.String("framePosition", params.FramePosition),
 			zap.String("url", params.Url))
 
-		return processVideoPreview(c, logger, cache, config, counters, params, s3cache)
+		return processVideoPreview(c, logger, cache, config, counters, performance, params, s3cache, inputs, extractor, failures, scheduler, httpClient, origins, coalescer)
 	}
 }
 
 // handleVideoProxyRequest processes raw video proxy requests (path params)
-func handleVideoProxyRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache) fiber.Handler {
+func handleVideoProxyRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], httpCache *ristretto.Cache[string, []byte], config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		pathParams := c.Params("*")
 		logger.Info("video proxy request received", zap.String("pathParams", pathParams))
 
@@ -79,7 +129,7 @@ func handleVideoProxyRequest(logger *zap.Logger, cache *ristretto.Cache[string,
 			return c.Status(status).SendString(err.Error())
 		}
 
-		return processVideoProxy(c, logger, cache, config, counters, params, s3cache)
+		return processVideoProxy(c, logger, cache, httpCache, config, counters, params, s3cache, inputs, extractor, failures, httpClient, origins)
 	}
 }
 
@@ -87,8 +137,19 @@ func handleVideoProxyRequest(logger *zap.Logger, cache *ristretto.Cache[string,
 
 //#region processVideoPreview
 
+// setPreviewHeaders sends the details of the extracted frame and tells the client when the preview shows the last frame
+// instead of the requested position
+func setPreviewHeaders(c *fiber.Ctx, clamped bool, headers map[string]string) {
+	for key, value := range headers {
+		c.Set(key, value)
+	}
+	if clamped {
+		c.Set("X-Frame-Position-Clamped", "true")
+	}
+}
+
 // processVideoPreview handles the common video preview processing logic
-func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache) error {
+func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, coalescer *requestCoalescer) error {
 	// Add debug logging for parameters
 	logger.Info("processing video preview",
 		zap.Int("width", params.Width),
@@ -103,113 +164,131 @@ func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cach
 		return c.Status(fiber.StatusBadRequest).SendString("either url or location is required")
 	}
 
-	cacheKey := cacheKey(params)
+	cacheKey := cacheKey(config, params)
+	previewKey := previewObjectKey(config, params)
 	cacheValue, ok := cache.Get(cacheKey)
+	if !ok {
+		// Identical requests arriving meanwhile wait for this one and are then served what it cached
+		waited, err := coalescer.do(cacheKey, func() error {
+			return renderVideoPreview(c, logger, cache, config, counters, performance, params, s3cache, inputs, extractor, failures, scheduler, httpClient, origins, cacheKey, previewKey)
+		})
+		if !waited {
+			return err
+		}
+		cacheValue, ok = cache.Get(cacheKey)
+	}
 	if ok {
 		counters.SuccessfullyServed.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 		counters.ServedCached.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 
+		setPreviewHeaders(c, cacheValue.FrameClamped, cacheValue.Headers)
 		c.Set("Content-Type", cacheValue.ContentType)
+		c.Set("Cache-Control", cacheControl(config, params))
+		if setResponseValidators(c, cacheValue) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		counters.ObserveServed("video-preview", true, cacheValue.ContentType, int64(len(cacheValue.Body)))
 		return c.Send(cacheValue.Body)
 	}
 
+	// The request that did the work failed or its result wasn't kept
+	return renderVideoPreview(c, logger, cache, config, counters, performance, params, s3cache, inputs, extractor, failures, scheduler, httpClient, origins, cacheKey, previewKey)
+}
+
+// renderVideoPreview answers a preview that isn't cached in memory from S3 or by extracting and encoding the frame
+func renderVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, cacheKey, previewKey string) error {
 	// Try S3 cache if enabled (check for cached preview, not source video)
 	if s3cache != nil && s3cache.Enabled {
-		if s3val, err := s3cache.Get(context.Background(), cacheKey); err == nil && s3val != nil {
+		var s3val *CacheValue
+		var err error
+		if previewKey != "" {
+			s3val, err = s3cache.GetValueDirect(context.Background(), previewKey)
+		} else {
+			s3val, err = s3cache.Get(context.Background(), cacheKey)
+		}
+		if err == nil && s3val != nil {
 			counters.SuccessfullyServed.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 			counters.ServedCached.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
 
-			cache.SetWithTTL(cacheKey, *s3val, 1000, time.Duration(config.CacheTTL)*time.Second)
+			s3val.ETag = contentETag(cacheKey, s3val.Body)
+			cache.SetWithTTL(cacheKey, *s3val, 1000, cacheTTL(config))
 
+			setPreviewHeaders(c, s3val.FrameClamped, s3val.Headers)
 			c.Set("Content-Type", s3val.ContentType)
+			c.Set("Cache-Control", cacheControl(config, params))
+			if setResponseValidators(c, *s3val) {
+				return c.SendStatus(fiber.StatusNotModified)
+			}
+			counters.ObserveServed("video-preview", true, s3val.ContentType, int64(len(s3val.Body)))
 			return c.Send(s3val.Body)
 		}
 	}
 
-	var videoURL string
-	var parsedContentType string
-
-	// If explicit S3 location provided, use it directly (signature already enforced in validation)
-	if params.CustomObjectKey != "" && s3cache != nil && s3cache.Enabled && s3cache.Client != nil {
-		// Use S3 location as video source (from bucket root, no prefix)
-		objKey := params.CustomObjectKey
-
-		// Get object info to validate it's a video
-		obj, err := s3cache.Client.StatObject(context.Background(), s3cache.Bucket, objKey, minio.StatObjectOptions{})
-		if err != nil {
-			logger.Error("failed to stat s3 object", zap.Error(err), zap.String("object", objKey))
-			return c.Status(fiber.StatusNotFound).SendString("video not found in s3")
-		}
-
-		parsedContentType = obj.ContentType
-		if parsedContentType == "" {
-			if ct, ok := obj.Metadata["Content-Type"]; ok && len(ct) > 0 {
-				parsedContentType = ct[0]
-			} else {
-				parsedContentType = "application/octet-stream"
-			}
-		}
-
-		parsed, _, err := mime.ParseMediaType(parsedContentType)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to parse content type")
-		}
-		parsedContentType = parsed
-
-		if !validation.IsVideoMime(parsedContentType) {
-			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("content type '%s' is not a video", parsedContentType))
-		}
-
-		// Generate presigned URL for ffmpeg to access
-		presignedURL, err := s3cache.Client.PresignedGetObject(context.Background(), s3cache.Bucket, objKey, time.Hour, nil)
-		if err != nil {
-			logger.Error("failed to generate presigned url", zap.Error(err))
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to generate presigned url")
-		}
-		videoURL = presignedURL.String()
-	} else {
-		// Use HTTP/HTTPS origin - requires URL to be provided
-		if params.Url == "" {
-			return c.Status(fiber.StatusBadRequest).SendString("url is required when location is not provided")
-		}
-
-		responseContentType, err := validation.GetContentType(params.Url)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to check video")
-		}
-
-		if responseContentType == "" {
-			return c.Status(fiber.StatusForbidden).SendString("no content type received")
-		}
-
-		parsed, _, err := mime.ParseMediaType(responseContentType)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("failed to parse content type")
-		}
-		parsedContentType = parsed
-
-		if !validation.IsVideoMime(parsedContentType) {
-			return c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("content type '%s' is not allowed", parsedContentType))
-		}
+	source, err := resolveMediaSource(c, logger, config, counters, params, s3cache, failures, httpClient, origins, "video-preview", videoMedia)
+	if source == nil {
+		return err
+	}
+	fail := func(status int, message string) error {
+		failures.add(source.FailureKey, probeFailure{Status: status, Message: message})
+		return c.Status(status).SendString(message)
+	}
 
-		videoURL = params.Url
+	// Frames are expensive work, they wait for their own workers rather than holding up image transforms
+	release, err := scheduler.acquire(workExpensive)
+	if err != nil {
+		return sendBusy(c, logger, err)
 	}
+	defer release()
 
 	// Extract frame from specified position
-	frameImage, err := extractFrameFromPosition(videoURL, params.FramePosition)
+	done := metrics.TimeVideoOperation("frame-extract", performance)
+	frame, err := extractor.ExtractFrame(source.URL, params.FramePosition, frameExtractionOptions{
+		Threads:              config.EncoderThreads,
+		RejectBeyondDuration: config.FramePositionBeyondDuration == "reject",
+		Inputs:               inputs,
+		ProbeTimeout:         time.Duration(config.VideoProbeTimeout) * time.Second,
+		Headers:              source.Headers,
+		MaxDuration:          float64(config.MaxVideoDuration),
+	})
+	done()
+	if errors.Is(err, errProbeTimeout) {
+		logger.Error("video probe timed out", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusGatewayTimeout, "video probe timed out")
+	}
+	if errors.Is(err, errVideoTooLong) {
+		logger.Warn("video is too long for a preview", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, videoTooLongMessage)
+	}
+	// The position is part of the request rather than the source, so this one isn't remembered
+	if errors.Is(err, errPositionBeyondDuration) {
+		logger.Warn("frame position beyond duration", zap.String("position", params.FramePosition), zap.String("url", params.Url))
+		return c.Status(fiber.StatusBadRequest).SendString("position beyond duration")
+	}
 	if err != nil {
 		logger.Error("failed to extract frame", zap.Error(err), zap.String("position", params.FramePosition))
-		return c.Status(fiber.StatusInternalServerError).SendString("failed to extract video preview")
+		return fail(fiber.StatusInternalServerError, "failed to extract video preview")
 	}
+	failures.forget(source.FailureKey)
+
+	frameImage := frame.Image
+	previewHeaders := frame.headers()
+	setPreviewHeaders(c, frame.Clamped, previewHeaders)
 
 	// Add debug logging for frame extraction
 	logger.Debug("frame extracted successfully",
 		zap.Int("originalWidth", frameImage.Bounds().Dx()),
 		zap.Int("originalHeight", frameImage.Bounds().Dy()))
 
+	applyFormatInterpolation(config, params, source.ContentType)
 	if params.Width > 0 || params.Height > 0 {
 		logger.Debug("resizing frame", zap.Int("targetWidth", params.Width), zap.Int("targetHeight", params.Height))
-		frameImage, err = resizeImage(frameImage, params.Width, params.Height, params.Interpolation)
+		done := metrics.TimeVideoOperation("resize", performance)
+		frameImage, err = resizeImage(frameImage, params.Width, params.Height, params.Interpolation, newOutputLimits(config))
+		done()
+		if errors.Is(err, errOutputTooLarge) {
+			logger.Warn("resized frame is too large", zap.Int("width", params.Width), zap.Int("height", params.Height), zap.String("url", params.Url))
+			return c.Status(fiber.StatusBadRequest).SendString(newOutputLimits(config).message())
+		}
 		if err != nil {
 			logger.Error("failed to resize image", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to resize image")
@@ -222,7 +301,13 @@ func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cach
 
 	if params.Scale > 0 {
 		logger.Debug("rescaling frame", zap.Float64("scale", params.Scale))
-		frameImage, err = rescaleImage(frameImage, params.Scale)
+		done := metrics.TimeVideoOperation("rescale", performance)
+		frameImage, err = rescaleImage(frameImage, params.Scale, newOutputLimits(config))
+		done()
+		if errors.Is(err, errOutputTooLarge) {
+			logger.Warn("rescaled frame is too large", zap.Float64("scale", params.Scale), zap.String("url", params.Url))
+			return c.Status(fiber.StatusBadRequest).SendString(newOutputLimits(config).message())
+		}
 		if err != nil {
 			logger.Error("failed to rescale image", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to rescale image")
@@ -233,36 +318,37 @@ func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cach
 			zap.Int("newHeight", frameImage.Bounds().Dy()))
 	}
 
+	quality := outputQuality(config, params.Quality, source.ContentType)
 	if params.Webp {
 		buf := pool.GetBuffer()
 		defer pool.PutBuffer(buf)
 
-		options, err := encoder.NewLossyEncoderOptions(encoder.PresetDefault, float32(params.Quality))
+		options, err := newWebpEncoderOptions(quality, webpMethod(config, params), config.EncoderThreads)
 		if err != nil {
 			logger.Error("failed to create webp encoder options", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to create webp encoder options")
 		}
 
+		done := metrics.TimeVideoOperation("webp-encode", performance)
 		err = webp.Encode(buf, frameImage, options)
+		done()
 		if err != nil {
 			logger.Error("failed to encode webp", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to encode webp")
 		}
 
-		value := CacheValue{Body: buf.Bytes(), ContentType: "image/webp"}
-		cache.SetWithTTL(cacheKey, value, 1000, time.Duration(config.CacheTTL)*time.Second)
-		if s3cache != nil && s3cache.Enabled {
-			data := make([]byte, len(value.Body))
-			copy(data, value.Body)
-			// Always store preview in cache using cacheKey (with prefix)
-			go func() { _ = s3cache.Put(context.Background(), cacheKey, data, value.ContentType) }()
-		}
+		value := CacheValue{Body: buf.Bytes(), ContentType: "image/webp", FrameClamped: frame.Clamped, Headers: previewHeaders}
+		value.ETag = contentETag(cacheKey, value.Body)
+		cache.SetWithTTL(cacheKey, value, 1000, cacheTTL(config))
+		storePreviewInS3(s3cache, cacheKey, previewKey, value)
 
 		c.Set("Content-Type", "image/webp")
-		c.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.HTTPCacheTTL))
+		c.Set("Cache-Control", cacheControl(config, params))
+		c.Set("ETag", value.ETag)
 
-		logger.Info("video preview served successfully", zap.String("original-content-type", parsedContentType), zap.String("origin", params.Hostname))
+		logger.Info("video preview served successfully", zap.String("original-content-type", source.ContentType), zap.String("origin", params.Hostname))
 		counters.SuccessfullyServed.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+		counters.ObserveServed("video-preview", false, "image/webp", int64(buf.Len()))
 
 		return c.Send(buf.Bytes())
 	}
@@ -270,35 +356,191 @@ func processVideoPreview(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cach
 	buf := pool.GetBuffer()
 	defer pool.PutBuffer(buf)
 
-	err = jpeg.Encode(buf, frameImage, &jpeg.Options{Quality: params.Quality})
+	done = metrics.TimeVideoOperation("jpeg-encode", performance)
+	err = encodeJPEG(buf, frameImage, quality, config.JPEGProgressive)
+	done()
 	if err != nil {
 		logger.Error("failed to encode jpeg", zap.Error(err))
 		return c.Status(fiber.StatusInternalServerError).SendString("failed to encode jpeg")
 	}
 
-	value := CacheValue{Body: buf.Bytes(), ContentType: "image/jpeg"}
-	cache.SetWithTTL(cacheKey, value, 1000, time.Duration(config.CacheTTL)*time.Second)
-	if s3cache != nil && s3cache.Enabled {
-		data := make([]byte, len(value.Body))
-		copy(data, value.Body)
-		// Always store preview in cache using cacheKey (with prefix)
-		go func() { _ = s3cache.Put(context.Background(), cacheKey, data, value.ContentType) }()
-	}
+	value := CacheValue{Body: buf.Bytes(), ContentType: "image/jpeg", FrameClamped: frame.Clamped, Headers: previewHeaders}
+	value.ETag = contentETag(cacheKey, value.Body)
+	cache.SetWithTTL(cacheKey, value, 1000, cacheTTL(config))
+	storePreviewInS3(s3cache, cacheKey, previewKey, value)
 
 	c.Set("Content-Type", "image/jpeg")
-	c.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", config.HTTPCacheTTL))
+	c.Set("Cache-Control", cacheControl(config, params))
+	c.Set("ETag", value.ETag)
 
-	logger.Info("video preview served successfully", zap.String("original-content-type", parsedContentType), zap.String("origin", params.Hostname))
+	logger.Info("video preview served successfully", zap.String("original-content-type", source.ContentType), zap.String("origin", params.Hostname))
 
 	counters.SuccessfullyServed.WithLabelValues("video-preview", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	counters.ObserveServed("video-preview", false, "image/jpeg", int64(buf.Len()))
 
 	return c.Send(buf.Bytes())
 }
 
+// videoTooLongMessage is sent with the 422 for videos longer than APP_MAX_VIDEO_DURATION_SECONDS
+const videoTooLongMessage = "video is longer than the allowed duration"
+
+// mediaSource is a checked video or audio source the decoders can open
+type mediaSource struct {
+	URL         string
+	ContentType string
+	// Size is the length of the source in bytes, -1 when the origin doesn't report it
+	Size int64
+	// Headers are sent with the requests for the source, APP_ORIGIN_HEADERS for origins; presigned S3 URLs are
+	// authorized on their own
+	Headers map[string]string
+	// FailureKey is what failed checks of the source are remembered under. Only URL sources are remembered, S3
+	// locations may show up right after an upload
+	FailureKey string
+}
+
+// sourceMedia is what a source has to be: Accept checks its content type, Name and Noun describe it in responses
+type sourceMedia struct {
+	Name   string
+	Noun   string
+	Accept func(mimeType string) bool
+}
+
+var (
+	videoMedia = sourceMedia{Name: "video", Noun: "a video", Accept: validation.IsVideoMime}
+	audioMedia = sourceMedia{Name: "audio", Noun: "audio", Accept: validation.IsAudioMime}
+)
+
+// resolveMediaSource checks that the S3 location or URL of a request is of the media and returns where to open it.
+// kind labels the origin error metrics. On failure the request has been answered and the source is nil
+func resolveMediaSource(c *fiber.Ctx, logger *zap.Logger, config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache, failures *probeFailureCache, httpClient *http.Client, origins *OriginRateLimiter, kind string, media sourceMedia) (*mediaSource, error) {
+	source := &mediaSource{}
+	fail := func(status int, message string) (*mediaSource, error) {
+		failures.add(source.FailureKey, probeFailure{Status: status, Message: message})
+		return nil, c.Status(status).SendString(message)
+	}
+
+	// If explicit S3 location provided, use it directly (signature already enforced in validation)
+	if params.CustomObjectKey != "" && s3cache != nil && s3cache.Enabled && s3cache.Client != nil {
+		// Use S3 location as the source (from bucket root, no prefix)
+		objKey := params.CustomObjectKey
+
+		// Get object info to validate its media
+		obj, err := s3cache.Client.StatObject(context.Background(), s3cache.Bucket, objKey, minio.StatObjectOptions{})
+		if err != nil {
+			logger.Error("failed to stat s3 object", zap.Error(err), zap.String("object", objKey))
+			return nil, c.Status(fiber.StatusNotFound).SendString(media.Name + " not found in s3")
+		}
+
+		source.ContentType = obj.ContentType
+		if source.ContentType == "" {
+			if ct, ok := obj.Metadata["Content-Type"]; ok && len(ct) > 0 {
+				source.ContentType = ct[0]
+			} else {
+				source.ContentType = "application/octet-stream"
+			}
+		}
+
+		parsed, _, err := mime.ParseMediaType(source.ContentType)
+		if err != nil {
+			return nil, c.Status(fiber.StatusInternalServerError).SendString("failed to parse content type")
+		}
+		source.ContentType = parsed
+
+		if !media.Accept(source.ContentType) {
+			return nil, c.Status(fiber.StatusForbidden).SendString(fmt.Sprintf("content type '%s' is not %s", source.ContentType, media.Noun))
+		}
+
+		if obj.Size == 0 {
+			logger.Error("empty origin response", zap.String("object", objKey))
+			counters.OriginErrors.WithLabelValues(kind, "s3").Inc()
+			return nil, c.Status(fiber.StatusBadGateway).SendString(emptyOriginResponse)
+		}
+
+		// Generate presigned URL for ffmpeg to access
+		presignedURL, err := s3cache.Client.PresignedGetObject(context.Background(), s3cache.Bucket, objKey, time.Hour, nil)
+		if err != nil {
+			logger.Error("failed to generate presigned url", zap.Error(err))
+			return nil, c.Status(fiber.StatusInternalServerError).SendString("failed to generate presigned url")
+		}
+		source.URL = presignedURL.String()
+		source.Size = obj.Size
+	} else {
+		// Use HTTP/HTTPS origin - requires URL to be provided
+		if params.Url == "" {
+			return nil, c.Status(fiber.StatusBadRequest).SendString("url is required when location is not provided")
+		}
+
+		source.FailureKey = params.Url
+		if failure, ok := failures.get(source.FailureKey); ok {
+			logger.Info("source failed recently, not probing it again", zap.String("url", params.Url), zap.Int("status", failure.Status))
+			return nil, c.Status(failure.Status).SendString(failure.Message)
+		}
+
+		if allowed, retryAfter := origins.allow(params.Hostname); !allowed {
+			return nil, sendOriginRateLimited(c, logger, params.Hostname, retryAfter)
+		}
+
+		responseContentType, contentLength, err := validation.ProbeContent(httpClient, params.Url)
+		if message := refusedFetchMessage(err); message != "" {
+			return fail(fiber.StatusForbidden, message)
+		}
+		if err != nil {
+			return fail(fiber.StatusInternalServerError, "failed to check "+media.Name)
+		}
+
+		if responseContentType == "" {
+			return fail(fiber.StatusForbidden, "no content type received")
+		}
+
+		parsed, _, err := mime.ParseMediaType(responseContentType)
+		if err != nil {
+			return fail(fiber.StatusInternalServerError, "failed to parse content type")
+		}
+		source.ContentType = parsed
+
+		if !media.Accept(source.ContentType) {
+			return fail(fiber.StatusForbidden, fmt.Sprintf("content type '%s' is not allowed", source.ContentType))
+		}
+
+		// Only an explicit Content-Length: 0 is rejected, an unknown length is left to ffmpeg
+		if contentLength == 0 {
+			logger.Error("empty origin response", zap.String("url", params.Url), zap.String("hostname", params.Hostname))
+			counters.OriginErrors.WithLabelValues(kind, metrics.CleanHostname(params.Hostname)).Inc()
+			return fail(fiber.StatusBadGateway, emptyOriginResponse)
+		}
+
+		source.URL = params.Url
+		source.Size = contentLength
+		source.Headers = config.OriginHeaders
+	}
+
+	return source, nil
+}
+
+// storePreviewInS3 copies a preview and stores it in S3 in the background. Previews of location sources are stored
+// next to the source when previewKey is set, everything else under cacheKey (with prefix)
+func storePreviewInS3(s3cache *S3Cache, cacheKey, previewKey string, value CacheValue) {
+	if s3cache == nil || !s3cache.Enabled {
+		return
+	}
+
+	value.Body = bytes.Clone(value.Body)
+	go func() {
+		if previewKey != "" {
+			_ = s3cache.PutValueDirect(context.Background(), previewKey, value)
+			return
+		}
+		_ = s3cache.PutValue(context.Background(), cacheKey, value)
+	}()
+}
+
 //#endregion
 
 //#region parseRangeHeader
 
+// errRangeNotSatisfiable is returned when none of the requested ranges lies within the object
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
 // parseRangeHeader parses a single Range header of the form "bytes=start-end".
 // Returns start, end (end == -1 means to the end), hasRange, error
 func parseRangeHeader(h string) (int64, int64, bool, error) {
@@ -339,17 +581,255 @@ func parseRangeHeader(h string) (int64, int64, bool, error) {
 	return start, end, true, nil
 }
 
+// resolveRange turns a parsed range into absolute offsets within total bytes, reporting false when it can't be satisfied
+func resolveRange(start, end, total int64) (int64, int64, bool) {
+	// Handle suffix-range (-N means last N bytes)
+	if start < 0 {
+		n := -start
+		if n > total {
+			start = 0
+		} else {
+			start = total - n
+		}
+		end = total - 1
+	} else if end == -1 || end >= total {
+		// start to end of file
+		end = total - 1
+	}
+
+	// Validate range
+	if start < 0 || start >= total || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// byteRange is a range of byte offsets, end is inclusive
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseRanges parses a Range header with one or more comma separated ranges, each as parseRangeHeader returns it
+func parseRanges(h string) ([]byteRange, error) {
+	if !strings.HasPrefix(h, "bytes=") {
+		return nil, fmt.Errorf("unsupported range unit")
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(strings.TrimPrefix(h, "bytes="), ",") {
+		start, end, _, err := parseRangeHeader("bytes=" + strings.TrimSpace(spec))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+	}
+	return ranges, nil
+}
+
+// resolveRanges resolves parsed ranges within total bytes, dropping unsatisfiable ones and merging those that
+// overlap or touch, the result is ordered by offset
+func resolveRanges(ranges []byteRange, total int64) []byteRange {
+	var resolved []byteRange
+	for _, r := range ranges {
+		if start, end, ok := resolveRange(r.start, r.end, total); ok {
+			resolved = append(resolved, byteRange{start: start, end: end})
+		}
+	}
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].start < resolved[j].start })
+
+	var merged []byteRange
+	for _, r := range resolved {
+		if last := len(merged) - 1; last >= 0 && r.start <= merged[last].end+1 {
+			merged[last].end = max(merged[last].end, r.end)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// rangesLength is the number of bytes covered by the ranges
+func rangesLength(ranges []byteRange) int64 {
+	var length int64
+	for _, r := range ranges {
+		length += r.end - r.start + 1
+	}
+	return length
+}
+
+// writeMultipartRanges writes every range as a part of a multipart/byteranges body, open returns the bytes of one range
+func writeMultipartRanges(parts *multipart.Writer, contentType string, total int64, ranges []byteRange, open func(byteRange) (io.ReadCloser, error)) error {
+	for _, r := range ranges {
+		header := textproto.MIMEHeader{}
+		if contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", r.start, r.end, total))
+
+		part, err := parts.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		body, err := open(r)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(part, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return parts.Close()
+}
+
+// mergeRangeHeader resolves a Range header with several ranges. Ranges that merge into one are returned as a plain
+// single range header, so they are served like a single range request; otherwise the resolved ranges are returned
+func mergeRangeHeader(h string, total int64) (string, []byteRange, error) {
+	ranges, err := parseRanges(h)
+	if err != nil {
+		return "", nil, err
+	}
+	ranges = resolveRanges(ranges, total)
+	if len(ranges) == 0 {
+		return "", nil, errRangeNotSatisfiable
+	}
+	if len(ranges) == 1 {
+		return fmt.Sprintf("bytes=%d-%d", ranges[0].start, ranges[0].end), nil, nil
+	}
+	return "", ranges, nil
+}
+
+//#endregion
+
+//#region videoProxyCache
+
+// videoProxyCacheKey keys full proxied videos in the HTTP cache store, apart from the entries of the cache middleware
+func videoProxyCacheKey(path string) string {
+	return "video-proxy:" + path
+}
+
+// cachedVideo splits a video proxy cache entry into its content type and body
+func cachedVideo(entry []byte) (string, []byte, bool) {
+	contentType, body, found := bytes.Cut(entry, []byte{'\n'})
+	return string(contentType), body, found
+}
+
+// videoCacheable reports whether a full video of the given size is small enough to be kept for later requests
+func videoCacheable(httpCache *ristretto.Cache[string, []byte], config *config.Config, size int64) bool {
+	return httpCache != nil && size > 0 && size <= int64(config.VideoCacheMaxMB)<<20
+}
+
+// readVideoForCache reads a whole origin response into a cache entry, the content type is kept in front of the body
+func readVideoForCache(body io.Reader, contentType string, contentLength int64) ([]byte, error) {
+	entry := bytes.NewBuffer(make([]byte, 0, int64(len(contentType))+1+contentLength))
+	entry.WriteString(contentType)
+	entry.WriteByte('\n')
+	if _, err := io.Copy(entry, body); err != nil {
+		return nil, err
+	}
+	return entry.Bytes(), nil
+}
+
+// sendCachedVideo serves a cached video, slicing the requested range out of the full body
+func sendCachedVideo(c *fiber.Ctx, counters *metrics.Metrics, contentType string, body []byte, rangeHeader string) error {
+	total := int64(len(body))
+	c.Set("Accept-Ranges", "bytes")
+	c.Set("X-Cache-Place", cachePlaceResponseHandler)
+
+	// Several ranges are sent as multipart/byteranges
+	if strings.Contains(rangeHeader, ",") {
+		merged, ranges, err := mergeRangeHeader(rangeHeader, total)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			c.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("range not satisfiable")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("invalid range")
+		}
+		if ranges != nil {
+			var multipartBody bytes.Buffer
+			parts := multipart.NewWriter(&multipartBody)
+			err := writeMultipartRanges(parts, contentType, total, ranges, func(r byteRange) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body[r.start : r.end+1])), nil
+			})
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).SendString("failed to write ranges")
+			}
+
+			c.Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+			counters.ObserveServed("video", true, contentType, rangesLength(ranges))
+			return c.Status(fiber.StatusPartialContent).Send(multipartBody.Bytes())
+		}
+		rangeHeader = merged
+	}
+
+	start, end, hasRange, err := parseRangeHeader(rangeHeader)
+	if err != nil {
+		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("invalid range")
+	}
+
+	if contentType != "" {
+		c.Set("Content-Type", contentType)
+	}
+
+	if !hasRange {
+		counters.ObserveServed("video", true, contentType, total)
+		return c.Status(fiber.StatusOK).Send(body)
+	}
+
+	start, end, ok := resolveRange(start, end, total)
+	if !ok {
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("range not satisfiable")
+	}
+
+	c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	counters.ObserveServed("video", true, contentType, end-start+1)
+	return c.Status(fiber.StatusPartialContent).Send(body[start : end+1])
+}
+
 //#endregion
 
 //#region processVideoProxy
 
 // processVideoProxy streams raw video bytes from either S3 (explicit location) or HTTP/HTTPS origin.
 // Supports Range requests and forwards relevant headers.
-func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache) error {
+func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], httpCache *ristretto.Cache[string, []byte], config *config.Config, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, httpClient *http.Client, origins *OriginRateLimiter) error {
 	logger.Info("processing video proxy", zap.String("url", params.Url), zap.String("location", params.CustomObjectKey))
 
 	rangeHeader := c.Get("Range")
 
+	// Videos fetched in full before are served from memory, ranges included, whether they came from S3 or an origin
+	httpCacheKey := videoProxyCacheKey(c.Path())
+	if httpCache != nil {
+		if entry, found := httpCache.Get(httpCacheKey); found {
+			if contentType, body, ok := cachedVideo(entry); ok {
+				return sendCachedVideo(c, counters, contentType, body, rangeHeader)
+			}
+		}
+	}
+
+	// The duration is read like for GET /videos/meta/*, and cached along with the rest of the metadata
+	if config.MaxVideoDuration > 0 {
+		metadata, _, err := cachedMetadata(cache, config, metadataCacheKey(config, params, "video"), func() (*mediaMetadata, error) {
+			return readVideoMetadata(c, logger, config, counters, params, s3cache, inputs, extractor, failures, httpClient, origins, "video")
+		})
+		if metadata == nil {
+			return err
+		}
+		if metadata.Duration > float64(config.MaxVideoDuration) {
+			logger.Warn("video is too long to proxy", zap.Float64("duration", metadata.Duration), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+			return c.Status(fiber.StatusUnprocessableEntity).SendString(videoTooLongMessage)
+		}
+	}
+
+	// Players probe the size and type with HEAD, that needs no body from S3 or the origin
+	if c.Method() == fiber.MethodHead {
+		return sendVideoProxyHead(c, logger, counters, params, s3cache, httpClient, origins)
+	}
+
 	// If explicit S3 location provided, fetch from S3 (signature already enforced in validation)
 	if params.CustomObjectKey != "" && s3cache != nil && s3cache.Enabled && s3cache.Client != nil {
 		// Use S3 location from bucket root (no prefix)
@@ -361,14 +841,23 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 			logger.Error("failed to stat s3 object", zap.Error(err))
 			return c.Status(fiber.StatusNotFound).SendString("object not found")
 		}
+		contentType := objectContentType(info)
 
-		contentType := info.ContentType
-		if contentType == "" {
-			if ct, ok := info.Metadata["Content-Type"]; ok && len(ct) > 0 {
-				contentType = ct[0]
-			} else {
-				contentType = "application/octet-stream"
+		// Several ranges are streamed as multipart/byteranges, ranges that merge into one are served as a single range
+		if strings.Contains(rangeHeader, ",") {
+			merged, ranges, err := mergeRangeHeader(rangeHeader, info.Size)
+			if errors.Is(err, errRangeNotSatisfiable) {
+				c.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+				return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("range not satisfiable")
+			}
+			if err != nil {
+				logger.Error("invalid range header", zap.Error(err))
+				return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("invalid range")
+			}
+			if ranges != nil {
+				return sendS3Ranges(c, logger, counters, s3cache, objKey, contentType, info.Size, ranges)
 			}
+			rangeHeader = merged
 		}
 
 		// Parse range header and compute actual byte range
@@ -382,22 +871,8 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 		if hasRange {
 			total := info.Size
 
-			// Handle suffix-range (-N means last N bytes)
-			if start < 0 {
-				n := -start
-				if n > total {
-					start = 0
-				} else {
-					start = total - n
-				}
-				end = total - 1
-			} else if end == -1 {
-				// start to end of file
-				end = total - 1
-			}
-
-			// Validate range
-			if start < 0 || start >= total || start > end {
+			start, end, ok := resolveRange(start, end, total)
+			if !ok {
 				return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("range not satisfiable")
 			}
 
@@ -414,11 +889,14 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 			obj, err := s3cache.Client.GetObject(context.Background(), s3cache.Bucket, objKey, opts)
 			if err != nil {
 				logger.Error("failed to get object from s3", zap.Error(err), zap.String("object", objKey))
+				counters.OriginErrors.WithLabelValues("video", "s3").Inc()
 				return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch object from s3")
 			}
 			// Note: Don't defer close here - SendStream will handle closing the reader
 			// If we defer close, it will close the stream before SendStream finishes reading
 
+			counters.ObserveServed("video", false, contentType, length)
+
 			// Return Partial Content
 			c.Status(http.StatusPartialContent)
 			return c.SendStream(obj)
@@ -428,19 +906,43 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 		obj, err := s3cache.Client.GetObject(context.Background(), s3cache.Bucket, objKey, opts)
 		if err != nil {
 			logger.Error("failed to get object from s3", zap.Error(err), zap.String("object", objKey))
+			counters.OriginErrors.WithLabelValues("video", "s3").Inc()
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch object from s3")
 		}
+
+		// Small videos are kept so repeated requests don't go to S3
+		if videoCacheable(httpCache, config, info.Size) {
+			entry, err := readVideoForCache(obj, contentType, info.Size)
+			obj.Close()
+			if err != nil {
+				logger.Error("failed to read object from s3", zap.Error(err), zap.String("object", objKey))
+				counters.OriginErrors.WithLabelValues("video", "s3").Inc()
+				return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch object from s3")
+			}
+			httpCache.SetWithTTL(httpCacheKey, entry, int64(len(entry)), time.Duration(flooredTTL(config, int64(config.HTTPCacheTTL)))*time.Second)
+
+			_, body, _ := cachedVideo(entry)
+			c.Set("Accept-Ranges", "bytes")
+			c.Set("Content-Type", contentType)
+			counters.ObserveServed("video", false, contentType, int64(len(body)))
+			return c.Status(fiber.StatusOK).Send(body)
+		}
 		// Note: Don't defer close here - SendStream will handle closing the reader
 		// If we defer close, it will close the stream before SendStream finishes reading
 
 		c.Set("Accept-Ranges", "bytes")
 		c.Set("Content-Type", contentType)
 		c.Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		counters.ObserveServed("video", false, contentType, info.Size)
 		c.Status(http.StatusOK)
 		return c.SendStream(obj)
 	}
 
 	// Otherwise proxy via HTTP/HTTPS
+	if allowed, retryAfter := origins.allow(params.Hostname); !allowed {
+		return sendOriginRateLimited(c, logger, params.Hostname, retryAfter)
+	}
+
 	req, err := http.NewRequestWithContext(c.Context(), http.MethodGet, params.Url, nil)
 	if err != nil {
 		logger.Error("failed to create request", zap.Error(err))
@@ -448,6 +950,7 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 	}
 	// Forward Range header if present
 	if rangeHeader != "" {
+		rangeHeader = absoluteSuffixRange(c.Context(), logger, httpClient, params.Url, rangeHeader)
 		req.Header.Set("Range", rangeHeader)
 		// Disable compression for Range requests to prevent conflicts
 		// When Accept-Encoding: gzip is sent with Range header, some servers/CDNs
@@ -455,13 +958,38 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 		req.Header.Set("Accept-Encoding", "identity")
 	}
 
-	resp, err := client.GetHTTPClient().Do(req)
+	resp, err := httpClient.Do(req)
+	if refusedFetchMessage(err) != "" {
+		return sendRefusedFetch(c, logger, params.Url, err)
+	}
 	if err != nil {
 		logger.Error("failed to fetch origin", zap.Error(err))
+		counters.OriginErrors.WithLabelValues("video", metrics.CleanHostname(params.Hostname)).Inc()
 		return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch origin")
 	}
-	// ensure body closed after streaming
-	defer resp.Body.Close()
+	// Note: Don't defer close here - SendStream closes the body once it has been streamed,
+	// a deferred close would cut the stream before the response is written
+
+	// Full responses of small enough videos are kept so repeated and later Range requests don't go to the origin
+	if rangeHeader == "" && resp.StatusCode == http.StatusOK && videoCacheable(httpCache, config, resp.ContentLength) {
+		contentType := resp.Header.Get("Content-Type")
+		entry, err := readVideoForCache(resp.Body, contentType, resp.ContentLength)
+		resp.Body.Close()
+		if err != nil {
+			logger.Error("failed to read origin", zap.Error(err))
+			counters.OriginErrors.WithLabelValues("video", metrics.CleanHostname(params.Hostname)).Inc()
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to read origin")
+		}
+		httpCache.SetWithTTL(httpCacheKey, entry, int64(len(entry)), time.Duration(flooredTTL(config, int64(config.HTTPCacheTTL)))*time.Second)
+
+		_, body, _ := cachedVideo(entry)
+		c.Set("Accept-Ranges", "bytes")
+		if contentType != "" {
+			c.Set("Content-Type", contentType)
+		}
+		counters.ObserveServed("video", false, contentType, int64(len(body)))
+		return c.Status(fiber.StatusOK).Send(body)
+	}
 
 	// Forward major headers
 	if ct := resp.Header.Get("Content-Type"); ct != "" {
@@ -479,10 +1007,137 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 		c.Set("Content-Length", cl)
 	}
 
+	// Streamed bodies are only counted when the origin announced their length
+	if resp.ContentLength > 0 {
+		counters.ObserveServed("video", false, resp.Header.Get("Content-Type"), resp.ContentLength)
+	}
+
 	// Pass through status code (200 or 206 expected)
 	return c.Status(resp.StatusCode).SendStream(resp.Body)
 }
 
+// sendVideoProxyHead answers a HEAD request with the headers a GET of the whole video would get. S3 objects are
+// stat'ed and origins asked with a HEAD request, so the video itself isn't fetched
+func sendVideoProxyHead(c *fiber.Ctx, logger *zap.Logger, counters *metrics.Metrics, params *validation.ImageContext, s3cache *S3Cache, httpClient *http.Client, origins *OriginRateLimiter) error {
+	c.Set("Accept-Ranges", "bytes")
+
+	if params.CustomObjectKey != "" && s3cache != nil && s3cache.Enabled && s3cache.Client != nil {
+		info, err := s3cache.Client.StatObject(context.Background(), s3cache.Bucket, params.CustomObjectKey, minio.StatObjectOptions{})
+		if err != nil {
+			logger.Error("failed to stat s3 object", zap.Error(err))
+			return c.Status(fiber.StatusNotFound).SendString("object not found")
+		}
+
+		c.Set("Content-Type", objectContentType(info))
+		c.Response().Header.SetContentLength(int(info.Size))
+		return c.Status(fiber.StatusOK).Send(nil)
+	}
+
+	if allowed, retryAfter := origins.allow(params.Hostname); !allowed {
+		return sendOriginRateLimited(c, logger, params.Hostname, retryAfter)
+	}
+
+	req, err := http.NewRequestWithContext(c.Context(), http.MethodHead, params.Url, nil)
+	if err != nil {
+		logger.Error("failed to create request", zap.Error(err))
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to create request to origin")
+	}
+	resp, err := httpClient.Do(req)
+	if refusedFetchMessage(err) != "" {
+		return sendRefusedFetch(c, logger, params.Url, err)
+	}
+	if err != nil {
+		logger.Error("failed to fetch origin", zap.Error(err))
+		counters.OriginErrors.WithLabelValues("video", metrics.CleanHostname(params.Hostname)).Inc()
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to fetch origin")
+	}
+	_ = resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		c.Set("Content-Type", ct)
+	}
+	if ar := resp.Header.Get("Accept-Ranges"); ar != "" {
+		c.Set("Accept-Ranges", ar)
+	}
+	// Without a body the length has to be set on the header directly, it would be taken from the empty body otherwise
+	if resp.ContentLength >= 0 {
+		c.Response().Header.SetContentLength(int(resp.ContentLength))
+	}
+	return c.Status(resp.StatusCode).Send(nil)
+}
+
+// objectContentType returns the content type stored with an S3 object, application/octet-stream when it has none
+func objectContentType(info minio.ObjectInfo) string {
+	if info.ContentType != "" {
+		return info.ContentType
+	}
+	if ct, ok := info.Metadata["Content-Type"]; ok && len(ct) > 0 {
+		return ct[0]
+	}
+	return "application/octet-stream"
+}
+
+// absoluteSuffixRange rewrites a suffix range (bytes=-N) into an absolute one, since not every origin supports suffix
+// ranges. The size comes from a HEAD request, the header is returned unchanged when the origin doesn't tell it
+func absoluteSuffixRange(ctx context.Context, logger *zap.Logger, httpClient *http.Client, url, rangeHeader string) string {
+	start, _, hasRange, err := parseRangeHeader(rangeHeader)
+	if err != nil || !hasRange || start >= 0 {
+		return rangeHeader
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return rangeHeader
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Debug("failed to learn the video size, forwarding the suffix range", zap.Error(err), zap.String("url", url))
+		return rangeHeader
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 {
+		logger.Debug("origin didn't report the video size, forwarding the suffix range", zap.Int("status", resp.StatusCode), zap.String("url", url))
+		return rangeHeader
+	}
+
+	start, end, ok := resolveRange(start, -1, resp.ContentLength)
+	if !ok {
+		return rangeHeader
+	}
+	return fmt.Sprintf("bytes=%d-%d", start, end)
+}
+
+// sendS3Ranges streams several ranges of an S3 object as a multipart/byteranges response, each range is fetched on its own
+func sendS3Ranges(c *fiber.Ctx, logger *zap.Logger, counters *metrics.Metrics, s3cache *S3Cache, objKey, contentType string, total int64, ranges []byteRange) error {
+	reader, writer := io.Pipe()
+	parts := multipart.NewWriter(writer)
+
+	// Note: SendStream closes the reader once the response is written, which also stops this writer
+	go func() {
+		err := writeMultipartRanges(parts, contentType, total, ranges, func(r byteRange) (io.ReadCloser, error) {
+			opts := minio.GetObjectOptions{}
+			if err := opts.SetRange(r.start, r.end); err != nil {
+				return nil, err
+			}
+			return s3cache.Client.GetObject(context.Background(), s3cache.Bucket, objKey, opts)
+		})
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			logger.Error("failed to stream ranges from s3", zap.Error(err), zap.String("object", objKey))
+			counters.OriginErrors.WithLabelValues("video", "s3").Inc()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	c.Set("Accept-Ranges", "bytes")
+	c.Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	counters.ObserveServed("video", false, contentType, rangesLength(ranges))
+	c.Status(http.StatusPartialContent)
+	return c.SendStream(reader)
+}
+
 //#endregion
 
 //#region handleVideoUpload
@@ -491,6 +1146,8 @@ func processVideoProxy(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[
 // Requires: deadline (unix timestamp), location (base64-encoded S3 key), signature (HMAC of deadline|location)
 func handleVideoUpload(logger *zap.Logger, config *config.Config, counters *metrics.Metrics, s3cache *S3Cache) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		logger.Info("video upload request received")
 
 		// Validate upload parameters (deadline, location, signature)
@@ -522,7 +1179,7 @@ func handleVideoUpload(logger *zap.Logger, config *config.Config, counters *metr
 			}
 		}
 
-		// Open and read video file
+		// Open video file
 		file, err := fileHeader.Open()
 		if err != nil {
 			logger.Error("failed to open video file", zap.Error(err))
@@ -548,20 +1205,26 @@ func handleVideoUpload(logger *zap.Logger, config *config.Config, counters *metr
 			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("content type '%s' is not a video", parsedContentType))
 		}
 
-		// Read file contents
-		videoData, err := io.ReadAll(file)
+		// The declared type has to match the container, only the leading bytes are read
+		matches, err := matchesDeclaredVideo(file, parsedContentType)
 		if err != nil {
 			logger.Error("failed to read video file", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to read video file")
 		}
+		if !matches {
+			logger.Error("video content does not match its content type", zap.String("contentType", parsedContentType))
+			return c.Status(fiber.StatusUnsupportedMediaType).SendString(fmt.Sprintf("file content is not a '%s' video", parsedContentType))
+		}
 
-		// Upload to S3
-		err = s3cache.PutAtLocation(context.Background(), location, videoData, parsedContentType)
+		// Stream the file to S3 rather than reading it into memory first
+		err = s3cache.PutAtLocationStream(context.Background(), location, file, fileHeader.Size, parsedContentType)
 		if err != nil {
 			logger.Error("failed to upload video to S3", zap.Error(err), zap.String("location", location))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to upload video")
 		}
 
+		waitForUploadedObjects(logger, config, s3cache, location)
+
 		// Increment metrics
 		counters.SuccessfullyServed.WithLabelValues("video-upload", "upload", "upload").Inc()
 
@@ -578,6 +1241,35 @@ func handleVideoUpload(logger *zap.Logger, config *config.Config, counters *metr
 	}
 }
 
+// matchesDeclaredVideo reports whether the file starts with the container of the declared video type, it is rewound
+// afterwards so it can be uploaded from the start
+func matchesDeclaredVideo(file io.ReadSeeker, mimeType string) (bool, error) {
+	header := make([]byte, validation.VideoSniffLength)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return validation.MatchesVideoContent(mimeType, header[:n]), nil
+}
+
+// waitForUploadedObjects holds the upload response until an eventually consistent store serves the written objects,
+// so reads right after it don't 404. Objects still missing after the retries are only logged, the write itself succeeded
+func waitForUploadedObjects(logger *zap.Logger, config *config.Config, s3cache *S3Cache, locations ...string) {
+	if config.S3ConsistencyRetries <= 0 {
+		return
+	}
+
+	backoff := time.Duration(config.S3ConsistencyBackoffMs) * time.Millisecond
+	for _, location := range locations {
+		if err := s3cache.WaitVisibleAtLocation(context.Background(), location, config.S3ConsistencyRetries, backoff); err != nil {
+			logger.Warn("uploaded object is not readable yet", zap.Error(err), zap.String("location", location))
+		}
+	}
+}
+
 //#endregion
 
 //#region handleMultipartUploadInit
@@ -585,8 +1277,10 @@ func handleVideoUpload(logger *zap.Logger, config *config.Config, counters *metr
 // handleMultipartUploadInit initializes a multi-part upload session
 // Required query params: token, deadline, location, size, contentType
 // Optional: chunkSize
-func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, uploadTracker *RedisUploadTracker) fiber.Handler {
+func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, s3cache *S3Cache, uploadTracker *RedisUploadTracker) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		logger.Info("multipart upload init request received")
 
 		// Check if uploading is enabled
@@ -599,6 +1293,11 @@ func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, upload
 			return c.Status(fiber.StatusServiceUnavailable).SendString("multi-part upload not configured")
 		}
 
+		// Check if S3 is enabled
+		if s3cache == nil || !s3cache.Enabled || s3cache.Client == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("video upload service unavailable")
+		}
+
 		// Validate token
 		token := c.Query("token")
 		if token == "" || token != config.Token {
@@ -686,13 +1385,29 @@ func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, upload
 			}
 		}
 
+		// S3 only accepts small parts at the end of an upload and caps the number of parts
+		if chunkSize < MinChunkSize && chunkSize < totalSize {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("chunkSize must be at least %d bytes", MinChunkSize))
+		}
+		if (totalSize+chunkSize-1)/chunkSize > MaxPartsCount {
+			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("chunkSize too small: an upload can have at most %d parts", MaxPartsCount))
+		}
+
 		// Generate upload ID
 		uploadID := fmt.Sprintf("%d", time.Now().UnixNano())
 
+		// Start the S3 multipart upload receiving the parts
+		s3UploadID, err := s3cache.NewMultipartUpload(context.Background(), location, parsedContentType)
+		if err != nil {
+			logger.Error("failed to start S3 multipart upload", zap.Error(err), zap.String("location", location))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to initialize upload")
+		}
+
 		// Initialize upload in Redis
 		uploadInfo, err := uploadTracker.InitializeUpload(
 			context.Background(),
 			uploadID,
+			s3UploadID,
 			location,
 			totalSize,
 			chunkSize,
@@ -701,6 +1416,9 @@ func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, upload
 		)
 		if err != nil {
 			logger.Error("failed to initialize upload", zap.Error(err))
+			if err := s3cache.AbortMultipartUpload(context.Background(), location, s3UploadID); err != nil {
+				logger.Warn("failed to abort S3 multipart upload", zap.Error(err), zap.String("location", location))
+			}
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to initialize upload")
 		}
 
@@ -733,6 +1451,8 @@ func handleMultipartUploadInit(logger *zap.Logger, config *config.Config, upload
 // Required query params: uploadToken (generated during init, not APP_TOKEN)
 func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, uploadTracker *RedisUploadTracker) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		logger.Info("multipart upload part request received")
 
 		// Check if uploading is enabled
@@ -791,8 +1511,24 @@ func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counte
 			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("invalid partIndex: must be between 0 and %d", uploadInfo.PartsCount-1))
 		}
 
-		// Get the part info
-		part := uploadInfo.Parts[partIndex]
+		// A part already stored isn't uploaded again, so a resuming client can resend parts it isn't sure about
+		if slices.Contains(uploadInfo.UploadedParts, partIndex) {
+			part := uploadInfo.Parts[partIndex]
+			logger.Info("video part already uploaded", zap.String("uploadId", uploadID), zap.Int("partIndex", partIndex))
+
+			response := fiber.Map{
+				"uploadId":        uploadID,
+				"partIndex":       partIndex,
+				"size":            part.UploadedSize,
+				"etag":            part.ETag,
+				"complete":        len(missingParts(uploadInfo)) == 0,
+				"alreadyUploaded": true,
+			}
+			if part.Checksum != "" {
+				response["checksum"] = part.Checksum
+			}
+			return c.Status(fiber.StatusOK).JSON(response)
+		}
 
 		// Get video part from multipart form
 		fileHeader, err := c.FormFile("video")
@@ -801,9 +1537,16 @@ func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counte
 			return c.Status(fiber.StatusBadRequest).SendString("video file is required")
 		}
 
-		// Validate part size
-		if fileHeader.Size != part.Size {
-			return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("part size mismatch: expected %d bytes, got %d bytes", part.Size, fileHeader.Size))
+		// Validate part size (a short final part is accepted)
+		if err := validatePartSize(uploadInfo, partIndex, fileHeader.Size); err != nil {
+			logger.Error("invalid part size", zap.Error(err), zap.String("uploadId", uploadID), zap.Int("partIndex", partIndex))
+
+			status := fiber.StatusBadRequest
+			var sizeErr *PartSizeError
+			if errors.As(err, &sizeErr) && sizeErr.TooLarge() {
+				status = fiber.StatusRequestEntityTooLarge
+			}
+			return c.Status(status).SendString(err.Error())
 		}
 
 		// Open and read video part
@@ -821,16 +1564,25 @@ func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counte
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to read video file")
 		}
 
-		// Upload part to S3 with part suffix
-		partLocation := fmt.Sprintf("%s.part%d", uploadInfo.Location, partIndex)
-		err = s3cache.PutAtLocationExpiring(context.Background(), partLocation, videoData, uploadInfo.ContentType, uploadInfo.ExpiresAt)
+		// A checksum sent with the part is verified before anything is stored
+		var checksum string
+		if expected := c.Query("checksum"); expected != "" {
+			checksum, err = verifyPartChecksum(videoData, expected)
+			if err != nil {
+				logger.Error("part checksum verification failed", zap.Error(err), zap.String("uploadId", uploadID), zap.Int("partIndex", partIndex))
+				return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+			}
+		}
+
+		// Upload part to the S3 multipart upload, which numbers parts from 1
+		etag, err := s3cache.PutObjectPart(context.Background(), uploadInfo.Location, uploadInfo.S3UploadID, partIndex+1, videoData)
 		if err != nil {
-			logger.Error("failed to upload video part to S3", zap.Error(err), zap.String("location", partLocation))
+			logger.Error("failed to upload video part to S3", zap.Error(err), zap.String("location", uploadInfo.Location), zap.Int("partIndex", partIndex))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to upload video part")
 		}
 
 		// Mark part as uploaded
-		err = uploadTracker.MarkPartUploaded(context.Background(), uploadID, partIndex)
+		err = uploadTracker.MarkPartUploaded(context.Background(), uploadID, partIndex, fileHeader.Size, etag, checksum)
 		if err != nil {
 			logger.Error("failed to mark part as uploaded", zap.Error(err))
 			return c.Status(fiber.StatusInternalServerError).SendString("failed to update upload status")
@@ -848,15 +1600,20 @@ func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counte
 		logger.Info("video part uploaded successfully",
 			zap.String("uploadId", uploadID),
 			zap.Int("partIndex", partIndex),
-			zap.String("location", partLocation),
+			zap.String("location", uploadInfo.Location),
 			zap.Int64("size", fileHeader.Size),
 			zap.Bool("complete", isComplete))
 
 		response := fiber.Map{
-			"uploadId":  uploadID,
-			"partIndex": partIndex,
-			"size":      fileHeader.Size,
-			"complete":  isComplete,
+			"uploadId":        uploadID,
+			"partIndex":       partIndex,
+			"size":            fileHeader.Size,
+			"etag":            etag,
+			"complete":        isComplete,
+			"alreadyUploaded": false,
+		}
+		if checksum != "" {
+			response["checksum"] = checksum
 		}
 
 		return c.Status(fiber.StatusOK).JSON(response)
@@ -865,12 +1622,199 @@ func handleMultipartUploadPart(logger *zap.Logger, config *config.Config, counte
 
 //#endregion
 
+//#region handleMultipartUploadComplete
+
+// handleMultipartUploadComplete completes the S3 multipart upload, assembling the uploaded parts into the final
+// object at the upload location, then removes the upload tracking
+// Required path params: uploadId
+// Required query params: uploadToken (generated during init, not APP_TOKEN)
+func handleMultipartUploadComplete(logger *zap.Logger, config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, uploadTracker *RedisUploadTracker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		logger.Info("multipart upload complete request received")
+
+		// Check if uploading is enabled
+		if !config.UploadingEnabled {
+			return c.Status(fiber.StatusForbidden).SendString("video uploading is disabled")
+		}
+
+		// Check if Redis is configured
+		if uploadTracker == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("multi-part upload not configured")
+		}
+
+		// Check if S3 is enabled
+		if s3cache == nil || !s3cache.Enabled || s3cache.Client == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("video upload service unavailable")
+		}
+
+		// Get upload ID from path parameter
+		uploadID := c.Params("uploadId")
+		if uploadID == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("uploadId parameter is required")
+		}
+
+		// Get upload info first to validate token
+		uploadInfo, err := uploadTracker.GetUploadInfo(context.Background(), uploadID)
+		if err != nil {
+			logger.Error("failed to get upload info", zap.Error(err))
+			return c.Status(fiber.StatusNotFound).SendString("upload not found or expired")
+		}
+
+		// Validate upload token (not APP_TOKEN)
+		uploadToken := c.Query("uploadToken")
+		if uploadToken == "" || uploadToken != uploadInfo.UploadToken {
+			logger.Error("invalid or missing upload token")
+			return c.Status(fiber.StatusForbidden).SendString("invalid upload token")
+		}
+
+		// Check if deadline has passed
+		if time.Now().After(uploadInfo.ExpiresAt) {
+			return c.Status(fiber.StatusForbidden).SendString("upload deadline has expired")
+		}
+
+		// Every part has to be there before the video can be assembled
+		isComplete, err := uploadTracker.IsUploadComplete(context.Background(), uploadID)
+		if err != nil {
+			logger.Error("failed to check upload completion", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to check upload status")
+		}
+		if missing := missingParts(uploadInfo); !isComplete || len(missing) > 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":        "upload is not complete",
+				"missingParts": missing,
+			})
+		}
+
+		// Verified parts must still be the ones S3 stored when they were checked, a different ETag means they were replaced
+		if hasVerifiedParts(uploadInfo) {
+			etags, err := s3cache.ListPartETags(context.Background(), uploadInfo.Location, uploadInfo.S3UploadID)
+			if err != nil {
+				logger.Error("failed to list S3 multipart upload parts", zap.Error(err), zap.String("uploadId", uploadID))
+				return c.Status(fiber.StatusInternalServerError).SendString("failed to check uploaded parts")
+			}
+			if changed := changedParts(uploadInfo, etags); len(changed) > 0 {
+				logger.Error("verified parts changed before completion", zap.String("uploadId", uploadID), zap.Ints("changedParts", changed))
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error":        "parts changed after they were verified",
+					"changedParts": changed,
+				})
+			}
+		}
+
+		// Assemble the parts into the final object, S3 makes it visible in one step
+		if err := s3cache.CompleteMultipartUpload(context.Background(), uploadInfo.Location, uploadInfo.S3UploadID, completedParts(uploadInfo)); err != nil {
+			logger.Error("failed to complete S3 multipart upload", zap.Error(err), zap.String("uploadId", uploadID), zap.String("location", uploadInfo.Location))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to assemble video")
+		}
+		waitForUploadedObjects(logger, config, s3cache, uploadInfo.Location)
+
+		// The video is stored, leftover tracking only costs memory and expires on its own
+		if err := uploadTracker.DeleteUpload(context.Background(), uploadID); err != nil {
+			logger.Warn("failed to delete upload tracking", zap.Error(err), zap.String("uploadId", uploadID))
+		}
+
+		// Increment metrics
+		counters.SuccessfullyServed.WithLabelValues("video-upload-complete", "upload", "upload").Inc()
+
+		logger.Info("multipart upload completed",
+			zap.String("uploadId", uploadID),
+			zap.String("location", uploadInfo.Location),
+			zap.Int64("size", uploadInfo.TotalSize))
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"uploadId": uploadID,
+			"location": uploadInfo.Location,
+			"size":     uploadInfo.TotalSize,
+		})
+	}
+}
+
+//#endregion
+
+//#region handleMultipartUploadAbort
+
+// handleMultipartUploadAbort cancels a multi-part upload, discarding the uploaded parts and the upload tracking
+// Required path params: uploadId
+// Required query params: uploadToken (generated during init) or token (APP_TOKEN)
+func handleMultipartUploadAbort(logger *zap.Logger, config *config.Config, counters *metrics.Metrics, s3cache *S3Cache, uploadTracker *RedisUploadTracker) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		logger.Info("multipart upload abort request received")
+
+		// Check if Redis is configured
+		if uploadTracker == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("multi-part upload not configured")
+		}
+
+		// Check if S3 is enabled
+		if s3cache == nil || !s3cache.Enabled || s3cache.Client == nil {
+			return c.Status(fiber.StatusServiceUnavailable).SendString("video upload service unavailable")
+		}
+
+		// Get upload ID from path parameter
+		uploadID := c.Params("uploadId")
+		if uploadID == "" {
+			return c.Status(fiber.StatusBadRequest).SendString("uploadId parameter is required")
+		}
+
+		// Get upload info first to validate token
+		uploadInfo, err := uploadTracker.GetUploadInfo(context.Background(), uploadID)
+		if err != nil {
+			logger.Error("failed to get upload info", zap.Error(err))
+			return c.Status(fiber.StatusNotFound).SendString("upload not found or expired")
+		}
+
+		// Either the uploader or the service may cancel
+		uploadToken, token := c.Query("uploadToken"), c.Query("token")
+		if (uploadToken == "" || uploadToken != uploadInfo.UploadToken) && (token == "" || token != config.Token) {
+			logger.Error("invalid or missing upload token")
+			return c.Status(fiber.StatusForbidden).SendString("invalid upload token")
+		}
+
+		// Drop the S3 multipart upload along with every part uploaded to it
+		if err := s3cache.AbortMultipartUpload(context.Background(), uploadInfo.Location, uploadInfo.S3UploadID); err != nil {
+			logger.Error("failed to abort S3 multipart upload", zap.Error(err), zap.String("uploadId", uploadID), zap.String("location", uploadInfo.Location))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to abort upload")
+		}
+
+		if err := uploadTracker.DeleteUpload(context.Background(), uploadID); err != nil {
+			logger.Error("failed to delete upload tracking", zap.Error(err), zap.String("uploadId", uploadID))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to delete upload tracking")
+		}
+
+		deletedParts := append([]int{}, uploadInfo.UploadedParts...)
+		sort.Ints(deletedParts)
+
+		// Increment metrics
+		counters.SuccessfullyServed.WithLabelValues("video-upload-abort", "upload", "upload").Inc()
+
+		logger.Info("multipart upload aborted",
+			zap.String("uploadId", uploadID),
+			zap.String("location", uploadInfo.Location),
+			zap.Int("deletedCount", len(deletedParts)))
+
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"uploadId":     uploadID,
+			"location":     uploadInfo.Location,
+			"deletedParts": deletedParts,
+			"deletedCount": len(deletedParts),
+		})
+	}
+}
+
+//#endregion
+
 //#region handleMultipartUploadStatus
 
 // handleMultipartUploadStatus returns the status of a multi-part upload
 // Requires token authentication
 func handleMultipartUploadStatus(logger *zap.Logger, config *config.Config, uploadTracker *RedisUploadTracker) fiber.Handler {
 	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
 		logger.Info("multipart upload status request received")
 
 		// Check if Redis is configured
@@ -908,6 +1852,7 @@ func handleMultipartUploadStatus(logger *zap.Logger, config *config.Config, uplo
 			"partsCount":    uploadInfo.PartsCount,
 			"uploadedParts": uploadInfo.UploadedParts,
 			"uploadedCount": len(uploadInfo.UploadedParts),
+			"missingParts":  missingParts(uploadInfo),
 			"complete":      isComplete,
 			"contentType":   uploadInfo.ContentType,
 			"createdAt":     uploadInfo.CreatedAt,
@@ -0,0 +1,210 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/pool"
+	"media-proxy/validation"
+)
+
+const (
+	// defaultAnimationDuration and defaultAnimationFPS apply to animated previews whose path has no dur: or fps:,
+	// lowered to the configured maximum
+	defaultAnimationDuration = 3
+	defaultAnimationFPS      = 10
+	// defaultAnimationWidth is the width of the frames of an animated preview whose path sets neither w: nor h:
+	defaultAnimationWidth = 320
+)
+
+// animationCacheKey keys an animated preview apart from the still previews of the same parameters
+func animationCacheKey(config *config.Config, params *validation.ImageContext, duration, fps float64) string {
+	return "animated;" + cacheKey(config, params) + ";dur=" + strconv.FormatFloat(duration, 'f', -1, 64) + ";fps=" + strconv.FormatFloat(fps, 'f', -1, 64)
+}
+
+// handleVideoAnimationRequest answers GET /videos/animated/* with a looping GIF or WebP of dur: seconds of the video
+// from fp: on, at fps: frames per second
+func handleVideoAnimationRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		pathParams := c.Params("*")
+		logger.Info("video animation request received", zap.String("pathParams", pathParams))
+
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+
+		return processVideoAnimation(c, logger, cache, config, counters, performance, params, s3cache, inputs, extractor, failures, scheduler, httpClient, origins)
+	}
+}
+
+// processVideoAnimation extracts the frames of the clip in one pass and compresses each into the animation as it is
+// decoded
+func processVideoAnimation(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) error {
+	duration, fps := params.ClipDuration, params.ClipFPS
+	if duration == 0 {
+		duration = min(defaultAnimationDuration, config.AnimationMaxDuration)
+	}
+	if fps == 0 {
+		fps = min(defaultAnimationFPS, config.AnimationMaxFPS)
+	}
+	if duration > config.AnimationMaxDuration {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("an animated preview is at most %g seconds long", config.AnimationMaxDuration))
+	}
+	if fps > config.AnimationMaxFPS {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("an animated preview has at most %g frames per second", config.AnimationMaxFPS))
+	}
+	sequence := frameSequence{Position: params.FramePosition, Interval: 1 / fps, Count: max(int(math.Ceil(duration*fps)), 1)}
+
+	key := animationCacheKey(config, params, duration, fps)
+	cacheValue, ok := cache.Get(key)
+	if !ok && s3cache != nil && s3cache.Enabled {
+		if s3val, err := s3cache.Get(context.Background(), key); err == nil && s3val != nil {
+			s3val.ETag = contentETag(key, s3val.Body)
+			cache.SetWithTTL(key, *s3val, 1000, cacheTTL(config))
+			cacheValue, ok = *s3val, true
+		}
+	}
+	if ok {
+		counters.SuccessfullyServed.WithLabelValues("video-animation", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+		counters.ServedCached.WithLabelValues("video-animation", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+
+		setPreviewHeaders(c, false, cacheValue.Headers)
+		c.Set("Content-Type", cacheValue.ContentType)
+		c.Set("Cache-Control", cacheControl(config, params))
+		if setResponseValidators(c, cacheValue) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		counters.ObserveServed("video-animation", true, cacheValue.ContentType, int64(len(cacheValue.Body)))
+		return c.Send(cacheValue.Body)
+	}
+
+	source, err := resolveMediaSource(c, logger, config, counters, params, s3cache, failures, httpClient, origins, "video-animation", videoMedia)
+	if source == nil {
+		return err
+	}
+	fail := func(status int, message string) error {
+		failures.add(source.FailureKey, probeFailure{Status: status, Message: message})
+		return c.Status(status).SendString(message)
+	}
+
+	release, err := scheduler.acquire(workExpensive)
+	if err != nil {
+		return sendBusy(c, logger, err)
+	}
+	defer release()
+
+	applyFormatInterpolation(config, params, source.ContentType)
+	width, height := params.Width, params.Height
+	if width == 0 && height == 0 {
+		width = defaultAnimationWidth
+	}
+
+	var animation animationEncoder = newGIFAnimation(fps)
+	if params.Webp {
+		options, err := newWebpEncoderOptions(outputQuality(config, params.Quality, source.ContentType), webpMethod(config, params), config.EncoderThreads)
+		if err != nil {
+			logger.Error("failed to create webp encoder options", zap.Error(err))
+			return c.Status(fiber.StatusInternalServerError).SendString("failed to create webp encoder options")
+		}
+		animation = newWebpAnimation(fps, options)
+	}
+
+	frames := 0
+	limits := newOutputLimits(config)
+	done := metrics.TimeVideoOperation("animation-extract", performance)
+	video, err := extractor.ExtractFrames(source.URL, sequence, frameExtractionOptions{
+		Threads:              config.EncoderThreads,
+		RejectBeyondDuration: config.FramePositionBeyondDuration == "reject",
+		Inputs:               inputs,
+		ProbeTimeout:         time.Duration(config.VideoProbeTimeout) * time.Second,
+		Headers:              source.Headers,
+		MaxDuration:          float64(config.MaxVideoDuration),
+	}, func(frame image.Image) error {
+		frame, err := resizeImage(frame, width, height, params.Interpolation, limits)
+		if err != nil {
+			return err
+		}
+		if params.Scale > 0 {
+			if frame, err = rescaleImage(frame, params.Scale, limits); err != nil {
+				return err
+			}
+		}
+		frames++
+		return animation.add(frame)
+	})
+	done()
+	if errors.Is(err, errProbeTimeout) {
+		logger.Error("video probe timed out", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusGatewayTimeout, "video probe timed out")
+	}
+	if errors.Is(err, errVideoTooLong) {
+		logger.Warn("video is too long for an animated preview", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, videoTooLongMessage)
+	}
+	// Both depend on the position, which is part of the request rather than the source, so they aren't remembered
+	if errors.Is(err, errUnknownDuration) {
+		logger.Warn("video duration is unknown", zap.String("position", params.FramePosition), zap.String("url", params.Url))
+		return c.Status(fiber.StatusUnprocessableEntity).SendString("video duration is unknown, the position can't be resolved")
+	}
+	if errors.Is(err, errPositionBeyondDuration) {
+		logger.Warn("frame position beyond duration", zap.String("position", params.FramePosition), zap.String("url", params.Url))
+		return c.Status(fiber.StatusBadRequest).SendString("position beyond duration")
+	}
+	// The frame size is part of the request as well
+	if errors.Is(err, errOutputTooLarge) {
+		logger.Warn("animation frame is too large", zap.Error(err), zap.Int("width", width), zap.Int("height", height))
+		return c.Status(fiber.StatusBadRequest).SendString(limits.message())
+	}
+	if err != nil {
+		logger.Error("failed to extract animation frames", zap.Error(err), zap.String("position", params.FramePosition))
+		return fail(fiber.StatusInternalServerError, "failed to extract animated preview")
+	}
+	failures.forget(source.FailureKey)
+
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+
+	done = metrics.TimeVideoOperation("animation-encode", performance)
+	err = animation.encode(buf)
+	done()
+	if err != nil {
+		logger.Error("failed to encode animated preview", zap.Error(err), zap.String("content-type", animation.contentType()))
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to encode animated preview")
+	}
+
+	headers := video.headers()
+	headers["X-Animation-Frames"] = strconv.Itoa(frames)
+
+	// The buffer goes back to the pool, the cached body can't share it
+	value := CacheValue{Body: bytes.Clone(buf.Bytes()), ContentType: animation.contentType(), Headers: headers}
+	value.ETag = contentETag(key, value.Body)
+	cache.SetWithTTL(key, value, 1000, cacheTTL(config))
+	storePreviewInS3(s3cache, key, "", value)
+
+	setPreviewHeaders(c, false, headers)
+	c.Set("Content-Type", value.ContentType)
+	c.Set("Cache-Control", cacheControl(config, params))
+	c.Set("ETag", value.ETag)
+
+	logger.Info("video animation served successfully", zap.Int("frames", frames), zap.String("origin", params.Hostname))
+	counters.SuccessfullyServed.WithLabelValues("video-animation", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	counters.ObserveServed("video-animation", false, value.ContentType, int64(len(value.Body)))
+
+	return c.Send(value.Body)
+}
@@ -0,0 +1,176 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"io"
+
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+)
+
+// animationEncoder collects the frames of an animated preview as they are decoded, each is compressed right away so
+// the decoded frames don't pile up
+type animationEncoder interface {
+	add(frame image.Image) error
+	encode(w io.Writer) error
+	contentType() string
+}
+
+// gifAnimation dithers every frame to the Plan 9 palette, GIF frames hold at most 256 colors
+type gifAnimation struct {
+	delay int // Hundredths of a second per frame
+	gif   gif.GIF
+}
+
+func newGIFAnimation(fps float64) *gifAnimation {
+	return &gifAnimation{delay: max(int(100/fps+0.5), 1)}
+}
+
+func (a *gifAnimation) add(frame image.Image) error {
+	bounds := frame.Bounds()
+	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette.Plan9)
+	draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), frame, bounds.Min)
+	a.gif.Image = append(a.gif.Image, paletted)
+	a.gif.Delay = append(a.gif.Delay, a.delay)
+	return nil
+}
+
+func (a *gifAnimation) encode(w io.Writer) error {
+	return gif.EncodeAll(w, &a.gif)
+}
+
+func (a *gifAnimation) contentType() string {
+	return "image/gif"
+}
+
+// webpAnimation encodes every frame as a still WebP and muxes their image chunks into the frames of an animated
+// WebP, libwebp's animation encoder isn't bound by the webp package
+type webpAnimation struct {
+	options  *encoder.Options
+	duration int // Milliseconds per frame
+
+	width  int
+	height int
+	alpha  bool
+	frames bytes.Buffer // ANMF chunks
+}
+
+func newWebpAnimation(fps float64, options *encoder.Options) *webpAnimation {
+	return &webpAnimation{options: options, duration: max(int(1000/fps+0.5), 1)}
+}
+
+func (a *webpAnimation) add(frame image.Image) error {
+	var still bytes.Buffer
+	if err := webp.Encode(&still, frame, a.options); err != nil {
+		return err
+	}
+	chunks, alpha, err := webpImageChunks(still.Bytes())
+	if err != nil {
+		return err
+	}
+	a.addFrame(frame.Bounds().Size(), chunks, alpha)
+	return nil
+}
+
+// addFrame appends a frame of the given size from the image chunks of its still
+func (a *webpAnimation) addFrame(size image.Point, chunks []byte, alpha bool) {
+	a.width, a.height = max(a.width, size.X), max(a.height, size.Y)
+	a.alpha = a.alpha || alpha
+
+	// Frames cover the canvas from its top left corner and replace the previous one instead of being blended into it
+	header := make([]byte, 16)
+	putUint24(header[6:], size.X-1)
+	putUint24(header[9:], size.Y-1)
+	putUint24(header[12:], a.duration)
+	header[15] = 0x02
+	writeWebpChunk(&a.frames, "ANMF", append(header, chunks...))
+}
+
+func (a *webpAnimation) encode(w io.Writer) error {
+	if a.frames.Len() == 0 {
+		return errors.New("no frames to encode")
+	}
+
+	var chunks bytes.Buffer
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 // Animation
+	if a.alpha {
+		vp8x[0] |= 0x10
+	}
+	putUint24(vp8x[4:], a.width-1)
+	putUint24(vp8x[7:], a.height-1)
+	writeWebpChunk(&chunks, "VP8X", vp8x)
+	// Transparent background, loops forever
+	writeWebpChunk(&chunks, "ANIM", make([]byte, 6))
+	chunks.Write(a.frames.Bytes())
+
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+chunks.Len()))
+	copy(header[8:], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(chunks.Bytes())
+	return err
+}
+
+func (a *webpAnimation) contentType() string {
+	return "image/webp"
+}
+
+// webpImageChunks returns the ALPH, VP8 and VP8L chunks of a still WebP as they are laid out in the file, and whether
+// the image has an alpha channel
+func webpImageChunks(still []byte) ([]byte, bool, error) {
+	if len(still) < 12 || string(still[0:4]) != "RIFF" || string(still[8:12]) != "WEBP" {
+		return nil, false, errors.New("not a webp image")
+	}
+
+	var chunks []byte
+	alpha := false
+	for offset := 12; offset+8 <= len(still); {
+		fourCC := string(still[offset : offset+4])
+		end := offset + 8 + int(binary.LittleEndian.Uint32(still[offset+4:]))
+		end += end % 2 // Chunks are padded to an even size
+		if end > len(still) {
+			return nil, false, errors.New("truncated webp chunk")
+		}
+
+		switch fourCC {
+		case "ALPH", "VP8L":
+			alpha = true
+			chunks = append(chunks, still[offset:end]...)
+		case "VP8 ":
+			chunks = append(chunks, still[offset:end]...)
+		}
+		offset = end
+	}
+
+	if len(chunks) == 0 {
+		return nil, false, errors.New("webp image has no image data")
+	}
+	return chunks, alpha, nil
+}
+
+// writeWebpChunk writes a RIFF chunk, padded to an even size
+func writeWebpChunk(w *bytes.Buffer, fourCC string, payload []byte) {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(payload)))
+	w.WriteString(fourCC)
+	w.Write(size)
+	w.Write(payload)
+	if len(payload)%2 != 0 {
+		w.WriteByte(0)
+	}
+}
+
+// putUint24 writes the 24 bit little endian numbers WebP headers use
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
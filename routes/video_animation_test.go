@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+func TestWebpImageChunks(t *testing.T) {
+	var still bytes.Buffer
+	writeWebpChunk(&still, "VP8X", make([]byte, 10))
+	writeWebpChunk(&still, "ALPH", []byte{1, 2, 3})
+	writeWebpChunk(&still, "VP8 ", []byte{4, 5, 6, 7})
+	file := append([]byte("RIFF\x00\x00\x00\x00WEBP"), still.Bytes()...)
+
+	chunks, alpha, err := webpImageChunks(file)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The odd sized ALPH chunk keeps its padding byte, VP8X is left out
+	expected := []byte("ALPH\x03\x00\x00\x00\x01\x02\x03\x00VP8 \x04\x00\x00\x00\x04\x05\x06\x07")
+	if !bytes.Equal(chunks, expected) || !alpha {
+		t.Errorf("expected the ALPH and VP8 chunks with alpha, got %q (alpha=%v)", chunks, alpha)
+	}
+
+	if _, _, err := webpImageChunks([]byte("\x89PNG\r\n\x1a\n....")); err == nil {
+		t.Error("expected an error for an image that isn't a webp")
+	}
+	if _, _, err := webpImageChunks(file[:len(file)-2]); err == nil {
+		t.Error("expected an error for a truncated chunk")
+	}
+}
+
+func TestWebpAnimation(t *testing.T) {
+	animation := newWebpAnimation(10, nil)
+	for range 3 {
+		animation.addFrame(image.Pt(16, 9), []byte("VP8 \x02\x00\x00\x00\x01\x02"), false)
+	}
+
+	var out bytes.Buffer
+	if err := animation.encode(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	file := out.Bytes()
+	if string(file[0:4]) != "RIFF" || string(file[8:12]) != "WEBP" || int(binary.LittleEndian.Uint32(file[4:])) != len(file)-8 {
+		t.Fatalf("expected a RIFF WEBP header covering the file, got %q", file[:12])
+	}
+
+	var fourCCs []string
+	for offset := 12; offset+8 <= len(file); {
+		fourCC := string(file[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(file[offset+4:]))
+		payload := file[offset+8 : offset+8+size]
+		switch fourCC {
+		case "VP8X":
+			width := int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16
+			height := int(payload[7]) | int(payload[8])<<8 | int(payload[9])<<16
+			if payload[0] != 0x02 || width != 15 || height != 8 {
+				t.Errorf("expected an animated 16x9 canvas without alpha, got flags %#x and %dx%d", payload[0], width+1, height+1)
+			}
+		case "ANMF":
+			if duration := int(payload[12]) | int(payload[13])<<8 | int(payload[14])<<16; duration != 100 {
+				t.Errorf("expected frames of 100ms at 10fps, got %dms", duration)
+			}
+			if string(payload[16:20]) != "VP8 " {
+				t.Errorf("expected the frame to hold the VP8 chunk, got %q", payload[16:])
+			}
+		}
+		fourCCs = append(fourCCs, fourCC)
+		offset += 8 + size + size%2
+	}
+	expected := []string{"VP8X", "ANIM", "ANMF", "ANMF", "ANMF"}
+	if len(fourCCs) != len(expected) {
+		t.Fatalf("expected chunks %v, got %v", expected, fourCCs)
+	}
+	for i := range expected {
+		if fourCCs[i] != expected[i] {
+			t.Errorf("expected chunks %v, got %v", expected, fourCCs)
+			break
+		}
+	}
+
+	if err := newWebpAnimation(10, nil).encode(&out); err == nil {
+		t.Error("expected an error for an animation without frames")
+	}
+}
+
+func TestVideoAnimation(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{EncoderThreads: 1, AnimationMaxDuration: 5, AnimationMaxFPS: 10}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	extractor := &stubFrameExtractor{
+		frame: &extractedFrame{Image: image.NewRGBA(image.Rect(0, 0, 64, 36))},
+		video: &probedVideo{Duration: 60, FPS: 30},
+	}
+	app := fiber.New()
+	app.Get("/videos/animated/*", handleVideoAnimationRequest(zap.NewNop(), cache, cfg, counters, nil, nil, newInputLimiter(0, nil), extractor, nil, nil, newOriginClient(t, cfg), nil))
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(serveOrigin(t, "video/mp4", []byte("not decoded by the stub"))))
+	request := func(pathParams string) *http.Response {
+		t.Helper()
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, "/videos/animated/"+pathParams+encoded, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return response
+	}
+
+	for range 2 {
+		response := request("fp:12/dur:1/fps:5/w:32/")
+		if response.StatusCode != fiber.StatusOK || response.Header.Get("Content-Type") != "image/gif" {
+			t.Fatalf("expected a gif, got %d %s", response.StatusCode, response.Header.Get("Content-Type"))
+		}
+		animation, err := gif.DecodeAll(response.Body)
+		if err != nil {
+			t.Fatalf("expected a gif: %v", err)
+		}
+		if len(animation.Image) != 5 || animation.Delay[0] != 20 || animation.Image[0].Bounds().Dx() != 32 {
+			t.Errorf("expected five 32 pixel wide frames of 20 hundredths, got %d frames of %d hundredths", len(animation.Image), animation.Delay[0])
+		}
+		if frames := response.Header.Get("X-Animation-Frames"); frames != "5" {
+			t.Errorf("expected X-Animation-Frames 5, got %q", frames)
+		}
+		cache.Wait()
+	}
+	if extractor.calls != 1 || extractor.position != "12" {
+		t.Errorf("expected one extraction from 12s and a cached second response, got %d from %q", extractor.calls, extractor.position)
+	}
+
+	if response := request("dur:6/"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for a clip over APP_ANIMATION_MAX_DURATION_SECONDS, got %d", response.StatusCode)
+	}
+	if response := request("fps:12/"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for a rate over APP_ANIMATION_MAX_FPS, got %d", response.StatusCode)
+	}
+
+	extractor.err = errPositionBeyondDuration
+	if response := request("fp:90/"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for a start beyond the duration, got %d", response.StatusCode)
+	}
+}
@@ -0,0 +1,282 @@
+package routes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ffmpegFrameExtractor runs the ffprobe and ffmpeg binaries instead of linking the FFmpeg libraries.
+// Frames are picked by seeking, so the reported position is the seek target rather than the timestamp of the frame.
+// ffmpeg turns rotated videos upright on its own
+type ffmpegFrameExtractor struct {
+	FFmpeg  string // Path of the ffmpeg binary
+	FFprobe string // Path of the ffprobe binary
+}
+
+// lastFrameWindow is how far before the end ffmpeg starts decoding to find the last frame, in seconds
+const lastFrameWindow = 3
+
+func (e ffmpegFrameExtractor) ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	info, err := e.probe(urlStr, options.ProbeTimeout, options.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.checkDuration(info.Duration); err != nil {
+		return nil, err
+	}
+
+	targetTime, err := calculateTargetTime(info.Duration, position)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate target time: %w", err)
+	}
+
+	targetTime, clamped, err := clampTargetTime(targetTime, info.Duration, options.RejectBeyondDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-nostdin", "-v", "error"}
+	if options.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(options.Threads))
+	}
+	framePosition := targetTime
+	if targetTime == -1 {
+		// The last frame is the last one decoded from the end of the video
+		args = append(args, "-sseof", strconv.Itoa(-lastFrameWindow))
+		framePosition = info.Duration
+	} else if targetTime > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(targetTime, 'f', 3, 64))
+	}
+	if len(options.Headers) > 0 {
+		args = append(args, "-headers", ffmpegHeaders(options.Headers))
+	}
+	args = append(args, "-i", urlStr, "-map", "0:v:0")
+	if targetTime != -1 {
+		args = append(args, "-frames:v", "1")
+	}
+	args = append(args, "-f", "image2pipe", "-c:v", "png", "pipe:1")
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(e.FFmpeg, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	img, err := decodeLastPNG(&stdout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &extractedFrame{
+		Image:    img,
+		Clamped:  clamped,
+		Position: framePosition,
+		Duration: info.Duration,
+		FPS:      info.FPS,
+		Frames:   info.Frames,
+	}, nil
+}
+
+func (e ffmpegFrameExtractor) ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	return e.probe(urlStr, options.ProbeTimeout, options.Headers)
+}
+
+// ExtractFrames seeks to the first frame and has the fps filter pick the others, it passes on one frame per interval.
+// The frames are decoded from the pipe as ffmpeg writes them, so they are never all held at once
+func (e ffmpegFrameExtractor) ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	info, err := e.probe(urlStr, options.ProbeTimeout, options.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if err := options.checkDuration(info.Duration); err != nil {
+		return nil, err
+	}
+	times, err := sequence.times(info.Duration, options.RejectBeyondDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-nostdin", "-v", "error"}
+	if options.Threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(options.Threads))
+	}
+	if times[0] > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(times[0], 'f', 3, 64))
+	}
+	if len(options.Headers) > 0 {
+		args = append(args, "-headers", ffmpegHeaders(options.Headers))
+	}
+	rate := strconv.FormatFloat(1/sequence.interval(info.Duration), 'f', -1, 64)
+	args = append(args, "-i", urlStr, "-map", "0:v:0", "-vf", "fps="+rate, "-frames:v", strconv.Itoa(len(times)), "-f", "image2pipe", "-c:v", "png", "pipe:1")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(e.FFmpeg, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	decoded, err := decodeEachPNG(stdout, each)
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if decoded == 0 {
+		return nil, fmt.Errorf("no video frames found")
+	}
+	return info, nil
+}
+
+// probe reads the duration and video stream details with ffprobe, failing with errProbeTimeout once timeout passes
+func (e ffmpegFrameExtractor) probe(urlStr string, timeout time.Duration, headers map[string]string) (*probedVideo, error) {
+	output, err := e.runProbe(urlStr, timeout, headers, "v:0", "format=duration:stream=avg_frame_rate,nb_frames,codec_name,width,height:stream_side_data=rotation")
+	if err != nil {
+		return nil, err
+	}
+	return parseProbeOutput(output)
+}
+
+// runProbe prints the entries of the selected streams and the format as JSON with ffprobe, failing with
+// errProbeTimeout once timeout passes
+func (e ffmpegFrameExtractor) runProbe(urlStr string, timeout time.Duration, headers map[string]string, streams, entries string) ([]byte, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	args := []string{"-v", "error", "-select_streams", streams, "-show_entries", entries, "-of", "json"}
+	if len(headers) > 0 {
+		args = append(args, "-headers", ffmpegHeaders(headers))
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.FFprobe, append(args, urlStr)...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w after %s", errProbeTimeout, timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// parseProbeOutput reads the JSON printed by ffprobe for the first video stream
+func parseProbeOutput(output []byte) (*probedVideo, error) {
+	var probed struct {
+		Streams []struct {
+			AvgFrameRate string `json:"avg_frame_rate"`
+			NbFrames     string `json:"nb_frames"`
+			CodecName    string `json:"codec_name"`
+			Width        int    `json:"width"`
+			Height       int    `json:"height"`
+			SideDataList []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probed); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %w", err)
+	}
+	if len(probed.Streams) == 0 {
+		return nil, fmt.Errorf("no video stream found")
+	}
+
+	// Fields the container doesn't report come as "N/A" or are left out, they stay zero
+	stream := probed.Streams[0]
+	video := &probedVideo{Codec: stream.CodecName}
+	video.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	video.Frames, _ = strconv.ParseInt(stream.NbFrames, 10, 64)
+	var rotation float64
+	for _, sideData := range stream.SideDataList {
+		rotation += sideData.Rotation
+	}
+	video.Width, video.Height = uprightSize(stream.Width, stream.Height, rotation)
+	if num, den, ok := strings.Cut(stream.AvgFrameRate, "/"); ok {
+		numerator, _ := strconv.ParseFloat(num, 64)
+		denominator, _ := strconv.ParseFloat(den, 64)
+		if denominator > 0 {
+			video.FPS = numerator / denominator
+		}
+	}
+	return video, nil
+}
+
+// decodeEachPNG decodes a stream of concatenated PNG images and calls each with every one of them in order, it returns
+// how many were decoded
+func decodeEachPNG(r io.Reader, each func(image.Image) error) (int, error) {
+	reader := bufio.NewReader(r)
+
+	decoded := 0
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return decoded, nil
+		}
+		img, err := png.Decode(reader)
+		if err != nil {
+			return decoded, fmt.Errorf("failed to decode frame: %w", err)
+		}
+		decoded++
+		if err := each(img); err != nil {
+			return decoded, err
+		}
+	}
+}
+
+// decodeLastPNG decodes a stream of concatenated PNG images and returns the last one
+func decodeLastPNG(r io.Reader) (image.Image, error) {
+	reader := bufio.NewReader(r)
+
+	var last image.Image
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+		img, err := png.Decode(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode frame: %w", err)
+		}
+		last = img
+	}
+
+	if last == nil {
+		return nil, fmt.Errorf("no video frames found")
+	}
+	return last, nil
+}
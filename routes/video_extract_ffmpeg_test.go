@@ -0,0 +1,193 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	video, err := parseProbeOutput([]byte(`{"streams":[{"avg_frame_rate":"30000/1001","nb_frames":"900"}],"format":{"duration":"30.030000"}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if video.Duration != 30.03 || video.Frames != 900 {
+		t.Errorf("expected 30.03s and 900 frames, got %vs and %d frames", video.Duration, video.Frames)
+	}
+	if video.FPS < 29.97 || video.FPS > 29.98 {
+		t.Errorf("expected about 29.97 fps, got %v", video.FPS)
+	}
+
+	// Streams without a frame count or rate leave them zero
+	video, err = parseProbeOutput([]byte(`{"streams":[{"avg_frame_rate":"0/0","nb_frames":"N/A"}],"format":{"duration":"N/A"}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if video.Duration != 0 || video.FPS != 0 || video.Frames != 0 {
+		t.Errorf("expected unreported details to be zero, got %+v", video)
+	}
+
+	if _, err := parseProbeOutput([]byte(`{"streams":[],"format":{"duration":"1.0"}}`)); err == nil {
+		t.Error("expected an error without a video stream")
+	}
+	if _, err := parseProbeOutput([]byte(`not json`)); err == nil {
+		t.Error("expected an error for invalid output")
+	}
+}
+
+// encodeTestPNG encodes a blank image of the given width
+func encodeTestPNG(t *testing.T, width int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, 1))); err != nil {
+		t.Fatalf("failed to encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeLastPNG(t *testing.T) {
+	stream := append(encodeTestPNG(t, 1), encodeTestPNG(t, 2)...)
+
+	img, err := decodeLastPNG(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if img.Bounds().Dx() != 2 {
+		t.Errorf("expected the last image, got one %d wide", img.Bounds().Dx())
+	}
+
+	if _, err := decodeLastPNG(bytes.NewReader(nil)); err == nil {
+		t.Error("expected an error without frames")
+	}
+	if _, err := decodeLastPNG(bytes.NewReader(stream[:len(stream)-10])); err == nil {
+		t.Error("expected an error for a truncated frame")
+	}
+}
+
+// fakeFFmpeg writes ffprobe and ffmpeg scripts to a temporary directory: ffprobe prints probeOutput and ffmpeg
+// records its arguments and prints a PNG frame. The recorded arguments are read with the returned function
+func fakeFFmpeg(t *testing.T, probeOutput string) (ffmpegFrameExtractor, func() string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binaries are shell scripts")
+	}
+
+	dir := t.TempDir()
+	frame := filepath.Join(dir, "frame.png")
+	if err := os.WriteFile(frame, encodeTestPNG(t, 4), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "probe.json"), []byte(probeOutput), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := filepath.Join(dir, "args")
+	scripts := map[string]string{
+		"ffprobe": "#!/bin/sh\ncat '" + filepath.Join(dir, "probe.json") + "'\n",
+		"ffmpeg":  "#!/bin/sh\necho \"$@\" > '" + args + "'\ncat '" + frame + "'\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return ffmpegFrameExtractor{FFmpeg: filepath.Join(dir, "ffmpeg"), FFprobe: filepath.Join(dir, "ffprobe")}, func() string {
+		data, _ := os.ReadFile(args)
+		return strings.TrimSpace(string(data))
+	}
+}
+
+func TestFFmpegFrameExtractor(t *testing.T) {
+	extractor, lastArgs := fakeFFmpeg(t, `{"streams":[{"avg_frame_rate":"25/1","nb_frames":"750"}],"format":{"duration":"30.0"}}`)
+
+	frame, err := extractor.ExtractFrame("http://origin/video.mp4", "12.5", frameExtractionOptions{Threads: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.Image.Bounds().Dx() != 4 || frame.Position != 12.5 || frame.Duration != 30 || frame.FPS != 25 || frame.Frames != 750 {
+		t.Errorf("unexpected frame %+v", frame)
+	}
+	if args := lastArgs(); !strings.Contains(args, "-threads 2 -ss 12.500 -i http://origin/video.mp4") || !strings.Contains(args, "-frames:v 1") {
+		t.Errorf("unexpected ffmpeg arguments %q", args)
+	}
+
+	frame, err = extractor.ExtractFrame("http://origin/video.mp4", "last", frameExtractionOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.Position != 30 {
+		t.Errorf("expected the last frame at the duration, got %v", frame.Position)
+	}
+	if args := lastArgs(); !strings.Contains(args, "-sseof -3") || strings.Contains(args, "-frames:v") {
+		t.Errorf("expected the last frame to be decoded from the end, got %q", args)
+	}
+
+	frame, err = extractor.ExtractFrame("http://origin/video.mp4", "45", frameExtractionOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !frame.Clamped {
+		t.Error("expected a position beyond the duration to be clamped")
+	}
+
+	_, err = extractor.ExtractFrame("http://origin/video.mp4", "45", frameExtractionOptions{RejectBeyondDuration: true})
+	if !errors.Is(err, errPositionBeyondDuration) {
+		t.Errorf("expected errPositionBeyondDuration, got %v", err)
+	}
+
+	_, err = extractor.ExtractFrame("http://origin/video.mp4", "first", frameExtractionOptions{MaxDuration: 20})
+	if !errors.Is(err, errVideoTooLong) {
+		t.Errorf("expected errVideoTooLong for a 30s video over a 20s limit, got %v", err)
+	}
+}
+
+func TestFFmpegFrameExtractor_ProbeVideo(t *testing.T) {
+	extractor, _ := fakeFFmpeg(t, `{"streams":[{"avg_frame_rate":"30/1","nb_frames":"300","codec_name":"hevc","width":1920,"height":1080,"side_data_list":[{"rotation":-90}]}],"format":{"duration":"10.0"}}`)
+
+	video, err := extractor.ProbeVideo("http://origin/video.mov", frameExtractionOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := probedVideo{Duration: 10, FPS: 30, Frames: 300, Width: 1080, Height: 1920, Codec: "hevc"}
+	if *video != expected {
+		t.Errorf("expected the rotated stream details %+v, got %+v", expected, *video)
+	}
+}
+
+func TestFFmpegFrameExtractor_ExtractFrames(t *testing.T) {
+	extractor, lastArgs := fakeFFmpeg(t, `{"streams":[{"avg_frame_rate":"25/1","nb_frames":"750"}],"format":{"duration":"30.0"}}`)
+
+	var frames []image.Image
+	video, err := extractor.ExtractFrames("http://origin/video.mp4", frameSequence{Count: 10}, frameExtractionOptions{}, func(img image.Image) error {
+		frames = append(frames, img)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The fake ffmpeg prints a single frame, as a video shorter than the sheet would
+	if len(frames) != 1 || video.Duration != 30 {
+		t.Errorf("expected one frame of a 30s video, got %d frames and %+v", len(frames), video)
+	}
+	if args := lastArgs(); !strings.Contains(args, "-vf fps=0.3333333333333333") || !strings.Contains(args, "-frames:v 10") {
+		t.Errorf("expected one frame every 3s, got %q", args)
+	}
+
+	stop := errors.New("stop")
+	if _, err := extractor.ExtractFrames("http://origin/video.mp4", frameSequence{Count: 10}, frameExtractionOptions{}, func(image.Image) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("expected the error of the callback, got %v", err)
+	}
+
+	unknown, _ := fakeFFmpeg(t, `{"streams":[{"avg_frame_rate":"25/1"}],"format":{"duration":"N/A"}}`)
+	if _, err := unknown.ExtractFrames("http://origin/live.m3u8", frameSequence{Count: 10}, frameExtractionOptions{}, func(image.Image) error { return nil }); !errors.Is(err, errUnknownDuration) {
+		t.Errorf("expected errUnknownDuration, got %v", err)
+	}
+}
@@ -1,3 +1,5 @@
+//go:build !nolibav
+
 package routes
 
 import (
@@ -8,7 +10,7 @@ import (
 	"github.com/asticode/go-astiav"
 )
 
-func extractFirstFrame(urlStr string) (image.Image, error) {
+func extractFirstFrame(urlStr string, threads int) (image.Image, error) {
 	// Open input format context
 	inputFormatContext := astiav.AllocFormatContext()
 	if inputFormatContext == nil {
@@ -60,6 +62,11 @@ func extractFirstFrame(urlStr string) (image.Image, error) {
 		return nil, fmt.Errorf("failed to copy codec parameters: %w", err)
 	}
 
+	// Cap decoder threads (0 keeps ffmpeg's automatic choice)
+	if threads > 0 {
+		codecContext.SetThreadCount(threads)
+	}
+
 	// Open codec
 	if err := codecContext.Open(codec, nil); err != nil {
 		return nil, fmt.Errorf("failed to open codec: %w", err)
@@ -1,79 +1,288 @@
+//go:build !nolibav
+
 package routes
 
 import (
 	"fmt"
 	"image"
 	"log"
-	"strconv"
-	"strings"
 
 	"github.com/asticode/go-astiav"
 )
 
-// extractFrameFromPosition extracts a frame from a specific position in the video
-// position can be: "first", "half", "last", or a time in seconds (e.g., "30.5")
-func extractFrameFromPosition(urlStr string, position string) (image.Image, error) {
-	// Open input format context
-	inputFormatContext := astiav.AllocFormatContext()
-	if inputFormatContext == nil {
-		return nil, fmt.Errorf("failed to allocate format context")
-	}
-	defer inputFormatContext.Free()
+// libavAvailable reports that the FFmpeg libraries are linked in, builds with the nolibav tag leave them out
+const libavAvailable = true
+
+// libavFrameExtractor decodes frames in process with the FFmpeg libraries
+type libavFrameExtractor struct{}
+
+func (libavFrameExtractor) ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	return extractFrameFromPosition(urlStr, position, options)
+}
+
+func (libavFrameExtractor) ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error) {
+	release := options.Inputs.acquire()
+	defer release()
 
-	// Open input
-	if err := inputFormatContext.OpenInput(urlStr, nil, nil); err != nil {
-		return nil, fmt.Errorf("failed to open input: %w", err)
+	inputFormatContext, closeInput, err := openMediaInput(urlStr, options)
+	if err != nil {
+		return nil, err
 	}
-	defer inputFormatContext.CloseInput()
+	defer closeInput()
 
-	// Find stream info
-	if err := inputFormatContext.FindStreamInfo(nil); err != nil {
-		return nil, fmt.Errorf("failed to find stream info: %w", err)
+	videoStream := findStream(inputFormatContext, astiav.MediaTypeVideo)
+	if videoStream == nil {
+		return nil, fmt.Errorf("no video stream found")
 	}
 
-	// Find video stream
-	videoStreamIndex := -1
-	var videoStream *astiav.Stream
-	for _, stream := range inputFormatContext.Streams() {
-		if stream.CodecParameters().MediaType() == astiav.MediaTypeVideo {
-			videoStreamIndex = stream.Index()
-			videoStream = stream
-			break
-		}
+	return describeVideo(inputFormatContext, videoStream), nil
+}
+
+func (libavFrameExtractor) ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	inputFormatContext, closeInput, err := openMediaInput(urlStr, options)
+	if err != nil {
+		return nil, err
 	}
+	defer closeInput()
 
-	if videoStreamIndex == -1 {
+	videoStream := findStream(inputFormatContext, astiav.MediaTypeVideo)
+	if videoStream == nil {
 		return nil, fmt.Errorf("no video stream found")
 	}
 
-	// Calculate target time based on position
-	targetTime, err := calculateTargetTime(inputFormatContext, videoStream, position)
+	video := describeVideo(inputFormatContext, videoStream)
+	if err := options.checkDuration(video.Duration); err != nil {
+		return nil, err
+	}
+	times, err := sequence.times(video.Duration, options.RejectBeyondDuration)
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate target time: %w", err)
+		return nil, err
+	}
+
+	codecContext, err := openDecoder(videoStream, options.Threads)
+	if err != nil {
+		return nil, err
+	}
+	defer codecContext.Free()
+
+	packet := astiav.AllocPacket()
+	defer packet.Free()
+
+	frame := astiav.AllocFrame()
+	defer frame.Free()
+
+	rotation := streamRotation(videoStream)
+	timeBase := videoStream.TimeBase()
+	next := 0
+	for next < len(times) {
+		if err := inputFormatContext.ReadFrame(packet); err != nil {
+			if err == astiav.ErrEof {
+				break
+			}
+			return nil, fmt.Errorf("failed to read frame: %w", err)
+		}
+
+		if packet.StreamIndex() != videoStream.Index() {
+			packet.Unref()
+			continue
+		}
+
+		if err := codecContext.SendPacket(packet); err != nil {
+			packet.Unref()
+			return nil, fmt.Errorf("failed to send packet: %w", err)
+		}
+		packet.Unref()
+
+		if err := codecContext.ReceiveFrame(frame); err != nil {
+			if err == astiav.ErrEagain || err == astiav.ErrEof {
+				continue
+			}
+			return nil, fmt.Errorf("failed to receive frame: %w", err)
+		}
+
+		// Frames before the next time are decoded but never converted
+		currentTime := float64(frame.Pts()) * float64(timeBase.Num()) / float64(timeBase.Den())
+		if currentTime < times[next] {
+			continue
+		}
+		if data, _ := frame.Data().Bytes(1); len(data) == 0 {
+			continue
+		}
+
+		img, err := frameToImage(frame)
+		if err != nil {
+			log.Printf("Failed to convert frame to image: %v, continuing...", err)
+			continue
+		}
+		img = uprightFrame(img, rotation)
+
+		// A frame stands in for every time it reached, videos with fewer frames than the sheet repeat them
+		for next < len(times) && currentTime >= times[next] {
+			if err := each(img); err != nil {
+				return nil, err
+			}
+			next++
+		}
+	}
+
+	if next == 0 {
+		return nil, fmt.Errorf("no video frames found")
 	}
+	return video, nil
+}
+
+// describeVideo reads the details of the video stream from the opened input
+func describeVideo(inputFormatContext *astiav.FormatContext, videoStream *astiav.Stream) *probedVideo {
+	codecParameters := videoStream.CodecParameters()
+	video := &probedVideo{
+		Duration: float64(inputFormatContext.Duration()) / 1000000.0, // Duration is in microseconds
+		FPS:      videoStream.AvgFrameRate().Float64(),
+		Frames:   videoStream.NbFrames(),
+		Codec:    codecParameters.CodecID().Name(),
+	}
+	video.Width, video.Height = uprightSize(codecParameters.Width(), codecParameters.Height(), streamRotation(videoStream))
+	return video
+}
 
-	// Find decoder
-	codec := astiav.FindDecoder(videoStream.CodecParameters().CodecID())
+// openDecoder opens a decoder for the stream with up to threads decoder threads, 0 keeps ffmpeg's automatic choice.
+// The caller frees the returned codec context
+func openDecoder(stream *astiav.Stream, threads int) (*astiav.CodecContext, error) {
+	codec := astiav.FindDecoder(stream.CodecParameters().CodecID())
 	if codec == nil {
 		return nil, fmt.Errorf("failed to find decoder")
 	}
 
-	// Allocate codec context
 	codecContext := astiav.AllocCodecContext(codec)
 	if codecContext == nil {
 		return nil, fmt.Errorf("failed to allocate codec context")
 	}
-	defer codecContext.Free()
 
-	// Copy codec parameters
-	if err := codecContext.FromCodecParameters(videoStream.CodecParameters()); err != nil {
+	if err := codecContext.FromCodecParameters(stream.CodecParameters()); err != nil {
+		codecContext.Free()
 		return nil, fmt.Errorf("failed to copy codec parameters: %w", err)
 	}
-
-	// Open codec
+	if threads > 0 {
+		codecContext.SetThreadCount(threads)
+	}
 	if err := codecContext.Open(codec, nil); err != nil {
+		codecContext.Free()
 		return nil, fmt.Errorf("failed to open codec: %w", err)
 	}
+	return codecContext, nil
+}
+
+// openMediaInput opens the video or audio source and reads its stream info, bounded by the probe timeout. The returned
+// function closes and frees the input again
+func openMediaInput(urlStr string, options frameExtractionOptions) (*astiav.FormatContext, func(), error) {
+	inputFormatContext := astiav.AllocFormatContext()
+	if inputFormatContext == nil {
+		return nil, nil, fmt.Errorf("failed to allocate format context")
+	}
+
+	// Interrupts blocking I/O of a probe that takes too long, slow network sources would otherwise hold the input slot
+	interrupter := astiav.NewIOInterrupter()
+	inputFormatContext.SetIOInterrupter(interrupter)
+
+	opened := false
+	closeInput := func() {
+		if opened {
+			inputFormatContext.CloseInput()
+		}
+		interrupter.Free()
+		inputFormatContext.Free()
+	}
+
+	// Origins may need headers, the HTTP protocol takes them as an input option
+	var inputOptions *astiav.Dictionary
+	if len(options.Headers) > 0 {
+		inputOptions = astiav.NewDictionary()
+		defer inputOptions.Free()
+		if err := inputOptions.Set("headers", ffmpegHeaders(options.Headers), 0); err != nil {
+			closeInput()
+			return nil, nil, fmt.Errorf("failed to set the request headers: %w", err)
+		}
+	}
+
+	err := probeWithTimeout(options.ProbeTimeout, interrupter.Interrupt, interrupter.Resume, func() error {
+		if err := inputFormatContext.OpenInput(urlStr, nil, inputOptions); err != nil {
+			return fmt.Errorf("failed to open input: %w", err)
+		}
+		opened = true
+
+		if err := inputFormatContext.FindStreamInfo(nil); err != nil {
+			return fmt.Errorf("failed to find stream info: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		closeInput()
+		return nil, nil, err
+	}
+	return inputFormatContext, closeInput, nil
+}
+
+// findStream returns the first stream of the media type in the input, nil when there is none
+func findStream(inputFormatContext *astiav.FormatContext, mediaType astiav.MediaType) *astiav.Stream {
+	for _, stream := range inputFormatContext.Streams() {
+		if stream.CodecParameters().MediaType() == mediaType {
+			return stream
+		}
+	}
+	return nil
+}
+
+// streamRotation is the clockwise display rotation of the stream in degrees, 0 without a display matrix
+func streamRotation(stream *astiav.Stream) float64 {
+	if matrix, ok := stream.CodecParameters().SideData().DisplayMatrix().Get(); ok {
+		return matrix.Rotation()
+	}
+	return 0
+}
+
+// extractFrameFromPosition extracts a frame from a specific position in the video
+// position can be: "first", "half", "last", or a time in seconds (e.g., "30.5")
+func extractFrameFromPosition(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	release := options.Inputs.acquire()
+	defer release()
+
+	inputFormatContext, closeInput, err := openMediaInput(urlStr, options)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+
+	videoStream := findStream(inputFormatContext, astiav.MediaTypeVideo)
+	if videoStream == nil {
+		return nil, fmt.Errorf("no video stream found")
+	}
+	videoStreamIndex := videoStream.Index()
+
+	// Sideways recordings carry a display matrix, the picked frame is turned upright with it
+	rotation := streamRotation(videoStream)
+
+	// Calculate target time based on position
+	duration := float64(inputFormatContext.Duration()) / 1000000.0 // Duration is in microseconds
+	if err := options.checkDuration(duration); err != nil {
+		return nil, err
+	}
+	targetTime, err := calculateTargetTime(duration, position)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate target time: %w", err)
+	}
+
+	targetTime, clamped, err := clampTargetTime(targetTime, duration, options.RejectBeyondDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	codecContext, err := openDecoder(videoStream, options.Threads)
+	if err != nil {
+		return nil, err
+	}
+	defer codecContext.Free()
 
 	// Note: Seeking is not implemented in this version of astiav
 	// We'll read through the video to find the target frame
@@ -88,6 +297,20 @@ func extractFrameFromPosition(urlStr string, position string) (image.Image, erro
 	var lastValidFrame image.Image
 	var closestFrame image.Image
 	var closestTimeDiff float64 = -1
+	var lastValidTime, closestTime float64
+
+	// picked fills in the video details for the returned frame. Only this frame is rotated, so whichever frame the
+	// position or a fallback ends up on comes out upright
+	picked := func(img image.Image, position float64, clamped bool) *extractedFrame {
+		return &extractedFrame{
+			Image:    uprightFrame(img, rotation),
+			Clamped:  clamped,
+			Position: position,
+			Duration: duration,
+			FPS:      videoStream.AvgFrameRate().Float64(),
+			Frames:   videoStream.NbFrames(),
+		}
+	}
 
 	// Read frames until we find the target frame or reach the end
 	for {
@@ -131,22 +354,24 @@ func extractFrameFromPosition(urlStr string, position string) (image.Image, erro
 			continue
 		}
 
+		// Calculate current frame time
+		currentTime := float64(frame.Pts()) * float64(videoStream.TimeBase().Num()) / float64(videoStream.TimeBase().Den())
+
 		// Store the first valid frame we encounter
 		if lastValidFrame == nil {
 			lastValidFrame = img
+			lastValidTime = currentTime
 		}
 
-		// Calculate current frame time
-		currentTime := float64(frame.Pts()) * float64(videoStream.TimeBase().Num()) / float64(videoStream.TimeBase().Den())
-
 		// For "first" position, return immediately
 		if position == "first" {
-			return img, nil
+			return picked(img, currentTime, false), nil
 		}
 
 		// For "last" position, keep updating until we reach the end
 		if position == "last" {
 			lastValidFrame = img
+			lastValidTime = currentTime
 			continue
 		}
 
@@ -156,10 +381,12 @@ func extractFrameFromPosition(urlStr string, position string) (image.Image, erro
 			if closestFrame == nil || timeDiff < closestTimeDiff {
 				closestFrame = img
 				closestTimeDiff = timeDiff
+				closestTime = currentTime
 			}
 		} else if targetTime == -1 {
 			// For "last" position, keep updating the last valid frame
 			lastValidFrame = img
+			lastValidTime = currentTime
 		}
 	}
 
@@ -167,59 +394,28 @@ func extractFrameFromPosition(urlStr string, position string) (image.Image, erro
 	switch position {
 	case "first":
 		if lastValidFrame != nil {
-			return lastValidFrame, nil
+			return picked(lastValidFrame, lastValidTime, false), nil
 		}
 	case "last":
 		if lastValidFrame != nil {
-			return lastValidFrame, nil
+			return picked(lastValidFrame, lastValidTime, false), nil
 		}
 	case "half":
 		if closestFrame != nil {
-			return closestFrame, nil
+			return picked(closestFrame, closestTime, false), nil
 		}
 		if lastValidFrame != nil {
-			return lastValidFrame, nil
+			return picked(lastValidFrame, lastValidTime, false), nil
 		}
 	default:
 		// For specific time
 		if closestFrame != nil {
-			return closestFrame, nil
+			return picked(closestFrame, closestTime, false), nil
 		}
 		if lastValidFrame != nil {
-			return lastValidFrame, nil
+			return picked(lastValidFrame, lastValidTime, clamped), nil
 		}
 	}
 
 	return nil, fmt.Errorf("no video frames found")
 }
-
-// calculateTargetTime calculates the target time in seconds based on the position parameter
-func calculateTargetTime(inputFormatContext *astiav.FormatContext, videoStream *astiav.Stream, position string) (float64, error) {
-	switch position {
-	case "first":
-		return 0, nil
-	case "last":
-		// For "last", we'll find the last frame by reading through the entire video
-		return -1, nil // Special value to indicate we want the last frame
-	case "half":
-		// Calculate half of the video duration
-		duration := float64(inputFormatContext.Duration()) / 1000000.0 // Duration is in microseconds
-		return duration / 2, nil
-	default:
-		// Try to parse as a time in seconds
-		if timeStr := strings.TrimSpace(position); timeStr != "" {
-			if time, err := strconv.ParseFloat(timeStr, 64); err == nil && time >= 0 {
-				return time, nil
-			}
-		}
-		return 0, fmt.Errorf("invalid position: %s", position)
-	}
-}
-
-// abs returns the absolute value of a float64
-func abs(x float64) float64 {
-	if x < 0 {
-		return -x
-	}
-	return x
-}
@@ -0,0 +1,149 @@
+//go:build !nolibav
+
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestExtractFrame_InputLimit needs a real video, it is read from MEDIA_PROXY_TEST_VIDEO and the test is skipped without it
+func TestExtractFrame_InputLimit(t *testing.T) {
+	source := os.Getenv("MEDIA_PROXY_TEST_VIDEO")
+	if source == "" {
+		t.Skip("MEDIA_PROXY_TEST_VIDEO is not set")
+	}
+
+	inputs := newInputLimiter(1, nil)
+	release := inputs.acquire()
+
+	extracted := make(chan error, 1)
+	go func() {
+		_, err := extractFrameFromPosition(source, "first", frameExtractionOptions{Threads: 1, Inputs: inputs})
+		extracted <- err
+	}()
+
+	// The only slot is held, so the extraction can't open the video
+	select {
+	case err := <-extracted:
+		t.Fatalf("expected the extraction to wait for a free slot, it finished with %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case err := <-extracted:
+		if err != nil {
+			t.Fatalf("failed to extract frame: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("expected the extraction to finish once the slot was released")
+	}
+}
+
+func TestExtractFrame_ProbeTimeout(t *testing.T) {
+	// Accepts the request and sends part of a header, then stalls like an overloaded origin
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", "1000000")
+		_, _ = w.Write([]byte{0, 0, 0, 0x20, 'f', 't', 'y', 'p'})
+		w.(http.Flusher).Flush()
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	start := time.Now()
+	_, err := extractFrameFromPosition(server.URL+"/video.mp4", "first", frameExtractionOptions{Threads: 1, ProbeTimeout: 200 * time.Millisecond})
+	if !errors.Is(err, errProbeTimeout) {
+		t.Fatalf("expected errProbeTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the probe to fail fast, took %s", elapsed)
+	}
+}
+
+// TestExtractFrame_RotatedVideo needs a landscape-coded video with a 90 degree display rotation, like a phone recording
+// in portrait. It is read from MEDIA_PROXY_TEST_ROTATED_VIDEO and the test is skipped without it. The ffmpeg backend
+// is checked too when the binaries are on the PATH
+func TestExtractFrame_RotatedVideo(t *testing.T) {
+	source := os.Getenv("MEDIA_PROXY_TEST_ROTATED_VIDEO")
+	if source == "" {
+		t.Skip("MEDIA_PROXY_TEST_ROTATED_VIDEO is not set")
+	}
+
+	backends := map[string]frameExtractor{"libav": libavFrameExtractor{}}
+	if ffmpeg, err := exec.LookPath("ffmpeg"); err == nil {
+		if ffprobe, err := exec.LookPath("ffprobe"); err == nil {
+			backends["ffmpeg"] = ffmpegFrameExtractor{FFmpeg: ffmpeg, FFprobe: ffprobe}
+		}
+	}
+
+	for name, extractor := range backends {
+		for _, position := range []string{"first", "half", "last", "1"} {
+			frame, err := extractor.ExtractFrame(source, position, frameExtractionOptions{Threads: 1})
+			if err != nil {
+				t.Fatalf("%s %s: failed to extract frame: %v", name, position, err)
+			}
+
+			bounds := frame.Image.Bounds()
+			if bounds.Dy() <= bounds.Dx() {
+				t.Errorf("%s %s: expected an upright portrait frame, got %v", name, position, bounds)
+			}
+
+			// The frame is at most a frame away from the target, the last one a frame before the end
+			var target float64
+			switch position {
+			case "first":
+				target = 0
+			case "half":
+				target = frame.Duration / 2
+			case "last":
+				target = frame.Duration - 1/frame.FPS
+			default:
+				target = 1
+			}
+			if math.Abs(frame.Position-target) > 1/frame.FPS+0.001 {
+				t.Errorf("%s %s: expected the frame position %v to be within a frame of %v", name, position, frame.Position, target)
+			}
+		}
+	}
+}
+
+// BenchmarkExtractFrameThreads compares parallel frame extraction throughput for different APP_ENCODER_THREADS values.
+// The source is read from MEDIA_PROXY_BENCH_VIDEO (a local path or URL ffmpeg can open), the benchmark is skipped without it.
+func BenchmarkExtractFrameThreads(b *testing.B) {
+	source := os.Getenv("MEDIA_PROXY_BENCH_VIDEO")
+	if source == "" {
+		b.Skip("MEDIA_PROXY_BENCH_VIDEO is not set")
+	}
+
+	threadCounts := []int{1, 2}
+	if procs := runtime.GOMAXPROCS(0); procs > 2 {
+		threadCounts = append(threadCounts, procs)
+	}
+
+	for _, threads := range threadCounts {
+		b.Run(fmt.Sprintf("threads=%d", threads), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := extractFrameFromPosition(source, "half", frameExtractionOptions{Threads: threads}); err != nil {
+						b.Errorf("failed to extract frame: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"media-proxy/config"
+)
+
+// frameExtractor picks a frame from a video for previews.
+// position can be: "first", "half", "last", or a time in seconds (e.g., "30.5")
+type frameExtractor interface {
+	ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error)
+	// ProbeVideo reads the details of a video from its container and stream headers, without decoding frames
+	ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error)
+	// ExtractFrames decodes the video once and calls each with the frames at the times of the sequence, upright and in
+	// order. each is called less often when the video runs out of frames early, an error from it stops the extraction
+	ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error)
+}
+
+// newFrameExtractor returns the backend selected by APP_VIDEO_FRAME_BACKEND: "libav" decodes in process with the
+// FFmpeg libraries, "ffmpeg" runs the ffmpeg and ffprobe binaries. Empty picks libav unless the build left it out
+func newFrameExtractor(config *config.Config) (frameExtractor, error) {
+	backend, err := decodeBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	if backend == "libav" {
+		return libavFrameExtractor{}, nil
+	}
+	return ffmpegFrameExtractor{FFmpeg: config.FFmpegPath, FFprobe: config.FFprobePath}, nil
+}
+
+// decodeBackend resolves APP_VIDEO_FRAME_BACKEND to "libav" or "ffmpeg", the audio routes decode with the same backend
+func decodeBackend(config *config.Config) (string, error) {
+	backend := config.VideoFrameBackend
+	if backend == "" {
+		backend = "libav"
+		if !libavAvailable {
+			backend = "ffmpeg"
+		}
+	}
+
+	switch backend {
+	case "libav":
+		if !libavAvailable {
+			return "", errors.New("the libav frame backend is not available in builds with the nolibav tag")
+		}
+		return backend, nil
+	case "ffmpeg":
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown video frame backend %q", backend)
+	}
+}
+
+// errPositionBeyondDuration is returned when a numeric position exceeds the video duration and clamping is disabled
+var errPositionBeyondDuration = errors.New("position beyond duration")
+
+// errVideoTooLong is returned for videos longer than APP_MAX_VIDEO_DURATION_SECONDS
+var errVideoTooLong = errors.New("video is too long")
+
+// errUnknownDuration is returned for frames spaced over a video whose container doesn't report its duration
+var errUnknownDuration = errors.New("video duration is unknown")
+
+// frameExtractionOptions tunes how a frame is extracted from the video
+type frameExtractionOptions struct {
+	// Threads caps the number of decoder threads, 0 leaves the ffmpeg default
+	Threads int
+	// RejectBeyondDuration fails with errPositionBeyondDuration instead of clamping to the last frame
+	RejectBeyondDuration bool
+	// Inputs caps the concurrently open inputs, extraction waits for a free slot before opening the video; nil leaves it uncapped
+	Inputs *inputLimiter
+	// ProbeTimeout bounds opening the video and reading its stream info, failing with errProbeTimeout; 0 leaves it unbounded
+	ProbeTimeout time.Duration
+	// Headers are sent with the HTTP requests for the video, APP_ORIGIN_HEADERS for origins and none for S3
+	Headers map[string]string
+	// MaxDuration fails videos reporting a longer duration in seconds with errVideoTooLong before decoding, 0 allows any
+	MaxDuration float64
+}
+
+// checkDuration fails with errVideoTooLong when the reported duration exceeds options.MaxDuration
+func (o frameExtractionOptions) checkDuration(duration float64) error {
+	if o.MaxDuration > 0 && duration > o.MaxDuration {
+		return fmt.Errorf("%w: %.3fs", errVideoTooLong, duration)
+	}
+	return nil
+}
+
+// ffmpegHeaders formats headers for the headers option of the ffmpeg HTTP protocol, one CRLF terminated line each
+func ffmpegHeaders(headers map[string]string) string {
+	var lines strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		lines.WriteString(name + ": " + headers[name] + "\r\n")
+	}
+	return lines.String()
+}
+
+// probedVideo holds what a probe reports about the video, zero when the container doesn't report it
+type probedVideo struct {
+	Duration float64
+	FPS      float64
+	Frames   int64
+	// Width and Height are the size of the frames once turned upright, Codec is the name of the video codec
+	Width  int
+	Height int
+	Codec  string
+}
+
+// extractedFrame is the frame picked from the video along with details about how it was picked
+type extractedFrame struct {
+	Image image.Image
+	// Clamped is set when the requested position was beyond the duration and the last frame was used instead
+	Clamped bool
+
+	// Position is the timestamp of the picked frame in seconds
+	Position float64
+	// Duration, FPS and Frames describe the video, zero when the container doesn't report them
+	Duration float64
+	FPS      float64
+	Frames   int64
+}
+
+// headers describes the picked frame and the video as X-Video-* and X-Frame-Position-Seconds response headers.
+// X-Video-Width and X-Video-Height are the size of the frame before it is resized
+func (f *extractedFrame) headers() map[string]string {
+	headers := (&probedVideo{Duration: f.Duration, FPS: f.FPS, Frames: f.Frames}).headers()
+	headers["X-Frame-Position-Seconds"] = strconv.FormatFloat(f.Position, 'f', 3, 64)
+	if f.Image != nil {
+		size := f.Image.Bounds().Size()
+		headers["X-Video-Width"] = strconv.Itoa(size.X)
+		headers["X-Video-Height"] = strconv.Itoa(size.Y)
+	}
+	return headers
+}
+
+// headers describes the video as X-Video-Duration, X-Video-FPS and X-Video-Frames response headers, leaving out the
+// ones the container doesn't report
+func (v *probedVideo) headers() map[string]string {
+	headers := map[string]string{}
+	if v.Duration > 0 {
+		headers["X-Video-Duration"] = strconv.FormatFloat(v.Duration, 'f', 3, 64)
+	}
+	if v.FPS > 0 {
+		headers["X-Video-FPS"] = strconv.FormatFloat(v.FPS, 'f', 3, 64)
+	}
+	if v.Frames > 0 {
+		headers["X-Video-Frames"] = strconv.FormatInt(v.Frames, 10)
+	}
+	return headers
+}
+
+// calculateTargetTime calculates the target time in seconds based on the position parameter
+func calculateTargetTime(duration float64, position string) (float64, error) {
+	switch position {
+	case "first":
+		return 0, nil
+	case "last":
+		// For "last", we'll find the last frame by reading through the entire video
+		return -1, nil // Special value to indicate we want the last frame
+	case "half":
+		// Calculate half of the video duration
+		return duration / 2, nil
+	default:
+		// Try to parse as a time in seconds
+		if timeStr := strings.TrimSpace(position); timeStr != "" {
+			if time, err := strconv.ParseFloat(timeStr, 64); err == nil && time >= 0 {
+				return time, nil
+			}
+		}
+		return 0, fmt.Errorf("invalid position: %s", position)
+	}
+}
+
+// clampTargetTime handles target times past the end of the video.
+// It either switches to the last frame (reporting clamped) or fails with errPositionBeyondDuration when reject is set.
+// Unknown durations (<= 0) are never clamped.
+func clampTargetTime(targetTime float64, duration float64, reject bool) (float64, bool, error) {
+	if duration <= 0 || targetTime <= duration {
+		return targetTime, false, nil
+	}
+
+	if reject {
+		return 0, false, errPositionBeyondDuration
+	}
+
+	return -1, true, nil
+}
+
+// frameSequence picks Count frames, Interval seconds apart from the Position on. Without an Interval the frames are
+// spread evenly over the whole video instead, the Position is ignored then
+type frameSequence struct {
+	Position string // "first", "half", "last" or a time in seconds, as for single frames
+	Interval float64
+	Count    int
+}
+
+// interval is the time between two frames of the sequence in a video of the given duration
+func (s frameSequence) interval(duration float64) float64 {
+	if s.Interval > 0 {
+		return s.Interval
+	}
+	return duration / float64(s.Count)
+}
+
+// times resolves the sequence in a video of the given duration. "last" and, unless reject is set, starts beyond the
+// duration place the sequence so it ends with the video; with reject they fail with errPositionBeyondDuration.
+// Sequences that depend on the duration fail with errUnknownDuration when the container doesn't report it
+func (s frameSequence) times(duration float64, reject bool) ([]float64, error) {
+	start := 0.0
+	if s.Interval > 0 {
+		if duration <= 0 && (s.Position == "half" || s.Position == "last") {
+			return nil, errUnknownDuration
+		}
+
+		var err error
+		if start, err = calculateTargetTime(duration, s.Position); err != nil {
+			return nil, fmt.Errorf("failed to calculate target time: %w", err)
+		}
+		if start, _, err = clampTargetTime(start, duration, reject); err != nil {
+			return nil, err
+		}
+		if start == -1 {
+			start = max(duration-s.Interval*float64(s.Count), 0)
+		}
+	} else if duration <= 0 {
+		return nil, errUnknownDuration
+	}
+
+	interval := s.interval(duration)
+	times := make([]float64, s.Count)
+	for i := range times {
+		times[i] = start + float64(i)*interval
+	}
+	return times, nil
+}
+
+// uprightFrame rotates a decoded frame by the clockwise display rotation of its video, rounded to quarter turns,
+// so portrait recordings stored sideways come out the way players show them
+func uprightFrame(img image.Image, clockwiseDegrees float64) image.Image {
+	turns := int(math.Round(clockwiseDegrees/90)) % 4
+	return rotateQuarterTurns(img, (4-turns)%4)
+}
+
+// uprightSize is the size of a frame of the given coded size once uprightFrame turned it
+func uprightSize(width, height int, clockwiseDegrees float64) (int, int) {
+	if int(math.Round(clockwiseDegrees/90))%2 != 0 {
+		return height, width
+	}
+	return width, height
+}
+
+// abs returns the absolute value of a float64
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
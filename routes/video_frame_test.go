@@ -0,0 +1,180 @@
+package routes
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+
+	"media-proxy/config"
+)
+
+func TestClampTargetTime_ClampMode(t *testing.T) {
+	target, err := calculateTargetTime(30, "9999")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	target, clamped, err := clampTargetTime(target, 30, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !clamped {
+		t.Error("expected position to be clamped")
+	}
+	if target != -1 {
+		t.Errorf("expected last frame target (-1), got %v", target)
+	}
+}
+
+func TestClampTargetTime_RejectMode(t *testing.T) {
+	target, err := calculateTargetTime(30, "9999")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, _, err = clampTargetTime(target, 30, true)
+	if !errors.Is(err, errPositionBeyondDuration) {
+		t.Errorf("expected errPositionBeyondDuration, got %v", err)
+	}
+}
+
+func TestClampTargetTime_WithinDuration(t *testing.T) {
+	for _, reject := range []bool{false, true} {
+		target, clamped, err := clampTargetTime(12.5, 30, reject)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if clamped || target != 12.5 {
+			t.Errorf("expected 12.5 unclamped, got %v (clamped=%v)", target, clamped)
+		}
+	}
+}
+
+func TestClampTargetTime_UnknownDuration(t *testing.T) {
+	target, clamped, err := clampTargetTime(9999, 0, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if clamped || target != 9999 {
+		t.Errorf("expected target to pass through, got %v (clamped=%v)", target, clamped)
+	}
+}
+
+func TestExtractedFrameHeaders(t *testing.T) {
+	frame := &extractedFrame{Image: image.NewRGBA(image.Rect(0, 0, 1920, 1080)), Position: 15.25, Duration: 30.031, FPS: 29.97, Frames: 900}
+
+	headers := frame.headers()
+	expected := map[string]string{
+		"X-Frame-Position-Seconds": "15.250",
+		"X-Video-Width":            "1920",
+		"X-Video-Height":           "1080",
+		"X-Video-Duration":         "30.031",
+		"X-Video-FPS":              "29.970",
+		"X-Video-Frames":           "900",
+	}
+	for key, value := range expected {
+		if headers[key] != value {
+			t.Errorf("%s: expected %q, got %q", key, value, headers[key])
+		}
+	}
+
+	// Details the container doesn't report are left out
+	headers = (&extractedFrame{}).headers()
+	if len(headers) != 1 || headers["X-Frame-Position-Seconds"] != "0.000" {
+		t.Errorf("expected only the frame position, got %v", headers)
+	}
+}
+
+func TestNewFrameExtractor(t *testing.T) {
+	extractor, err := newFrameExtractor(&config.Config{VideoFrameBackend: "ffmpeg", FFmpegPath: "/opt/ffmpeg", FFprobePath: "/opt/ffprobe"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if extractor != (ffmpegFrameExtractor{FFmpeg: "/opt/ffmpeg", FFprobe: "/opt/ffprobe"}) {
+		t.Errorf("expected the ffmpeg backend with the configured paths, got %#v", extractor)
+	}
+
+	extractor, err = newFrameExtractor(&config.Config{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := extractor.(libavFrameExtractor); ok != libavAvailable {
+		t.Errorf("expected the default backend to be libav only when it is available, got %#v", extractor)
+	}
+
+	if _, err := newFrameExtractor(&config.Config{VideoFrameBackend: "gstreamer"}); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
+
+func TestUprightFrame(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.RGBA{255, 0, 0, 255}
+	img.SetRGBA(0, 0, marker) // top left
+
+	tests := []struct {
+		rotation float64
+		width    int
+		height   int
+		markerX  int
+		markerY  int
+	}{
+		{0, 3, 2, 0, 0},
+		{90, 2, 3, 1, 0},    // clockwise, the top left corner goes to the top right
+		{89.97, 2, 3, 1, 0}, // rounded to the nearest quarter turn
+		{-90, 2, 3, 0, 2},   // anticlockwise, the top left corner goes to the bottom left
+		{180, 3, 2, 2, 1},
+		{-180, 3, 2, 2, 1},
+		{270, 2, 3, 0, 2},
+	}
+	for _, tc := range tests {
+		upright := uprightFrame(img, tc.rotation)
+		if upright.Bounds().Dx() != tc.width || upright.Bounds().Dy() != tc.height {
+			t.Errorf("%v degrees: expected %dx%d, got %v", tc.rotation, tc.width, tc.height, upright.Bounds())
+			continue
+		}
+		if got := upright.At(tc.markerX, tc.markerY); got != marker {
+			t.Errorf("%v degrees: expected the marker at %d,%d, got %v", tc.rotation, tc.markerX, tc.markerY, got)
+		}
+	}
+}
+
+func TestFrameSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		sequence frameSequence
+		duration float64
+		reject   bool
+		expected []float64
+		err      error
+	}{
+		{"spread over the video", frameSequence{Count: 4}, 60, false, []float64{0, 15, 30, 45}, nil},
+		{"spread over an unknown duration", frameSequence{Count: 4}, 0, false, nil, errUnknownDuration},
+		{"from a time", frameSequence{Position: "10", Interval: 0.5, Count: 3}, 60, false, []float64{10, 10.5, 11}, nil},
+		{"from the middle", frameSequence{Position: "half", Interval: 1, Count: 2}, 60, false, []float64{30, 31}, nil},
+		{"ending with the video", frameSequence{Position: "last", Interval: 1, Count: 3}, 60, false, []float64{57, 58, 59}, nil},
+		{"beyond the duration", frameSequence{Position: "90", Interval: 1, Count: 2}, 60, false, []float64{58, 59}, nil},
+		{"beyond the duration rejected", frameSequence{Position: "90", Interval: 1, Count: 2}, 60, true, nil, errPositionBeyondDuration},
+		{"longer than the video", frameSequence{Position: "last", Interval: 1, Count: 3}, 2, false, []float64{0, 1, 2}, nil},
+		{"from a time in an unknown duration", frameSequence{Position: "first", Interval: 1, Count: 2}, 0, false, []float64{0, 1}, nil},
+		{"from the middle of an unknown duration", frameSequence{Position: "half", Interval: 1, Count: 2}, 0, false, nil, errUnknownDuration},
+	}
+	for _, tc := range tests {
+		times, err := tc.sequence.times(tc.duration, tc.reject)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.err, err)
+			continue
+		}
+		if len(times) != len(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, times)
+			continue
+		}
+		for i := range times {
+			if times[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, times)
+				break
+			}
+		}
+	}
+}
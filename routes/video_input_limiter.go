@@ -0,0 +1,42 @@
+package routes
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// inputLimiter caps how many ffmpeg input contexts are open at once. Every open input holds a connection or file
+// descriptor and demuxer buffers, so the cap is about resources rather than CPU
+type inputLimiter struct {
+	slots chan struct{}
+	// open tracks the number of held slots, nil when metrics are disabled
+	open prometheus.Gauge
+}
+
+// newInputLimiter creates a limiter for the given number of open inputs, a limit of 0 or less disables the cap
+func newInputLimiter(limit int, open prometheus.Gauge) *inputLimiter {
+	limiter := &inputLimiter{open: open}
+	if limit > 0 {
+		limiter.slots = make(chan struct{}, limit)
+	}
+	return limiter
+}
+
+// acquire blocks until an input may be opened, the returned function gives the slot back once the input is closed
+func (l *inputLimiter) acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+	if l.open != nil {
+		l.open.Inc()
+	}
+
+	return func() {
+		if l.open != nil {
+			l.open.Dec()
+		}
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+}
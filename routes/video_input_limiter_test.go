@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInputLimiter(t *testing.T) {
+	open := prometheus.NewGauge(prometheus.GaugeOpts{Name: "open_inputs"})
+	limiter := newInputLimiter(1, open)
+
+	release := limiter.acquire()
+	if value := testutil.ToFloat64(open); value != 1 {
+		t.Errorf("expected one open input, got %v", value)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		acquired <- limiter.acquire()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("expected a surplus input to wait for a free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case releaseSecond := <-acquired:
+		releaseSecond()
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting input to get the released slot")
+	}
+
+	if value := testutil.ToFloat64(open); value != 0 {
+		t.Errorf("expected no open inputs, got %v", value)
+	}
+}
+
+func TestInputLimiter_Disabled(t *testing.T) {
+	// Without a cap and without a gauge acquiring never blocks
+	limiter := newInputLimiter(0, nil)
+	for range 3 {
+		defer limiter.acquire()()
+	}
+
+	var nilLimiter *inputLimiter
+	nilLimiter.acquire()()
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errProbeTimeout is returned when opening a video and reading its stream info takes longer than the probe timeout
+var errProbeTimeout = errors.New("video probe timed out")
+
+// probeWithTimeout runs probe and calls interrupt once timeout passes, so I/O blocked inside probe returns early.
+// An interrupted probe fails with errProbeTimeout; when the probe finished before the interrupt took effect, resume
+// clears it again for the reads that follow. A timeout of zero or less leaves the probe unbounded
+func probeWithTimeout(timeout time.Duration, interrupt, resume func(), probe func() error) error {
+	if timeout <= 0 {
+		return probe()
+	}
+
+	var mu sync.Mutex
+	expired, finished := false, false
+	timer := time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !finished {
+			expired = true
+			interrupt()
+		}
+	})
+
+	err := probe()
+	timer.Stop()
+
+	mu.Lock()
+	finished = true
+	mu.Unlock()
+
+	if !expired {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w after %s: %v", errProbeTimeout, timeout, err)
+	}
+	resume()
+	return nil
+}
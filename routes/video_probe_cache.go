@@ -0,0 +1,63 @@
+package routes
+
+import (
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+)
+
+// probeFailure is the response a failed check or fetch of a source ended with, replayed for the same source
+type probeFailure struct {
+	Status  int
+	Message string
+}
+
+// probeFailureCache remembers sources that failed their checks for a short TTL, so requests for a known-bad
+// source fail fast instead of probing it again. A nil cache remembers nothing
+type probeFailureCache struct {
+	cache *ristretto.Cache[string, probeFailure]
+	ttl   time.Duration
+}
+
+// newProbeFailureCache returns nil when ttl is zero or less, leaving negative caching off
+func newProbeFailureCache(ttl time.Duration) (*probeFailureCache, error) {
+	if ttl <= 0 {
+		return nil, nil
+	}
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, probeFailure]{
+		NumCounters: 1e5,
+		MaxCost:     1e4, // Entries cost 1, so this is the number of sources remembered
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &probeFailureCache{cache: cache, ttl: ttl}, nil
+}
+
+// get returns the failure remembered for a source
+func (p *probeFailureCache) get(source string) (probeFailure, bool) {
+	if p == nil || source == "" {
+		return probeFailure{}, false
+	}
+	return p.cache.Get(source)
+}
+
+// add remembers a failure for a source until the TTL passes
+func (p *probeFailureCache) add(source string, failure probeFailure) {
+	if p == nil || source == "" {
+		return
+	}
+	p.cache.SetWithTTL(source, failure, 1, p.ttl)
+	// Sets are applied asynchronously, waiting lets the very next request see the failure
+	p.cache.Wait()
+}
+
+// forget drops the failure remembered for a source once it works again
+func (p *probeFailureCache) forget(source string) {
+	if p == nil || source == "" {
+		return
+	}
+	p.cache.Del(source)
+}
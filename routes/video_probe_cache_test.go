@@ -0,0 +1,48 @@
+package routes
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeFailureCache(t *testing.T) {
+	failures, err := newProbeFailureCache(time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create the failure cache: %v", err)
+	}
+
+	failures.add("https://example.com/broken.mp4", probeFailure{Status: 403, Message: "not a video"})
+	failure, ok := failures.get("https://example.com/broken.mp4")
+	if !ok || failure.Status != 403 || failure.Message != "not a video" {
+		t.Fatalf("expected the failure to be remembered, got %+v (%v)", failure, ok)
+	}
+	if _, ok := failures.get("https://example.com/other.mp4"); ok {
+		t.Error("expected other sources not to be affected")
+	}
+
+	// A source that works again is forgotten right away
+	failures.forget("https://example.com/broken.mp4")
+	if _, ok := failures.get("https://example.com/broken.mp4"); ok {
+		t.Error("expected the failure to be forgotten")
+	}
+
+	// Without a key nothing is remembered, S3 location sources use none
+	failures.add("", probeFailure{Status: 500})
+	if _, ok := failures.get(""); ok {
+		t.Error("expected an empty key to be ignored")
+	}
+}
+
+func TestProbeFailureCache_Disabled(t *testing.T) {
+	failures, err := newProbeFailureCache(0)
+	if err != nil || failures != nil {
+		t.Fatalf("expected no cache for a zero TTL, got %v (%v)", failures, err)
+	}
+
+	// A nil cache is usable and remembers nothing
+	failures.add("https://example.com/broken.mp4", probeFailure{Status: 403})
+	if _, ok := failures.get("https://example.com/broken.mp4"); ok {
+		t.Error("expected a disabled cache to remember nothing")
+	}
+	failures.forget("https://example.com/broken.mp4")
+}
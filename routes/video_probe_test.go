@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeWithTimeout_InterruptsSlowProbe(t *testing.T) {
+	interrupted := make(chan struct{})
+	var resumed atomic.Bool
+
+	start := time.Now()
+	err := probeWithTimeout(20*time.Millisecond, func() { close(interrupted) }, func() { resumed.Store(true) }, func() error {
+		// Blocks like a read on a stalled source until it is interrupted
+		select {
+		case <-interrupted:
+			return errors.New("immediate exit requested")
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	})
+	if !errors.Is(err, errProbeTimeout) {
+		t.Fatalf("expected errProbeTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the probe to fail fast, took %s", elapsed)
+	}
+	if resumed.Load() {
+		t.Errorf("expected a failed probe to stay interrupted")
+	}
+}
+
+func TestProbeWithTimeout_FastProbe(t *testing.T) {
+	var interrupted atomic.Bool
+	probeErr := errors.New("no such file")
+
+	if err := probeWithTimeout(time.Second, func() { interrupted.Store(true) }, func() {}, func() error { return nil }); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if err := probeWithTimeout(time.Second, func() { interrupted.Store(true) }, func() {}, func() error { return probeErr }); !errors.Is(err, probeErr) || errors.Is(err, errProbeTimeout) {
+		t.Errorf("expected the probe error as is, got %v", err)
+	}
+
+	// Without a timeout the probe is never interrupted
+	if err := probeWithTimeout(0, func() { interrupted.Store(true) }, func() {}, func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if interrupted.Load() {
+		t.Errorf("expected no interrupt for probes within the timeout")
+	}
+}
+
+func TestProbeWithTimeout_LateInterruptIsResumed(t *testing.T) {
+	var resumed atomic.Bool
+	interrupt := make(chan struct{})
+
+	// The interrupt fires while the probe is already returning successfully
+	err := probeWithTimeout(time.Millisecond, func() { close(interrupt) }, func() { resumed.Store(true) }, func() error {
+		<-interrupt
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the finished probe to succeed, got %v", err)
+	}
+	if !resumed.Load() {
+		t.Errorf("expected the interrupt to be cleared for the reads after the probe")
+	}
+}
@@ -0,0 +1,260 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/kolesa-team/go-webp/encoder"
+	"github.com/kolesa-team/go-webp/webp"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/pool"
+	"media-proxy/validation"
+)
+
+const (
+	// defaultSpriteFrames is the number of frames of a sprite sheet whose path has no n: parameter
+	defaultSpriteFrames = 10
+	// defaultSpriteTileWidth is the width of the tiles of a sprite sheet whose path sets neither w: nor h:
+	defaultSpriteTileWidth = 160
+)
+
+// errSpriteTooLarge is returned when the tiled sheet would have more than APP_SPRITE_MAX_PIXELS pixels
+var errSpriteTooLarge = errors.New("sprite sheet is too large")
+
+// spriteSheet tiles frames left to right and top to bottom into a grid about as wide as it is tall. The tile size is
+// taken from the first frame, the sheet is allocated once it is known
+type spriteSheet struct {
+	columns   int
+	rows      int
+	maxPixels int64
+
+	tileWidth  int
+	tileHeight int
+	canvas     *image.RGBA
+	last       image.Image
+	tiles      int
+}
+
+// newSpriteSheet lays out a grid for count tiles
+func newSpriteSheet(count int, maxPixels int64) *spriteSheet {
+	columns := int(math.Ceil(math.Sqrt(float64(count))))
+	return &spriteSheet{columns: columns, rows: (count + columns - 1) / columns, maxPixels: maxPixels}
+}
+
+// add draws the tile into the next cell, failing with errSpriteTooLarge when the first one makes the sheet too large
+func (s *spriteSheet) add(tile image.Image) error {
+	if s.canvas == nil {
+		size := tile.Bounds().Size()
+		width, height := s.columns*size.X, s.rows*size.Y
+		if s.maxPixels > 0 && int64(width)*int64(height) > s.maxPixels {
+			return fmt.Errorf("%w: %dx%d", errSpriteTooLarge, width, height)
+		}
+		s.tileWidth, s.tileHeight = size.X, size.Y
+		s.canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+
+	x, y := (s.tiles%s.columns)*s.tileWidth, (s.tiles/s.columns)*s.tileHeight
+	draw.Draw(s.canvas, image.Rect(x, y, x+s.tileWidth, y+s.tileHeight), tile, tile.Bounds().Min, draw.Src)
+	s.last = tile
+	s.tiles++
+	return nil
+}
+
+// fill repeats the last tile in the cells of frames the video ran out of before, up to count tiles
+func (s *spriteSheet) fill(count int) {
+	for s.last != nil && s.tiles < count {
+		_ = s.add(s.last)
+	}
+}
+
+// headers describe the grid as X-Sprite-* response headers, along with the video details of the probe
+func (s *spriteSheet) headers(count int, video *probedVideo) map[string]string {
+	headers := video.headers()
+	headers["X-Sprite-Frames"] = strconv.Itoa(count)
+	headers["X-Sprite-Columns"] = strconv.Itoa(s.columns)
+	headers["X-Sprite-Rows"] = strconv.Itoa(s.rows)
+	headers["X-Sprite-Tile-Width"] = strconv.Itoa(s.tileWidth)
+	headers["X-Sprite-Tile-Height"] = strconv.Itoa(s.tileHeight)
+	headers["X-Sprite-Interval-Seconds"] = strconv.FormatFloat(video.Duration/float64(count), 'f', 3, 64)
+	return headers
+}
+
+// spriteCacheKey keys a sprite sheet apart from the previews of the same parameters
+func spriteCacheKey(config *config.Config, params *validation.ImageContext, count int) string {
+	return "sprite;" + cacheKey(config, params) + ";n=" + strconv.Itoa(count)
+}
+
+// handleVideoSpriteRequest answers GET /videos/sprite/* with n: evenly spaced frames of the video tiled into one image
+func handleVideoSpriteRequest(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		pathParams := c.Params("*")
+		logger.Info("video sprite request received", zap.String("pathParams", pathParams))
+
+		ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+
+		return processVideoSprite(c, logger, cache, config, counters, performance, params, s3cache, inputs, extractor, failures, scheduler, httpClient, origins)
+	}
+}
+
+// processVideoSprite extracts the frames of a sprite sheet in one pass over the video, resizing each into its tile as
+// it is decoded
+func processVideoSprite(c *fiber.Ctx, logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, params *validation.ImageContext, s3cache *S3Cache, inputs *inputLimiter, extractor frameExtractor, failures *probeFailureCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter) error {
+	count := params.FrameCount
+	if count == 0 {
+		count = defaultSpriteFrames
+	}
+	if count > config.SpriteMaxFrames {
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("a sprite sheet holds at most %d frames", config.SpriteMaxFrames))
+	}
+
+	key := spriteCacheKey(config, params, count)
+	cacheValue, ok := cache.Get(key)
+	if !ok && s3cache != nil && s3cache.Enabled {
+		if s3val, err := s3cache.Get(context.Background(), key); err == nil && s3val != nil {
+			s3val.ETag = contentETag(key, s3val.Body)
+			cache.SetWithTTL(key, *s3val, 1000, cacheTTL(config))
+			cacheValue, ok = *s3val, true
+		}
+	}
+	if ok {
+		counters.SuccessfullyServed.WithLabelValues("video-sprite", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+		counters.ServedCached.WithLabelValues("video-sprite", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+
+		setPreviewHeaders(c, false, cacheValue.Headers)
+		c.Set("Content-Type", cacheValue.ContentType)
+		c.Set("Cache-Control", cacheControl(config, params))
+		if setResponseValidators(c, cacheValue) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		counters.ObserveServed("video-sprite", true, cacheValue.ContentType, int64(len(cacheValue.Body)))
+		return c.Send(cacheValue.Body)
+	}
+
+	source, err := resolveMediaSource(c, logger, config, counters, params, s3cache, failures, httpClient, origins, "video-sprite", videoMedia)
+	if source == nil {
+		return err
+	}
+	fail := func(status int, message string) error {
+		failures.add(source.FailureKey, probeFailure{Status: status, Message: message})
+		return c.Status(status).SendString(message)
+	}
+
+	release, err := scheduler.acquire(workExpensive)
+	if err != nil {
+		return sendBusy(c, logger, err)
+	}
+	defer release()
+
+	applyFormatInterpolation(config, params, source.ContentType)
+	width, height := params.Width, params.Height
+	if width == 0 && height == 0 {
+		width = defaultSpriteTileWidth
+	}
+
+	sheet := newSpriteSheet(count, config.SpriteMaxPixels)
+	limits := newOutputLimits(config)
+	done := metrics.TimeVideoOperation("sprite-extract", performance)
+	video, err := extractor.ExtractFrames(source.URL, frameSequence{Count: count}, frameExtractionOptions{
+		Threads:      config.EncoderThreads,
+		Inputs:       inputs,
+		ProbeTimeout: time.Duration(config.VideoProbeTimeout) * time.Second,
+		Headers:      source.Headers,
+		MaxDuration:  float64(config.MaxVideoDuration),
+	}, func(frame image.Image) error {
+		tile, err := resizeImage(frame, width, height, params.Interpolation, limits)
+		if err != nil {
+			return err
+		}
+		if params.Scale > 0 {
+			if tile, err = rescaleImage(tile, params.Scale, limits); err != nil {
+				return err
+			}
+		}
+		return sheet.add(tile)
+	})
+	done()
+	if errors.Is(err, errProbeTimeout) {
+		logger.Error("video probe timed out", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusGatewayTimeout, "video probe timed out")
+	}
+	if errors.Is(err, errVideoTooLong) {
+		logger.Warn("video is too long for a sprite sheet", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, videoTooLongMessage)
+	}
+	if errors.Is(err, errUnknownDuration) {
+		logger.Warn("video duration is unknown", zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+		return fail(fiber.StatusUnprocessableEntity, "video duration is unknown, frames can't be spaced over it")
+	}
+	// The tile size is part of the request rather than the source, so this one isn't remembered
+	if errors.Is(err, errSpriteTooLarge) {
+		logger.Warn("sprite sheet is too large", zap.Error(err), zap.Int("frames", count))
+		return c.Status(fiber.StatusBadRequest).SendString(fmt.Sprintf("sprite sheet would exceed %d pixels, request fewer or smaller frames", config.SpriteMaxPixels))
+	}
+	if errors.Is(err, errOutputTooLarge) {
+		logger.Warn("sprite tile is too large", zap.Error(err), zap.Int("width", width), zap.Int("height", height))
+		return c.Status(fiber.StatusBadRequest).SendString(limits.message())
+	}
+	if err != nil {
+		logger.Error("failed to extract sprite frames", zap.Error(err), zap.Int("frames", count))
+		return fail(fiber.StatusInternalServerError, "failed to extract video sprite")
+	}
+	failures.forget(source.FailureKey)
+	sheet.fill(count)
+
+	buf := pool.GetBuffer()
+	defer pool.PutBuffer(buf)
+
+	contentType := "image/jpeg"
+	quality := outputQuality(config, params.Quality, source.ContentType)
+	done = metrics.TimeVideoOperation("sprite-encode", performance)
+	if params.Webp {
+		contentType = "image/webp"
+		var options *encoder.Options
+		if options, err = newWebpEncoderOptions(quality, webpMethod(config, params), config.EncoderThreads); err == nil {
+			err = webp.Encode(buf, sheet.canvas, options)
+		}
+	} else {
+		err = encodeJPEG(buf, sheet.canvas, quality, config.JPEGProgressive)
+	}
+	done()
+	if err != nil {
+		logger.Error("failed to encode sprite sheet", zap.Error(err), zap.String("content-type", contentType))
+		return c.Status(fiber.StatusInternalServerError).SendString("failed to encode sprite sheet")
+	}
+
+	// The buffer goes back to the pool, the cached body can't share it
+	headers := sheet.headers(count, video)
+	value := CacheValue{Body: bytes.Clone(buf.Bytes()), ContentType: contentType, Headers: headers}
+	value.ETag = contentETag(key, value.Body)
+	cache.SetWithTTL(key, value, 1000, cacheTTL(config))
+	storePreviewInS3(s3cache, key, "", value)
+
+	setPreviewHeaders(c, false, headers)
+	c.Set("Content-Type", contentType)
+	c.Set("Cache-Control", cacheControl(config, params))
+	c.Set("ETag", value.ETag)
+
+	logger.Info("video sprite served successfully", zap.Int("frames", count), zap.String("origin", params.Hostname))
+	counters.SuccessfullyServed.WithLabelValues("video-sprite", metrics.CleanHostname(params.Hostname), metrics.HashURL(params.Url)).Inc()
+	counters.ObserveServed("video-sprite", false, contentType, int64(len(value.Body)))
+
+	return c.Send(value.Body)
+}
@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+func TestSpriteSheet(t *testing.T) {
+	sheet := newSpriteSheet(10, 0)
+	if sheet.columns != 4 || sheet.rows != 3 {
+		t.Errorf("expected a 4x3 grid for 10 frames, got %dx%d", sheet.columns, sheet.rows)
+	}
+
+	tile := image.NewRGBA(image.Rect(0, 0, 16, 9))
+	tile.Set(0, 0, color.RGBA{R: 255, A: 255})
+	for range 7 {
+		if err := sheet.add(tile); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// A video that ran out of frames early repeats its last one
+	sheet.fill(10)
+	if sheet.tiles != 10 {
+		t.Errorf("expected the sheet to be filled up to 10 tiles, got %d", sheet.tiles)
+	}
+	if size := sheet.canvas.Bounds().Size(); size != image.Pt(64, 27) {
+		t.Errorf("expected a 64x27 sheet, got %v", size)
+	}
+	if r, _, _, _ := sheet.canvas.At(16, 18).RGBA(); r == 0 {
+		t.Error("expected the filled tenth cell to hold the last tile")
+	}
+
+	headers := sheet.headers(10, &probedVideo{Duration: 30, FPS: 25})
+	expected := map[string]string{
+		"X-Sprite-Frames":           "10",
+		"X-Sprite-Columns":          "4",
+		"X-Sprite-Rows":             "3",
+		"X-Sprite-Tile-Width":       "16",
+		"X-Sprite-Tile-Height":      "9",
+		"X-Sprite-Interval-Seconds": "3.000",
+		"X-Video-Duration":          "30.000",
+		"X-Video-FPS":               "25.000",
+	}
+	for name, value := range expected {
+		if headers[name] != value {
+			t.Errorf("expected %s %q, got %q", name, value, headers[name])
+		}
+	}
+
+	// The first tile decides the size of the sheet, one over the limit is refused before it is allocated
+	small := newSpriteSheet(10, 64*27-1)
+	if err := small.add(tile); !errors.Is(err, errSpriteTooLarge) || small.canvas != nil {
+		t.Errorf("expected errSpriteTooLarge without a sheet, got %v", err)
+	}
+}
+
+func TestVideoSprite(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{EncoderThreads: 1, SpriteMaxFrames: 20, SpriteMaxPixels: 1 << 20}
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	extractor := &stubFrameExtractor{
+		frame:  &extractedFrame{Image: image.NewRGBA(image.Rect(0, 0, 320, 180))},
+		video:  &probedVideo{Duration: 60, FPS: 30},
+		frames: 3,
+	}
+	app := fiber.New()
+	app.Get("/videos/sprite/*", handleVideoSpriteRequest(zap.NewNop(), cache, cfg, counters, nil, nil, newInputLimiter(0, nil), extractor, nil, nil, newOriginClient(t, cfg), nil))
+
+	encoded := base64.URLEncoding.EncodeToString([]byte(serveOrigin(t, "video/mp4", []byte("not decoded by the stub"))))
+	request := func(pathParams string) *http.Response {
+		t.Helper()
+		response, err := app.Test(httptest.NewRequest(http.MethodGet, "/videos/sprite/"+pathParams+encoded, nil), -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return response
+	}
+
+	for range 2 {
+		response := request("n:4/w:80/")
+		if response.StatusCode != fiber.StatusOK {
+			t.Fatalf("expected 200, got %d", response.StatusCode)
+		}
+		sheet, err := jpeg.Decode(response.Body)
+		if err != nil {
+			t.Fatalf("expected a jpeg sheet: %v", err)
+		}
+		if size := sheet.Bounds().Size(); size != image.Pt(160, 90) {
+			t.Errorf("expected a 2x2 grid of 80x45 tiles, got %v", size)
+		}
+		if columns, height, interval := response.Header.Get("X-Sprite-Columns"), response.Header.Get("X-Sprite-Tile-Height"), response.Header.Get("X-Sprite-Interval-Seconds"); columns != "2" || height != "45" || interval != "15.000" {
+			t.Errorf("unexpected tile geometry: columns %q, tile height %q, interval %q", columns, height, interval)
+		}
+		cache.Wait()
+	}
+	if extractor.calls != 1 {
+		t.Errorf("expected the second request to be served from the cache, got %d extractions", extractor.calls)
+	}
+
+	if response := request("n:21/"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for more frames than APP_SPRITE_MAX_FRAMES, got %d", response.StatusCode)
+	}
+	if response := request("n:16/w:400/"); response.StatusCode != fiber.StatusBadRequest {
+		t.Errorf("expected 400 for a sheet over APP_SPRITE_MAX_PIXELS, got %d", response.StatusCode)
+	}
+
+	extractor.err = errUnknownDuration
+	if response := request("n:5/"); response.StatusCode != fiber.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a video of unknown duration, got %d", response.StatusCode)
+	}
+}
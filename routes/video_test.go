@@ -0,0 +1,781 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// newVideoTestApp registers the video routes on a fresh app with an in-memory cache and no S3, the cache is returned for seeding
+func newVideoTestApp(t *testing.T, cfg *config.Config) (*fiber.App, *ristretto.Cache[string, CacheValue]) {
+	t.Helper()
+
+	app, cache, _, _ := newVideoTestAppWithState(t, cfg)
+	return app, cache
+}
+
+// newVideoTestAppWithState is newVideoTestApp that also returns the HTTP cache store and the counters the routes report to
+func newVideoTestAppWithState(t *testing.T, cfg *config.Config) (*fiber.App, *ristretto.Cache[string, CacheValue], *ristretto.Cache[string, []byte], *metrics.Metrics) {
+	t.Helper()
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	httpCache, err := ristretto.NewCache(&ristretto.Config[string, []byte]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create http cache: %v", err)
+	}
+	t.Cleanup(httpCache.Close)
+
+	if cfg.EncoderThreads == 0 {
+		cfg.EncoderThreads = 1
+	}
+
+	app := fiber.New()
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	RegisterVideoRoutes(zap.NewNop(), cache, httpCache, cfg, app, counters, nil, nil, nil, nil, newOriginClient(t, cfg), NewOriginRateLimiter(cfg))
+	return app, cache, httpCache, counters
+}
+
+// requestVideoPreview performs a GET /videos/preview/<path>/<base64 url> against the app
+func requestVideoPreview(t *testing.T, app *fiber.App, path, originURL string) *http.Response {
+	t.Helper()
+
+	target := "/videos/preview/" + path + base64.URLEncoding.EncodeToString([]byte(originURL))
+	response, err := app.Test(httptest.NewRequest(http.MethodGet, target, nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return response
+}
+
+func TestCacheKey_FramePosition(t *testing.T) {
+	params := &validation.ImageContext{Url: "https://example.com/video.mp4", Quality: 80}
+
+	defaultKey := cacheKey(&config.Config{}, params)
+
+	params.FramePosition = "first"
+	if cacheKey(&config.Config{}, params) != defaultKey {
+		t.Error("expected the first frame to keep the default key")
+	}
+
+	params.FramePosition = "9999"
+	if cacheKey(&config.Config{}, params) == defaultKey {
+		t.Error("expected a different frame position to change the key")
+	}
+}
+
+func TestVideoPreview_CachedClampedHeader(t *testing.T) {
+	cfg := &config.Config{}
+	app, cache := newVideoTestApp(t, cfg)
+	// The origin is not a video, so anything not served from the cache fails
+	originURL := serveOrigin(t, "text/plain", []byte("not a video"))
+
+	// Seed the cache under the key the handler computes for the same request
+	path := "fp:9999/" + base64.URLEncoding.EncodeToString([]byte(originURL))
+	ok, _, params, err := validation.ProcessImageContextFromPath(zap.NewNop(), path, cfg)
+	if !ok {
+		t.Fatalf("failed to parse request: %v", err)
+	}
+	cache.Set(cacheKey(cfg, params), CacheValue{
+		Body:         []byte("preview"),
+		ContentType:  "image/jpeg",
+		FrameClamped: true,
+		Headers:      map[string]string{"X-Video-Duration": "30.000", "X-Frame-Position-Seconds": "29.967"},
+	}, 1)
+	cache.Wait()
+
+	response := requestVideoPreview(t, app, "fp:9999/", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected 200 from the cache, got %d", response.StatusCode)
+	}
+	if response.Header.Get("X-Frame-Position-Clamped") != "true" {
+		t.Error("expected the clamp header to be restored on a cache hit")
+	}
+	if response.Header.Get("X-Video-Duration") != "30.000" || response.Header.Get("X-Frame-Position-Seconds") != "29.967" {
+		t.Error("expected the video details to be restored on a cache hit")
+	}
+
+	// The first frame is a different entry and goes to the origin
+	response = requestVideoPreview(t, app, "fp:first/", originURL)
+	if response.StatusCode == fiber.StatusOK {
+		t.Error("expected fp:first not to be served from the fp:9999 entry")
+	}
+}
+
+// serveTestVideo serves the video from MEDIA_PROXY_TEST_VIDEO, skipping the test without it
+func serveTestVideo(t *testing.T) string {
+	t.Helper()
+
+	source := os.Getenv("MEDIA_PROXY_TEST_VIDEO")
+	if source == "" {
+		t.Skip("MEDIA_PROXY_TEST_VIDEO is not set")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeFile(w, r, source)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/video.mp4"
+}
+
+// TestVideoPreview_BeyondDuration needs a real video, it is read from MEDIA_PROXY_TEST_VIDEO and the test is skipped without it
+func TestVideoPreview_BeyondDuration(t *testing.T) {
+	originURL := serveTestVideo(t)
+
+	app, _ := newVideoTestApp(t, &config.Config{FramePositionBeyondDuration: "reject"})
+	response := requestVideoPreview(t, app, "fp:999999/", originURL)
+	if response.StatusCode != fiber.StatusBadRequest {
+		body, _ := io.ReadAll(response.Body)
+		t.Errorf("expected 400 in reject mode, got %d: %s", response.StatusCode, body)
+	}
+
+	app, _ = newVideoTestApp(t, &config.Config{FramePositionBeyondDuration: "clamp"})
+	response = requestVideoPreview(t, app, "fp:999999/", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("expected 200 in clamp mode, got %d: %s", response.StatusCode, body)
+	}
+	if response.Header.Get("X-Frame-Position-Clamped") != "true" {
+		t.Error("expected the clamp header in clamp mode")
+	}
+}
+
+// TestVideoPreview_FramePositionHeaders needs a real video, it is read from MEDIA_PROXY_TEST_VIDEO and the test is skipped without it
+func TestVideoPreview_FramePositionHeaders(t *testing.T) {
+	originURL := serveTestVideo(t)
+	app, _ := newVideoTestApp(t, &config.Config{})
+
+	response := requestVideoPreview(t, app, "fp:half/", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+
+	duration, err := strconv.ParseFloat(response.Header.Get("X-Video-Duration"), 64)
+	if err != nil {
+		t.Fatalf("invalid X-Video-Duration: %v", err)
+	}
+	fps, err := strconv.ParseFloat(response.Header.Get("X-Video-FPS"), 64)
+	if err != nil || fps <= 0 {
+		t.Fatalf("invalid X-Video-FPS %q: %v", response.Header.Get("X-Video-FPS"), err)
+	}
+	position, err := strconv.ParseFloat(response.Header.Get("X-Frame-Position-Seconds"), 64)
+	if err != nil {
+		t.Fatalf("invalid X-Frame-Position-Seconds: %v", err)
+	}
+
+	// The picked frame is the one closest to the computed target time, so at most one frame away
+	target, err := calculateTargetTime(duration, "half")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if math.Abs(position-target) > 1/fps+0.001 {
+		t.Errorf("expected the frame position %v to be within a frame of the target %v", position, target)
+	}
+}
+
+// requestVideo performs a GET /videos/<base64 url> against the app, with a Range header unless it is empty
+func requestVideo(t *testing.T, app *fiber.App, originURL, rangeHeader string) (*http.Response, []byte) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodGet, "/videos/"+base64.URLEncoding.EncodeToString([]byte(originURL)), nil)
+	if rangeHeader != "" {
+		request.Header.Set("Range", rangeHeader)
+	}
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return response, body
+}
+
+func TestVideoProxy_RangeFromCache(t *testing.T) {
+	app, _, httpCache, counters := newVideoTestAppWithState(t, &config.Config{VideoCacheMaxMB: 1})
+	video := []byte("0123456789abcdef")
+	originURL, hits := serveCountingOrigin(t, "video/mp4", video)
+
+	response, body := requestVideo(t, app, originURL, "")
+	if response.StatusCode != fiber.StatusOK || string(body) != string(video) {
+		t.Fatalf("expected the full video, got %d: %q", response.StatusCode, body)
+	}
+
+	// Cache writes are buffered, make sure the entry landed before requesting ranges
+	httpCache.Wait()
+
+	tests := []struct {
+		rangeHeader  string
+		body         string
+		contentRange string
+	}{
+		{"bytes=2-5", "2345", "bytes 2-5/16"},
+		{"bytes=10-", "abcdef", "bytes 10-15/16"},
+		{"bytes=-3", "def", "bytes 13-15/16"},
+		{"bytes=14-99", "ef", "bytes 14-15/16"},
+	}
+	for _, test := range tests {
+		response, body := requestVideo(t, app, originURL, test.rangeHeader)
+		if response.StatusCode != fiber.StatusPartialContent {
+			t.Errorf("%s: expected 206, got %d", test.rangeHeader, response.StatusCode)
+			continue
+		}
+		if string(body) != test.body {
+			t.Errorf("%s: expected %q, got %q", test.rangeHeader, test.body, body)
+		}
+		if contentRange := response.Header.Get("Content-Range"); contentRange != test.contentRange {
+			t.Errorf("%s: expected Content-Range %q, got %q", test.rangeHeader, test.contentRange, contentRange)
+		}
+		if contentType := response.Header.Get("Content-Type"); contentType != "video/mp4" {
+			t.Errorf("%s: expected the origin content type, got %q", test.rangeHeader, contentType)
+		}
+	}
+
+	response, _ = requestVideo(t, app, originURL, "bytes=16-")
+	if response.StatusCode != fiber.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416 past the end, got %d", response.StatusCode)
+	}
+
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+	if served := testutil.ToFloat64(counters.BytesServed.WithLabelValues("video", "true")); served != 4+6+3+2 {
+		t.Errorf("expected 15 cached bytes, got %v", served)
+	}
+}
+
+func TestVideoProxy_RepeatedFromCache(t *testing.T) {
+	app, _, httpCache, counters := newVideoTestAppWithState(t, &config.Config{VideoCacheMaxMB: 1})
+	video := []byte("0123456789abcdef")
+	originURL, hits := serveCountingOrigin(t, "video/mp4", video)
+
+	response, _ := requestVideo(t, app, originURL, "")
+	if place := response.Header.Get("X-Cache-Place"); place != "" {
+		t.Errorf("expected the first response to come from the origin, got %q", place)
+	}
+	httpCache.Wait()
+
+	response, body := requestVideo(t, app, originURL, "")
+	if response.StatusCode != fiber.StatusOK || string(body) != string(video) {
+		t.Fatalf("expected the full video, got %d: %q", response.StatusCode, body)
+	}
+	if place := response.Header.Get("X-Cache-Place"); place != cachePlaceResponseHandler {
+		t.Errorf("expected the repeat to be served from memory, got %q", place)
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+	if served := testutil.ToFloat64(counters.BytesServed.WithLabelValues("video", "true")); served != float64(len(video)) {
+		t.Errorf("expected %d cached bytes, got %v", len(video), served)
+	}
+}
+
+func TestVideoProxy_TooLargeToCache(t *testing.T) {
+	app, _, httpCache, _ := newVideoTestAppWithState(t, &config.Config{VideoCacheMaxMB: 1})
+	video := bytes.Repeat([]byte{'v'}, 2<<20)
+	originURL, hits := serveCountingOrigin(t, "video/mp4", video)
+
+	response, body := requestVideo(t, app, originURL, "")
+	if response.StatusCode != fiber.StatusOK || len(body) != len(video) {
+		t.Fatalf("expected the full video, got %d with %d bytes", response.StatusCode, len(body))
+	}
+	httpCache.Wait()
+
+	requestVideo(t, app, originURL, "")
+	if hits.Load() != 2 {
+		t.Errorf("expected a video above the limit to be fetched again, got %d origin hits", hits.Load())
+	}
+}
+
+func TestResolveRanges(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []byteRange
+	}{
+		// Two separate ranges keep their order of offsets
+		{"bytes=10-19, 0-4", []byteRange{{0, 4}, {10, 19}}},
+		// Overlapping and touching ranges are merged
+		{"bytes=0-9,5-14", []byteRange{{0, 14}}},
+		{"bytes=0-4,5-9,20-", []byteRange{{0, 9}, {20, 99}}},
+		// Suffix ranges resolve against the end, unsatisfiable ones are dropped
+		{"bytes=-10,200-300", []byteRange{{90, 99}}},
+		{"bytes=100-,150-", nil},
+	}
+	for _, test := range tests {
+		ranges, err := parseRanges(test.header)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.header, err)
+			continue
+		}
+		if resolved := resolveRanges(ranges, 100); !slices.Equal(resolved, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.header, test.expected, resolved)
+		}
+	}
+
+	for _, header := range []string{"bytes=0-4,", "bytes=0-4,x-9", "items=0-4,5-9"} {
+		if _, err := parseRanges(header); err == nil {
+			t.Errorf("%s: expected an error", header)
+		}
+	}
+}
+
+func TestVideoProxy_MultipleRangesFromCache(t *testing.T) {
+	app, _, httpCache, _ := newVideoTestAppWithState(t, &config.Config{VideoCacheMaxMB: 1})
+	originURL, hits := serveCountingOrigin(t, "video/mp4", []byte("0123456789abcdef"))
+
+	requestVideo(t, app, originURL, "")
+	httpCache.Wait()
+
+	response, body := requestVideo(t, app, originURL, "bytes=0-1,10-12")
+	if response.StatusCode != fiber.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", response.StatusCode)
+	}
+	mediaType, mediaParams, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("expected a multipart/byteranges response, got %q", response.Header.Get("Content-Type"))
+	}
+
+	expected := []struct{ contentRange, body string }{
+		{"bytes 0-1/16", "01"},
+		{"bytes 10-12/16", "abc"},
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), mediaParams["boundary"])
+	for _, want := range expected {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatalf("expected a part for %s: %v", want.contentRange, err)
+		}
+		partBody, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != want.contentRange || string(partBody) != want.body {
+			t.Errorf("expected %s with %q, got %s with %q", want.contentRange, want.body, part.Header.Get("Content-Range"), partBody)
+		}
+		if part.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("expected parts to carry the video content type, got %q", part.Header.Get("Content-Type"))
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("expected exactly two parts, got %v", err)
+	}
+
+	// Overlapping ranges merge into one and are answered like a single range request
+	response, body = requestVideo(t, app, originURL, "bytes=2-5,4-7")
+	if response.StatusCode != fiber.StatusPartialContent || string(body) != "234567" {
+		t.Errorf("expected the merged range, got %d: %q", response.StatusCode, body)
+	}
+	if contentRange := response.Header.Get("Content-Range"); contentRange != "bytes 2-7/16" {
+		t.Errorf("expected Content-Range bytes 2-7/16, got %q", contentRange)
+	}
+
+	response, _ = requestVideo(t, app, originURL, "bytes=20-,30-")
+	if response.StatusCode != fiber.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416 when no range is satisfiable, got %d", response.StatusCode)
+	}
+
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+}
+
+// serveRangeOrigin serves the video with range support, HEAD requests are answered only when allowHead is set and
+// suffix ranges are rejected when noSuffix is set
+func serveRangeOrigin(t *testing.T, video []byte, allowHead, noSuffix bool) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && !allowHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if noSuffix && strings.HasPrefix(r.Header.Get("Range"), "bytes=-") {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL + "/video.mp4"
+}
+
+func TestVideoProxy_SuffixRangeFromOrigin(t *testing.T) {
+	video := []byte("0123456789abcdef")
+
+	// The origin rejects suffix ranges, the size from HEAD turns the request into an absolute range
+	app, _ := newVideoTestApp(t, &config.Config{})
+	response, body := requestVideo(t, app, serveRangeOrigin(t, video, true, true), "bytes=-4")
+	if response.StatusCode != fiber.StatusPartialContent || string(body) != "cdef" {
+		t.Errorf("expected the last 4 bytes, got %d: %q", response.StatusCode, body)
+	}
+	if contentRange := response.Header.Get("Content-Range"); contentRange != "bytes 12-15/16" {
+		t.Errorf("expected Content-Range bytes 12-15/16, got %q", contentRange)
+	}
+
+	// Without HEAD the suffix range is forwarded as is
+	response, body = requestVideo(t, app, serveRangeOrigin(t, video, false, false), "bytes=-4")
+	if response.StatusCode != fiber.StatusPartialContent || string(body) != "cdef" {
+		t.Errorf("expected the origin to answer the suffix range, got %d: %q", response.StatusCode, body)
+	}
+}
+
+func TestPreviewObjectKey(t *testing.T) {
+	cfg := &config.Config{PreviewKeysFromLocation: true}
+	params := &validation.ImageContext{CustomObjectKey: "videos/2024/clip.mp4", Quality: 80, Width: 320, FramePosition: "half", Webp: true}
+
+	if key := previewObjectKey(cfg, params); key != "videos/2024/clip.mp4.preview.q80_w320_h0_s0_i0_fphalf.webp" {
+		t.Errorf("unexpected preview key %q", key)
+	}
+
+	params.Webp = false
+	params.FramePosition = ""
+	params.Scale = 0.5
+	if key := previewObjectKey(cfg, params); key != "videos/2024/clip.mp4.preview.q80_w320_h0_s0.5_i0_fpfirst.jpg" {
+		t.Errorf("unexpected preview key %q", key)
+	}
+
+	// URL sources and a disabled option keep the hashed cache keys
+	if key := previewObjectKey(cfg, &validation.ImageContext{Url: "https://example.com/clip.mp4", Quality: 80}); key != "" {
+		t.Errorf("expected no preview key for a url source, got %q", key)
+	}
+	if key := previewObjectKey(&config.Config{}, params); key != "" {
+		t.Errorf("expected no preview key with the option off, got %q", key)
+	}
+}
+
+// stubFrameExtractor returns a fixed frame and video details, or err when set, and records how often and for which
+// position it was called. ExtractFrames yields the frame up to frames times, every time asked for when frames is 0
+type stubFrameExtractor struct {
+	frame    *extractedFrame
+	video    *probedVideo
+	frames   int
+	err      error
+	position string
+	headers  map[string]string
+	calls    int
+}
+
+func (s *stubFrameExtractor) ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	s.position = position
+	s.headers = options.Headers
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.frame, nil
+}
+
+func (s *stubFrameExtractor) ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error) {
+	s.headers = options.Headers
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.video, nil
+}
+
+func (s *stubFrameExtractor) ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error) {
+	s.position = sequence.Position
+	s.headers = options.Headers
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	count := sequence.Count
+	if s.frames > 0 {
+		count = min(count, s.frames)
+	}
+	for range count {
+		if err := each(s.frame.Image); err != nil {
+			return nil, err
+		}
+	}
+	return s.video, nil
+}
+
+// newStubPreviewApp registers the preview route on a fresh app with the given frame extractor and probe failure cache
+func newStubPreviewApp(t *testing.T, extractor frameExtractor, failures *probeFailureCache) *fiber.App {
+	t.Helper()
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	app := fiber.New()
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	cfg := &config.Config{EncoderThreads: 1}
+	app.Get("/videos/preview/*", handleVideoPreviewRequest(zap.NewNop(), cache, cfg, counters, nil, nil, newInputLimiter(0, nil), extractor, failures, nil, newOriginClient(t, cfg), nil, nil))
+	return app
+}
+
+func TestVideoPreview_StubExtractor(t *testing.T) {
+	originURL := serveOrigin(t, "video/mp4", []byte("not decoded by the stub"))
+	extractor := &stubFrameExtractor{frame: &extractedFrame{
+		Image:    image.NewRGBA(image.Rect(0, 0, 16, 9)),
+		Position: 12.5,
+		Duration: 30,
+		FPS:      25,
+	}}
+	app := newStubPreviewApp(t, extractor, nil)
+
+	response := requestVideoPreview(t, app, "fp:12.5/w:8/", originURL)
+	if response.StatusCode != fiber.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		t.Fatalf("expected 200, got %d: %s", response.StatusCode, body)
+	}
+	if response.Header.Get("X-Video-Width") != "16" || response.Header.Get("X-Video-Height") != "9" {
+		t.Errorf("expected the size of the frame before resizing, got %sx%s", response.Header.Get("X-Video-Width"), response.Header.Get("X-Video-Height"))
+	}
+	if extractor.position != "12.5" {
+		t.Errorf("expected the extractor to get position 12.5, got %q", extractor.position)
+	}
+	if response.Header.Get("X-Frame-Position-Seconds") != "12.500" || response.Header.Get("X-Video-Duration") != "30.000" {
+		t.Errorf("expected the frame details from the extractor, got position %q and duration %q",
+			response.Header.Get("X-Frame-Position-Seconds"), response.Header.Get("X-Video-Duration"))
+	}
+}
+
+func TestVideoPreview_StubExtractorErrors(t *testing.T) {
+	originURL := serveOrigin(t, "video/mp4", []byte("not decoded by the stub"))
+
+	cases := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w after 1s", errProbeTimeout), fiber.StatusGatewayTimeout},
+		{errPositionBeyondDuration, fiber.StatusBadRequest},
+		{fmt.Errorf("%w: 7200.000s", errVideoTooLong), fiber.StatusUnprocessableEntity},
+		{errors.New("broken input"), fiber.StatusInternalServerError},
+	}
+	for _, tc := range cases {
+		app := newStubPreviewApp(t, &stubFrameExtractor{err: tc.err}, nil)
+		response := requestVideoPreview(t, app, "fp:half/", originURL)
+		if response.StatusCode != tc.status {
+			t.Errorf("expected %d for %v, got %d", tc.status, tc.err, response.StatusCode)
+		}
+	}
+}
+
+func TestVideoPreview_ProbeFailureCache(t *testing.T) {
+	failures, err := newProbeFailureCache(time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create the failure cache: %v", err)
+	}
+
+	// A source that isn't a video is checked once, the second request gets the same answer without probing it
+	originURL, hits := serveCountingOrigin(t, "text/plain", []byte("not a video"))
+	extractor := &stubFrameExtractor{err: errors.New("broken input")}
+	app := newStubPreviewApp(t, extractor, failures)
+	for i := 0; i < 2; i++ {
+		response := requestVideoPreview(t, app, "fp:first/", originURL)
+		if response.StatusCode != fiber.StatusForbidden {
+			t.Errorf("request %d: expected 403, got %d", i+1, response.StatusCode)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be probed once, got %d hits", hits.Load())
+	}
+
+	// A video that can't be decoded is remembered too, whatever position is asked for next
+	videoURL := serveOrigin(t, "video/mp4", []byte("not decodable"))
+	for _, path := range []string{"fp:first/", "fp:half/"} {
+		response := requestVideoPreview(t, app, path, videoURL)
+		if response.StatusCode != fiber.StatusInternalServerError {
+			t.Errorf("%s: expected 500, got %d", path, response.StatusCode)
+		}
+	}
+	if extractor.calls != 1 {
+		t.Errorf("expected a single extraction attempt, got %d", extractor.calls)
+	}
+
+	// A position past the end is about the request, not the source
+	beyondURL := serveOrigin(t, "video/mp4", []byte("short video"))
+	extractor = &stubFrameExtractor{err: errPositionBeyondDuration}
+	app = newStubPreviewApp(t, extractor, failures)
+	for i := 0; i < 2; i++ {
+		if response := requestVideoPreview(t, app, "fp:999/", beyondURL); response.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("request %d: expected 400, got %d", i+1, response.StatusCode)
+		}
+	}
+	if extractor.calls != 2 {
+		t.Errorf("expected every request to reach the extractor, got %d calls", extractor.calls)
+	}
+}
+
+func TestMatchesDeclaredVideo(t *testing.T) {
+	file := bytes.NewReader([]byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00rest of the video"))
+	matches, err := matchesDeclaredVideo(file, "video/mp4")
+	if err != nil || !matches {
+		t.Fatalf("expected an mp4 to match, got %v, %v", matches, err)
+	}
+	// The file is uploaded from the start afterwards
+	if offset, _ := file.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Errorf("expected the file to be rewound, at offset %d", offset)
+	}
+
+	if matches, err := matchesDeclaredVideo(file, "video/webm"); err != nil || matches {
+		t.Errorf("expected an mp4 declared as webm to be rejected, got %v, %v", matches, err)
+	}
+	if matches, err := matchesDeclaredVideo(bytes.NewReader([]byte("MZ")), "video/mp4"); err != nil || matches {
+		t.Errorf("expected a short non-video to be rejected, got %v, %v", matches, err)
+	}
+	if matches, err := matchesDeclaredVideo(bytes.NewReader(nil), "video/mp4"); err != nil || matches {
+		t.Errorf("expected an empty file to be rejected, got %v, %v", matches, err)
+	}
+}
+
+// requestVideoHead performs a HEAD /videos/<base64 url> against the app
+func requestVideoHead(t *testing.T, app *fiber.App, originURL string) (*http.Response, []byte) {
+	t.Helper()
+
+	request := httptest.NewRequest(http.MethodHead, "/videos/"+base64.URLEncoding.EncodeToString([]byte(originURL)), nil)
+	response, err := app.Test(request, -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	return response, body
+}
+
+func TestVideoProxy_HeadFromOrigin(t *testing.T) {
+	video := []byte("0123456789abcdef")
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "video.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	t.Cleanup(server.Close)
+
+	app, _ := newVideoTestApp(t, &config.Config{})
+	response, body := requestVideoHead(t, app, server.URL+"/video.mp4")
+	if response.StatusCode != fiber.StatusOK || len(body) != 0 {
+		t.Fatalf("expected 200 without a body, got %d: %q", response.StatusCode, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "video/mp4" {
+		t.Errorf("expected the origin content type, got %q", contentType)
+	}
+	if contentLength := response.Header.Get("Content-Length"); contentLength != "16" {
+		t.Errorf("expected Content-Length 16, got %q", contentLength)
+	}
+	if acceptRanges := response.Header.Get("Accept-Ranges"); acceptRanges != "bytes" {
+		t.Errorf("expected Accept-Ranges bytes, got %q", acceptRanges)
+	}
+	if !slices.Equal(methods, []string{http.MethodHead}) {
+		t.Errorf("expected the origin to be asked with HEAD only, got %v", methods)
+	}
+}
+
+func TestVideoProxy_HeadFromS3(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		if r.URL.Path != "/bucket/videos/clip.webm" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Content-Type", "video/webm")
+		w.Header().Set("Content-Length", "2048")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	s3cache := &S3Cache{Enabled: true, Client: client, Bucket: "bucket"}
+
+	// The location signature is checked by the validation, the handler is handed the parsed parameters
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	httpClient := newOriginClient(t, &config.Config{})
+	app := fiber.New()
+	app.Get("/videos/*", func(c *fiber.Ctx) error {
+		params := &validation.ImageContext{Url: "https://example.com/clip.webm", CustomObjectKey: c.Params("*")}
+		return processVideoProxy(c, zap.NewNop(), nil, nil, &config.Config{}, counters, params, s3cache, nil, nil, nil, httpClient, nil)
+	})
+
+	response, err := app.Test(httptest.NewRequest(http.MethodHead, "/videos/videos/clip.webm", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != fiber.StatusOK || len(body) != 0 {
+		t.Fatalf("expected 200 without a body, got %d: %q", response.StatusCode, body)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "video/webm" {
+		t.Errorf("expected the object content type, got %q", contentType)
+	}
+	if contentLength := response.Header.Get("Content-Length"); contentLength != "2048" {
+		t.Errorf("expected Content-Length 2048, got %q", contentLength)
+	}
+	if acceptRanges := response.Header.Get("Accept-Ranges"); acceptRanges != "bytes" {
+		t.Errorf("expected Accept-Ranges bytes, got %q", acceptRanges)
+	}
+	if slices.Contains(methods, http.MethodGet) {
+		t.Errorf("expected the object not to be read, got %v", methods)
+	}
+
+	response, err = app.Test(httptest.NewRequest(http.MethodHead, "/videos/videos/missing.webm", nil), -1)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if response.StatusCode != fiber.StatusNotFound {
+		t.Errorf("expected 404 for a missing object, got %d", response.StatusCode)
+	}
+}
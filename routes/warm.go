@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// cacheWarmer processes queued image requests in the background with a fixed number of workers,
+// so warming many images doesn't open more origin connections than that
+type cacheWarmer struct {
+	queue chan *validation.ImageContext
+}
+
+// newCacheWarmer starts the workers, they run for the lifetime of the process
+func newCacheWarmer(workers, queueSize int, warm func(params *validation.ImageContext)) *cacheWarmer {
+	warmer := &cacheWarmer{queue: make(chan *validation.ImageContext, queueSize)}
+	for i := 0; i < max(workers, 1); i++ {
+		go func() {
+			for params := range warmer.queue {
+				warm(params)
+			}
+		}()
+	}
+	return warmer
+}
+
+// enqueue queues an image without blocking and reports false when the queue is full
+func (w *cacheWarmer) enqueue(params *validation.ImageContext) bool {
+	select {
+	case w.queue <- params:
+		return true
+	default:
+		return false
+	}
+}
+
+// warmImage runs an image through the regular request pipeline on a detached context, which stores the result
+// in memory and S3. The response itself is discarded. A refresh fetches the source again even when the result is cached
+func warmImage(logger *zap.Logger, cache *ristretto.Cache[string, CacheValue], config *config.Config, app *fiber.App, counters *metrics.Metrics, performance *metrics.PerformanceMetrics, s3cache *S3Cache, levels *tileLevelCache, scheduler *WorkScheduler, httpClient *http.Client, origins *OriginRateLimiter, failures *probeFailureCache, coalescer *requestCoalescer, refresh bool) func(params *validation.ImageContext) {
+	return func(params *validation.ImageContext) {
+		c := app.AcquireCtx(&fasthttp.RequestCtx{})
+		defer app.ReleaseCtx(c)
+		if refresh {
+			c.Locals(cacheRefreshLocal, true)
+		}
+
+		if err := processImageResponse(c, logger, cache, config, counters, performance, params, s3cache, levels, scheduler, httpClient, origins, failures, nil, coalescer); err != nil {
+			logger.Error("failed to warm image", zap.Error(err), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+			return
+		}
+
+		if status := c.Response().StatusCode(); status != fiber.StatusOK {
+			logger.Warn("image not warmed", zap.Int("status", status), zap.String("url", params.Url), zap.String("s3_location", params.CustomObjectKey))
+			return
+		}
+		logger.Debug("image warmed", zap.String("cache_key", cacheKey(config, params)), zap.String("url", params.Url), zap.Bool("refresh", refresh))
+	}
+}
+
+//#region handleCacheWarmRequest
+
+// handleCacheWarmRequest validates a JSON array of image path parameters, as used by GET /images/*, and queues them.
+// It answers right away with how many were queued, rejected as invalid or dropped because the queue is full
+func handleCacheWarmRequest(logger *zap.Logger, config *config.Config, warmer *cacheWarmer) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		logger := requestLogger(c, logger)
+
+		token := c.Query("token")
+		if token == "" || token != config.Token {
+			logger.Error("invalid or missing token")
+			return c.Status(fiber.StatusForbidden).SendString("invalid token")
+		}
+
+		var paths []string
+		if err := json.Unmarshal(c.Body(), &paths); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("body must be a JSON array of image path parameters")
+		}
+
+		queued, rejected, dropped := 0, 0, 0
+		for _, pathParams := range paths {
+			ok, status, params, err := validation.ProcessImageContextFromPath(logger, pathParams, config)
+			if !ok {
+				logger.Warn("rejected cache warm path", zap.String("pathParams", pathParams), zap.Int("status", status), zap.Error(err))
+				rejected++
+				continue
+			}
+
+			if !warmer.enqueue(params) {
+				dropped++
+				continue
+			}
+			queued++
+		}
+
+		logger.Info("cache warm requested", zap.Int("queued", queued), zap.Int("rejected", rejected), zap.Int("dropped", dropped))
+
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"queued":   queued,
+			"rejected": rejected,
+			"dropped":  dropped,
+		})
+	}
+}
+
+//#endregion
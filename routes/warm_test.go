@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/validation"
+)
+
+func TestCacheWarm_ProcessesQueuedImages(t *testing.T) {
+	cfg := &config.Config{Token: "secret", CacheWarmConcurrency: 2, CacheWarmQueueSize: 10}
+	app, cache, _ := newImageTestAppWithState(t, cfg)
+	originURL, hits := serveCountingOrigin(t, "image/png", encodePNG(t, 8, 8))
+	pathParams := "w:4/" + base64.URLEncoding.EncodeToString([]byte(originURL))
+
+	warm := func(token, body string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, "/cache/warm?token="+token, strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/json")
+		response, err := app.Test(request, -1)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		return response
+	}
+
+	if response := warm("wrong", "[]"); response.StatusCode != fiber.StatusForbidden {
+		t.Fatalf("expected 403 without the token, got %d", response.StatusCode)
+	}
+	if response := warm("secret", `{"path": "q:50"}`); response.StatusCode != fiber.StatusBadRequest {
+		t.Fatalf("expected 400 for a body that isn't an array, got %d", response.StatusCode)
+	}
+
+	response := warm("secret", `["`+pathParams+`", "w:4/not-base64!"]`)
+	var summary map[string]int
+	if err := json.NewDecoder(response.Body).Decode(&summary); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.StatusCode != fiber.StatusAccepted || summary["queued"] != 1 || summary["rejected"] != 1 || summary["dropped"] != 0 {
+		t.Fatalf("expected one queued and one rejected path, got %d %v", response.StatusCode, summary)
+	}
+
+	// The image is processed in the background and lands in the memory cache
+	_, _, params, err := validation.ProcessImageContextFromPath(zap.NewNop(), pathParams, cfg)
+	if err != nil {
+		t.Fatalf("failed to parse path: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.Wait()
+		if _, found := cache.Get(cacheKey(cfg, params)); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the warmed image to be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Requests are served from the cache without going to the origin again
+	requestImage(t, app, "w:4/", originURL)
+	if hits.Load() != 1 {
+		t.Errorf("expected the origin to be fetched once, got %d", hits.Load())
+	}
+}
@@ -0,0 +1,125 @@
+package routes
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+	"media-proxy/validation"
+)
+
+// workClass sorts processing work by cost. Every class gets its own workers, so a backlog of video frames or large
+// images can't hold up the transforms of small images. Cache hits don't go through the scheduler at all
+type workClass string
+
+const (
+	workCheap     workClass = "cheap"     // Transforms of images up to APP_EXPENSIVE_IMAGE_PIXELS
+	workExpensive workClass = "expensive" // Video frames and larger images
+	workDocument  workClass = "document"  // PDF, office and ebook pages, rendering them can take a lot of memory
+)
+
+// errWorkQueueFull is returned when a class already has as many requests waiting as its queue holds
+var errWorkQueueFull = errors.New("work queue is full")
+
+// workQueue runs up to cap(workers) jobs at once, up to size more wait for a worker
+type workQueue struct {
+	workers chan struct{}
+	size    int64
+	waiting atomic.Int64
+	// depth tracks the number of waiting jobs and inFlight the ones holding a worker, nil when metrics are disabled
+	depth    prometheus.Gauge
+	inFlight prometheus.Gauge
+}
+
+// WorkScheduler hands out workers per work class
+type WorkScheduler struct {
+	queues map[workClass]*workQueue
+}
+
+// NewWorkScheduler sizes the classes from APP_CHEAP_WORKERS, APP_EXPENSIVE_WORKERS, APP_DOCUMENT_WORKERS and their
+// queue sizes, performance may be nil when metrics are disabled
+func NewWorkScheduler(config *config.Config, performance *metrics.PerformanceMetrics) *WorkScheduler {
+	newQueue := func(class workClass, workers, size int) *workQueue {
+		queue := &workQueue{workers: make(chan struct{}, max(workers, 1)), size: int64(size)}
+		if performance != nil {
+			queue.depth = performance.WorkQueueDepth.WithLabelValues(string(class))
+			queue.inFlight = performance.WorkInFlight.WithLabelValues(string(class))
+		}
+		return queue
+	}
+
+	return &WorkScheduler{queues: map[workClass]*workQueue{
+		workCheap:     newQueue(workCheap, config.CheapWorkers, config.CheapQueueSize),
+		workExpensive: newQueue(workExpensive, config.ExpensiveWorkers, config.ExpensiveQueueSize),
+		workDocument:  newQueue(workDocument, config.DocumentWorkers, config.DocumentQueueSize),
+	}}
+}
+
+// acquire waits for a worker of the class, the returned function gives it back once the work is done. Fails with
+// errWorkQueueFull instead of waiting when the queue of the class is full. A nil scheduler never waits
+func (s *WorkScheduler) acquire(class workClass) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	queue := s.queues[class]
+
+	// A free worker is taken right away, the queue only holds jobs that have to wait
+	select {
+	case queue.workers <- struct{}{}:
+		return queue.started(), nil
+	default:
+	}
+
+	if queue.waiting.Add(1) > queue.size {
+		queue.waiting.Add(-1)
+		return nil, errWorkQueueFull
+	}
+	if queue.depth != nil {
+		queue.depth.Inc()
+	}
+
+	queue.workers <- struct{}{}
+
+	queue.waiting.Add(-1)
+	if queue.depth != nil {
+		queue.depth.Dec()
+	}
+	return queue.started(), nil
+}
+
+// started counts a job that took a worker and returns the function giving the worker back
+func (q *workQueue) started() func() {
+	if q.inFlight == nil {
+		return func() { <-q.workers }
+	}
+
+	q.inFlight.Inc()
+	return func() {
+		q.inFlight.Dec()
+		<-q.workers
+	}
+}
+
+// acquireImageWorker waits for a worker of the class the image falls in by its pixel count, documents always take a
+// document worker. Images whose dimensions can't be read count as cheap, their decode fails early
+func acquireImageWorker(scheduler *WorkScheduler, config *config.Config, imageData []byte, contentType string) (func(), error) {
+	class := workCheap
+	if validation.IsDocumentMime(contentType) {
+		class = workDocument
+	} else if width, height, err := readImageDimensions(imageData, contentType); err == nil && exceedsPixelLimit(width, height, config.ExpensiveImagePixels) {
+		class = workExpensive
+	}
+	return scheduler.acquire(class)
+}
+
+// sendBusy answers a request whose work queue is full
+func sendBusy(c *fiber.Ctx, logger *zap.Logger, err error) error {
+	logger.Warn("rejecting request, no worker available", zap.Error(err), zap.String("path", c.Path()))
+	c.Set("Retry-After", "1")
+	return c.Status(fiber.StatusServiceUnavailable).SendString("server is busy, try again later")
+}
@@ -0,0 +1,200 @@
+package routes
+
+import (
+	"image"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+
+	"media-proxy/config"
+	"media-proxy/metrics"
+)
+
+// waitForGauge polls a gauge until it reaches the expected value
+func waitForGauge(t *testing.T, gauge prometheus.Gauge, expected float64) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(gauge) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the gauge to reach %v, got %v", expected, testutil.ToFloat64(gauge))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWorkScheduler(t *testing.T) {
+	performance := metrics.InitializePerformanceMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	scheduler := NewWorkScheduler(&config.Config{CheapWorkers: 1, ExpensiveWorkers: 1, CheapQueueSize: 1, ExpensiveQueueSize: 1}, performance)
+	depth := performance.WorkQueueDepth.WithLabelValues(string(workExpensive))
+
+	release, err := scheduler.acquire(workExpensive)
+	if err != nil {
+		t.Fatalf("expected a free worker, got %v", err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		releaseQueued, _ := scheduler.acquire(workExpensive)
+		acquired <- releaseQueued
+	}()
+	waitForGauge(t, depth, 1)
+
+	// The queue holds one waiting job, further ones are turned away
+	if _, err := scheduler.acquire(workExpensive); err != errWorkQueueFull {
+		t.Errorf("expected a full queue, got %v", err)
+	}
+
+	// Cheap work has its own workers
+	releaseCheap, err := scheduler.acquire(workCheap)
+	if err != nil {
+		t.Fatalf("expected cheap work to get a worker while expensive work is queued, got %v", err)
+	}
+	releaseCheap()
+
+	release()
+	select {
+	case releaseQueued := <-acquired:
+		releaseQueued()
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued job to get the released worker")
+	}
+	waitForGauge(t, depth, 0)
+
+	// Without a scheduler nothing waits
+	var disabled *WorkScheduler
+	for range 3 {
+		releaseDisabled, err := disabled.acquire(workExpensive)
+		if err != nil {
+			t.Fatalf("expected no limit without a scheduler, got %v", err)
+		}
+		defer releaseDisabled()
+	}
+}
+
+func TestWorkScheduler_DocumentRenders(t *testing.T) {
+	performance := metrics.InitializePerformanceMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	cfg := &config.Config{CheapWorkers: 1, ExpensiveWorkers: 1, DocumentWorkers: 1, CheapQueueSize: 1, ExpensiveQueueSize: 1, DocumentQueueSize: 1, ExpensiveImagePixels: 1 << 24}
+	scheduler := NewWorkScheduler(cfg, performance)
+	inFlight := performance.WorkInFlight.WithLabelValues(string(workDocument))
+	depth := performance.WorkQueueDepth.WithLabelValues(string(workDocument))
+
+	pdf := []byte("%PDF-1.4")
+	release, err := acquireImageWorker(scheduler, cfg, pdf, "application/pdf")
+	if err != nil {
+		t.Fatalf("expected a free document worker, got %v", err)
+	}
+	if rendering := testutil.ToFloat64(inFlight); rendering != 1 {
+		t.Errorf("expected one document render in flight, got %v", rendering)
+	}
+
+	// The second render waits for the worker, the third is turned away
+	acquired := make(chan func())
+	go func() {
+		releaseQueued, _ := acquireImageWorker(scheduler, cfg, pdf, "application/pdf")
+		acquired <- releaseQueued
+	}()
+	waitForGauge(t, depth, 1)
+	select {
+	case <-acquired:
+		t.Fatal("expected the second render to wait while the worker is busy")
+	default:
+	}
+	if _, err := acquireImageWorker(scheduler, cfg, pdf, "application/pdf"); err != errWorkQueueFull {
+		t.Errorf("expected a full document queue, got %v", err)
+	}
+
+	// Images don't share the document workers
+	releaseImage, err := acquireImageWorker(scheduler, cfg, encodePNG(t, 8, 8), "image/png")
+	if err != nil {
+		t.Fatalf("expected images to get a worker while documents are queued, got %v", err)
+	}
+	releaseImage()
+
+	release()
+	select {
+	case releaseQueued := <-acquired:
+		releaseQueued()
+	case <-time.After(time.Second):
+		t.Fatal("expected the queued render to get the released worker")
+	}
+	if rendering := testutil.ToFloat64(inFlight); rendering != 0 {
+		t.Errorf("expected no document renders in flight, got %v", rendering)
+	}
+}
+
+// blockingFrameExtractor holds every extraction until unblock is closed
+type blockingFrameExtractor struct {
+	unblock chan struct{}
+}
+
+func (b blockingFrameExtractor) ExtractFrame(urlStr string, position string, options frameExtractionOptions) (*extractedFrame, error) {
+	<-b.unblock
+	return &extractedFrame{Image: image.NewRGBA(image.Rect(0, 0, 16, 9))}, nil
+}
+
+func (b blockingFrameExtractor) ProbeVideo(urlStr string, options frameExtractionOptions) (*probedVideo, error) {
+	<-b.unblock
+	return &probedVideo{Width: 16, Height: 9}, nil
+}
+
+func (b blockingFrameExtractor) ExtractFrames(urlStr string, sequence frameSequence, options frameExtractionOptions, each func(image.Image) error) (*probedVideo, error) {
+	<-b.unblock
+	return &probedVideo{Width: 16, Height: 9}, each(image.NewRGBA(image.Rect(0, 0, 16, 9)))
+}
+
+func TestWorkScheduler_CheapRequestsWhileExpensiveSaturated(t *testing.T) {
+	cache, err := ristretto.NewCache(&ristretto.Config[string, CacheValue]{
+		NumCounters: 1e4,
+		MaxCost:     1 << 24,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(cache.Close)
+
+	cfg := &config.Config{EncoderThreads: 1, CheapWorkers: 1, ExpensiveWorkers: 1, CheapQueueSize: 1, ExpensiveQueueSize: 1, ExpensiveImagePixels: 1 << 24}
+	performance := metrics.InitializePerformanceMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	counters := metrics.InitializeMetrics(prometheus.NewRegistry(), prometheus.Labels{})
+	scheduler := NewWorkScheduler(cfg, performance)
+
+	extractor := blockingFrameExtractor{unblock: make(chan struct{})}
+	app := fiber.New()
+	RegisterImageRoutes(zap.NewNop(), cache, cfg, app, counters, performance, nil, scheduler, newOriginClient(t, cfg), nil)
+	app.Get("/videos/preview/*", handleVideoPreviewRequest(zap.NewNop(), cache, cfg, counters, performance, nil, newInputLimiter(0, nil), extractor, nil, scheduler, newOriginClient(t, cfg), nil, nil))
+
+	videoURL := serveOrigin(t, "video/mp4", []byte("not decoded by the stub"))
+	imageURL := serveOrigin(t, "image/png", encodePNG(t, 64, 64))
+
+	// One preview runs and one waits, which saturates the expensive class
+	statuses := make(chan int, 2)
+	for _, position := range []string{"fp:1/", "fp:2/"} {
+		go func() {
+			statuses <- requestVideoPreview(t, app, position, videoURL).StatusCode
+		}()
+	}
+	waitForGauge(t, performance.WorkQueueDepth.WithLabelValues(string(workExpensive)), 1)
+
+	if response := requestVideoPreview(t, app, "fp:3/", videoURL); response.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 once the expensive queue is full, got %d", response.StatusCode)
+	}
+
+	// Image transforms don't wait behind the previews
+	if response := requestImage(t, app, "w:16/webp/", imageURL); response.StatusCode != http.StatusOK {
+		t.Errorf("expected the image to be served while previews are queued, got %d", response.StatusCode)
+	}
+
+	close(extractor.unblock)
+	for range 2 {
+		if status := <-statuses; status != http.StatusOK {
+			t.Errorf("expected the queued previews to be served, got %d", status)
+		}
+	}
+}
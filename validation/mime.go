@@ -1,6 +1,12 @@
 package validation
 
-import "media-proxy/client"
+import (
+	"bytes"
+	"net/http"
+	"slices"
+)
+
+// The lists below are the single source of the accepted mime types, other packages go through the functions in this file
 
 var imageMimeTypes = []string{
 	"image/jpeg",
@@ -10,6 +16,12 @@ var imageMimeTypes = []string{
 	"image/bmp",
 	"image/tiff",
 	"image/avif",
+	"image/heic",
+	"image/heif",
+}
+
+// documentMimeTypes are rendered to an image from their first page, they are accepted wherever images are
+var documentMimeTypes = []string{
 	"application/pdf",
 	"application/epub+zip",
 	"application/x-mobipocket-ebook",
@@ -27,41 +39,107 @@ var videoMimeTypes = []string{
 	"video/x-matroska",
 	"video/x-flv",
 	"video/x-m4v",
-	"video/x-m4v",
 }
 
+// audioMimeTypes are decoded for waveforms, audio isn't proxied
+var audioMimeTypes = []string{
+	"audio/mpeg",
+	"audio/mp4",
+	"audio/x-m4a",
+	"audio/aac",
+	"audio/ogg",
+	"audio/opus",
+	"audio/webm",
+	"audio/wav",
+	"audio/x-wav",
+	"audio/wave",
+	"audio/flac",
+	"audio/x-flac",
+}
+
+// ImageMimeTypes returns the accepted image mime types, documents not included
+func ImageMimeTypes() []string {
+	return slices.Clone(imageMimeTypes)
+}
+
+// VideoMimeTypes returns the accepted video mime types
+func VideoMimeTypes() []string {
+	return slices.Clone(videoMimeTypes)
+}
+
+// AudioMimeTypes returns the accepted audio mime types
+func AudioMimeTypes() []string {
+	return slices.Clone(audioMimeTypes)
+}
+
+// IsImageMime reports whether the mime type is accepted by the image routes, documents included
 func IsImageMime(mimeType string) bool {
-	for _, imageMimeType := range imageMimeTypes {
-		if mimeType == imageMimeType {
-			return true
-		}
-	}
+	return slices.Contains(imageMimeTypes, mimeType) || IsDocumentMime(mimeType)
+}
 
-	return false
+// IsDocumentMime reports whether the mime type is a document rendered from its first page
+func IsDocumentMime(mimeType string) bool {
+	return slices.Contains(documentMimeTypes, mimeType)
+}
+
+// IsHeicMime reports whether the mime type is a HEIC/HEIF container, which needs native decoding support
+func IsHeicMime(mimeType string) bool {
+	return mimeType == "image/heic" || mimeType == "image/heif"
 }
 
 func IsVideoMime(mimeType string) bool {
-	for _, videoMimeType := range videoMimeTypes {
-		if mimeType == videoMimeType {
-			return true
-		}
-	}
+	return slices.Contains(videoMimeTypes, mimeType)
+}
 
+// IsAudioMime reports whether the mime type is accepted by the audio routes
+func IsAudioMime(mimeType string) bool {
+	return slices.Contains(audioMimeTypes, mimeType)
+}
+
+// VideoSniffLength is how many leading bytes of a file MatchesVideoContent needs to recognize its container
+const VideoSniffLength = 12
+
+// MatchesVideoContent reports whether the leading bytes of a file are the container the video mime type is stored in.
+// MP4, QuickTime and M4V share the ISO base media format, they are only told apart by the declared type
+func MatchesVideoContent(mimeType string, header []byte) bool {
+	switch mimeType {
+	case "video/mp4", "video/quicktime", "video/x-m4v":
+		return len(header) >= 8 && slices.Contains(isoBaseMediaBoxes, string(header[4:8]))
+	case "video/webm", "video/x-matroska":
+		return bytes.HasPrefix(header, []byte{0x1a, 0x45, 0xdf, 0xa3})
+	case "video/ogg":
+		return bytes.HasPrefix(header, []byte("OggS"))
+	case "video/x-msvideo":
+		return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "AVI "
+	case "video/x-flv":
+		return bytes.HasPrefix(header, []byte("FLV\x01"))
+	}
 	return false
 }
 
-func GetContentType(url string) (string, error) {
+// isoBaseMediaBoxes are the box types an MP4 or QuickTime file can start with, older QuickTime files have no ftyp box
+var isoBaseMediaBoxes = []string{"ftyp", "moov", "mdat", "free", "skip", "wide", "pnot"}
+
+func GetContentType(httpClient *http.Client, url string) (string, error) {
+	contentType, _, err := ProbeContent(httpClient, url)
+	return contentType, err
+}
+
+// ProbeContent returns the content type and length the origin reports for a URL, the length is -1 when unknown
+func ProbeContent(httpClient *http.Client, url string) (string, int64, error) {
 	// First try HEAD request
-	headResp, err := client.GetHTTPClient().Head(url)
+	headResp, err := httpClient.Head(url)
 	if err == nil {
-		return headResp.Header.Get("Content-Type"), nil
+		_ = headResp.Body.Close()
+		return headResp.Header.Get("Content-Type"), headResp.ContentLength, nil
 	}
 
 	// If HEAD fails, try GET request
-	getResp, err := client.GetHTTPClient().Get(url)
+	getResp, err := httpClient.Get(url)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
+	_ = getResp.Body.Close()
 
-	return getResp.Header.Get("Content-Type"), nil
+	return getResp.Header.Get("Content-Type"), getResp.ContentLength, nil
 }
@@ -0,0 +1,77 @@
+package validation
+
+import "testing"
+
+func TestIsHeicMime(t *testing.T) {
+	for mimeType, expected := range map[string]bool{
+		"image/heic": true,
+		"image/heif": true,
+		"image/jpeg": false,
+		"":           false,
+	} {
+		if got := IsHeicMime(mimeType); got != expected {
+			t.Errorf("IsHeicMime(%q) = %v, expected %v", mimeType, got, expected)
+		}
+	}
+
+	if !IsImageMime("image/heic") || !IsImageMime("image/heif") {
+		t.Error("expected heic/heif to be accepted image mime types")
+	}
+}
+
+func TestMimeAllowlists(t *testing.T) {
+	seen := map[string]bool{}
+	for _, list := range [][]string{imageMimeTypes, documentMimeTypes, videoMimeTypes, audioMimeTypes} {
+		for _, mimeType := range list {
+			if seen[mimeType] {
+				t.Errorf("mime type %q is listed more than once", mimeType)
+			}
+			seen[mimeType] = true
+		}
+	}
+
+	if !IsImageMime("application/pdf") || !IsDocumentMime("application/pdf") {
+		t.Error("expected documents to be accepted as images")
+	}
+	if IsDocumentMime("image/png") || IsImageMime("video/mp4") || IsVideoMime("image/png") || IsVideoMime("audio/mp4") || IsAudioMime("video/mp4") {
+		t.Error("expected the allowlists not to overlap")
+	}
+	if !IsImageMime("image/avif") || !IsVideoMime("video/x-m4v") {
+		t.Error("expected avif images and m4v videos to be accepted")
+	}
+	if !IsAudioMime("audio/mpeg") || !IsAudioMime("audio/flac") {
+		t.Error("expected mp3 and flac audio to be accepted")
+	}
+}
+
+func TestMatchesVideoContent(t *testing.T) {
+	mp4 := []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00")
+	for _, tc := range []struct {
+		mimeType string
+		header   []byte
+		expected bool
+	}{
+		{"video/mp4", mp4, true},
+		{"video/quicktime", mp4, true},
+		{"video/quicktime", []byte("\x00\x00\x00\x08wide\x00\x00\x00\x00"), true},
+		{"video/webm", []byte{0x1a, 0x45, 0xdf, 0xa3, 0x01, 0x00}, true},
+		{"video/x-matroska", []byte{0x1a, 0x45, 0xdf, 0xa3, 0x01, 0x00}, true},
+		{"video/ogg", []byte("OggS\x00\x02"), true},
+		{"video/x-msvideo", []byte("RIFF\x00\x10\x00\x00AVI LIST"), true},
+		{"video/x-flv", []byte("FLV\x01\x05"), true},
+		// Declared types have to match the container
+		{"video/webm", mp4, false},
+		{"video/mp4", []byte{0x1a, 0x45, 0xdf, 0xa3, 0x01, 0x00}, false},
+		{"video/x-msvideo", []byte("RIFF\x00\x10\x00\x00WAVEfmt "), false},
+		{"video/mp4", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), false},
+		{"video/mp4", []byte("<html><body>"), false},
+		// Files too short to hold a signature are rejected
+		{"video/mp4", []byte("\x00\x00"), false},
+		{"video/mp4", nil, false},
+		{"image/png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d"), false},
+	} {
+		if got := MatchesVideoContent(tc.mimeType, tc.header); got != tc.expected {
+			t.Errorf("MatchesVideoContent(%q, %q) = %v, expected %v", tc.mimeType, tc.header, got, tc.expected)
+		}
+	}
+}
@@ -85,3 +85,127 @@ func TestParsePathParams_WithLocationAndURL(t *testing.T) {
 		t.Errorf("Expected encoded URL 'aHR0cHM6Ly9leGFtcGxl', got '%s'", params.EncodedURL)
 	}
 }
+
+func TestParsePathParams_WithTile(t *testing.T) {
+	// Test case: tile coordinates span three path segments
+	pathParams := "q:80/tile:3/4/5/aHR0cHM6Ly9leGFtcGxlLmNvbS9tYXAudGlm"
+
+	params, err := ParsePathParams(pathParams)
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+
+	if params.Tile != "3/4/5" {
+		t.Errorf("Expected tile '3/4/5', got '%s'", params.Tile)
+	}
+	if params.Quality != 80 {
+		t.Errorf("Expected quality 80, got %d", params.Quality)
+	}
+	if params.EncodedURL != "aHR0cHM6Ly9leGFtcGxlLmNvbS9tYXAudGlm" {
+		t.Errorf("Expected encoded URL 'aHR0cHM6Ly9leGFtcGxlLmNvbS9tYXAudGlm', got '%s'", params.EncodedURL)
+	}
+
+	z, x, y, err := parseTile(params.Tile)
+	if err != nil || z != 3 || x != 4 || y != 5 {
+		t.Errorf("Expected tile 3/4/5, got %d/%d/%d (err=%v)", z, x, y, err)
+	}
+}
+
+func TestParsePathParams_WithMaxAge(t *testing.T) {
+	params, err := ParsePathParams("maxage:0/w:100/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if !params.MaxAgeSet || params.MaxAge != 0 {
+		t.Errorf("Expected max age 0 to be set, got %d (set=%v)", params.MaxAge, params.MaxAgeSet)
+	}
+
+	// Negative and malformed values are ignored like other parameters
+	for _, pathParams := range []string{"maxage:-5/aHR0cHM6Ly9leGFtcGxl", "maxage:soon/aHR0cHM6Ly9leGFtcGxl", "w:100/aHR0cHM6Ly9leGFtcGxl"} {
+		params, err := ParsePathParams(pathParams)
+		if err != nil {
+			t.Fatalf("ParsePathParams failed: %v", err)
+		}
+		if params.MaxAgeSet {
+			t.Errorf("Expected no max age for %s, got %d", pathParams, params.MaxAge)
+		}
+	}
+}
+
+func TestParsePathParams_WithFrameCount(t *testing.T) {
+	params, err := ParsePathParams("n:12/w:160/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if params.FrameCount != 12 {
+		t.Errorf("Expected 12 frames, got %d", params.FrameCount)
+	}
+
+	for _, pathParams := range []string{"n:0/aHR0cHM6Ly9leGFtcGxl", "n:many/aHR0cHM6Ly9leGFtcGxl"} {
+		params, err := ParsePathParams(pathParams)
+		if err != nil {
+			t.Fatalf("ParsePathParams failed: %v", err)
+		}
+		if params.FrameCount != 0 {
+			t.Errorf("Expected no frame count for %s, got %d", pathParams, params.FrameCount)
+		}
+	}
+}
+
+func TestParsePathParams_WithClip(t *testing.T) {
+	params, err := ParsePathParams("fp:12.5/dur:2.5/fps:12/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if params.FramePosition != "12.5" || params.ClipDuration != 2.5 || params.ClipFPS != 12 {
+		t.Errorf("Expected a 2.5s clip at 12fps from 12.5s, got %vs at %vfps from %s", params.ClipDuration, params.ClipFPS, params.FramePosition)
+	}
+
+	params, err = ParsePathParams("dur:-1/fps:0/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if params.ClipDuration != 0 || params.ClipFPS != 0 {
+		t.Errorf("Expected invalid clip parameters to be ignored, got %vs at %vfps", params.ClipDuration, params.ClipFPS)
+	}
+}
+
+func TestParsePathParams_WithColor(t *testing.T) {
+	params, err := ParsePathParams("c:FF8800/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if params.Color != "ff8800" {
+		t.Errorf("Expected color ff8800, got %q", params.Color)
+	}
+
+	for _, pathParams := range []string{"color:ff88/aHR0cHM6Ly9leGFtcGxl", "color:gg8800/aHR0cHM6Ly9leGFtcGxl", "color:#ff8800/aHR0cHM6Ly9leGFtcGxl"} {
+		params, err := ParsePathParams(pathParams)
+		if err != nil {
+			t.Fatalf("ParsePathParams failed: %v", err)
+		}
+		if params.Color != "" {
+			t.Errorf("Expected no color for %s, got %q", pathParams, params.Color)
+		}
+	}
+}
+
+func TestParsePathParams_WithWebpMethod(t *testing.T) {
+	params, err := ParsePathParams("m:0/webp/aHR0cHM6Ly9leGFtcGxl")
+	if err != nil {
+		t.Fatalf("ParsePathParams failed: %v", err)
+	}
+	if !params.WebpMethodSet || params.WebpMethod != 0 {
+		t.Errorf("Expected method 0 to be set, got %d (set: %v)", params.WebpMethod, params.WebpMethodSet)
+	}
+
+	for _, pathParams := range []string{"method:7/aHR0cHM6Ly9leGFtcGxl", "method:-1/aHR0cHM6Ly9leGFtcGxl", "aHR0cHM6Ly9leGFtcGxl"} {
+		params, err := ParsePathParams(pathParams)
+		if err != nil {
+			t.Fatalf("ParsePathParams failed: %v", err)
+		}
+		if params.WebpMethodSet {
+			t.Errorf("Expected no method for %s, got %d", pathParams, params.WebpMethod)
+		}
+	}
+}
@@ -3,9 +3,11 @@ package validation
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"strconv"
 	"strings"
 	"time"
@@ -28,20 +30,62 @@ type ImageContext struct {
 
 	Scale         float64
 	Interpolation resize.InterpolationFunction
+	// The request omitted the interpolation, the configured default of the source format applies once it is known
+	InterpolationByFormat bool
 
 	Webp bool
+	// WebP encoder effort from 0 to 6, only when WebpMethodSet; APP_WEBP_METHOD applies otherwise
+	WebpMethod    int
+	WebpMethodSet bool
 
 	// Video-specific parameters
 	FramePosition string // "first", "half", "last", or time in seconds
+	// Number of frames of a sprite sheet, 0 when the path has none
+	FrameCount int
+	// Length in seconds and frame rate of an animated preview starting at FramePosition, 0 when the path has none
+	ClipDuration float64
+	ClipFPS      float64
+
+	// Color of an audio waveform as RRGGBB or RRGGBBAA hex digits in lower case, empty when the path has none
+	Color string
+
+	// Optional deep-zoom tile coordinates (only honored when tiling is enabled)
+	Tiled bool
+	TileZ int
+	TileX int
+	TileY int
 
 	Hostname string
 
 	// Optional explicit S3 object key provided by request (requires signature)
 	CustomObjectKey string
+
+	// Optional max-age in seconds for the Cache-Control of the result, clamped to APP_HTTP_CACHE_MAX_TTL_SECONDS.
+	// Only sent to the client, results are cached the same either way
+	MaxAge    int
+	MaxAgeSet bool
+
+	// Strong ETag of the source at the origin, part of the cache key under APP_CONTENT_ADDRESSED_CACHE. Set by the
+	// routes rather than the request
+	SourceETag string
+}
+
+// Output formats of processed results
+const (
+	OutputFormatOriginal = "original" // Keeps the format of the source
+	OutputFormatWebp     = "webp"
+)
+
+// OutputFormat names the format the result is encoded in, results of different formats must never share a cache entry
+func (c *ImageContext) OutputFormat() string {
+	if c.Webp {
+		return OutputFormatWebp
+	}
+	return OutputFormatOriginal
 }
 
 func (c *ImageContext) String() string {
-	return fmt.Sprintf("quality=%d;width=%d;height=%d;scale=%f;interpolation=%d;webp=%t;framePosition=%s", c.Quality, c.Width, c.Height, c.Scale, c.Interpolation, c.Webp, c.FramePosition)
+	return fmt.Sprintf("quality=%d;width=%d;height=%d;scale=%f;interpolation=%d;format=%s;framePosition=%s", c.Quality, c.Width, c.Height, c.Scale, c.Interpolation, c.OutputFormat(), c.FramePosition)
 }
 
 // PathParams holds the parsed parameters from the URL path
@@ -51,12 +95,25 @@ type PathParams struct {
 	Height        int
 	Scale         float64
 	Interpolation resize.InterpolationFunction
-	Webp          bool
-	FramePosition string
-	Signature     string
-	Token         string
-	EncodedURL    string
-	Location      string
+	// InterpolationSet reports whether the path picked an interpolation or the default applies
+	InterpolationSet bool
+	Webp             bool
+	WebpMethod       int
+	WebpMethodSet    bool
+	FramePosition    string
+	FrameCount       int
+	ClipDuration     float64
+	ClipFPS          float64
+	Color            string
+	Signature        string
+	Token            string
+	EncodedURL       string
+	Location         string
+	Tile             string // raw "z/x/y" tile coordinates
+	Origins          string // signed, comma-separated origins claim scoping this request
+	Expires          string // signed unix timestamp after which the request is rejected
+	MaxAge           int    // max-age of the response in seconds, see MaxAgeSet
+	MaxAgeSet        bool
 }
 
 // ParsePathParams extracts parameters from the URL path
@@ -78,6 +135,8 @@ func ParsePathParams(pathParams string) (*PathParams, error) {
 		return nil, fmt.Errorf("no path parameters found")
 	}
 
+	parts = joinTileParts(parts)
+
 	// The last part might be the encoded URL if it doesn't look like a parameter
 	// A parameter either contains ":" or is exactly "webp"
 	var processParts []string
@@ -130,21 +189,96 @@ func ParsePathParams(pathParams string) (*PathParams, error) {
 		case "i", "interpolation":
 			if i, err := strconv.Atoi(value); err == nil && i >= 0 && i <= 5 {
 				params.Interpolation = resize.InterpolationFunction(i)
+				params.InterpolationSet = true
+			}
+		case "m", "method":
+			if m, err := strconv.Atoi(value); err == nil && m >= 0 && m <= 6 {
+				params.WebpMethod = m
+				params.WebpMethodSet = true
 			}
 		case "sig", "signature":
 			params.Signature = value
 		case "fp", "framePosition":
 			params.FramePosition = value
+		case "n", "frames":
+			if n, err := strconv.Atoi(value); err == nil && n > 0 {
+				params.FrameCount = n
+			}
+		case "dur", "duration":
+			if d, err := strconv.ParseFloat(value, 64); err == nil && d > 0 {
+				params.ClipDuration = d
+			}
+		case "fps":
+			if f, err := strconv.ParseFloat(value, 64); err == nil && f > 0 {
+				params.ClipFPS = f
+			}
+		case "c", "color":
+			if isHexColor(value) {
+				params.Color = strings.ToLower(value)
+			}
 		case "t", "token":
 			params.Token = value
 		case "loc", "location":
 			params.Location = value
+		case "tile":
+			params.Tile = value
+		case "org", "origins":
+			params.Origins = value
+		case "exp", "expires":
+			params.Expires = value
+		case "maxage", "maxAge":
+			if m, err := strconv.Atoi(value); err == nil && m >= 0 {
+				params.MaxAge = m
+				params.MaxAgeSet = true
+			}
 		}
 	}
 
 	return params, nil
 }
 
+// isHexColor reports whether the value is a color in RRGGBB or RRGGBBAA hex digits
+func isHexColor(value string) bool {
+	if len(value) != 6 && len(value) != 8 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// joinTileParts merges a "tile:z/x/y" parameter, which spans three path segments, back into a single part
+func joinTileParts(parts []string) []string {
+	joined := make([]string, 0, len(parts))
+	for i := 0; i < len(parts); i++ {
+		if strings.HasPrefix(parts[i], "tile:") && i+2 < len(parts) {
+			joined = append(joined, parts[i]+"/"+parts[i+1]+"/"+parts[i+2])
+			i += 2
+			continue
+		}
+		joined = append(joined, parts[i])
+	}
+	return joined
+}
+
+// parseTile parses "z/x/y" tile coordinates
+func parseTile(tile string) (z, x, y int, err error) {
+	coordinates := strings.Split(tile, "/")
+	if len(coordinates) != 3 {
+		return 0, 0, 0, fmt.Errorf("tile must be in z/x/y format")
+	}
+
+	values := make([]int, 3)
+	for i, coordinate := range coordinates {
+		value, err := strconv.Atoi(coordinate)
+		if err != nil || value < 0 {
+			return 0, 0, 0, fmt.Errorf("tile coordinates must be non-negative integers")
+		}
+		values[i] = value
+	}
+
+	return values[0], values[1], values[2], nil
+}
+
 // DecodeURL decodes a base64-encoded URL
 func DecodeURL(encodedURL string) (string, error) {
 	decoded, err := base64.URLEncoding.DecodeString(encodedURL)
@@ -163,10 +297,48 @@ func DecodeBase64URL(encoded string) (string, error) {
 	return string(decoded), nil
 }
 
-func compareHmac(url, providedSignature, secret string) bool {
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(url))
-	expectedMAC := mac.Sum(nil)
+// DefaultHmacAlgorithm signs URLs unless APP_HMAC_ALGORITHM picks another one
+const DefaultHmacAlgorithm = "sha256"
+
+// hmacAlgorithms are the hashes signatures can be made with. A signature prefixed with a name, e.g. sha512:<hex>,
+// uses that hash, so URLs signed before a switch of APP_HMAC_ALGORITHM keep working
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// IsHmacAlgorithm reports whether signatures can be made with the named hash
+func IsHmacAlgorithm(name string) bool {
+	_, ok := hmacAlgorithms[name]
+	return ok
+}
+
+// hmacKeys returns the keys signatures are checked against: APP_HMAC_KEY, the one new signatures are made with, and
+// the APP_HMAC_KEYS still accepted during a rotation
+func hmacKeys(config *config.Config) []string {
+	if config.HmacKey == "" {
+		return config.HmacKeys
+	}
+	return append([]string{config.HmacKey}, config.HmacKeys...)
+}
+
+func compareHmac(url, providedSignature string, secrets []string, algorithm string) bool {
+	return compareHmacForMessage(url, providedSignature, secrets, algorithm)
+}
+
+// compareHmacForMessage validates HMAC for an arbitrary message, a signature made with any of the secrets matches.
+// algorithm applies to signatures without an algorithm prefix, empty means DefaultHmacAlgorithm
+func compareHmacForMessage(message, providedSignature string, secrets []string, algorithm string) bool {
+	if name, digest, found := strings.Cut(providedSignature, ":"); found {
+		algorithm, providedSignature = name, digest
+	}
+	if algorithm == "" {
+		algorithm = DefaultHmacAlgorithm
+	}
+	newHash, ok := hmacAlgorithms[algorithm]
+	if !ok {
+		return false
+	}
 
 	// Decode provided signature (hex to bytes)
 	providedMAC, err := hex.DecodeString(providedSignature)
@@ -174,20 +346,53 @@ func compareHmac(url, providedSignature, secret string) bool {
 		return false
 	}
 
-	// Use constant-time comparison
-	return hmac.Equal(expectedMAC, providedMAC)
+	// Every key is compared in constant time, which key matched doesn't change the time taken
+	matched := false
+	for _, secret := range secrets {
+		mac := hmac.New(newHash, []byte(secret))
+		mac.Write([]byte(message))
+		if hmac.Equal(mac.Sum(nil), providedMAC) {
+			matched = true
+		}
+	}
+	return matched
 }
 
-// compareHmacForMessage validates HMAC for an arbitrary message
-func compareHmacForMessage(message, providedSignature, secret string) bool {
-	mac := hmac.New(sha256.New, []byte(secret))
-	mac.Write([]byte(message))
-	expectedMAC := mac.Sum(nil)
-	providedMAC, err := hex.DecodeString(providedSignature)
-	if err != nil {
+// withExpiry appends the expiry of a request to its signed message, before any origins claim
+func withExpiry(message, expires string) string {
+	if expires == "" {
+		return message
+	}
+	return message + "|" + expires
+}
+
+// withOriginsClaim appends an origins claim to a signed message, so a claim can't be added to or changed on a signed URL
+func withOriginsClaim(message, origins string) string {
+	if origins == "" {
+		return message
+	}
+	return message + "|origins=" + origins
+}
+
+// validateOriginsClaim checks the URL against the origins scoped by a signed claim, on top of the global allowed origins.
+// The claim can only narrow what the global list allows, the URL has to match both.
+func validateOriginsClaim(logger *zap.Logger, url, origins string, config *config.Config) bool {
+	if origins == "" {
+		return true
+	}
+
+	var claimed []string
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			claimed = append(claimed, origin)
+		}
+	}
+	if len(claimed) == 0 {
 		return false
 	}
-	return hmac.Equal(expectedMAC, providedMAC)
+
+	valid, _ := pool.ValidateUrl(logger, url, claimed, config.AllowedSchemes)
+	return valid
 }
 
 // sanitizeLocation ensures S3 object key is in an acceptable format
@@ -211,6 +416,24 @@ func sanitizeLocation(loc string) (string, error) {
 	return loc, nil
 }
 
+// resolveScale applies APP_SCALE_WITH_DIMENSIONS to a scale requested along with a width or height: "compose" keeps
+// it to scale the resized image, "dimensions" drops it so the requested dimensions are met, "reject" (the default)
+// refuses it
+func resolveScale(config *config.Config, width, height int, scale float64) (float64, error) {
+	if scale <= 0 || (width <= 0 && height <= 0) {
+		return scale, nil
+	}
+
+	switch config.ScaleWithDimensions {
+	case "compose":
+		return scale, nil
+	case "dimensions":
+		return 0, nil
+	default:
+		return 0, fmt.Errorf("scale can't be combined with width or height, request one or the other")
+	}
+}
+
 // ProcessImageUploadFromPath processes image upload parameters from path
 // Validation: Either validate token OR if location and signature provided, validate signature
 func ProcessImageUploadFromPath(logger *zap.Logger, pathParams string, config *config.Config) (bool, int, *ImageContext, error) {
@@ -223,7 +446,7 @@ func ProcessImageUploadFromPath(logger *zap.Logger, pathParams string, config *c
 	var customObjectKey string
 	if params.Location != "" && params.Signature != "" {
 		// Signature validation mode for S3 upload
-		if config.HmacKey == "" {
+		if len(hmacKeys(config)) == 0 {
 			return false, fiber.StatusInternalServerError, nil, fmt.Errorf("hmac key not configured")
 		}
 
@@ -240,7 +463,7 @@ func ProcessImageUploadFromPath(logger *zap.Logger, pathParams string, config *c
 		}
 
 		// Validate signature: HMAC(location)
-		if !compareHmacForMessage(sanitized, params.Signature, config.HmacKey) {
+		if !compareHmacForMessage(sanitized, params.Signature, hmacKeys(config), config.HmacAlgorithm) {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("invalid signature")
 		}
 
@@ -264,6 +487,11 @@ func ProcessImageUploadFromPath(logger *zap.Logger, pathParams string, config *c
 		return false, fiber.StatusBadRequest, nil, fmt.Errorf("scale must be between 0 and 1")
 	}
 
+	params.Scale, err = resolveScale(config, params.Width, params.Height, params.Scale)
+	if err != nil {
+		return false, fiber.StatusBadRequest, nil, err
+	}
+
 	// Apply default webp setting if not specified
 	if !params.Webp && config.Webp {
 		params.Webp = config.Webp
@@ -308,6 +536,11 @@ func ProcessImageUpload(logger *zap.Logger, c *fiber.Ctx, config *config.Config)
 		return false, fiber.StatusBadRequest, fmt.Errorf("scale must be between 0 and 1"), nil
 	}
 
+	scale, err = resolveScale(config, width, height, scale)
+	if err != nil {
+		return false, fiber.StatusBadRequest, err, nil
+	}
+
 	webp := c.QueryBool("webp", config.Webp)
 
 	return true, fiber.StatusOK, nil, &ImageContext{
@@ -327,6 +560,23 @@ func ProcessImageContextFromPath(logger *zap.Logger, pathParams string, config *
 		return false, fiber.StatusBadRequest, nil, fmt.Errorf("invalid path parameters: %w", err)
 	}
 
+	// An origins claim is only trusted when it is covered by the signature
+	if params.Origins != "" && params.Signature == "" {
+		return false, fiber.StatusForbidden, nil, fmt.Errorf("signature required for origins claim")
+	}
+
+	// So is an expiry, without a signature it could just be dropped
+	var expires int64
+	if params.Expires != "" {
+		if params.Signature == "" {
+			return false, fiber.StatusForbidden, nil, fmt.Errorf("signature required for expiry")
+		}
+		expires, err = strconv.ParseInt(params.Expires, 10, 64)
+		if err != nil {
+			return false, fiber.StatusBadRequest, nil, fmt.Errorf("invalid expiry")
+		}
+	}
+
 	// URL is optional if location is provided
 	urlParam := ""
 	if params.EncodedURL != "" {
@@ -339,7 +589,7 @@ func ProcessImageContextFromPath(logger *zap.Logger, pathParams string, config *
 	// If custom location is requested, require signature and validate location
 	customObjectKey := ""
 	if params.Location != "" {
-		if config.HmacKey == "" || params.Signature == "" {
+		if len(hmacKeys(config)) == 0 || params.Signature == "" {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("signature required for custom location")
 		}
 		// Expect location to be base64 URL-safe encoded
@@ -362,18 +612,18 @@ func ProcessImageContextFromPath(logger *zap.Logger, pathParams string, config *
 			signedMsg = sanitized
 		}
 
-		if !compareHmacForMessage(signedMsg, params.Signature, config.HmacKey) {
+		if !compareHmacForMessage(withOriginsClaim(withExpiry(signedMsg, params.Expires), params.Origins), params.Signature, hmacKeys(config), config.HmacAlgorithm) {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("invalid signature for location")
 		}
 		customObjectKey = sanitized
 	} else if params.Signature != "" { // normal signature over URL only
-		if config.HmacKey == "" {
+		if len(hmacKeys(config)) == 0 {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("hmac key is not set")
 		}
 		if urlParam == "" {
 			return false, fiber.StatusBadRequest, nil, fmt.Errorf("url is required when signature is provided without location")
 		}
-		if !compareHmac(urlParam, params.Signature, config.HmacKey) {
+		if !compareHmac(withOriginsClaim(withExpiry(urlParam, params.Expires), params.Origins), params.Signature, hmacKeys(config), config.HmacAlgorithm) {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("invalid signature")
 		}
 	} else {
@@ -383,11 +633,16 @@ func ProcessImageContextFromPath(logger *zap.Logger, pathParams string, config *
 		}
 	}
 
+	// Checked once the signature holds, so the expiry is known to be the signed one
+	if params.Expires != "" && time.Now().Unix() > expires {
+		return false, fiber.StatusForbidden, nil, fmt.Errorf("signed url has expired")
+	}
+
 	// Validate URL if provided
 	hostname := ""
 	if urlParam != "" {
-		validOrigin, validHostname := pool.ValidateUrl(logger, urlParam, config.AllowedOrigins)
-		if !validOrigin {
+		validOrigin, validHostname := pool.ValidateUrl(logger, urlParam, config.AllowedOrigins, config.AllowedSchemes)
+		if !validOrigin || !validateOriginsClaim(logger, urlParam, params.Origins, config) {
 			return false, fiber.StatusForbidden, nil, fmt.Errorf("url is not allowed")
 		}
 		hostname = validHostname
@@ -405,22 +660,51 @@ func ProcessImageContextFromPath(logger *zap.Logger, pathParams string, config *
 		return false, fiber.StatusBadRequest, nil, fmt.Errorf("scale must be between 0 and 1")
 	}
 
+	params.Scale, err = resolveScale(config, params.Width, params.Height, params.Scale)
+	if err != nil {
+		return false, fiber.StatusBadRequest, nil, err
+	}
+
+	var tileZ, tileX, tileY int
+	if params.Tile != "" {
+		if !config.TilingEnabled {
+			return false, fiber.StatusBadRequest, nil, fmt.Errorf("tiling is disabled")
+		}
+		tileZ, tileX, tileY, err = parseTile(params.Tile)
+		if err != nil {
+			return false, fiber.StatusBadRequest, nil, err
+		}
+	}
+
 	// Apply default webp setting if not specified
 	if !params.Webp && config.Webp {
 		params.Webp = config.Webp
 	}
 
 	return true, fiber.StatusOK, &ImageContext{
-		Url:             urlParam,
-		Quality:         params.Quality,
-		Width:           params.Width,
-		Height:          params.Height,
-		Scale:           params.Scale,
-		Interpolation:   params.Interpolation,
-		Webp:            params.Webp,
-		FramePosition:   params.FramePosition,
-		Hostname:        hostname,
-		CustomObjectKey: customObjectKey,
+		Url:                   urlParam,
+		Quality:               params.Quality,
+		Width:                 params.Width,
+		Height:                params.Height,
+		Scale:                 params.Scale,
+		Interpolation:         params.Interpolation,
+		Webp:                  params.Webp,
+		WebpMethod:            params.WebpMethod,
+		WebpMethodSet:         params.WebpMethodSet,
+		FramePosition:         params.FramePosition,
+		FrameCount:            params.FrameCount,
+		ClipDuration:          params.ClipDuration,
+		ClipFPS:               params.ClipFPS,
+		Color:                 params.Color,
+		Tiled:                 params.Tile != "",
+		InterpolationByFormat: !params.InterpolationSet && len(config.InterpolationByFormat) > 0,
+		TileZ:                 tileZ,
+		TileX:                 tileX,
+		TileY:                 tileY,
+		Hostname:              hostname,
+		CustomObjectKey:       customObjectKey,
+		MaxAge:                params.MaxAge,
+		MaxAgeSet:             params.MaxAgeSet,
 	}, nil
 }
 
@@ -432,9 +716,16 @@ func ProcessImageContext(logger *zap.Logger, c *fiber.Ctx, config *config.Config
 
 	signature := c.Query("signature")
 	location := c.Query("location")
+	origins := c.Query("origins")
 	customObjectKey := ""
+
+	// An origins claim is only trusted when it is covered by the signature
+	if origins != "" && signature == "" {
+		return false, fiber.StatusForbidden, fmt.Errorf("signature required for origins claim"), nil
+	}
+
 	if location != "" {
-		if config.HmacKey == "" || signature == "" {
+		if len(hmacKeys(config)) == 0 || signature == "" {
 			return false, fiber.StatusForbidden, fmt.Errorf("signature required for custom location"), nil
 		}
 		// Expect location to be base64 URL-safe encoded
@@ -451,21 +742,21 @@ func ProcessImageContext(logger *zap.Logger, c *fiber.Ctx, config *config.Config
 		}
 
 		signedMsg := urlParam + "|" + sanitized
-		if !compareHmacForMessage(signedMsg, signature, config.HmacKey) {
+		if !compareHmacForMessage(withOriginsClaim(signedMsg, origins), signature, hmacKeys(config), config.HmacAlgorithm) {
 			return false, fiber.StatusForbidden, fmt.Errorf("invalid signature for location"), nil
 		}
 		customObjectKey = sanitized
 	} else if signature != "" {
-		if config.HmacKey == "" {
+		if len(hmacKeys(config)) == 0 {
 			return false, fiber.StatusForbidden, fmt.Errorf("hmac key is not set"), nil
 		}
-		if !compareHmac(urlParam, signature, config.HmacKey) {
+		if !compareHmac(withOriginsClaim(urlParam, origins), signature, hmacKeys(config), config.HmacAlgorithm) {
 			return false, fiber.StatusForbidden, fmt.Errorf("invalid signature"), nil
 		}
 	}
 
-	validOrigin, hostname := pool.ValidateUrl(logger, urlParam, config.AllowedOrigins)
-	if !validOrigin {
+	validOrigin, hostname := pool.ValidateUrl(logger, urlParam, config.AllowedOrigins, config.AllowedSchemes)
+	if !validOrigin || !validateOriginsClaim(logger, urlParam, origins, config) {
 		return false, fiber.StatusForbidden, fmt.Errorf("url is not allowed"), nil
 	}
 
@@ -490,9 +781,20 @@ func ProcessImageContext(logger *zap.Logger, c *fiber.Ctx, config *config.Config
 		return false, fiber.StatusBadRequest, fmt.Errorf("scale must be between 0 and 1"), nil
 	}
 
+	scale, err = resolveScale(config, width, height, scale)
+	if err != nil {
+		return false, fiber.StatusBadRequest, err, nil
+	}
+
 	webp := c.QueryBool("webp", config.Webp)
+	method := c.QueryInt("method", -1)
+	if method < -1 || method > 6 {
+		return false, fiber.StatusBadRequest, fmt.Errorf("method must be between 0 and 6"), nil
+	}
 	framePosition := c.Query("framePosition", "first")
 
+	maxAge := c.QueryInt("maxage", -1)
+
 	return true, fiber.StatusOK, nil, &ImageContext{
 		Url:           urlParam,
 		Quality:       quality,
@@ -501,10 +803,17 @@ func ProcessImageContext(logger *zap.Logger, c *fiber.Ctx, config *config.Config
 		Scale:         scale,
 		Interpolation: resize.InterpolationFunction(interpolation),
 		Webp:          webp,
+		WebpMethod:    max(method, 0),
+		WebpMethodSet: method >= 0,
 		FramePosition: framePosition,
 
+		InterpolationByFormat: c.Query("interpolation") == "" && len(config.InterpolationByFormat) > 0,
+
 		Hostname:        hostname,
 		CustomObjectKey: customObjectKey,
+
+		MaxAge:    max(maxAge, 0),
+		MaxAgeSet: maxAge >= 0,
 	}
 }
 
@@ -543,7 +852,7 @@ func ValidateVideoUpload(c *fiber.Ctx, config *config.Config) (location string,
 		return "", fiber.StatusForbidden, fmt.Errorf("video uploading is disabled")
 	}
 
-	if config.HmacKey == "" {
+	if len(hmacKeys(config)) == 0 {
 		return "", fiber.StatusInternalServerError, fmt.Errorf("hmac key not configured")
 	}
 
@@ -590,7 +899,7 @@ func ValidateVideoUpload(c *fiber.Ctx, config *config.Config) (location string,
 
 	// Validate signature: HMAC(deadline|location)
 	message := deadlineStr + "|" + sanitized
-	if !compareHmacForMessage(message, signature, config.HmacKey) {
+	if !compareHmacForMessage(message, signature, hmacKeys(config), config.HmacAlgorithm) {
 		return "", fiber.StatusForbidden, fmt.Errorf("invalid signature")
 	}
 
@@ -3,10 +3,13 @@ package validation
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"net/http"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"go.uber.org/zap"
@@ -25,25 +28,76 @@ func TestCompareHmac_ValidAndInvalid(t *testing.T) {
 	url := "https://example.com/path/to/file.jpg"
 	validSig := hexHMAC(url, secret)
 
-	if !compareHmac(url, validSig, secret) {
+	if !compareHmac(url, validSig, []string{secret}, "") {
 		t.Fatalf("expected compareHmac to return true for valid signature")
 	}
 
-	if compareHmac(url, "deadbeef", secret) {
+	if compareHmac(url, "deadbeef", []string{secret}, "") {
 		t.Fatalf("expected compareHmac to return false for invalid signature")
 	}
 
 	// message variant
 	msg := url + "|" + "uploads/2025/08/file.jpg"
 	validMsgSig := hexHMAC(msg, secret)
-	if !compareHmacForMessage(msg, validMsgSig, secret) {
+	if !compareHmacForMessage(msg, validMsgSig, []string{secret}, "") {
 		t.Fatalf("expected compareHmacForMessage to return true for valid signature")
 	}
-	if compareHmacForMessage(msg, "deadbeef", secret) {
+	if compareHmacForMessage(msg, "deadbeef", []string{secret}, "") {
 		t.Fatalf("expected compareHmacForMessage to return false for invalid signature")
 	}
 }
 
+func TestCompareHmac_Algorithms(t *testing.T) {
+	secret := "test-secret"
+	url := "https://example.com/path/to/file.jpg"
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(url))
+	sha512Sig := hex.EncodeToString(mac.Sum(nil))
+	sha256Sig := hexHMAC(url, secret)
+
+	// Unprefixed signatures use the configured algorithm
+	if !compareHmac(url, sha512Sig, []string{secret}, "sha512") || compareHmac(url, sha256Sig, []string{secret}, "sha512") {
+		t.Error("expected unprefixed signatures to be checked with the configured algorithm")
+	}
+
+	// A prefix picks the algorithm, so signatures of the previous one keep working after a switch
+	if !compareHmac(url, "sha256:"+sha256Sig, []string{secret}, "sha512") || !compareHmac(url, "sha512:"+sha512Sig, []string{secret}, "") {
+		t.Error("expected prefixed signatures to be checked with their algorithm")
+	}
+	if compareHmac(url, "sha512:"+sha256Sig, []string{secret}, "") {
+		t.Error("expected a signature not matching its prefix to be rejected")
+	}
+	if compareHmac(url, "md5:"+sha256Sig, []string{secret}, "") || compareHmac(url, sha256Sig, []string{secret}, "md5") {
+		t.Error("expected unknown algorithms to be rejected")
+	}
+}
+
+func TestCompareHmac_KeyRotation(t *testing.T) {
+	url := "https://example.com/path/to/file.jpg"
+	cfg := &config.Config{HmacKey: "new-key", HmacKeys: []string{"old-key"}}
+
+	// Signatures of the new key and of the previous one still accepted both validate
+	for _, secret := range []string{"new-key", "old-key"} {
+		if !compareHmac(url, hexHMAC(url, secret), hmacKeys(cfg), "") {
+			t.Errorf("expected a signature made with %s to validate", secret)
+		}
+	}
+
+	// Once the old key is rotated out its signatures are rejected
+	cfg.HmacKeys = nil
+	if compareHmac(url, hexHMAC(url, "old-key"), hmacKeys(cfg), "") {
+		t.Error("expected a signature of a rotated-out key to be rejected")
+	}
+
+	// Previous keys alone still enable signing
+	encoded := base64.URLEncoding.EncodeToString([]byte(url))
+	cfg = &config.Config{HmacKeys: []string{"old-key"}, AllowedOrigins: []string{"example.com"}}
+	ok, status, _, err := ProcessImageContextFromPath(zap.NewNop(), "sig:"+hexHMAC(url, "old-key")+"/"+encoded, cfg)
+	if !ok || status != http.StatusOK {
+		t.Errorf("expected the request signed with the previous key to pass, got %d %v", status, err)
+	}
+}
+
 func TestProcessImageContextFromPath_URLOnlySignature_Valid(t *testing.T) {
 	logger := zap.NewNop()
 	secret := "test-secret"
@@ -219,3 +273,237 @@ func TestProcessImageContext_QueryFlow_InvalidSignature(t *testing.T) {
 		t.Fatalf("expected 403, got %d", resp.StatusCode)
 	}
 }
+
+func TestProcessImageContextFromPath_RejectsNonHTTPSchemes(t *testing.T) {
+	logger := zap.NewNop()
+	// No origins configured: the default-open setup must still reject internal schemes
+	cfg := &config.Config{}
+
+	for _, url := range []string{
+		"file:///etc/passwd",
+		"data:image/png;base64,iVBORw0KGgo=",
+		"ftp://example.com/cat.jpg",
+	} {
+		encoded := base64.URLEncoding.EncodeToString([]byte(url))
+
+		ok, status, _, err := ProcessImageContextFromPath(logger, encoded, cfg)
+		if ok || status != http.StatusForbidden || err == nil {
+			t.Fatalf("expected forbidden for %s, got ok=%v status=%d err=%v", url, ok, status, err)
+		}
+	}
+}
+
+func TestProcessImageContextFromPath_AllowedSchemes(t *testing.T) {
+	logger := zap.NewNop()
+	cfg := &config.Config{
+		AllowedSchemes: []string{"ftp"},
+	}
+
+	url := "ftp://example.com/cat.jpg"
+	encoded := base64.URLEncoding.EncodeToString([]byte(url))
+
+	ok, status, ctx, err := ProcessImageContextFromPath(logger, encoded, cfg)
+	if !ok || status != http.StatusOK || err != nil {
+		t.Fatalf("expected OK for allowed scheme, got ok=%v status=%d err=%v", ok, status, err)
+	}
+	if ctx == nil || ctx.Url != url {
+		t.Fatalf("unexpected ctx: %+v", ctx)
+	}
+
+	// file: is still rejected since only ftp was allowed
+	encoded = base64.URLEncoding.EncodeToString([]byte("file:///etc/passwd"))
+	ok, status, _, err = ProcessImageContextFromPath(logger, encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for file scheme, got ok=%v status=%d err=%v", ok, status, err)
+	}
+}
+
+func TestProcessImageContextFromPath_OriginsClaim(t *testing.T) {
+	logger := zap.NewNop()
+	secret := "test-secret"
+	cfg := &config.Config{
+		HmacKey:        secret,
+		AllowedOrigins: []string{"tenant-a.com", "*.tenant-b.com"},
+	}
+
+	signedPath := func(url, origins string) string {
+		sig := hexHMAC(url+"|origins="+origins, secret)
+		return "org:" + origins + "/sig:" + sig + "/" + base64.URLEncoding.EncodeToString([]byte(url))
+	}
+
+	// The tenant's own origin is allowed
+	ok, status, ctx, err := ProcessImageContextFromPath(logger, signedPath("https://tenant-a.com/cat.jpg", "tenant-a.com"), cfg)
+	if !ok || status != http.StatusOK || err != nil {
+		t.Fatalf("expected OK for the claimed origin, got ok=%v status=%d err=%v", ok, status, err)
+	}
+	if ctx.Hostname != "tenant-a.com" {
+		t.Errorf("unexpected hostname %q", ctx.Hostname)
+	}
+
+	// Another tenant's origin is globally allowed but outside the claim
+	ok, status, _, err = ProcessImageContextFromPath(logger, signedPath("https://img.tenant-b.com/cat.jpg", "tenant-a.com"), cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden outside the claim, got ok=%v status=%d err=%v", ok, status, err)
+	}
+
+	// A claim can't widen the global list
+	ok, status, _, err = ProcessImageContextFromPath(logger, signedPath("https://evil.com/cat.jpg", "evil.com"), cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden outside the global origins, got ok=%v status=%d err=%v", ok, status, err)
+	}
+}
+
+func TestProcessImageContextFromPath_OriginsClaimMustBeSigned(t *testing.T) {
+	logger := zap.NewNop()
+	secret := "test-secret"
+	cfg := &config.Config{HmacKey: secret}
+
+	url := "https://tenant-a.com/cat.jpg"
+	encoded := base64.URLEncoding.EncodeToString([]byte(url))
+
+	// Without a signature the claim is rejected
+	ok, status, _, err := ProcessImageContextFromPath(logger, "org:tenant-a.com/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for an unsigned claim, got ok=%v status=%d err=%v", ok, status, err)
+	}
+
+	// A signature over the URL alone doesn't cover a claim added afterwards
+	ok, status, _, err = ProcessImageContextFromPath(logger, "org:tenant-b.com/sig:"+hexHMAC(url, secret)+"/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for a claim outside the signature, got ok=%v status=%d err=%v", ok, status, err)
+	}
+}
+
+func TestProcessImageContextFromPath_Expiry(t *testing.T) {
+	logger := zap.NewNop()
+	secret := "test-secret"
+	cfg := &config.Config{HmacKey: secret, AllowedOrigins: []string{"example.com"}}
+
+	url := "https://example.com/cat.jpg"
+	encoded := base64.URLEncoding.EncodeToString([]byte(url))
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	// A deadline ahead is accepted
+	ok, status, _, err := ProcessImageContextFromPath(logger, "exp:"+future+"/sig:"+hexHMAC(url+"|"+future, secret)+"/"+encoded, cfg)
+	if !ok || status != http.StatusOK || err != nil {
+		t.Fatalf("expected OK before the deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+
+	// A passed one is rejected
+	ok, status, _, err = ProcessImageContextFromPath(logger, "exp:"+past+"/sig:"+hexHMAC(url+"|"+past, secret)+"/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden after the deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+
+	// The deadline is signed, it can't be moved or added to an unsigned URL
+	ok, status, _, err = ProcessImageContextFromPath(logger, "exp:"+future+"/sig:"+hexHMAC(url+"|"+past, secret)+"/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for a moved deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+	ok, status, _, err = ProcessImageContextFromPath(logger, "exp:"+future+"/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for an unsigned deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+
+	// With a location the deadline follows it in the signed message
+	location := "uploads/cat.jpg"
+	encodedLocation := base64.URLEncoding.EncodeToString([]byte(location))
+	ok, status, ctx, err := ProcessImageContextFromPath(logger, "loc:"+encodedLocation+"/exp:"+future+"/sig:"+hexHMAC(url+"|"+location+"|"+future, secret)+"/"+encoded, cfg)
+	if !ok || status != http.StatusOK || err != nil || ctx.CustomObjectKey != location {
+		t.Fatalf("expected OK for a location before the deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+	ok, status, _, err = ProcessImageContextFromPath(logger, "loc:"+encodedLocation+"/exp:"+past+"/sig:"+hexHMAC(url+"|"+location+"|"+past, secret)+"/"+encoded, cfg)
+	if ok || status != http.StatusForbidden || err == nil {
+		t.Fatalf("expected forbidden for a location after the deadline, got ok=%v status=%d err=%v", ok, status, err)
+	}
+}
+
+func TestProcessImageContext_QueryFlow_OriginsClaim(t *testing.T) {
+	logger := zap.NewNop()
+	secret := "test-secret"
+	cfg := &config.Config{HmacKey: secret}
+
+	app := fiber.New()
+	app.Get("/images", func(c *fiber.Ctx) error {
+		ok, status, err, _ := ProcessImageContext(logger, c, cfg)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+		return c.SendStatus(status)
+	})
+
+	request := func(url string) int {
+		sig := hexHMAC(url+"|origins=tenant-a.com", secret)
+		req, _ := http.NewRequest(http.MethodGet, "/images?url="+url+"&origins=tenant-a.com&signature="+sig, nil)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test error: %v", err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := request("https://tenant-a.com/cat.jpg"); status != http.StatusOK {
+		t.Errorf("expected 200 for the claimed origin, got %d", status)
+	}
+	if status := request("https://tenant-b.com/cat.jpg"); status != http.StatusForbidden {
+		t.Errorf("expected 403 outside the claim, got %d", status)
+	}
+}
+
+func TestProcessImageContext_ScaleWithDimensions(t *testing.T) {
+	url := "https://example.com/media/cat.jpg"
+	encoded := base64.URLEncoding.EncodeToString([]byte(url))
+
+	for _, tc := range []struct {
+		mode          string
+		path          string
+		expectedScale float64
+		expectedOK    bool
+	}{
+		{"compose", "w:500/s:0.5/", 0.5, true},
+		{"dimensions", "w:500/s:0.5/", 0, true},
+		{"dimensions", "s:0.5/", 0.5, true},
+		{"reject", "h:300/s:0.5/", 0, false},
+		{"reject", "s:0.5/", 0.5, true},
+		{"reject", "w:500/", 0, true},
+		{"", "w:500/s:0.5/", 0, false},
+	} {
+		cfg := &config.Config{ScaleWithDimensions: tc.mode, HmacKey: "test-secret"}
+		pathParams := tc.path + "sig:" + hexHMAC(url, "test-secret") + "/" + encoded
+
+		ok, status, ctx, err := ProcessImageContextFromPath(zap.NewNop(), pathParams, cfg)
+		if ok != tc.expectedOK {
+			t.Errorf("%s %s: expected ok=%v, got %v (%d, %v)", tc.mode, tc.path, tc.expectedOK, ok, status, err)
+			continue
+		}
+		if !ok {
+			if status != http.StatusBadRequest {
+				t.Errorf("%s %s: expected 400, got %d", tc.mode, tc.path, status)
+			}
+			continue
+		}
+		if ctx.Scale != tc.expectedScale {
+			t.Errorf("%s %s: expected scale %v, got %v", tc.mode, tc.path, tc.expectedScale, ctx.Scale)
+		}
+	}
+
+	// The query flow follows the same mode, rejecting is the default
+	cfg := &config.Config{HmacKey: "test-secret"}
+	app := fiber.New()
+	app.Get("/images", func(c *fiber.Ctx) error {
+		ok, status, err, _ := ProcessImageContext(zap.NewNop(), c, cfg)
+		if !ok {
+			return c.Status(status).SendString(err.Error())
+		}
+		return c.SendStatus(status)
+	})
+	req, _ := http.NewRequest(http.MethodGet, "/images?url="+url+"&signature="+hexHMAC(url, "test-secret")+"&width=500&scale=0.5", nil)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test error: %v", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400 for scale with a width, got %d", resp.StatusCode)
+	}
+}